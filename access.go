@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Permission scopes a credential can carry
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// AccessGrant records that a request was authorized by a credential rather
+// than by where it came from
+type AccessGrant struct {
+	Via    string
+	Scopes map[string]bool
+}
+
+type accessGrantKey struct{}
+
+// Attach a grant to a request
+func withAccessGrant(r *http.Request, grant AccessGrant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessGrantKey{}, grant))
+}
+
+// Get the grant attached to a request, if any
+func accessGrant(r *http.Request) (AccessGrant, bool) {
+	grant, ok := r.Context().Value(accessGrantKey{}).(AccessGrant)
+	return grant, ok
+}
+
+// Whether a request carries a grant with the given scope
+func hasScope(r *http.Request, scope string) bool {
+	grant, ok := accessGrant(r)
+	return ok && grant.Scopes[scope]
+}
+
+// The scope a request needs: admin for the dashboard, write for anything
+// that changes files and read for everything else
+func requiredScope(r *http.Request) string {
+	if r.URL.Path == "/admin" || len(r.URL.Path) > 7 && r.URL.Path[:7] == "/admin/" {
+		return ScopeAdmin
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ScopeRead
+	}
+	return ScopeWrite
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Split the -acme flag into host names
+func acmeDomains(list string) []string {
+	var domains []string
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// TLS configuration obtaining certificates for domains from Let's Encrypt
+// and renewing them before they expire. Certificates and the account key
+// are kept in the data directory. The CA checks the server controls the
+// domain over a TLS connection to port 443 (the TLS-ALPN-01 challenge),
+// which is answered before any request reaches the handlers.
+func acmeTLSConfig(domains []string, email, dataDir string) *tls.Config {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(dataDir, "acme")),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      email,
+	}
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Only allow requests from this machine, which is treated as the admin, or
+// carrying a credential with the admin scope. While a tunnel is open only
+// the credential works.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fromThisMachine(r) && !hasScope(r, ScopeAdmin) {
+			message := "Access denied: the admin dashboard is only available from this machine"
+			if tunnelOpen.Load() {
+				message = "Access denied: while a tunnel is open the admin dashboard needs an admin API key"
+			}
+			http.Error(w, message, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Template for the admin dashboard
+const adminTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Admin - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            text-align: left;
+            padding: 8px;
+            border-bottom: 1px solid #ddd;
+        }
+        th {
+            background-color: #f0f0f0;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        form {
+            display: inline;
+        }
+        .approve-button, .reject-button {
+            padding: 4px 10px;
+            color: white;
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+        .approve-button {
+            background-color: #4CAF50;
+        }
+        .reject-button {
+            background-color: #c62828;
+        }
+        .muted {
+            color: #777;
+        }
+    </style>
+</head>
+<body>
+    <h1>Admin Dashboard</h1>
+    <p><a href="./">&larr; Back to files</a> | <a href="activity">Recent activity</a> | <a href="stats">Download statistics</a> | <a href="admin/snapshots">Snapshots</a> | <a href="admin/guests">Guest uploads</a></p>
+
+    <h3>Pending Uploads</h3>
+    {{if not .QuarantineEnabled}}
+    <p>Upload quarantine is disabled. Start the server with <code>-quarantine</code> to review uploads before they become visible.</p>
+    {{else if .Pending}}
+    <table>
+        <tr><th>File</th><th>Destination</th><th>Size</th><th>From</th><th>When</th><th></th></tr>
+        {{range .Pending}}
+        <tr>
+            <td>{{.Filename}}</td>
+            <td>/{{.TargetPath}}</td>
+            <td>{{.Size}} bytes</td>
+            <td>{{.Client}}</td>
+            <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+            <td>
+                <form method="post" action="admin/approve">
+                    <input type="hidden" name="id" value="{{.ID}}">
+                    <button type="submit" class="approve-button">Approve</button>
+                </form>
+                <form method="post" action="admin/reject">
+                    <input type="hidden" name="id" value="{{.ID}}">
+                    <button type="submit" class="reject-button">Reject</button>
+                </form>
+            </td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p>No uploads are waiting for approval.</p>
+    {{end}}
+
+    <h3>Active Transfers</h3>
+    <table>
+        <tr><th></th><th>File</th><th>From</th><th>Progress</th><th>Speed</th><th>Remaining</th></tr>
+        <tbody id="transfers"></tbody>
+    </table>
+    <p id="no-transfers" class="muted">No uploads or downloads in progress.</p>
+
+    <script>
+        function formatBytes(bytes) {
+            const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+            let i = 0;
+            while (bytes >= 1024 && i < units.length - 1) {
+                bytes /= 1024;
+                i++;
+            }
+            return (i === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+        }
+
+        function formatDuration(seconds) {
+            seconds = Math.round(seconds);
+            if (seconds < 60) return seconds + 's';
+            if (seconds < 3600) return Math.floor(seconds / 60) + 'm ' + (seconds % 60) + 's';
+            return Math.floor(seconds / 3600) + 'h ' + Math.floor((seconds % 3600) / 60) + 'm';
+        }
+
+        // Refresh the transfer table from the server's accounting
+        function refreshTransfers() {
+            fetch('admin/transfers').then(response => response.json()).then(transfers => {
+                const body = document.getElementById('transfers');
+                body.textContent = '';
+                transfers.forEach(t => {
+                    const row = body.insertRow();
+                    const progress = t.size > 0 ? formatBytes(t.bytes) + ' of ' + formatBytes(t.size) : formatBytes(t.bytes);
+                    [t.kind === 'upload' ? '⬆' : '⬇', t.path || '—', t.client, progress,
+                     t.speed > 0 ? formatBytes(t.speed) + '/s' : '—',
+                     t.eta >= 0 ? formatDuration(t.eta) : '—'].forEach(value => {
+                        row.insertCell().textContent = value;
+                    });
+                });
+                document.getElementById('no-transfers').style.display = transfers.length ? 'none' : 'block';
+            }).catch(() => {});
+        }
+        refreshTransfers();
+        setInterval(refreshTransfers, 2000);
+    </script>
+</body>
+</html>
+`
+
+// Handler for the admin dashboard and its actions
+func adminHandler(config Config, quarantine *QuarantineStore, burns *BurnStore, snapshots *SnapshotStore, guests *GuestUploadStore, checksums *ChecksumStore, encryption *AtRestEncryption, dedup *DedupStore, uploadTypes UploadTypeFilter, events *EventBus, transfers *TransferTracker) http.Handler {
+	tmpl := template.Must(template.New("admin").Parse(adminTemplate))
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		var pending []PendingUpload
+		if quarantine != nil {
+			pending = quarantine.List()
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := tmpl.Execute(w, struct {
+			QuarantineEnabled bool
+			Pending           []PendingUpload
+		}{
+			QuarantineEnabled: quarantine != nil,
+			Pending:           pending,
+		})
+		if err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	mux.HandleFunc("/admin/transfers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(transfers.List())
+	})
+
+	mux.Handle("/admin/chmod", chmodHandler(config))
+	mux.Handle("/admin/verify", verifyHandler(config, checksums))
+
+	snapshotPages := snapshotsHandler(config, snapshots)
+	mux.Handle("/admin/snapshots", snapshotPages)
+	mux.Handle("/admin/snapshots/", snapshotPages)
+
+	guestPages := guestUploadsHandler(config, guests)
+	mux.Handle("/admin/guests", guestPages)
+	mux.Handle("/admin/guests/", guestPages)
+
+	mux.HandleFunc("/admin/approve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || quarantine == nil {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		item, relPath, err := quarantine.Approve(r.FormValue("id"), config.DownloadDir, encryption, dedup, config.AppendOnly)
+		if err != nil {
+			http.Error(w, "Error approving upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if item.Extract && isExtractableArchive(item.Filename) && !encryption.Covers(relPath) && !dedup.Covers(relPath) && !config.AppendOnly {
+			archivePath, err := safeJoinPath(config.DownloadDir, relPath)
+			if err == nil {
+				var count int
+				count, err = extractArchive(archivePath, filepath.Dir(archivePath), uploadTypes)
+				os.Remove(archivePath)
+				logf("Approved archive %s extracted (%d files)", relPath, count)
+			}
+			if err != nil {
+				http.Error(w, "Error extracting archive: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		logf("Pending upload approved: %s", relPath)
+		events.Publish(Event{Type: EventUpload, Path: relPath, Client: item.Client, RequestID: requestID(r)})
+		if !config.AppendOnly {
+			burns.Set(relPath, item.MaxDownloads)
+		}
+		redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("/admin/reject", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || quarantine == nil {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		item, err := quarantine.Reject(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "Error rejecting upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logf("Pending upload rejected: %s from %s", item.Filename, item.Client)
+		redirect(w, r, "/admin", http.StatusSeeOther)
+	})
+
+	return adminOnly(mux)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// APIKey is a static credential for scripts, with the scopes it may use
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// Load API keys from a JSON file of the form
+// [{"name": "backup", "key": "...", "scopes": ["read", "write"]}]
+func loadAPIKeys(path string) ([]APIKey, error) {
+	var keys []APIKey
+	if err := loadJSON(path, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if len(key.Key) < 16 {
+			return nil, fmt.Errorf("API key %q is too short (use at least 16 characters)", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			switch scope {
+			case ScopeRead, ScopeWrite, ScopeAdmin:
+			default:
+				return nil, fmt.Errorf("API key %q has unknown scope %q", key.Name, scope)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Get the API key presented with a request, from X-API-Key or a bearer token
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Find the configured key matching a presented one
+func matchAPIKey(keys []APIKey, presented string) (APIKey, bool) {
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(presented)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// Middleware authenticating API keys. A valid key with the scope the
+// request needs grants access from anywhere; unknown keys and missing
+// scopes are rejected, and repeated bad keys lock the client out. Requests
+// without a key pass through unchanged.
+func apiKeyAuth(next http.Handler, keys []APIKey, lockout *AuthLockout) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := presentedAPIKey(r)
+		if presented == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if lockout.reject(w, r) {
+			return
+		}
+
+		key, ok := matchAPIKey(keys, presented)
+		if !ok {
+			lockout.Fail(clientIP(r))
+			log.Printf("Rejected invalid API key from %s", clientIP(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="local-fileserver"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		lockout.Succeed(clientIP(r))
+
+		grant := AccessGrant{Via: "api-key:" + key.Name, Scopes: make(map[string]bool)}
+		for _, scope := range key.Scopes {
+			grant.Scopes[scope] = true
+		}
+		// Admin keys can do everything
+		if grant.Scopes[ScopeAdmin] {
+			grant.Scopes[ScopeRead] = true
+			grant.Scopes[ScopeWrite] = true
+		}
+
+		scope := requiredScope(r)
+		if !grant.Scopes[scope] {
+			http.Error(w, fmt.Sprintf("API key %q lacks the %s scope", key.Name, scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, withAccessGrant(r, grant))
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AppendLocks serializes appends to the same file, so records sent by
+// several devices at once never interleave
+type AppendLocks struct {
+	mu    sync.Mutex
+	files map[string]*appendLock
+}
+
+type appendLock struct {
+	sync.Mutex
+	// Requests holding or waiting for the lock
+	users int
+}
+
+func newAppendLocks() *AppendLocks {
+	return &AppendLocks{files: make(map[string]*appendLock)}
+}
+
+// Wait for exclusive access to append to a file. Call the returned function
+// when done.
+func (a *AppendLocks) lock(path string) func() {
+	a.mu.Lock()
+	l, ok := a.files[path]
+	if !ok {
+		l = &appendLock{}
+		a.files[path] = l
+	}
+	l.users++
+	a.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(a.files, path)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Handler appending the request body to an existing file. A failed append
+// is rolled back, so the file only ever grows by whole requests.
+func (s *Server) handleAppend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/append/"))
+	fullPath, err := safeJoinPath(s.config.DownloadDir, relPath)
+	if err != nil || relPath == "" {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	if s.encryption.Covers(relPath) {
+		http.Error(w, "Appending is not available for encrypted files", http.StatusForbidden)
+		return
+	}
+	if s.dedup.Covers(relPath) {
+		http.Error(w, "Appending is not available for deduplicated files", http.StatusForbidden)
+		return
+	}
+	// Appended data would skip the review uploads wait for
+	if s.quarantine != nil {
+		http.Error(w, "Appending is not available while uploads are quarantined", http.StatusForbidden)
+		return
+	}
+	if lock := s.locks.Conflict(relPath, lockToken(r)); lock != nil {
+		writeLockConflict(w, lock)
+		return
+	}
+	if err := runHooks(&HookEvent{Point: HookPreUpload, Path: relPath, Client: clientIP(r), Size: r.ContentLength}); err != nil {
+		log.Printf("Append to %s from %s rejected by hook: %v", relPath, clientIP(r), err)
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkDiskSpace(r.ContentLength, filepath.Dir(fullPath)); err != nil {
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	unlock := s.appends.lock(relPath)
+	defer unlock()
+
+	// Only existing files are appended to; create them with a normal upload
+	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error opening file: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// Checked under the lock, so an ETag from the last append guards the next
+	if !writePreconditionsMet(r, info) {
+		http.Error(w, "Upload rejected: the file is not the version the request expects", http.StatusPreconditionFailed)
+		return
+	}
+
+	transfer := s.transfers.Start(transferID(r.Header.Get("X-Upload-ID")), "upload", relPath, clientIP(r), r.ContentLength)
+	defer s.transfers.Finish(transfer)
+	appended, err := io.Copy(f, countingReader{r.Body, transfer})
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if truncErr := f.Truncate(info.Size()); truncErr != nil {
+			log.Printf("Error rolling back append to %s: %v", relPath, truncErr)
+		}
+		http.Error(w, "Error appending to file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	newInfo, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Error appending to file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debugf("Appended %d bytes to %s from %s", appended, relPath, clientIP(r))
+	s.events.Publish(Event{Type: EventUpload, Path: relPath, Client: clientIP(r), RequestID: requestID(r), Detail: "appended"})
+	go runHooks(&HookEvent{Point: HookPostUpload, Path: relPath, Client: clientIP(r), Size: newInfo.Size()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(newInfo))
+	json.NewEncoder(w).Encode(struct {
+		Path     string `json:"path"`
+		Appended int64  `json:"appended"`
+		Size     int64  `json:"size"`
+	}{relPath, appended, newInfo.Size()})
+}
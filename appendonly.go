@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Message for requests that would replace or remove files in -append-only mode
+const appendOnlyMessage = "the server is append-only: existing files cannot be replaced or removed"
+
+// Pick a name that does not exist yet for a new file, keeping path if it is
+// free and otherwise adding a version, e.g. "backup (2).tar"
+func versionedName(path string) (string, error) {
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		return path, nil
+	}
+
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	if strings.HasSuffix(strings.ToLower(name), ".tar.gz") {
+		ext = name[len(name)-len(".tar.gz"):]
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 2; i < 10000; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := os.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("too many versions already exist")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached archives not downloaded for this long are removed
+const archiveCacheTTL = 7 * 24 * time.Hour
+
+// ArchiveCache keeps the folder archives built for download in the data
+// directory, so everyone after the first person downloading a big folder
+// gets it without compressing it again. Archives are keyed by the folder
+// and a hash of its tree, so any change to the folder builds a fresh one.
+type ArchiveCache struct {
+	dir string
+
+	mu sync.Mutex
+	// Archives being built, closed when done
+	building map[string]chan struct{}
+}
+
+// Set up the archive cache in the data directory
+func openArchiveCache(dataDir string) (*ArchiveCache, error) {
+	c := &ArchiveCache{
+		dir:      filepath.Join(dataDir, "archives"),
+		building: make(map[string]chan struct{}),
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Hash the names, sizes, modes and modification times of everything that
+// goes into an archive of srcDir. Reading 10 GB of photos to notice a
+// change would cost as much as compressing them, and any edit to a file
+// changes its size or modification time.
+func archiveTreeHash(srcDir string) (string, error) {
+	h := sha256.New()
+	err := walkArchiveEntries(srcDir, func(path, name string, info fs.FileInfo) error {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%o\n", name, info.Size(), info.ModTime().UnixNano(), info.Mode())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get the cached archive of srcDir in format ("zip" or "tar.gz"), building
+// it on first use. Concurrent requests for the same archive wait for one
+// build rather than each compressing the folder.
+func (c *ArchiveCache) Get(srcDir, format string) (string, error) {
+	var ext string
+	switch format {
+	case "zip":
+		ext = ".zip"
+	case "tar.gz":
+		ext = ".tar.gz"
+	default:
+		return "", fmt.Errorf("unsupported archive format: %s", format)
+	}
+
+	treeHash, err := archiveTreeHash(srcDir)
+	if err != nil {
+		return "", err
+	}
+	folderSum := sha256.Sum256([]byte(srcDir + "\x00" + format))
+	folderKey := hex.EncodeToString(folderSum[:8])
+	name := folderKey + "-" + treeHash[:32] + ext
+	archivePath := filepath.Join(c.dir, name)
+
+	for {
+		c.mu.Lock()
+		if _, err := os.Stat(archivePath); err == nil {
+			c.mu.Unlock()
+			// Keep archives that are still downloaded from expiring
+			now := time.Now()
+			os.Chtimes(archivePath, now, now)
+			return archivePath, nil
+		}
+		done, busy := c.building[name]
+		if !busy {
+			done = make(chan struct{})
+			c.building[name] = done
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+		<-done
+	}
+
+	defer func() {
+		c.mu.Lock()
+		close(c.building[name])
+		delete(c.building, name)
+		c.mu.Unlock()
+	}()
+	if err := c.build(srcDir, format, archivePath); err != nil {
+		return "", err
+	}
+	c.prune(folderKey, name)
+	return archivePath, nil
+}
+
+// Write an archive to a temporary file and move it into place when done
+func (c *ArchiveCache) build(srcDir, format, dest string) error {
+	started := time.Now()
+	tmp, err := os.CreateTemp(c.dir, ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var count int
+	if format == "zip" {
+		count, err = writeZipArchive(tmp, srcDir)
+	} else {
+		count, err = writeTarGzArchive(tmp, srcDir)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	debugf("Built archive of %s with %d file(s) in %v", srcDir, count, time.Since(started).Round(time.Millisecond))
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Remove earlier archives of the same folder and format, which can't be
+// served again once its tree changed, and archives nobody downloaded for
+// archiveCacheTTL
+func (c *ArchiveCache) prune(folderKey, keep string) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-archiveCacheTTL)
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == keep || strings.HasPrefix(name, ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(name, folderKey+"-") || info.ModTime().Before(cutoff) {
+			c.mu.Lock()
+			_, busy := c.building[name]
+			if !busy {
+				if err := os.Remove(filepath.Join(c.dir, name)); err != nil {
+					log.Printf("Error removing cached archive %s: %v", name, err)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Handler for downloading a folder as an archive. Accepts an optional
+// "format" (zip or tar.gz).
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/archive/"))
+	if relPath == "" {
+		http.Error(w, "Cannot download the root folder", http.StatusBadRequest)
+		return
+	}
+	if s.encryption.Covers(relPath) {
+		http.Error(w, "Folders cannot be downloaded from the encrypted folder", http.StatusBadRequest)
+		return
+	}
+	if s.dedup.Covers(relPath) {
+		http.Error(w, "Folders cannot be downloaded from the deduplicated folder", http.StatusBadRequest)
+		return
+	}
+	srcDir, err := safeJoinPath(s.config.DownloadDir, relPath)
+	if err != nil {
+		http.Error(w, "Invalid folder path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	// An archive would hand out the subfolders the client may not read
+	if !s.rules.ReadableTree(r, relPath) {
+		http.Error(w, "Access denied: the folder contains folders you can't read", http.StatusForbidden)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	archivePath, err := s.archives.Get(srcDir, format)
+	if err != nil {
+		http.Error(w, "Error creating archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		http.Error(w, "Error opening archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Error opening archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := filepath.Base(srcDir) + "." + format
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	size := int64(-1)
+	if r.Header.Get("Range") == "" {
+		size = info.Size()
+	}
+	transfer := s.transfers.Start("", "download", relPath+"/", clientIP(r), size)
+	defer s.transfers.Finish(transfer)
+	if s.bandwidth != nil {
+		share := s.bandwidth.Start()
+		defer share.Done()
+		w = throttledResponseWriter{w, share}
+	}
+	w = countingResponseWriter{w, transfer}
+
+	logf("Folder downloaded: %s (%s)", relPath, format)
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP parameters, the defaults every authenticator app understands
+// (RFC 6238: HMAC-SHA1, 30 second steps, 6 digits)
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// Codes from one step before or after are accepted for clock drift
+	totpSkew = 1
+)
+
+// Login sessions
+const (
+	sessionCookieName = "lfs_session"
+	sessionTTL        = 12 * time.Hour
+)
+
+// PasswordAuth protects the server with a login page asking for a
+// password, optionally followed by a TOTP code from an authenticator app.
+// Logging in starts a session kept in a signed cookie.
+type PasswordAuth struct {
+	password string
+	totp     []byte // nil without a second factor
+	lockout  *AuthLockout
+	// Sessions that haven't been logged out are in the state database
+	db *sql.DB
+	// Key signing the session cookies
+	key []byte
+
+	mu sync.Mutex
+	// The last step whose code was used, so a code works only once
+	lastStep int64
+}
+
+// How earlier versions saved sessions in the data directory
+type sessionFile struct {
+	Key      string               `json:"key"`
+	Sessions map[string]time.Time `json:"sessions"`
+}
+
+// Set up password authentication with its sessions in the state database,
+// importing the sessions.json of earlier versions, or nil without a
+// password
+func openPasswordAuth(password string, totpSecret []byte, db *sql.DB, dataDir string, lockout *AuthLockout) (*PasswordAuth, error) {
+	if password == "" {
+		return nil, nil
+	}
+	a := &PasswordAuth{
+		password: password,
+		totp:     totpSecret,
+		lockout:  lockout,
+		db:       db,
+	}
+
+	var saved sessionFile
+	err := importJSON(filepath.Join(dataDir, "sessions.json"), &saved, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			if saved.Key == "" {
+				return nil
+			}
+			if _, err := tx.Exec("INSERT OR REPLACE INTO settings (name, value) VALUES ('session_key', ?)", saved.Key); err != nil {
+				return err
+			}
+			for id, expires := range saved.Sessions {
+				if _, err := tx.Exec("INSERT OR REPLACE INTO sessions (id, expires) VALUES (?, ?)", id, expires.UnixNano()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var key string
+	err = db.QueryRow("SELECT value FROM settings WHERE name = 'session_key'").Scan(&key)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	a.key, _ = hex.DecodeString(key)
+	if len(a.key) != 32 {
+		// Sessions signed with a lost key can't be checked anymore
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec("DELETE FROM sessions"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT OR REPLACE INTO settings (name, value) VALUES ('session_key', ?)", hex.EncodeToString(a.key))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Sign a session ID for its cookie
+func (a *PasswordAuth) sign(id string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Compute the TOTP code of secret for a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// Check a TOTP code, returning the step it belongs to
+func (a *PasswordAuth) verifyCode(code string, now time.Time) (int64, bool) {
+	current := now.Unix() / int64(totpStep/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(a.totp, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Check a login, and start a session if it is right, giving its cookie value
+func (a *PasswordAuth) Login(password, code string) (string, time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+		return "", time.Time{}, false
+	}
+	if a.totp != nil {
+		step, ok := a.verifyCode(strings.ReplaceAll(code, " ", ""), now)
+		if !ok || step <= a.lastStep {
+			return "", time.Time{}, false
+		}
+		a.lastStep = step
+	}
+
+	id, err := randomID()
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		return "", time.Time{}, false
+	}
+	if _, err := a.db.Exec("DELETE FROM sessions WHERE expires < ?", now.UnixNano()); err != nil {
+		log.Printf("Error saving sessions: %v", err)
+	}
+	expires := now.Add(sessionTTL)
+	if _, err := a.db.Exec("INSERT INTO sessions (id, expires) VALUES (?, ?)", id, expires.UnixNano()); err != nil {
+		log.Printf("Error saving sessions: %v", err)
+		return "", time.Time{}, false
+	}
+	return id + "." + a.sign(id), expires, true
+}
+
+// The session ID in a cookie value, if it is genuine and still active
+func (a *PasswordAuth) session(value string) (string, bool) {
+	id, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.sign(id))) {
+		return "", false
+	}
+	var expires int64
+	if err := a.db.QueryRow("SELECT expires FROM sessions WHERE id = ?", id).Scan(&expires); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error reading sessions: %v", err)
+		}
+		return "", false
+	}
+	return id, time.Now().UnixNano() < expires
+}
+
+// Whether a request belongs to a logged in session
+func (a *PasswordAuth) LoggedIn(r *http.Request) bool {
+	_, ok := a.SessionID(r)
+	return ok
+}
+
+// The ID of the logged in session a request belongs to
+func (a *PasswordAuth) SessionID(r *http.Request) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	return a.session(cookie.Value)
+}
+
+// End the session of a request
+func (a *PasswordAuth) Logout(r *http.Request) error {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	id, ok := a.session(cookie.Value)
+	if !ok {
+		return nil
+	}
+	_, err = a.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// Set or, with an empty value, clear the session cookie
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     basePathOf(r) + "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Where to go after logging in: a path on this server, never another site
+func loginTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// Middleware requiring a login session. Browsers are sent to the login
+// page; other clients get a 401. Requests already authorized by a signed URL
+// or API key pass, as do reads from public folders.
+func passwordAuth(next http.Handler, auth *PasswordAuth, public PublicFolders) http.Handler {
+	if auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login", "/logout", "/favicon.ico":
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Guest upload links carry their own credential
+		if strings.HasPrefix(r.URL.Path, "/guest/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Addresses listed with noauth skip the login
+		if addr, ok := listenAddr(r); ok && addr.NoAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, granted := accessGrant(r); granted || public.Allows(r) || auth.LoggedIn(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if (r.Method == "GET" || r.Method == "HEAD") && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			redirect(w, r, "/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		http.Error(w, "Login required", http.StatusUnauthorized)
+	})
+}
+
+// Template for the login page
+const loginTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Log In - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 400px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        label {
+            display: block;
+            margin: 12px 0 4px 0;
+        }
+        input {
+            width: 100%;
+            box-sizing: border-box;
+            padding: 8px;
+            font-size: 1em;
+        }
+        button {
+            margin-top: 16px;
+            padding: 8px 16px;
+            cursor: pointer;
+        }
+        .error {
+            color: #b00020;
+        }
+    </style>
+</head>
+<body>
+    <h1>Local File Server</h1>
+    {{if .Failed}}<p class="error">Wrong password{{if .TOTP}} or code{{end}}.</p>{{end}}
+    <form method="post" action="login">
+        <input type="hidden" name="next" value="{{.Next}}">
+        <label for="password">Password</label>
+        <input type="password" id="password" name="password" autocomplete="current-password" autofocus required>
+        {{if .TOTP}}
+        <label for="code">Code from your authenticator app</label>
+        <input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" maxlength="7" required>
+        {{end}}
+        <button type="submit">Log in</button>
+    </form>
+</body>
+</html>
+`
+
+// Handlers for logging in and out. GET /login shows the login page and
+// POST /login checks it, counting wrong passwords and codes against the
+// client; POST /logout ends the session.
+func loginHandler(auth *PasswordAuth) http.Handler {
+	tmpl := template.Must(template.New("login").Parse(loginTemplate))
+	mux := http.NewServeMux()
+
+	render := func(w http.ResponseWriter, status int, next string, failed bool) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		tmpl.Execute(w, struct {
+			Next   string
+			TOTP   bool
+			Failed bool
+		}{next, auth.totp != nil, failed})
+	}
+
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			render(w, http.StatusOK, loginTarget(r.URL.Query().Get("next")), false)
+
+		case "POST":
+			if auth.lockout.reject(w, r) {
+				return
+			}
+			next := loginTarget(r.FormValue("next"))
+			value, expires, ok := auth.Login(r.FormValue("password"), r.FormValue("code"))
+			if !ok {
+				auth.lockout.Fail(clientIP(r))
+				log.Printf("Rejected login from %s", clientIP(r))
+				render(w, http.StatusUnauthorized, next, true)
+				return
+			}
+			auth.lockout.Succeed(clientIP(r))
+			logf("Login from %s", clientIP(r))
+			setSessionCookie(w, r, value, expires)
+			redirect(w, r, next, http.StatusSeeOther)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := auth.Logout(r); err != nil {
+			log.Printf("Error saving sessions: %v", err)
+		}
+		setSessionCookie(w, r, "", time.Time{})
+		redirect(w, r, "/login", http.StatusSeeOther)
+	})
+
+	return mux
+}
+
+// Load the base32 TOTP secret from secretFile, generating one and showing
+// how to add it to an authenticator app if the file doesn't exist
+func loadOrCreateTOTPSecret(secretFile string) ([]byte, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	data, err := os.ReadFile(secretFile)
+	if os.IsNotExist(err) {
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		encoded := encoding.EncodeToString(secret)
+		if err := os.WriteFile(secretFile, []byte(encoded+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new TOTP secret in %s - add it to your authenticator app:", secretFile)
+		printTOTPSetup(encoded)
+		return secret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := encoding.DecodeString(strings.ToUpper(strings.TrimSpace(string(data))))
+	if err != nil || len(secret) < 10 {
+		return nil, fmt.Errorf("%s must contain a base32 encoded secret of at least 80 bits", secretFile)
+	}
+	return secret, nil
+}
+
+// Print the otpauth URI of a secret along with a QR code to scan
+func printTOTPSetup(encoded string) {
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + AppName,
+		RawQuery: url.Values{"secret": {encoded}, "issuer": {AppName}}.Encode(),
+	}
+	fmt.Println(uri.String())
+	if qr, err := encodeQR([]byte(uri.String())); err == nil {
+		qr.WriteText(os.Stdout)
+	}
+}
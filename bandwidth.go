@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Bounds on how much a throttled response writes at once. Chunks are sized
+// to about an eighth of a second at the stream's share so pacing stays
+// smooth without a syscall per few bytes.
+const (
+	minThrottleChunk = 4 << 10
+	maxThrottleChunk = 256 << 10
+)
+
+// BandwidthLimiter caps the total rate of outgoing downloads and divides it
+// evenly among the ones running, so a background sync gets no more than an
+// interactive download started next to it
+type BandwidthLimiter struct {
+	rate int64
+
+	mu     sync.Mutex
+	active int64
+}
+
+// Create a limiter for rate bytes per second, or nil for no limit
+func newBandwidthLimiter(rate int64) *BandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{rate: rate}
+}
+
+// Register a stream, which gets an equal share of the rate until Done
+func (b *BandwidthLimiter) Start() *BandwidthShare {
+	b.mu.Lock()
+	b.active++
+	b.mu.Unlock()
+	return &BandwidthShare{limiter: b}
+}
+
+// The rate each running stream currently gets
+func (b *BandwidthLimiter) share() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.rate/max(b.active, 1), 1)
+}
+
+// BandwidthShare paces one stream at its share of a BandwidthLimiter
+type BandwidthShare struct {
+	limiter *BandwidthLimiter
+	// When the stream may send again
+	next time.Time
+	once sync.Once
+}
+
+// How many bytes to send before pacing again
+func (s *BandwidthShare) chunk() int {
+	return int(min(max(s.limiter.share()/8, minThrottleChunk), maxThrottleChunk))
+}
+
+// Wait until the stream may send n bytes. The share is looked up each
+// time, so streams speed up as others finish.
+func (s *BandwidthShare) Wait(n int) {
+	now := time.Now()
+	if s.next.After(now) {
+		time.Sleep(s.next.Sub(now))
+	} else {
+		s.next = now
+	}
+	s.next = s.next.Add(time.Duration(int64(n) * int64(time.Second) / s.limiter.share()))
+}
+
+// Give the stream's share back to the others
+func (s *BandwidthShare) Done() {
+	s.once.Do(func() {
+		s.limiter.mu.Lock()
+		s.limiter.active--
+		s.limiter.mu.Unlock()
+	})
+}
+
+// ResponseWriter sending no faster than its bandwidth share
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	share *BandwidthShare
+}
+
+func (w throttledResponseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := min(len(p), w.share.chunk())
+		w.share.Wait(chunk)
+		n, err := w.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Keep the underlying ReadFrom (and with it sendfile), fed one paced chunk
+// at a time
+func (w throttledResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+
+	limit := int64(-1)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, limit = lr.R, lr.N
+	}
+
+	var total int64
+	for limit != 0 {
+		chunk := int64(w.share.chunk())
+		if limit > 0 && limit < chunk {
+			chunk = limit
+		}
+		w.share.Wait(int(chunk))
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		total += n
+		if limit > 0 {
+			limit -= n
+		}
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (w throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type basePathKey struct{}
+
+// Normalize a -base-path value to "" or "/prefix" without a trailing slash
+func cleanBasePath(p string) string {
+	p = cleanRelPath(p)
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// Middleware serving the site under a URL prefix. The prefix is stripped
+// before routing and remembered so redirects can add it back; pages only
+// use relative links, so they work under any prefix.
+func withBasePath(next http.Handler, base string) http.Handler {
+	if base == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == base {
+			target := base + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		rest, ok := strings.CutPrefix(r.URL.Path, base+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := r.WithContext(context.WithValue(r.Context(), basePathKey{}, base))
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// The prefix a request was served under
+func basePathOf(r *http.Request) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// Redirect to a site path such as "/?path=docs", keeping the URL prefix
+func redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	http.Redirect(w, r, basePathOf(r)+target, code)
+}
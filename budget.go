@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Returned by writes once the transfer budget is used up
+var errBudgetExhausted = errors.New("transfer budget used up")
+
+// TransferBudget caps the total bytes sent by downloads since the server
+// started. Once it's used up new downloads are refused and running ones
+// are cut off.
+type TransferBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	sent int64
+	// Closed when the budget runs out
+	done chan struct{}
+}
+
+// Create a budget of limit bytes, or nil for no limit
+func newTransferBudget(limit int64) *TransferBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &TransferBudget{limit: limit, done: make(chan struct{})}
+}
+
+// Take up to n bytes from the budget, returning how many may be sent
+func (b *TransferBudget) take(n int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n = min(n, b.limit-b.sent)
+	if n <= 0 {
+		return 0
+	}
+	b.sent += n
+	if b.sent == b.limit {
+		logf("Transfer budget of %s used up, refusing further downloads", formatByteSize(b.limit))
+		close(b.done)
+	}
+	return n
+}
+
+// Give back bytes taken but not sent
+func (b *TransferBudget) refund(n int64) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sent < b.limit {
+		b.sent -= n
+	}
+}
+
+// Whether the budget is used up
+func (b *TransferBudget) Exhausted() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closed when the budget is used up
+func (b *TransferBudget) Done() <-chan struct{} {
+	return b.done
+}
+
+// Bytes sent and the limit
+func (b *TransferBudget) Usage() (int64, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sent, b.limit
+}
+
+// ResponseWriter drawing what it sends from a TransferBudget
+type budgetResponseWriter struct {
+	http.ResponseWriter
+	budget *TransferBudget
+}
+
+func (w budgetResponseWriter) Write(p []byte) (int, error) {
+	allowed := w.budget.take(int64(len(p)))
+	n, err := w.ResponseWriter.Write(p[:allowed])
+	w.budget.refund(allowed - int64(n))
+	if err == nil && n < len(p) {
+		err = errBudgetExhausted
+	}
+	return n, err
+}
+
+// Keep the underlying ReadFrom, and with it sendfile, taking the budget in
+// chunks
+func (w budgetResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+
+	limit := int64(-1)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, limit = lr.R, lr.N
+	}
+
+	var total int64
+	for limit != 0 {
+		chunk := int64(transferChunk)
+		if limit > 0 && limit < chunk {
+			chunk = limit
+		}
+		allowed := w.budget.take(chunk)
+		if allowed == 0 {
+			return total, errBudgetExhausted
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: allowed})
+		w.budget.refund(allowed - n)
+		total += n
+		if limit > 0 {
+			limit -= n
+		}
+		if err != nil || n < allowed {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (w budgetResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Refuse downloads once the budget is used up, and count what the others
+// send against it
+func budgetDownloads(next http.Handler, budget *TransferBudget) http.Handler {
+	if budget == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if budget.Exhausted() {
+			debugf("Refused download of %s: transfer budget used up", r.URL.Path)
+			http.Error(w, "Downloads are no longer available: the server's transfer limit has been reached", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(budgetResponseWriter{w, budget}, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// BurnStore tracks files that are deleted after a limited number of
+// downloads, in the state database
+type BurnStore struct {
+	// Claims read and update the count together
+	mu sync.Mutex
+	db *sql.DB
+}
+
+// Open the burn-after-reading store, importing the burn.json of earlier
+// versions
+func openBurnStore(db *sql.DB, dataDir string) (*BurnStore, error) {
+	s := &BurnStore{db: db}
+
+	remaining := make(map[string]int)
+	err := importJSON(filepath.Join(dataDir, "burn.json"), &remaining, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for path, n := range remaining {
+				if _, err := tx.Exec("INSERT OR REPLACE INTO download_limits (path, remaining) VALUES (?, ?)", path, n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Limit a file to n more downloads; n <= 0 removes any limit
+func (s *BurnStore) Set(path string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if n > 0 {
+		_, err = s.db.Exec("INSERT OR REPLACE INTO download_limits (path, remaining) VALUES (?, ?)", path, n)
+	} else {
+		_, err = s.db.Exec("DELETE FROM download_limits WHERE path = ?", path)
+	}
+	if err != nil {
+		log.Printf("Error saving download limits: %v", err)
+	}
+}
+
+// Claim one download of a file. Returns whether the file is limited at all,
+// whether this download is allowed, and whether it used up the last one.
+func (s *BurnStore) Claim(path string) (limited, allowed, last bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.remaining(path)
+	if err != nil {
+		// Refuse rather than hand out a download that may have been the last
+		log.Printf("Error reading download limits: %v", err)
+		return true, false, false
+	}
+	if n < 0 {
+		return false, true, false
+	}
+	if n == 0 {
+		return true, false, false
+	}
+
+	n--
+	if _, err := s.db.Exec("UPDATE download_limits SET remaining = ? WHERE path = ?", n, path); err != nil {
+		log.Printf("Error saving download limits: %v", err)
+	}
+	return true, true, n == 0
+}
+
+// Remaining downloads for a file, or -1 if it isn't limited
+func (s *BurnStore) Remaining(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.remaining(path)
+	if err != nil {
+		log.Printf("Error reading download limits: %v", err)
+	}
+	return n
+}
+
+func (s *BurnStore) remaining(path string) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT remaining FROM download_limits WHERE path = ?", path).Scan(&n)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return max(n, 0), nil
+}
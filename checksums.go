@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileChecksum is the recorded SHA-256 of a file's content
+type FileChecksum struct {
+	Path     string    `json:"path"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Hashed   time.Time `json:"hashed"`
+}
+
+// ChecksumStore remembers the SHA-256 of files so they are only read again
+// once they change. Entries are persisted to a JSON file.
+type ChecksumStore struct {
+	mu   sync.Mutex
+	path string
+	sums map[string]*FileChecksum
+}
+
+// Open the checksum store in the data directory, loading recorded sums
+func openChecksumStore(dataDir string) (*ChecksumStore, error) {
+	c := &ChecksumStore{
+		path: filepath.Join(dataDir, "checksums.json"),
+		sums: make(map[string]*FileChecksum),
+	}
+
+	var sums []*FileChecksum
+	if err := loadJSON(c.path, &sums); err != nil {
+		return nil, err
+	}
+	for _, sum := range sums {
+		c.sums[sum.Path] = sum
+	}
+	return c, nil
+}
+
+// Hash the content of a file
+func hashFile(fullPath string) (string, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get the SHA-256 of a file, hashing it only if it changed size or
+// modification time since it was last recorded. Call Save when done.
+func (c *ChecksumStore) Sum(relPath, fullPath string, info fs.FileInfo) (string, error) {
+	c.mu.Lock()
+	recorded, ok := c.sums[relPath]
+	c.mu.Unlock()
+	if ok && recorded.Size == info.Size() && recorded.Modified.Equal(info.ModTime()) {
+		return recorded.SHA256, nil
+	}
+
+	sum, err := hashFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.sums[relPath] = &FileChecksum{Path: relPath, SHA256: sum, Size: info.Size(), Modified: info.ModTime(), Hashed: time.Now()}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// Persist the recorded sums
+func (c *ChecksumStore) Save() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sums := make([]*FileChecksum, 0, len(c.sums))
+	for _, sum := range c.sums {
+		sums = append(sums, sum)
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Path < sums[j].Path })
+	if err := saveJSON(c.path, sums); err != nil {
+		log.Printf("Error saving checksums: %v", err)
+	}
+}
+
+// Format a line of a SHA256SUMS file the way sha256sum does, escaping
+// names with backslashes or newlines and marking the line with a leading
+// backslash
+func checksumLine(sum, name string) string {
+	if !strings.ContainsAny(name, "\\\n") {
+		return sum + "  " + name + "\n"
+	}
+	name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+	return "\\" + sum + "  " + name + "\n"
+}
+
+// Handler streaming a SHA256SUMS manifest of a folder, or of a single file,
+// with names relative to it so "sha256sum -c SHA256SUMS" works from inside
+// the downloaded folder. Files are hashed as the manifest is written; sums
+// recorded earlier are reused for files that haven't changed.
+func (s *Server) handleChecksums(w http.ResponseWriter, r *http.Request) {
+	relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/checksums/"))
+	if s.encryption.Covers(relPath) {
+		http.Error(w, "Checksums are not available in the encrypted folder", http.StatusBadRequest)
+		return
+	}
+	if s.dedup.Covers(relPath) {
+		http.Error(w, "Checksums are not available in the deduplicated folder", http.StatusBadRequest)
+		return
+	}
+	root, err := safeJoinPath(s.config.DownloadDir, relPath)
+	if err != nil {
+		http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "SHA256SUMS"))
+	defer s.checksums.Save()
+	rc := http.NewResponseController(w)
+
+	if !info.IsDir() {
+		sum, err := s.checksums.Sum(relPath, root, info)
+		if err != nil {
+			http.Error(w, "Error hashing file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, checksumLine(sum, info.Name()))
+		return
+	}
+
+	count := 0
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.config.DownloadDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if !s.rules.Allowed(r, rel, false) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || s.rules != nil && d.Name() == accessFileName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := s.checksums.Sum(rel, path, info)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		io.WriteString(w, checksumLine(sum, filepath.ToSlash(name)))
+		rc.Flush()
+		count++
+		return nil
+	})
+	if err != nil {
+		// The status is already sent; leave a line sha256sum will reject
+		log.Printf("Error writing checksums of %s: %v", relPath, err)
+		fmt.Fprintf(w, "error: %v\n", err)
+		return
+	}
+	debugf("Sent checksums of %d file(s) in %s", count, relPath)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	errSymlinkMode = errors.New("refusing to change the mode of a symbolic link")
+	errOutsideRoot = errors.New("refusing to change the mode of a file outside the served folder")
+)
+
+// Parse an octal permission string such as "640" or "0755". Only the
+// permission bits may be set; setuid, setgid and sticky are refused.
+func parseFileMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an octal mode", s)
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("mode %s has bits outside 0777", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// Directory mode matching a file mode: execute (search) is added wherever
+// read is granted, like chmod's X
+func dirModeFor(mode fs.FileMode) fs.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// Change the mode of a file or folder inside root, and optionally of
+// everything inside it. Symbolic links are skipped so a change cannot reach
+// outside the served directory. Returns the number of entries changed.
+func chmodPath(root, fullPath string, fileMode, dirMode fs.FileMode, recursive bool) (int, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return 0, errSymlinkMode
+	}
+
+	// A link among the parent folders could still lead elsewhere, so work
+	// on the real path once it is known to be inside the real root
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return 0, err
+	}
+	if fullPath, err = filepath.EvalSymlinks(fullPath); err != nil {
+		return 0, err
+	}
+	rel, err := filepath.Rel(realRoot, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return 0, errOutsideRoot
+	}
+
+	if !info.IsDir() || !recursive {
+		mode := fileMode
+		if info.IsDir() {
+			mode = dirMode
+		}
+		return 1, os.Chmod(fullPath, mode)
+	}
+
+	// Folders get their final mode last, deepest first, so a mode without
+	// read or search permission does not stop the walk
+	count := 0
+	var dirs []string
+	err = filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			return nil
+		case d.IsDir():
+			dirs = append(dirs, path)
+		default:
+			if err := os.Chmod(path, fileMode); err != nil {
+				return err
+			}
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], dirMode); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Admin handler changing file modes. Expects "path" and an octal "mode";
+// with "recursive" set the mode applies to all files inside a folder, and
+// folders get "dir_mode", or mode plus execute where read is granted.
+func chmodHandler(config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		relPath := cleanRelPath(r.FormValue("path"))
+		if relPath == "" {
+			http.Error(w, "Invalid path: the served folder itself cannot be changed", http.StatusBadRequest)
+			return
+		}
+		fullPath, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil {
+			http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fileMode, err := parseFileMode(r.FormValue("mode"))
+		if err != nil {
+			http.Error(w, "Invalid mode: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		dirMode := dirModeFor(fileMode)
+		if s := r.FormValue("dir_mode"); s != "" {
+			if dirMode, err = parseFileMode(s); err != nil {
+				http.Error(w, "Invalid dir_mode: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		recursive := r.FormValue("recursive") != ""
+		count, err := chmodPath(config.DownloadDir, fullPath, fileMode, dirMode, recursive)
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errSymlinkMode) || errors.Is(err, errOutsideRoot) {
+			http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error changing mode: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			http.Error(w, "Error changing mode: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logf("Mode of %s changed to %s (%d entries) by %s", relPath, info.Mode().Perm(), count, clientIP(r))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Path    string `json:"path"`
+			Mode    string `json:"mode"`
+			Changed int    `json:"changed"`
+		}{
+			Path:    relPath,
+			Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+			Changed: count,
+		})
+	})
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partial uploads nobody added to for this long are thrown away
+const chunkedUploadExpiry = 24 * time.Hour
+
+// Highest part number of an upload sent in parallel parts
+const maxUploadParts = 10000
+
+// Returned when a parallel upload is completed before all parts arrived
+var errMissingParts = errors.New("not all parts have been uploaded")
+
+var contentRangePattern = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+// ChunkedUpload is the state of a file being uploaded in ranged PUTs
+type ChunkedUpload struct {
+	Path     string `json:"path"`
+	Received int64  `json:"received"`
+	// -1 until a chunk states the total size
+	Total    int64 `json:"total"`
+	Complete bool  `json:"complete"`
+	// Parts received so far of an upload sent in parallel
+	Parts []UploadPart `json:"parts,omitempty"`
+}
+
+// UploadPart is one received part of a parallel upload
+type UploadPart struct {
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+// ChunkedUploads keeps partial uploads in the data directory until they are
+// committed. Each path takes one request at a time, except that the parts
+// of a parallel upload are received side by side.
+type ChunkedUploads struct {
+	mu   sync.Mutex
+	dir  string
+	busy map[string]bool
+	// Parts being received for each path
+	parts map[string]int
+}
+
+func openChunkedUploads(dataDir string) (*ChunkedUploads, error) {
+	dir := filepath.Join(dataDir, "partial")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ChunkedUploads{dir: dir, busy: make(map[string]bool), parts: make(map[string]int)}, nil
+}
+
+// Files holding the data and the stated total size of a partial upload
+func (c *ChunkedUploads) files(relPath string) (data, meta string) {
+	sum := sha256.Sum256([]byte(relPath))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(c.dir, name), filepath.Join(c.dir, name+".json")
+}
+
+// Folder holding the parts of a parallel upload, one file per part number
+func (c *ChunkedUploads) partsDir(relPath string) string {
+	data, _ := c.files(relPath)
+	return data + ".parts"
+}
+
+// Reserve a path for one request; release with the returned function
+func (c *ChunkedUploads) acquire(relPath string) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.busy[relPath] || c.parts[relPath] > 0 {
+		return nil, false
+	}
+	c.busy[relPath] = true
+	return func() {
+		c.mu.Lock()
+		delete(c.busy, relPath)
+		c.mu.Unlock()
+	}, true
+}
+
+// Reserve one part of a path for a request, leaving the other parts free
+func (c *ChunkedUploads) acquirePart(relPath string, part int) (func(), bool) {
+	key := fmt.Sprintf("%s\x00%d", relPath, part)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.busy[relPath] || c.busy[key] {
+		return nil, false
+	}
+	c.busy[key] = true
+	c.parts[relPath]++
+	return func() {
+		c.mu.Lock()
+		delete(c.busy, key)
+		if c.parts[relPath]--; c.parts[relPath] == 0 {
+			delete(c.parts, relPath)
+		}
+		c.mu.Unlock()
+	}, true
+}
+
+// Current state of a partial upload
+func (c *ChunkedUploads) status(relPath string) (ChunkedUpload, error) {
+	data, meta := c.files(relPath)
+	upload := ChunkedUpload{Path: relPath, Total: -1}
+	parts, err := c.receivedParts(relPath)
+	if err != nil {
+		return upload, err
+	}
+	upload.Parts = parts
+	info, err := os.Stat(data)
+	if os.IsNotExist(err) {
+		return upload, nil
+	}
+	if err != nil {
+		return upload, err
+	}
+	if err := loadJSON(meta, &upload); err != nil {
+		return upload, err
+	}
+	upload.Received = info.Size()
+	upload.Complete = upload.Total == upload.Received
+	return upload, nil
+}
+
+// The parts of a parallel upload received so far, in order
+func (c *ChunkedUploads) receivedParts(relPath string) ([]UploadPart, error) {
+	entries, err := os.ReadDir(c.partsDir(relPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var parts []UploadPart
+	for _, entry := range entries {
+		// Parts still being received have a temporary name
+		part, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadPart{Part: part, Size: info.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Part < parts[j].Part })
+	return parts, nil
+}
+
+// Join parts 1 to count of a parallel upload into its data file, which then
+// commits like a sequential upload
+func (c *ChunkedUploads) assemble(relPath string, count int) (ChunkedUpload, error) {
+	upload, err := c.status(relPath)
+	if err != nil {
+		return upload, err
+	}
+	if len(upload.Parts) != count || upload.Parts[count-1].Part != count {
+		return upload, errMissingParts
+	}
+	var total int64
+	for _, part := range upload.Parts {
+		total += part.Size
+	}
+	if err := checkDiskSpace(total, c.dir); err != nil {
+		return upload, err
+	}
+
+	dir := c.partsDir(relPath)
+	tmp, err := os.CreateTemp(c.dir, ".assemble-*")
+	if err != nil {
+		return upload, err
+	}
+	defer os.Remove(tmp.Name())
+	for _, part := range upload.Parts {
+		in, err := os.Open(filepath.Join(dir, strconv.Itoa(part.Part)))
+		if err != nil {
+			tmp.Close()
+			return upload, err
+		}
+		_, err = io.Copy(tmp, in)
+		in.Close()
+		if err != nil {
+			tmp.Close()
+			return upload, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return upload, err
+	}
+
+	data, meta := c.files(relPath)
+	if err := saveJSON(meta, ChunkedUpload{Path: relPath, Total: total}); err != nil {
+		return upload, err
+	}
+	if err := os.Rename(tmp.Name(), data); err != nil {
+		return upload, err
+	}
+	os.RemoveAll(dir)
+	return c.status(relPath)
+}
+
+// Throw away a partial upload
+func (c *ChunkedUploads) discard(relPath string) {
+	data, meta := c.files(relPath)
+	os.Remove(data)
+	os.Remove(meta)
+	os.RemoveAll(c.partsDir(relPath))
+}
+
+// Remove partial uploads that were abandoned
+func (c *ChunkedUploads) expire() {
+	entries, _ := os.ReadDir(c.dir)
+	for _, entry := range entries {
+		// The data file changes with every chunk, its size file does not
+		if strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		// Folders of parts change with every part that arrives
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > chunkedUploadExpiry {
+			os.RemoveAll(filepath.Join(c.dir, entry.Name()))
+			os.Remove(filepath.Join(c.dir, entry.Name()+".json"))
+		}
+	}
+}
+
+// Parse "bytes start-end/total" with "*" for an unknown total
+func parseContentRange(header string) (start, end, total int64, err error) {
+	m := contentRangePattern.FindStringSubmatch(header)
+	if m == nil {
+		return 0, 0, 0, errors.New("expected Content-Range: bytes start-end/total")
+	}
+	start, _ = strconv.ParseInt(m[1], 10, 64)
+	end, _ = strconv.ParseInt(m[2], 10, 64)
+	total = -1
+	if m[3] != "*" {
+		total, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	if end < start || total >= 0 && end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid range %s", header)
+	}
+	return start, end, total, nil
+}
+
+func writeChunkedStatus(w http.ResponseWriter, code int, upload ChunkedUpload) {
+	if upload.Received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", upload.Received-1))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// Handler for uploads in sequential ranged PUTs to /upload/<path>, each with
+// a Content-Range continuing where the last one ended. GET reports how much
+// arrived so a client can resume after a network blip, POST commits the
+// file once all data is there, and DELETE abandons the upload.
+//
+// A PUT without Content-Range, as sent by "curl -T", uploads the whole file
+// at once, creating any missing folders on the way.
+//
+// Alternatively parts of the file are PUT side by side with "part=N", in any
+// order, and POST with "parts=N" joins parts 1 to N and commits the file.
+func (s *Server) handleChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/upload/"))
+	fullPath, err := safeJoinPath(s.config.DownloadDir, relPath)
+	if err != nil || relPath == "" {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	filename, err := sanitizeFilename(filepath.Base(relPath))
+	if err != nil || filename != filepath.Base(relPath) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	part := 0
+	if v := r.URL.Query().Get("part"); v != "" && r.Method == "PUT" {
+		if part, err = strconv.Atoi(v); err != nil || part < 1 || part > maxUploadParts {
+			http.Error(w, fmt.Sprintf("Invalid part: must be between 1 and %d", maxUploadParts), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Status requests don't change anything, so they never wait
+	if r.Method != "GET" && r.Method != "HEAD" {
+		var release func()
+		var ok bool
+		if part > 0 {
+			release, ok = s.chunked.acquirePart(relPath, part)
+		} else {
+			release, ok = s.chunked.acquire(relPath)
+		}
+		if !ok {
+			http.Error(w, "Another request for this upload is in progress", http.StatusConflict)
+			return
+		}
+		defer release()
+	}
+
+	upload, err := s.chunked.status(relPath)
+	if err != nil {
+		http.Error(w, "Error reading upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeChunkedStatus(w, http.StatusOK, upload)
+
+	case "PUT":
+		switch {
+		case part > 0:
+			s.putPart(w, r, upload, part, fullPath)
+		case r.Header.Get("Content-Range") == "":
+			s.putWhole(w, r, upload, fullPath)
+		default:
+			s.putChunk(w, r, upload, fullPath)
+		}
+
+	case "POST":
+		// Join the parts of a parallel upload, unless an earlier attempt to
+		// commit did already
+		if v := r.URL.Query().Get("parts"); v != "" && len(upload.Parts) > 0 {
+			count, err := strconv.Atoi(v)
+			if err != nil || count < 1 || count > maxUploadParts {
+				http.Error(w, fmt.Sprintf("Invalid parts: must be between 1 and %d", maxUploadParts), http.StatusBadRequest)
+				return
+			}
+			if upload, err = s.chunked.assemble(relPath, count); err != nil {
+				if errors.Is(err, errMissingParts) {
+					writeChunkedStatus(w, http.StatusConflict, upload)
+				} else {
+					http.Error(w, "Error assembling upload: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+		s.commitChunkedUpload(w, r, upload, fullPath)
+
+	case "DELETE":
+		s.chunked.discard(relPath)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Append one chunk to a partial upload
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request, upload ChunkedUpload, fullPath string) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, "Invalid Content-Range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lock := s.locks.Conflict(upload.Path, lockToken(r)); lock != nil {
+		writeLockConflict(w, lock)
+		return
+	}
+	if len(upload.Parts) > 0 {
+		http.Error(w, "This file is being uploaded in parallel parts", http.StatusConflict)
+		return
+	}
+	// Chunks must arrive in order; tell the client where to continue
+	if start != upload.Received {
+		writeChunkedStatus(w, http.StatusConflict, upload)
+		return
+	}
+	if upload.Total >= 0 && total >= 0 && total != upload.Total {
+		http.Error(w, fmt.Sprintf("Invalid Content-Range: the total size was given as %d before", upload.Total), http.StatusBadRequest)
+		return
+	}
+	if total < 0 {
+		total = upload.Total
+	}
+
+	if start == 0 {
+		s.chunked.expire()
+		need := end + 1
+		if total >= 0 {
+			need = total
+		}
+		if err := checkDiskSpace(need, s.config.DataDir, filepath.Dir(fullPath)); err != nil {
+			http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	data, meta := s.chunked.files(upload.Path)
+	if total != upload.Total || start == 0 {
+		if err := saveJSON(meta, ChunkedUpload{Path: upload.Path, Total: total}); err != nil {
+			http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		upload.Total = total
+	}
+
+	out, err := os.OpenFile(data, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer out.Close()
+
+	transfer := s.transfers.Start(transferID(r.Header.Get("X-Upload-ID")), "upload", upload.Path, clientIP(r), end-start+1)
+	defer s.transfers.Finish(transfer)
+
+	// Keep only whole chunks, so a dropped connection leaves the upload
+	// where the last good chunk ended
+	length := end - start + 1
+	out.Seek(start, io.SeekStart)
+	n, err := io.Copy(out, io.LimitReader(countingReader{r.Body, transfer}, length+1))
+	if err == nil && n != length {
+		err = fmt.Errorf("received %d bytes for a range of %d", n, length)
+	}
+	if err != nil {
+		out.Truncate(start)
+		http.Error(w, "Error receiving chunk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := out.Close(); err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload.Received = end + 1
+	upload.Complete = upload.Total == upload.Received
+	debugf("Chunk %d-%d of %s received from %s", start, end, upload.Path, clientIP(r))
+	writeChunkedStatus(w, http.StatusOK, upload)
+}
+
+// Receive a whole file in one PUT and commit it right away
+func (s *Server) putWhole(w http.ResponseWriter, r *http.Request, upload ChunkedUpload, fullPath string) {
+	// "curl -T file url/" adds the name itself; a bare folder has none
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "No file name given", http.StatusBadRequest)
+		return
+	}
+	if upload.Received > 0 || len(upload.Parts) > 0 {
+		http.Error(w, "An upload of this file in chunks is in progress", http.StatusConflict)
+		return
+	}
+	if lock := s.locks.Conflict(upload.Path, lockToken(r)); lock != nil {
+		writeLockConflict(w, lock)
+		return
+	}
+	s.chunked.expire()
+	if err := checkDiskSpace(r.ContentLength, s.config.DataDir, filepath.Dir(fullPath)); err != nil {
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	data, meta := s.chunked.files(upload.Path)
+	out, err := os.OpenFile(data, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	transfer := s.transfers.Start(transferID(r.Header.Get("X-Upload-ID")), "upload", upload.Path, clientIP(r), r.ContentLength)
+	defer s.transfers.Finish(transfer)
+	n, err := io.Copy(out, countingReader{r.Body, transfer})
+	if err == nil && r.ContentLength >= 0 && n != r.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", n, r.ContentLength)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = saveJSON(meta, ChunkedUpload{Path: upload.Path, Total: n})
+	}
+	if err != nil {
+		s.chunked.discard(upload.Path)
+		http.Error(w, "Error receiving file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload.Received, upload.Total, upload.Complete = n, n, true
+	s.commitChunkedUpload(w, r, upload, fullPath)
+}
+
+// Receive one part of a parallel upload. A part that doesn't arrive
+// completely, or doesn't match its X-Content-SHA256, is dropped so it can
+// simply be sent again.
+func (s *Server) putPart(w http.ResponseWriter, r *http.Request, upload ChunkedUpload, part int, fullPath string) {
+	if lock := s.locks.Conflict(upload.Path, lockToken(r)); lock != nil {
+		writeLockConflict(w, lock)
+		return
+	}
+	if upload.Received > 0 {
+		http.Error(w, "This file is being uploaded in sequential chunks", http.StatusConflict)
+		return
+	}
+	s.chunked.expire()
+	if err := checkDiskSpace(r.ContentLength, s.config.DataDir, filepath.Dir(fullPath)); err != nil {
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	dir := s.chunked.partsDir(upload.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(out.Name())
+
+	transfer := s.transfers.Start("", "upload", upload.Path, clientIP(r), r.ContentLength)
+	defer s.transfers.Finish(transfer)
+
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, sum), countingReader{r.Body, transfer})
+	if err == nil && r.ContentLength >= 0 && n != r.ContentLength {
+		err = fmt.Errorf("received %d of %d bytes", n, r.ContentLength)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		http.Error(w, "Error receiving part: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if want := r.Header.Get("X-Content-SHA256"); want != "" && !strings.EqualFold(want, hex.EncodeToString(sum.Sum(nil))) {
+		http.Error(w, "The part does not match X-Content-SHA256", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := os.Rename(out.Name(), filepath.Join(dir, strconv.Itoa(part))); err != nil {
+		http.Error(w, "Error saving upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload, err = s.chunked.status(upload.Path)
+	if err != nil {
+		http.Error(w, "Error reading upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debugf("Part %d of %s received from %s (%d bytes)", part, upload.Path, clientIP(r), n)
+	writeChunkedStatus(w, http.StatusOK, upload)
+}
+
+// Move a finished partial upload into place, with the same checks as a
+// regular upload
+func (s *Server) commitChunkedUpload(w http.ResponseWriter, r *http.Request, upload ChunkedUpload, fullPath string) {
+	data, _ := s.chunked.files(upload.Path)
+	// Only a whole-file PUT can complete an upload of zero bytes
+	if !upload.Complete && (upload.Received == 0 || upload.Total >= 0) {
+		writeChunkedStatus(w, http.StatusConflict, upload)
+		return
+	}
+	if lock := s.locks.Conflict(upload.Path, lockToken(r)); lock != nil {
+		writeLockConflict(w, lock)
+		return
+	}
+	if !writePreconditionsMet(r, writeTarget(fullPath)) {
+		http.Error(w, "Upload rejected: the file is not the version the request expects", http.StatusPreconditionFailed)
+		return
+	}
+
+	in, err := os.Open(data)
+	if err != nil {
+		http.Error(w, "Error reading upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer in.Close()
+	filename := filepath.Base(fullPath)
+	if _, err := s.uploadTypes.Check(filename, in); err != nil {
+		log.Printf("Rejected upload of %s from %s: %v", filename, clientIP(r), err)
+		s.chunked.discard(upload.Path)
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if want := r.Header.Get("X-Content-SHA256"); want != "" {
+		sum := sha256.New()
+		in.Seek(0, io.SeekStart)
+		if _, err := io.Copy(sum, in); err != nil {
+			http.Error(w, "Error reading upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !strings.EqualFold(want, hex.EncodeToString(sum.Sum(nil))) {
+			http.Error(w, "The uploaded file does not match X-Content-SHA256", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	in.Close()
+
+	if err := runHooks(&HookEvent{Point: HookPreUpload, Path: upload.Path, Client: clientIP(r), Size: upload.Received}); err != nil {
+		log.Printf("Upload of %s from %s rejected by hook: %v", upload.Path, clientIP(r), err)
+		s.chunked.discard(upload.Path)
+		http.Error(w, "Upload rejected: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	targetPath := filepath.ToSlash(filepath.Dir(upload.Path))
+	if s.quarantine != nil {
+		in, err := os.Open(data)
+		if err != nil {
+			http.Error(w, "Error reading upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item, err := s.quarantine.Add(in, filename, cleanRelPath(targetPath), clientIP(r), 0, false)
+		in.Close()
+		if err != nil {
+			http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.chunked.discard(upload.Path)
+		logf("File held for approval: %s to %s (%s)", item.Filename, targetPath, item.ID)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.config.AppendOnly {
+		if fullPath, err = versionedName(fullPath); err != nil {
+			http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	relPath := cleanRelPath(filepath.Join(targetPath, filepath.Base(fullPath)))
+	os.Chmod(data, 0644)
+	if s.encryption.Covers(relPath) {
+		err = encryptFile(data, fullPath, s.encryption)
+	} else if s.dedup.Covers(relPath) {
+		err = dedupFile(data, fullPath, s.dedup)
+	} else {
+		err = moveFile(data, fullPath)
+	}
+	if err != nil {
+		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.chunked.discard(upload.Path)
+
+	logf("File uploaded in chunks: %s (%d bytes) by %s", relPath, upload.Received, clientIP(r))
+	s.events.Publish(Event{Type: EventUpload, Path: relPath, Client: clientIP(r), RequestID: requestID(r)})
+	go runHooks(&HookEvent{Point: HookPostUpload, Path: relPath, Client: clientIP(r), Size: upload.Received})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	}{relPath, upload.Received})
+}
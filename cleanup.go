@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	cleanupMu    sync.Mutex
+	cleanupFuncs []func()
+	cleanupOnce  sync.Once
+)
+
+// Register a function to run when the process is interrupted or terminated.
+// Functions run in reverse order of registration, like deferred calls.
+func onExit(fn func()) {
+	cleanupMu.Lock()
+	cleanupFuncs = append(cleanupFuncs, fn)
+	cleanupMu.Unlock()
+
+	cleanupOnce.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			runCleanup()
+			os.Exit(0)
+		}()
+	})
+}
+
+// Run all registered cleanup functions
+func runCleanup() {
+	cleanupMu.Lock()
+	funcs := cleanupFuncs
+	cleanupFuncs = nil
+	cleanupMu.Unlock()
+
+	for i := len(funcs) - 1; i >= 0; i-- {
+		funcs[i]()
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files larger than this are uploaded in chunks of this size, so a dropped
+// connection only costs the chunk being sent
+const clientChunkSize = 32 << 20
+
+// Attempts at each request before put and get give up
+const clientAttempts = 5
+
+// Client talks to another server's API for the put, get and ls commands
+type Client struct {
+	root   *url.URL // the server's root, ending in "/"
+	apiKey string
+	client *http.Client
+}
+
+// An error status from the server
+type clientStatusError struct {
+	code int
+	text string
+}
+
+func (e *clientStatusError) Error() string {
+	return e.text
+}
+
+// Check if a failed request is worth sending again: the connection broke,
+// or the server was busy or restarting. These are the statuses the upload
+// queue in the browser retries too.
+func retryable(err error) bool {
+	var status *clientStatusError
+	if errors.As(err, &status) {
+		switch status.code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Run put, get or ls with their arguments
+func runClientCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	apiKey := flags.String("key", os.Getenv("LOCAL_FILESERVER_API_KEY"), "API key to send (or set LOCAL_FILESERVER_API_KEY)")
+	password := flags.String("password", os.Getenv("LOCAL_FILESERVER_PASSWORD"), "Password to log in with (or set LOCAL_FILESERVER_PASSWORD)")
+	var output *string
+	var long *bool
+	switch command {
+	case "put":
+		flags.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Usage: local-fileserver put [options] <file or folder>... <url>")
+			flags.PrintDefaults()
+		}
+	case "get":
+		output = flags.String("o", "", "File or folder to save to, - for stdout (default is the name on the server, in the current folder)")
+		flags.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Usage: local-fileserver get [options] <url>")
+			flags.PrintDefaults()
+		}
+	case "ls":
+		long = flags.Bool("l", false, "Show permissions, size and modification time")
+		flags.Usage = func() {
+			fmt.Fprintln(os.Stderr, "Usage: local-fileserver ls [options] <url>")
+			flags.PrintDefaults()
+		}
+	}
+	flags.Parse(args)
+	args = flags.Args()
+	if command == "put" && len(args) < 2 || command != "put" && len(args) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	root, remote, folder, err := parseClientURL(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	c, err := newClient(root, *apiKey, *password)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "put":
+		return c.putAll(args[:len(args)-1], remote, folder)
+	case "get":
+		return c.getAll(remote, *output)
+	default:
+		return c.printList(os.Stdout, remote, *long)
+	}
+}
+
+// Split a URL given to put, get or ls into the server's root and a path on
+// it, noting if the path names a folder. Besides
+// http://host:8080/folder/file, the links the pages use work:
+// http://host:8080/?path=folder and http://host:8080/download/folder/file.
+// Behind -base-path only those tell the prefix from the path.
+func parseClientURL(raw string) (*url.URL, string, bool, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", false, fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	root := &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host, Path: "/"}
+	remote := u.Path
+	if query := u.Query(); query.Has("path") {
+		root.Path = u.Path[:strings.LastIndex(u.Path, "/")+1]
+		if root.Path == "" {
+			root.Path = "/"
+		}
+		return root, cleanRelPath(query.Get("path")), true, nil
+	}
+	for _, prefix := range []string{"/download/", "/upload/"} {
+		if i := strings.Index(u.Path, prefix); i >= 0 {
+			root.Path, remote = u.Path[:i+1], u.Path[i+len(prefix):]
+			break
+		}
+	}
+	return root, cleanRelPath(remote), remote == "" || strings.HasSuffix(remote, "/"), nil
+}
+
+// Connect to the server at root, logging in first when a password is given
+func newClient(root *url.URL, apiKey, password string) (*Client, error) {
+	c := &Client{root: root, apiKey: apiKey, client: &http.Client{}}
+	if password == "" {
+		return c, nil
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c.client.Jar = jar
+	// The login answers with a redirect, which only needs its cookie
+	login := *c.client
+	login.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := login.PostForm(c.url("login", nil), url.Values{"password": {password}})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusSeeOther:
+		return c, nil
+	case http.StatusUnauthorized:
+		return nil, errors.New("login failed: wrong password")
+	}
+	return nil, fmt.Errorf("login failed: %s", resp.Status)
+}
+
+// The address of an API path on the server
+func (c *Client) url(apiPath string, query url.Values) string {
+	return c.root.ResolveReference(&url.URL{Path: apiPath, RawQuery: query.Encode()}).String()
+}
+
+// Send a request, turning error statuses into a clientStatusError
+func (c *Client) do(method, apiPath string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(apiPath, query), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, &clientStatusError{resp.StatusCode, fmt.Sprintf("%s: %s %s", apiPath, resp.Status, strings.TrimSpace(string(text)))}
+	}
+	return resp, nil
+}
+
+// Run send up to clientAttempts times, waiting longer after each failure
+// that may go away by itself
+func retry(what string, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt == clientAttempts || !retryable(err) {
+			return err
+		}
+		wait := time.Duration(1<<(attempt-1)) * time.Second
+		fmt.Fprintf(os.Stderr, "%s failed (%v), trying again in %v\n", what, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// List a folder on the server page by page
+func (c *Client) List(dir string) ([]FileInfo, error) {
+	var entries []FileInfo
+	for offset := 0; offset >= 0; {
+		var page ListingPage
+		err := retry("Listing "+dir, func() error {
+			resp, err := c.do("GET", "list", url.Values{"path": {dir}, "offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(maxListingPageSize)}}, nil, nil, 0)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			return json.NewDecoder(resp.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Entries...)
+		offset = page.Next
+	}
+	return entries, nil
+}
+
+// Check if a path on the server is a folder
+func (c *Client) isDir(remote string) bool {
+	resp, err := c.do("GET", "list", url.Values{"path": {remote}, "limit": {"1"}}, nil, nil, 0)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// Print a folder's entries, folders with a trailing slash, optionally with
+// their permissions, size and modification time
+func (c *Client) printList(w io.Writer, remote string, long bool) error {
+	entries, err := c.List(remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.IsDir {
+			name += "/"
+		}
+		if long {
+			fmt.Fprintf(w, "%s %10s %s %s\n", entry.Mode, formatByteSize(entry.Size), entry.ModTime.Local().Format("2006-01-02 15:04"), name)
+		} else {
+			fmt.Fprintln(w, name)
+		}
+	}
+	return nil
+}
+
+// Upload files and folders. They go into the remote folder, or a single
+// file takes the remote name when that is not an existing folder.
+func (c *Client) putAll(locals []string, remote string, folder bool) error {
+	if !folder && len(locals) == 1 {
+		if info, err := os.Stat(locals[0]); err == nil && info.IsDir() {
+			folder = true
+		}
+	}
+	folder = folder || len(locals) > 1 || c.isDir(remote)
+
+	for _, local := range locals {
+		target := remote
+		if folder {
+			target = path.Join(remote, filepath.Base(local))
+		}
+		info, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err := c.putFile(local, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Folders are uploaded file by file; the server creates the
+		// folders on the way
+		err = filepath.WalkDir(local, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(local, file)
+			if err != nil {
+				return err
+			}
+			return c.putFile(file, path.Join(target, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload one file, in a single PUT or in chunks when it is large
+func (c *Client) putFile(local, remote string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	var resp *http.Response
+	if size <= clientChunkSize {
+		err = retry("Uploading "+local, func() error {
+			resp, err = c.do("PUT", "upload/"+remote, nil, nil, io.NewSectionReader(file, 0, size), size)
+			return err
+		})
+	} else {
+		resp, err = c.putChunks(file, size, remote)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		fmt.Fprintf(os.Stderr, "Uploaded %s, waiting for approval\n", remote)
+		return nil
+	}
+	var result struct {
+		Path string `json:"path"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Path != "" {
+		remote = result.Path
+	}
+	fmt.Fprintf(os.Stderr, "Uploaded %s (%s)\n", remote, formatByteSize(size))
+	return nil
+}
+
+// Upload a large file in sequential chunks and commit it, checking the
+// server got every byte. An upload a previous run left unfinished is
+// continued where it stopped.
+func (c *Client) putChunks(file *os.File, size int64, remote string) (*http.Response, error) {
+	apiPath := "upload/" + remote
+	var status ChunkedUpload
+	err := retry("Checking "+remote, func() error {
+		resp, err := c.do("GET", apiPath, nil, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(&status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Anything else left there was a different upload
+	if status.Received > 0 && status.Total != size || len(status.Parts) > 0 {
+		resp, err := c.do("DELETE", apiPath, nil, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		status.Received = 0
+	}
+
+	sum := &fileHash{file: file, hash: sha256.New()}
+	conflicts := 0
+	for sent := status.Received; sent < size; {
+		end := min(sent+clientChunkSize, size) - 1
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", sent, end, size)}}
+		err := retry(fmt.Sprintf("Uploading %s at %d", remote, sent), func() error {
+			resp, err := c.do("PUT", apiPath, nil, header, io.NewSectionReader(file, sent, end-sent+1), end-sent+1)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			sent = end + 1
+			return nil
+		})
+		// An earlier attempt may have arrived after all; the server says
+		// where to continue
+		var statusErr *clientStatusError
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusConflict && conflicts < clientAttempts {
+			conflicts++
+			resp, getErr := c.do("GET", apiPath, nil, nil, nil, 0)
+			if getErr != nil {
+				return nil, err
+			}
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			resp.Body.Close()
+			sent = status.Received
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := sum.upTo(sent); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "\r%s: %d%%", remote, sent*100/size)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if err := sum.upTo(size); err != nil {
+		return nil, err
+	}
+	header := http.Header{"X-Content-SHA256": {hex.EncodeToString(sum.hash.Sum(nil))}}
+	var resp *http.Response
+	err = retry("Finishing "+remote, func() error {
+		resp, err = c.do("POST", apiPath, nil, header, nil, 0)
+		return err
+	})
+	return resp, err
+}
+
+// SHA-256 of the start of a file, extended as more of it is sent
+type fileHash struct {
+	file   *os.File
+	hash   hash.Hash
+	hashed int64
+}
+
+// Extend the hash to the first n bytes of the file, starting over if the
+// server went back to before what was hashed
+func (h *fileHash) upTo(n int64) error {
+	if n < h.hashed {
+		h.hash.Reset()
+		h.hashed = 0
+	}
+	_, err := io.Copy(h.hash, io.NewSectionReader(h.file, h.hashed, n-h.hashed))
+	if err == nil {
+		h.hashed = n
+	}
+	return err
+}
+
+// Download a file, or a folder with everything in it, to dest: a file, a
+// folder to put it in, or "-" for stdout. Without dest it is saved under
+// its own name in the current folder.
+func (c *Client) getAll(remote, dest string) error {
+	name := path.Base("/" + remote)
+	if remote == "" || c.isDir(remote) {
+		if dest == "-" {
+			return fmt.Errorf("%q is a folder", remote)
+		}
+		if dest == "" {
+			dest = name
+			if remote == "" {
+				dest = "."
+			}
+		}
+		return c.getDir(remote, dest)
+	}
+
+	if dest == "-" {
+		_, _, err := c.download(remote, os.Stdout)
+		return err
+	}
+	if dest == "" {
+		dest = name
+	} else if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, name)
+	}
+	return c.getFile(remote, dest)
+}
+
+// Download a folder recursively into the local folder dest
+func (c *Client) getDir(remote, dest string) error {
+	entries, err := c.List(remote)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// Names come from the other server, so keep them inside dest. "."
+		// and "" would fetch the folder into itself forever, and a name
+		// like "C:" starts a path of its own on Windows.
+		if entry.Name == "" || entry.Name == "." || entry.Name == ".." ||
+			strings.ContainsAny(entry.Name, `/\`) || filepath.VolumeName(entry.Name) != "" {
+			continue
+		}
+		target := filepath.Join(dest, entry.Name)
+		if entry.IsDir {
+			err = c.getDir(entry.Path, target)
+		} else {
+			err = c.getFile(entry.Path, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Download one file next to dest, then move it into place with the
+// server's modification time
+func (c *Client) getFile(remote, dest string) error {
+	out, err := os.CreateTemp(filepath.Dir(dest), ".get-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	n, modTime, err := c.download(remote, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Chmod(out.Name(), 0644)
+	if !modTime.IsZero() {
+		os.Chtimes(out.Name(), modTime, modTime)
+	}
+	if err := os.Rename(out.Name(), dest); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Downloaded %s (%s)\n", dest, formatByteSize(n))
+	return nil
+}
+
+// Write a file on the server to w. A broken connection is resumed where
+// it stopped, as long as the file didn't change in the meantime.
+func (c *Client) download(remote string, w io.Writer) (int64, time.Time, error) {
+	var written int64
+	var etag string
+	var modTime time.Time
+	err := retry("Downloading "+remote, func() error {
+		header := http.Header{}
+		if written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			header.Set("If-Range", etag)
+		}
+		resp, err := c.do("GET", "download/"+remote, nil, header, nil, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("%s changed while it was being downloaded", remote)
+		}
+		if written == 0 {
+			etag = resp.Header.Get("ETag")
+			modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		}
+		n, err := io.Copy(w, resp.Body)
+		written += n
+		// Without an ETag there is no telling if the rest still fits
+		if err != nil && etag == "" {
+			return fmt.Errorf("downloading %s: %v", remote, err)
+		}
+		return err
+	})
+	return written, modTime, err
+}
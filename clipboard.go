@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the shared clipboard
+const (
+	clipboardCapacity = 20
+	maxClipboardText  = 64 << 10
+)
+
+// ClipboardEntry is one piece of text shared through the clipboard
+type ClipboardEntry struct {
+	ID     string    `json:"id"`
+	Text   string    `json:"text"`
+	Client string    `json:"client"`
+	Time   time.Time `json:"time"`
+}
+
+// Clipboard keeps the most recent shared texts in a JSON file and streams
+// new ones to every device watching
+type Clipboard struct {
+	mu       sync.Mutex
+	path     string
+	entries  []ClipboardEntry // oldest first
+	watchers map[chan ClipboardEntry]bool
+	// Closed on shutdown to end the streams
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Open the clipboard in the data directory
+func openClipboard(dataDir string) (*Clipboard, error) {
+	c := &Clipboard{
+		path:     filepath.Join(dataDir, "clipboard.json"),
+		watchers: make(map[chan ClipboardEntry]bool),
+		closed:   make(chan struct{}),
+	}
+	if err := loadJSON(c.path, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Add text to the clipboard and send it to the watchers
+func (c *Clipboard) Add(text, client string) (ClipboardEntry, error) {
+	id, err := randomID()
+	if err != nil {
+		return ClipboardEntry{}, err
+	}
+	entry := ClipboardEntry{ID: id, Text: text, Client: client, Time: time.Now()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, entry)
+	if len(c.entries) > clipboardCapacity {
+		c.entries = c.entries[len(c.entries)-clipboardCapacity:]
+	}
+	for watcher := range c.watchers {
+		// A watcher that is not keeping up misses the entry rather than
+		// holding up everyone else
+		select {
+		case watcher <- entry:
+		default:
+		}
+	}
+	return entry, saveJSON(c.path, c.entries)
+}
+
+// Empty the clipboard
+func (c *Clipboard) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	return saveJSON(c.path, []ClipboardEntry{})
+}
+
+// Get the clipboard entries, newest first
+func (c *Clipboard) List() []ClipboardEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make([]ClipboardEntry, len(c.entries))
+	for i, e := range c.entries {
+		result[len(c.entries)-1-i] = e
+	}
+	return result
+}
+
+// Receive new entries until the returned function is called
+func (c *Clipboard) Watch() (<-chan ClipboardEntry, func()) {
+	watcher := make(chan ClipboardEntry, 8)
+	c.mu.Lock()
+	c.watchers[watcher] = true
+	c.mu.Unlock()
+	return watcher, func() {
+		c.mu.Lock()
+		delete(c.watchers, watcher)
+		c.mu.Unlock()
+	}
+}
+
+// End all streams, so they don't hold up a graceful shutdown
+func (c *Clipboard) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Template for the clipboard page
+const clipboardTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Clipboard - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        textarea {
+            width: 100%;
+            box-sizing: border-box;
+            min-height: 80px;
+            font-family: monospace;
+        }
+        button {
+            padding: 6px 14px;
+            margin-top: 6px;
+            cursor: pointer;
+        }
+        .clip {
+            border-bottom: 1px solid #ddd;
+            padding: 10px 0;
+        }
+        .clip pre {
+            white-space: pre-wrap;
+            word-break: break-all;
+            margin: 0 0 6px 0;
+        }
+        .muted {
+            color: #777;
+            font-size: 0.9em;
+        }
+    </style>
+</head>
+<body>
+    <h1>Clipboard</h1>
+    <p><a href="./">&larr; Back to files</a></p>
+    <form id="clipboard-form" method="post" action="clipboard">
+        <textarea name="text" placeholder="Paste a URL, a code or any text to share with your other devices" required></textarea>
+        <button type="submit">Share</button>
+    </form>
+    <div id="clips">
+        {{range .}}
+        <div class="clip">
+            <pre>{{.Text}}</pre>
+            <span class="muted">{{.Time.Format "2006-01-02 15:04:05"}} from {{.Client}}</span>
+            <button type="button" class="copy-button">Copy</button>
+        </div>
+        {{end}}
+    </div>
+    <p id="no-clips" class="muted"{{if .}} style="display: none"{{end}}>Nothing shared yet.</p>
+
+    <script>
+        function copyClip(button) {
+            const text = button.parentElement.querySelector('pre').textContent;
+            navigator.clipboard.writeText(text).then(() => {
+                button.textContent = 'Copied';
+                setTimeout(() => { button.textContent = 'Copy'; }, 1500);
+            });
+        }
+
+        function renderClip(entry) {
+            const clip = document.createElement('div');
+            clip.className = 'clip';
+            const text = document.createElement('pre');
+            text.textContent = entry.text;
+            const meta = document.createElement('span');
+            meta.className = 'muted';
+            meta.textContent = new Date(entry.time).toLocaleString() + ' from ' + entry.client;
+            const button = document.createElement('button');
+            button.type = 'button';
+            button.className = 'copy-button';
+            button.textContent = 'Copy';
+            clip.append(text, meta, ' ', button);
+            return clip;
+        }
+
+        document.getElementById('clips').addEventListener('click', event => {
+            if (event.target.classList.contains('copy-button')) {
+                copyClip(event.target);
+            }
+        });
+
+        // Share without reloading; the new entry arrives over the stream
+        const form = document.getElementById('clipboard-form');
+        form.addEventListener('submit', event => {
+            event.preventDefault();
+            fetch('clipboard', {method: 'POST', body: new URLSearchParams(new FormData(form))}).then(response => {
+                if (response.ok) {
+                    form.reset();
+                }
+            });
+        });
+
+        // Show what other devices share as it happens
+        const stream = new EventSource('clipboard/events');
+        stream.onmessage = event => {
+            const clips = document.getElementById('clips');
+            clips.prepend(renderClip(JSON.parse(event.data)));
+            document.getElementById('no-clips').style.display = 'none';
+        };
+    </script>
+</body>
+</html>
+`
+
+// Handler for the shared clipboard. GET shows the page, or the entries as
+// JSON with format=json or just the latest text with format=text; POST adds
+// "text" (or a text/plain body); DELETE empties it. New entries stream to
+// browsers from /clipboard/events.
+func clipboardHandler(clipboard *Clipboard) http.Handler {
+	tmpl := template.Must(template.New("clipboard").Parse(clipboardTemplate))
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/clipboard", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			entries := clipboard.List()
+			switch r.URL.Query().Get("format") {
+			case "json":
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(entries)
+			case "text":
+				if len(entries) == 0 {
+					http.Error(w, "The clipboard is empty", http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				io.WriteString(w, entries[0].Text)
+			default:
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				if err := tmpl.Execute(w, entries); err != nil {
+					http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+				}
+			}
+
+		case "POST":
+			r.Body = http.MaxBytesReader(w, r.Body, maxClipboardText+1024)
+			var text string
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, "Error reading text: "+err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				text = string(body)
+			} else {
+				text = r.FormValue("text")
+			}
+			if strings.TrimSpace(text) == "" {
+				http.Error(w, "No text specified", http.StatusBadRequest)
+				return
+			}
+			if len(text) > maxClipboardText {
+				http.Error(w, fmt.Sprintf("Text is too long: at most %d bytes", maxClipboardText), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			entry, err := clipboard.Add(text, clientIP(r))
+			if err != nil {
+				log.Printf("Error saving clipboard: %v", err)
+				http.Error(w, "Error saving clipboard: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			debugf("Clipboard text shared by %s", clientIP(r))
+
+			// Form posts from browsers without JavaScript go back to the page
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				redirect(w, r, "/clipboard", http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entry)
+
+		case "DELETE":
+			if err := clipboard.Clear(); err != nil {
+				http.Error(w, "Error clearing clipboard: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/clipboard/events", func(w http.ResponseWriter, r *http.Request) {
+		entries, stop := clipboard.Watch()
+		defer stop()
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		// Comments keep proxies from closing an idle stream
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case entry := <-entries:
+				data, _ := json.Marshal(entry)
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", entry.ID, data)
+			case <-keepalive.C:
+				io.WriteString(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-clipboard.closed:
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return mux
+}
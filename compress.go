@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Comment written into the archives the server creates, so they can be
+// told apart from a file of the same name that someone uploaded
+var archiveComment = "Created by " + AppName
+
+// A file named like the archive exists and wasn't made by the server
+var errArchiveExists = errors.New("a file with the archive's name already exists")
+
+// Choose the path of the archive of srcDir in format, "zip" or "tar.gz".
+// Archives are never replaced: if the server compressed the folder before,
+// the new one gets a versioned name, and any other file with that name
+// refuses the request with errArchiveExists.
+func archiveDestination(srcDir, format string) (string, error) {
+	var destPath string
+	switch format {
+	case "zip":
+		destPath = srcDir + ".zip"
+	case "tar.gz":
+		destPath = srcDir + ".tar.gz"
+	default:
+		return "", fmt.Errorf("unsupported archive format: %s", format)
+	}
+	if _, err := os.Lstat(destPath); err == nil && !isServerArchive(destPath, format) {
+		return "", errArchiveExists
+	}
+	return versionedName(destPath)
+}
+
+// Whether the file at path is an archive in format the server created
+func isServerArchive(path, format string) bool {
+	if format == "zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return false
+		}
+		defer zr.Close()
+		return zr.Comment == archiveComment
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	return gz.Comment == archiveComment
+}
+
+// Compress a folder into an archive at destPath, returning the number of
+// files added. Format is "zip" or "tar.gz". The archive is written to a
+// temporary file first so a half-written bundle is never visible to
+// downloaders.
+func createArchive(srcDir, destPath, format string) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".archive-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var count int
+	if format == "zip" {
+		count, err = writeZipArchive(tmp, srcDir)
+	} else {
+		count, err = writeTarGzArchive(tmp, srcDir)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), destPath); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Walk the regular files and directories of srcDir with archive entry names
+// prefixed by the folder's own name. Symlinks, special files and .access
+// files are skipped.
+func walkArchiveEntries(srcDir string, fn func(path, name string, info fs.FileInfo) error) error {
+	base := filepath.Base(srcDir)
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (!info.Mode().IsRegular() || d.Name() == accessFileName) {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(filepath.Join(base, rel)), info)
+	})
+}
+
+func writeZipArchive(w io.Writer, srcDir string) (int, error) {
+	zw := zip.NewWriter(w)
+	count := 0
+	err := walkArchiveEntries(srcDir, func(path, name string, info fs.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+			_, err := zw.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFileTo(entry, path); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		zw.Close()
+		return count, err
+	}
+	if err := zw.SetComment(archiveComment); err != nil {
+		zw.Close()
+		return count, err
+	}
+	return count, zw.Close()
+}
+
+func writeTarGzArchive(w io.Writer, srcDir string) (int, error) {
+	gz := gzip.NewWriter(w)
+	gz.Comment = archiveComment
+	tw := tar.NewWriter(gz)
+	count := 0
+	err := walkArchiveEntries(srcDir, func(path, name string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if err := copyFileTo(tw, path); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		tw.Close()
+		gz.Close()
+		return count, err
+	}
+	if err := tw.Close(); err != nil {
+		gz.Close()
+		return count, err
+	}
+	return count, gz.Close()
+}
+
+// Copy the contents of a file to w
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Handler for compressing a folder into an archive saved next to it.
+// Expects the folder "path" and an optional "format" (zip or tar.gz).
+func compressHandler(config Config, encryption *AtRestEncryption, dedup *DedupStore, events *EventBus, rules *AccessRules, locks *LockStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		relPath := cleanRelPath(r.FormValue("path"))
+		if relPath == "" {
+			http.Error(w, "Cannot compress the root folder", http.StatusBadRequest)
+			return
+		}
+		if encryption.Covers(relPath) {
+			http.Error(w, "Folders cannot be compressed in the encrypted folder", http.StatusBadRequest)
+			return
+		}
+		if dedup.Covers(relPath) {
+			http.Error(w, "Folders cannot be compressed in the deduplicated folder", http.StatusBadRequest)
+			return
+		}
+		srcDir, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil {
+			http.Error(w, "Invalid folder path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+
+		// The archive is written to the parent folder and holds the whole tree
+		parent := path.Dir(relPath)
+		if parent == "." {
+			parent = ""
+		}
+		if !rules.Allowed(r, parent, true) {
+			http.Error(w, "Access denied: not allowed by the folder's access rules", http.StatusForbidden)
+			return
+		}
+		if !rules.ReadableTree(r, relPath) {
+			http.Error(w, "Access denied: the folder contains folders you can't read", http.StatusForbidden)
+			return
+		}
+
+		format := r.FormValue("format")
+		if format == "" {
+			format = "zip"
+		}
+
+		archivePath, err := archiveDestination(srcDir, format)
+		if errors.Is(err, errArchiveExists) {
+			http.Error(w, "Error creating archive: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error creating archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		archiveRel, _ := filepath.Rel(config.DownloadDir, archivePath)
+		archiveRel = filepath.ToSlash(archiveRel)
+		if lock := locks.Conflict(archiveRel, lockToken(r)); lock != nil {
+			writeLockConflict(w, lock)
+			return
+		}
+
+		count, err := createArchive(srcDir, archivePath, format)
+		if err != nil {
+			http.Error(w, "Error creating archive: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		logf("Created archive %s with %d file(s)", archiveRel, count)
+		events.Publish(Event{Type: EventUpload, Path: archiveRel, Client: clientIP(r), RequestID: requestID(r)})
+
+		redirectURL := "/"
+		if dir := filepath.ToSlash(filepath.Dir(relPath)); dir != "." {
+			redirectURL += "?path=" + url.QueryEscape(dir)
+		}
+		redirect(w, r, redirectURL, http.StatusSeeOther)
+	})
+}
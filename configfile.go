@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Name of the file in the data directory holding the settings saved with
+// "config import"
+const configFileName = "config.json"
+
+// Flags that run a one-off task rather than set up the server. They are
+// neither exported nor imported, and neither is -data-dir, which is where
+// the imported settings are kept.
+var oneOffFlags = map[string]bool{
+	"data-dir":    true,
+	"help":        true,
+	"name":        true,
+	"sign":        true,
+	"sign-start":  true,
+	"sign-ttl":    true,
+	"sign-upload": true,
+	"stdin":       true,
+	"verify":      true,
+	"version":     true,
+}
+
+// Environment variables that flags take their default from. A variable
+// that is set wins over the configuration file.
+var flagEnv = map[string]string{
+	"password":   "LOCAL_FILESERVER_PASSWORD",
+	"url-secret": "LOCAL_FILESERVER_URL_SECRET",
+}
+
+// Flags such as -listen that may be given more than once
+type repeatableFlag interface {
+	Values() []string
+}
+
+// Run "config export" or "config import <file>", after the flags that
+// follow the command were parsed and the configuration file loaded
+func runConfigCommand(command string, args []string, dataDir string) error {
+	switch command {
+	case "export":
+		return exportConfig(os.Stdout)
+	case "import":
+		if len(args) != 1 {
+			return errors.New("usage: local-fileserver config import [options] <file>")
+		}
+		return importConfig(args[0], dataDir)
+	}
+	return fmt.Errorf("unknown config command %q, use export or import", command)
+}
+
+// Write every setting of the server as JSON: flag names with their values
+// from the command line, the environment, the configuration file or the
+// defaults, in that order of preference
+func exportConfig(w io.Writer) error {
+	settings := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if oneOffFlags[f.Name] {
+			return
+		}
+		if values, ok := f.Value.(repeatableFlag); ok {
+			settings[f.Name] = values.Values()
+		} else {
+			settings[f.Name] = f.Value.String()
+		}
+	})
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Check the settings exported to file ("-" for stdin) and save them in the
+// data directory, replacing any imported before
+func importConfig(file, dataDir string) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	// Setting the flags checks each value the way the command line would
+	for _, name := range sortedKeys(settings) {
+		if err := setFlag(name, settings[name]); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+	// The settings may hold the password and other secrets
+	path := filepath.Join(dataDir, configFileName)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d settings into %s\n", len(settings), path)
+	return nil
+}
+
+// Apply the settings saved with "config import" to the flags not given on
+// the command line or through their environment variable
+func loadConfigFile(dataDir string) error {
+	data, err := os.ReadFile(filepath.Join(dataDir, configFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+
+	// Note what was given before applying anything, since applying a
+	// setting marks its flag as given
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, env := range flagEnv {
+		if os.Getenv(env) != "" {
+			given[name] = true
+		}
+	}
+	for _, name := range sortedKeys(settings) {
+		if given[name] {
+			continue
+		}
+		if err := setFlag(name, settings[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse exported settings into the values of each flag. Values may be
+// strings, numbers or booleans, and lists of strings for flags that may be
+// given more than once.
+func parseConfig(data []byte) (map[string][]string, error) {
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	settings := make(map[string][]string, len(raw))
+	for name, value := range raw {
+		f := flag.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown setting %q", name)
+		}
+		if oneOffFlags[name] {
+			return nil, fmt.Errorf("-%s can't be saved in the configuration", name)
+		}
+		_, repeatable := f.Value.(repeatableFlag)
+		switch value := value.(type) {
+		case string:
+			settings[name] = []string{value}
+		case json.Number:
+			settings[name] = []string{value.String()}
+		case bool:
+			settings[name] = []string{fmt.Sprint(value)}
+		case []any:
+			if !repeatable {
+				return nil, fmt.Errorf("-%s takes a single value", name)
+			}
+			values := make([]string, len(value))
+			for i, v := range value {
+				s, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("-%s values must be strings", name)
+				}
+				values[i] = s
+			}
+			settings[name] = values
+		default:
+			return nil, fmt.Errorf("invalid value for -%s", name)
+		}
+	}
+	return settings, nil
+}
+
+// Give a flag its values as if they were on the command line
+func setFlag(name string, values []string) error {
+	for _, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid -%s %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(settings map[string][]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Encrypted files start with this magic followed by an 8 byte random nonce
+// prefix, then a sequence of AES-256-GCM sealed chunks. The chunk index
+// completes each nonce and the last chunk is marked in its additional data,
+// so reordered, truncated or extended files fail to decrypt.
+const (
+	encryptMagic     = "LFSENC01"
+	encryptHeaderLen = len(encryptMagic) + 8
+	encryptChunkSize = 64 * 1024
+)
+
+// AtRestEncryption encrypts files stored below one subfolder of the download dir
+type AtRestEncryption struct {
+	Folder string
+	aead   cipher.AEAD
+}
+
+// Set up encryption for folder using the hex encoded 32 byte key in keyFile,
+// generating a new key if the file doesn't exist yet
+func newAtRestEncryption(folder, keyFile string) (*AtRestEncryption, error) {
+	key, err := loadOrCreateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtRestEncryption{Folder: cleanRelPath(folder), aead: aead}, nil
+}
+
+func loadOrCreateKey(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new encryption key in %s - back it up, files cannot be decrypted without it", keyFile)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain a hex encoded 32 byte key", keyFile)
+	}
+	return key, nil
+}
+
+// Whether a slash separated relative path lies in the encrypted folder
+func (e *AtRestEncryption) Covers(relPath string) bool {
+	if e == nil {
+		return false
+	}
+	relPath = cleanRelPath(relPath)
+	return e.Folder == "" || relPath == e.Folder || strings.HasPrefix(relPath, e.Folder+"/")
+}
+
+func (e *AtRestEncryption) nonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, e.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], index)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Encrypt everything from r to w, returning the number of plaintext bytes
+func (e *AtRestEncryption) Encrypt(w io.Writer, r io.Reader) (int64, error) {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(append([]byte(encryptMagic), prefix...)); err != nil {
+		return 0, err
+	}
+
+	readChunk := func(buf []byte) ([]byte, bool, error) {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return buf[:n], true, nil
+		}
+		return buf[:n], false, err
+	}
+
+	var total int64
+	bufs := [2][]byte{make([]byte, encryptChunkSize), make([]byte, encryptChunkSize)}
+	sealed := make([]byte, 0, encryptChunkSize+e.aead.Overhead())
+
+	cur, eof, err := readChunk(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	for i := uint32(0); ; i++ {
+		// A full chunk is only the last one if nothing follows it
+		last := eof
+		var next []byte
+		if !last {
+			next, eof, err = readChunk(bufs[(i+1)%2])
+			if err != nil {
+				return total, err
+			}
+			last = len(next) == 0 && eof
+		}
+
+		sealed = e.aead.Seal(sealed[:0], e.nonce(prefix, i), cur, chunkAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return total, err
+		}
+		total += int64(len(cur))
+
+		if last {
+			return total, nil
+		}
+		cur = next
+	}
+}
+
+// Whether a file on disk is in the encrypted format
+func isEncryptedFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == encryptMagic
+}
+
+// Size of the plaintext for an encrypted file of the given size
+func (e *AtRestEncryption) PlainSize(encryptedSize int64) int64 {
+	n := encryptedSize - int64(encryptHeaderLen)
+	sealedChunk := int64(encryptChunkSize + e.aead.Overhead())
+	chunks := n / sealedChunk
+	if n%sealedChunk != 0 {
+		chunks++
+	}
+	return n - chunks*int64(e.aead.Overhead())
+}
+
+// Open an encrypted file for reading its plaintext
+func (e *AtRestEncryption) Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, encryptHeaderLen)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		f.Close()
+		return nil, errors.New("not an encrypted file")
+	}
+
+	return &decryptReader{
+		e:      e,
+		file:   f,
+		src:    bufio.NewReader(f),
+		prefix: header[len(encryptMagic):],
+		sealed: make([]byte, encryptChunkSize+e.aead.Overhead()),
+	}, nil
+}
+
+// decryptReader streams the plaintext of an encrypted file chunk by chunk
+type decryptReader struct {
+	e      *AtRestEncryption
+	file   *os.File
+	src    *bufio.Reader
+	prefix []byte
+	index  uint32
+	sealed []byte
+	plain  bytes.Reader
+	done   bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for d.plain.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	return d.plain.Read(p)
+}
+
+func (d *decryptReader) nextChunk() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		// A full chunk is the last one only if nothing follows it
+		if _, err := d.src.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := d.e.aead.Open(nil, d.e.nonce(d.prefix, d.index), d.sealed[:n], chunkAD(last))
+	if err != nil {
+		return errors.New("encrypted file is corrupt or was modified")
+	}
+	d.index++
+	d.done = last
+	d.plain.Reset(plain)
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.file.Close()
+}
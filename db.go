@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite"
+)
+
+// Schema migrations of the state database, applied in order. The
+// database records how many it has had in its user_version, so each runs
+// once. Migrations are only ever added at the end, never changed, and
+// only add to the schema unless noted, so a process being replaced by a
+// graceful restart keeps working with a database its successor upgraded.
+var migrations = []string{
+	// 1: download counts, download limits and share codes
+	`CREATE TABLE IF NOT EXISTS downloads (
+		path          TEXT PRIMARY KEY,
+		count         INTEGER NOT NULL DEFAULT 0,
+		last_download INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS download_limits (
+		path      TEXT PRIMARY KEY,
+		remaining INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS share_codes (
+		code    TEXT PRIMARY KEY,
+		path    TEXT NOT NULL,
+		expires INTEGER NOT NULL
+	);`,
+	// 2: tags
+	`CREATE TABLE tags (
+		path TEXT NOT NULL,
+		tag  TEXT NOT NULL,
+		PRIMARY KEY (path, tag)
+	);
+	CREATE INDEX tags_by_tag ON tags (tag);`,
+	// 3: outcomes of uploads sent with an Idempotency-Key
+	`CREATE TABLE upload_keys (
+		key      TEXT PRIMARY KEY,
+		location TEXT NOT NULL,
+		created  INTEGER NOT NULL
+	);`,
+	// 4: favorites, snapshots, guest upload links and login sessions
+	`CREATE TABLE favorites (
+		visitor TEXT NOT NULL,
+		path    TEXT NOT NULL,
+		PRIMARY KEY (visitor, path)
+	);
+	CREATE TABLE snapshots (
+		name    TEXT PRIMARY KEY,
+		created INTEGER NOT NULL
+	);
+	CREATE TABLE snapshot_files (
+		snapshot TEXT NOT NULL,
+		path     TEXT NOT NULL,
+		size     INTEGER NOT NULL,
+		mod_time INTEGER NOT NULL,
+		is_dir   INTEGER NOT NULL,
+		PRIMARY KEY (snapshot, path)
+	);
+	CREATE TABLE guest_links (
+		token   TEXT PRIMARY KEY,
+		folder  TEXT NOT NULL,
+		note    TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		uploads INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE sessions (
+		id      TEXT PRIMARY KEY,
+		expires INTEGER NOT NULL
+	);
+	CREATE TABLE settings (
+		name  TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// 5: outcomes of uploads by the client that sent the Idempotency-Key,
+	// replacing upload_keys, whose keys matched any client. A server being
+	// replaced by a graceful restart fails keyed uploads until it exits,
+	// and clients retry them.
+	`CREATE TABLE client_upload_keys (
+		client   TEXT NOT NULL,
+		key      TEXT NOT NULL,
+		location TEXT NOT NULL,
+		created  INTEGER NOT NULL,
+		PRIMARY KEY (client, key)
+	);
+	DROP TABLE upload_keys;`,
+}
+
+// Open the SQLite database in the data directory holding the server's
+// metadata: download counts, download limits, share codes, tags, finished
+// uploads, favorites, snapshots, guest upload links and login sessions.
+// Each change is a small write instead of rewriting a JSON file with
+// everything, and a crash loses at most the change in progress. The
+// database can be shared with a new process during a graceful restart.
+func openDatabase(dataDir string) (*sql.DB, error) {
+	path := filepath.Join(dataDir, "state.db")
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(path)+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serializes writes, which SQLite does anyway
+	db.SetMaxOpenConns(1)
+	if err := migrateDatabase(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Bring the schema up to date, each migration in a transaction of its own
+func migrateDatabase(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at version %d, newer than this server (%d)", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migrations[version]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migrating to version %d: %w", version+1, err)
+		}
+		debugf("Upgraded state database to version %d", version+1)
+	}
+	return nil
+}
+
+// Move state kept in a JSON file by earlier versions into the database.
+// The file is loaded into v, insert stores it, and the file is renamed so
+// it isn't imported again.
+func importJSON(path string, v interface{}, insert func() error) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := loadJSON(path, v); err != nil {
+		return err
+	}
+	if err := insert(); err != nil {
+		return err
+	}
+	logf("Imported %s into the state database", filepath.Base(path))
+	if err := os.Rename(path, path+".imported"); err != nil {
+		log.Printf("Error renaming %s: %v", path, err)
+	}
+	return nil
+}
+
+// Run fn in a transaction, committing if it succeeds
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deduplicated files are stored as a recipe: this magic, then the SHA-256
+// and length of each chunk of the content in order, then the content's
+// total length. The chunks themselves are kept once each in the data
+// directory, however many files contain them.
+const (
+	dedupMagic      = "LFSDDP01"
+	dedupEntryLen   = sha256.Size + 4
+	dedupTrailerLen = 8
+)
+
+// Chunk boundaries are chosen by the content: a rolling hash of the last
+// bytes ending in dedupMaskBits zero bits ends a chunk, so the same data
+// is cut the same way wherever it sits in a file. Chunks average about
+// 256 KB.
+const (
+	dedupMinChunk = 64 << 10
+	dedupMaxChunk = 1 << 20
+	dedupMaskBits = 18
+)
+
+// How often chunks no file uses anymore are removed, and how old they must
+// be, so the chunks of an upload still being stored are left alone
+const (
+	dedupCollectInterval = time.Hour
+	dedupCollectGrace    = time.Hour
+)
+
+// Random values for the rolling hash, derived from a fixed seed so chunks
+// are cut the same way by every version of the server
+var dedupGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("local-fileserver gear %d", i)))
+		gear[i] = binary.BigEndian.Uint64(sum[:])
+	}
+	return gear
+}()
+
+// DedupStore stores files below one subfolder of the download dir as
+// content-defined chunks, each kept once, so many VM images or backups
+// sharing most of their content take up little more than one of them
+type DedupStore struct {
+	Folder  string
+	baseDir string
+	dir     string
+}
+
+// Set up deduplication for folder, keeping the chunks in the data directory
+func openDedupStore(folder, baseDir, dataDir string) (*DedupStore, error) {
+	d := &DedupStore{
+		Folder:  cleanRelPath(folder),
+		baseDir: baseDir,
+		dir:     filepath.Join(dataDir, "chunks"),
+	}
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			time.Sleep(dedupCollectInterval)
+			d.collect()
+		}
+	}()
+	return d, nil
+}
+
+// Whether a slash separated relative path lies in the deduplicated folder
+func (d *DedupStore) Covers(relPath string) bool {
+	if d == nil {
+		return false
+	}
+	relPath = cleanRelPath(relPath)
+	return d.Folder == "" || relPath == d.Folder || strings.HasPrefix(relPath, d.Folder+"/")
+}
+
+// File holding a chunk, in one of 256 folders by its first byte
+func (d *DedupStore) chunkPath(sum []byte) string {
+	name := hex.EncodeToString(sum)
+	return filepath.Join(d.dir, name[:2], name)
+}
+
+// Split everything from r into chunks, storing those not stored yet, and
+// write the recipe to w. Returns the number of content bytes.
+func (d *DedupStore) Store(w io.Writer, r io.Reader) (int64, error) {
+	src := bufio.NewReaderSize(r, 64<<10)
+	recipe := bufio.NewWriter(w)
+	if _, err := recipe.WriteString(dedupMagic); err != nil {
+		return 0, err
+	}
+
+	chunk := make([]byte, 0, dedupMaxChunk)
+	entry := make([]byte, dedupEntryLen)
+	var total int64
+	for eof := false; !eof; {
+		chunk = chunk[:0]
+		var hash uint64
+		for len(chunk) < dedupMaxChunk {
+			b, err := src.ReadByte()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return total, err
+			}
+			chunk = append(chunk, b)
+			hash = hash<<1 + dedupGear[b]
+			if len(chunk) >= dedupMinChunk && hash&(1<<dedupMaskBits-1) == 0 {
+				break
+			}
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		sum := sha256.Sum256(chunk)
+		if err := d.putChunk(sum[:], chunk); err != nil {
+			return total, err
+		}
+		copy(entry, sum[:])
+		binary.BigEndian.PutUint32(entry[sha256.Size:], uint32(len(chunk)))
+		if _, err := recipe.Write(entry); err != nil {
+			return total, err
+		}
+		total += int64(len(chunk))
+	}
+
+	trailer := make([]byte, dedupTrailerLen)
+	binary.BigEndian.PutUint64(trailer, uint64(total))
+	if _, err := recipe.Write(trailer); err != nil {
+		return total, err
+	}
+	return total, recipe.Flush()
+}
+
+// Store a chunk unless it already is. A chunk already stored has its
+// modification time refreshed, so it isn't collected while the recipe
+// using it again is still being written.
+func (d *DedupStore) putChunk(sum, data []byte) error {
+	path := d.chunkPath(sum)
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		return os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Whether a file on disk is a deduplicated file's recipe
+func isDedupFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(dedupMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == dedupMagic
+}
+
+// Size of the content of a deduplicated file, read from its recipe
+func dedupSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	trailer := make([]byte, dedupTrailerLen)
+	if _, err := f.Seek(-dedupTrailerLen, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(trailer)), nil
+}
+
+// One chunk of a deduplicated file and where it starts in the content
+type dedupEntry struct {
+	sum    []byte
+	offset int64
+	size   int64
+}
+
+// Read the chunk list of a recipe
+func readRecipe(path string) ([]dedupEntry, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	body := len(data) - len(dedupMagic) - dedupTrailerLen
+	if body < 0 || body%dedupEntryLen != 0 || string(data[:len(dedupMagic)]) != dedupMagic {
+		return nil, 0, errors.New("not a deduplicated file")
+	}
+
+	entries := make([]dedupEntry, 0, body/dedupEntryLen)
+	var offset int64
+	for pos := len(dedupMagic); pos < len(dedupMagic)+body; pos += dedupEntryLen {
+		size := int64(binary.BigEndian.Uint32(data[pos+sha256.Size:]))
+		entries = append(entries, dedupEntry{sum: data[pos : pos+sha256.Size], offset: offset, size: size})
+		offset += size
+	}
+	if total := int64(binary.BigEndian.Uint64(data[len(data)-dedupTrailerLen:])); total != offset {
+		return nil, 0, errors.New("damaged deduplicated file")
+	}
+	return entries, offset, nil
+}
+
+// Open a deduplicated file for reading its content. The reader can seek,
+// so downloads of it can be resumed and fetched in ranges.
+func (d *DedupStore) Open(path string) (*dedupReader, error) {
+	entries, size, err := readRecipe(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dedupReader{d: d, entries: entries, size: size, current: -1}, nil
+}
+
+// dedupReader reassembles a deduplicated file from its chunks, checking
+// each chunk against its hash as it is loaded
+type dedupReader struct {
+	d       *DedupStore
+	entries []dedupEntry
+	size    int64
+	pos     int64
+
+	current int // index of the chunk in data, -1 for none
+	data    []byte
+}
+
+func (r *dedupReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].offset+r.entries[i].size > r.pos })
+	if i != r.current {
+		data, err := os.ReadFile(r.d.chunkPath(r.entries[i].sum))
+		if err != nil {
+			return 0, fmt.Errorf("missing chunk %x: %w", r.entries[i].sum, err)
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], r.entries[i].sum) || int64(len(data)) != r.entries[i].size {
+			return 0, fmt.Errorf("chunk %x is damaged", r.entries[i].sum)
+		}
+		r.current, r.data = i, data
+	}
+	n := copy(p, r.data[r.pos-r.entries[i].offset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *dedupReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *dedupReader) Size() int64 {
+	return r.size
+}
+
+func (r *dedupReader) Close() error {
+	r.data = nil
+	return nil
+}
+
+// Store an existing file deduplicated at dst and remove the original
+func dedupFile(src, dst string, dedup *DedupStore) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := dedup.Store(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Show the content size of deduplicated files in a listing, recursively
+func (d *DedupStore) Annotate(files []FileInfo) {
+	if d == nil {
+		return
+	}
+	for i := range files {
+		d.Annotate(files[i].Children)
+		if files[i].IsDir || !d.Covers(files[i].Path) {
+			continue
+		}
+		fullPath := filepath.Join(d.baseDir, filepath.FromSlash(files[i].Path))
+		if !isDedupFile(fullPath) {
+			continue
+		}
+		if size, err := dedupSize(fullPath); err == nil {
+			files[i].Size = size
+		}
+	}
+}
+
+// Remove the chunks no recipe uses anymore. Every recipe in the download
+// dir counts, not only those in the deduplicated folder, in case one was
+// moved out of it.
+func (d *DedupStore) collect() {
+	used := make(map[string]bool)
+	var content int64
+	err := filepath.WalkDir(d.baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		// Only files of a recipe's size can be one
+		body := info.Size() - int64(len(dedupMagic)) - dedupTrailerLen
+		if body < 0 || body%dedupEntryLen != 0 || !isDedupFile(path) {
+			return nil
+		}
+		entries, size, err := readRecipe(path)
+		if err != nil {
+			log.Printf("Error reading deduplicated file %s: %v", path, err)
+			return nil
+		}
+		for _, e := range entries {
+			used[string(e.sum)] = true
+		}
+		content += size
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error looking for deduplicated files: %v", err)
+		return
+	}
+
+	removed := 0
+	var stored int64
+	filepath.WalkDir(d.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		sum, err := hex.DecodeString(entry.Name())
+		if err == nil && used[string(sum)] {
+			stored += info.Size()
+			return nil
+		}
+		if time.Since(info.ModTime()) < dedupCollectGrace {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing chunk %s: %v", entry.Name(), err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	debugf("Removed %d unused chunk(s); deduplicated files hold %s in %s of chunks",
+		removed, formatByteSize(content), formatByteSize(stored))
+}
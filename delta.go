@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Block sizes for delta sync. Small blocks find more matches, big ones keep
+// the signature of multi-GB files short.
+const (
+	defaultDeltaBlock = 64 << 10
+	minDeltaBlock     = 1 << 10
+	maxDeltaBlock     = 16 << 20
+)
+
+// Operations of a delta patch, each a one byte tag followed by big endian
+// fields:
+//
+//	'C' uint64 index, uint32 count   copy count blocks of the current file
+//	'D' uint32 length, data          literal data
+//	'E'                              end of patch
+const (
+	deltaCopy = 'C'
+	deltaData = 'D'
+	deltaEnd  = 'E'
+)
+
+// Upper bound on a single literal operation
+const maxDeltaLiteral = 64 << 20
+
+// DeltaBlock describes one block of a file for delta sync
+type DeltaBlock struct {
+	Index int64 `json:"index"`
+	// rsync style rolling checksum, cheap to slide over the new file
+	Weak uint32 `json:"weak"`
+	// SHA-256 to confirm a weak match
+	Strong string `json:"strong"`
+}
+
+// DeltaSignature lists the block checksums of a file
+type DeltaSignature struct {
+	Path      string       `json:"path"`
+	Size      int64        `json:"size"`
+	BlockSize int          `json:"block_size"`
+	ETag      string       `json:"etag"`
+	Blocks    []DeltaBlock `json:"blocks"`
+}
+
+// rsync's rolling checksum of a block
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// Compute the block checksums of a file
+func deltaSignature(f io.Reader, blockSize int) ([]DeltaBlock, error) {
+	var blocks []DeltaBlock
+	buf := make([]byte, blockSize)
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			strong := sha256.Sum256(buf[:n])
+			blocks = append(blocks, DeltaBlock{Index: index, Weak: weakChecksum(buf[:n]), Strong: hex.EncodeToString(strong[:])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Build the new version of a file from its current version and a patch.
+// Returns the bytes copied from the current file and the literal bytes.
+func applyDeltaPatch(out io.Writer, base io.ReaderAt, baseSize int64, blockSize int, patch io.Reader) (copied, literal int64, err error) {
+	r := bufio.NewReader(patch)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return copied, literal, fmt.Errorf("patch ends without an end marker")
+		}
+		switch op {
+		case deltaCopy:
+			var fields struct {
+				Index uint64
+				Count uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &fields); err != nil {
+				return copied, literal, fmt.Errorf("truncated copy operation")
+			}
+			offset := int64(fields.Index) * int64(blockSize)
+			if fields.Index > uint64(baseSize) || offset >= baseSize || fields.Count == 0 {
+				return copied, literal, fmt.Errorf("copy of block %d is out of range", fields.Index)
+			}
+			n, err := io.Copy(out, io.NewSectionReader(base, offset, int64(fields.Count)*int64(blockSize)))
+			copied += n
+			if err != nil {
+				return copied, literal, err
+			}
+		case deltaData:
+			var length uint32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				return copied, literal, fmt.Errorf("truncated data operation")
+			}
+			if length > maxDeltaLiteral {
+				return copied, literal, fmt.Errorf("data operation of %d bytes is too large", length)
+			}
+			n, err := io.CopyN(out, r, int64(length))
+			literal += n
+			if err != nil {
+				return copied, literal, fmt.Errorf("truncated data operation")
+			}
+		case deltaEnd:
+			return copied, literal, nil
+		default:
+			return copied, literal, fmt.Errorf("unknown patch operation %q", op)
+		}
+	}
+}
+
+// Handler for delta sync of large files. GET returns the block checksums of
+// a file; POST applies a patch built against them, so only changed blocks
+// travel over the network. Patches should carry the signature's ETag in
+// If-Match and may carry the SHA-256 of the result in X-Content-SHA256.
+func deltaHandler(config Config, encryption *AtRestEncryption, dedup *DedupStore, uploadTypes UploadTypeFilter, events *EventBus, transfers *TransferTracker, locks *LockStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/delta/"))
+		if encryption.Covers(relPath) {
+			http.Error(w, "Delta sync is not available for encrypted files", http.StatusForbidden)
+			return
+		}
+		if dedup.Covers(relPath) {
+			http.Error(w, "Delta sync is not available for deduplicated files", http.StatusForbidden)
+			return
+		}
+		fullPath, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil || relPath == "" {
+			http.Error(w, "Invalid file path", http.StatusBadRequest)
+			return
+		}
+
+		blockSize := defaultDeltaBlock
+		if v := r.URL.Query().Get("block"); v != "" {
+			blockSize, err = strconv.Atoi(v)
+			if err != nil || blockSize < minDeltaBlock || blockSize > maxDeltaBlock {
+				http.Error(w, fmt.Sprintf("Invalid block size: must be between %d and %d", minDeltaBlock, maxDeltaBlock), http.StatusBadRequest)
+				return
+			}
+		}
+
+		base, err := os.Open(fullPath)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		defer base.Close()
+		info, err := base.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			blocks, err := deltaSignature(bufio.NewReaderSize(base, blockSize), blockSize)
+			if err != nil {
+				http.Error(w, "Error reading file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", fileETag(info))
+			json.NewEncoder(w).Encode(DeltaSignature{
+				Path:      relPath,
+				Size:      info.Size(),
+				BlockSize: blockSize,
+				ETag:      fileETag(info),
+				Blocks:    blocks,
+			})
+
+		case "POST":
+			if config.AppendOnly {
+				http.Error(w, "Delta upload rejected: "+appendOnlyMessage, http.StatusForbidden)
+				return
+			}
+			// Patched content would skip the review uploads wait for
+			if config.Quarantine {
+				http.Error(w, "Delta sync uploads are not available while uploads are quarantined", http.StatusForbidden)
+				return
+			}
+			if lock := locks.Conflict(relPath, lockToken(r)); lock != nil {
+				writeLockConflict(w, lock)
+				return
+			}
+			if !writePreconditionsMet(r, info) {
+				http.Error(w, "The file changed since its signature was taken", http.StatusPreconditionFailed)
+				return
+			}
+			if err := runHooks(&HookEvent{Point: HookPreUpload, Path: relPath, Client: clientIP(r), Size: info.Size()}); err != nil {
+				log.Printf("Delta upload of %s from %s rejected by hook: %v", relPath, clientIP(r), err)
+				http.Error(w, "Upload rejected: "+err.Error(), http.StatusForbidden)
+				return
+			}
+			if err := checkDiskSpace(info.Size(), filepath.Dir(fullPath)); err != nil {
+				http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+
+			transfer := transfers.Start(transferID(r.Header.Get("X-Upload-ID")), "upload", relPath, clientIP(r), r.ContentLength)
+			defer transfers.Finish(transfer)
+
+			// Build the new version next to the old one and swap it in
+			out, err := os.CreateTemp(filepath.Dir(fullPath), ".delta-*")
+			if err != nil {
+				http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(out.Name())
+			sum := sha256.New()
+			counted := bufio.NewWriter(io.MultiWriter(out, sum))
+			copied, literal, err := applyDeltaPatch(counted, base, info.Size(), blockSize, countingReader{r.Body, transfer})
+			if err == nil {
+				err = counted.Flush()
+			}
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				http.Error(w, "Error applying patch: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			result := hex.EncodeToString(sum.Sum(nil))
+			if want := r.Header.Get("X-Content-SHA256"); want != "" && !strings.EqualFold(want, result) {
+				http.Error(w, "The patched file does not match X-Content-SHA256", http.StatusUnprocessableEntity)
+				return
+			}
+			// The new version must pass the upload type filter like any upload
+			if err := checkUploadType(uploadTypes, filepath.Base(relPath), out.Name()); err != nil {
+				log.Printf("Rejected delta upload of %s from %s: %v", relPath, clientIP(r), err)
+				http.Error(w, "Upload rejected: "+err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			os.Chmod(out.Name(), info.Mode().Perm())
+			if err := os.Rename(out.Name(), fullPath); err != nil {
+				http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			newInfo, err := os.Stat(fullPath)
+			if err != nil {
+				http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logf("File updated by delta sync: %s (%d bytes reused, %d bytes sent) by %s", relPath, copied, literal, clientIP(r))
+			events.Publish(Event{Type: EventUpload, Path: relPath, Client: clientIP(r), RequestID: requestID(r)})
+			go runHooks(&HookEvent{Point: HookPostUpload, Path: relPath, Client: clientIP(r), Size: newInfo.Size()})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", fileETag(newInfo))
+			json.NewEncoder(w).Encode(struct {
+				Path    string `json:"path"`
+				Size    int64  `json:"size"`
+				SHA256  string `json:"sha256"`
+				ETag    string `json:"etag"`
+				Reused  int64  `json:"reused"`
+				Literal int64  `json:"literal"`
+			}{relPath, newInfo.Size(), result, fileETag(newInfo), copied, literal})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
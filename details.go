@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/fs"
+	"mime"
+	"os/user"
+	"path/filepath"
+	"sync"
+)
+
+// Build a listing entry from the file's metadata
+func newFileInfo(name, relPath string, info fs.FileInfo) FileInfo {
+	fileInfo := FileInfo{
+		Name:    name,
+		Size:    info.Size(),
+		IsDir:   info.IsDir(),
+		Path:    relPath,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode().String(),
+		Owner:   fileOwner(info),
+	}
+	if !info.IsDir() {
+		fileInfo.MimeType = mimeType(name)
+	}
+	return fileInfo
+}
+
+// Guess a file's MIME type from its extension
+func mimeType(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// User names by ID, since listings look up the same few owners many times
+var (
+	ownerNamesMu sync.Mutex
+	ownerNames   = map[string]string{}
+)
+
+// Resolve a user ID to its name, falling back to the ID itself
+func ownerName(uid string) string {
+	ownerNamesMu.Lock()
+	defer ownerNamesMu.Unlock()
+	if name, ok := ownerNames[uid]; ok {
+		return name
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	ownerNames[uid] = name
+	return name
+}
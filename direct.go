@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits of the direct transfer rooms. Only the WebRTC offer, answer and
+// network candidates pass through the server, so messages are small and few.
+const (
+	directRoomTTL      = 30 * time.Minute
+	maxDirectMessage   = 64 << 10
+	directInboxLength  = 64
+	directSenderRole   = "sender"
+	directReceiverRole = "receiver"
+)
+
+var (
+	errDirectRoomNotFound = errors.New("unknown or expired room code")
+	errDirectRoleTaken    = errors.New("another device is already connected to this room")
+	errDirectInboxFull    = errors.New("the other device is not reading its messages")
+)
+
+// A room pairs the device sending a file with the device receiving it
+type directRoom struct {
+	expires time.Time
+	// Messages waiting for each role, kept until that device connects
+	inbox     map[string]chan json.RawMessage
+	connected map[string]bool
+}
+
+// DirectRooms brokers the signaling of WebRTC connections between two
+// browsers, so files can go from one device to the other without passing
+// through the server
+type DirectRooms struct {
+	mu    sync.Mutex
+	rooms map[string]*directRoom
+	// Closed on shutdown to end the streams
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Create the rooms for direct transfers; they only live in memory
+func newDirectRooms() *DirectRooms {
+	return &DirectRooms{
+		rooms:  make(map[string]*directRoom),
+		closed: make(chan struct{}),
+	}
+}
+
+// The role of the device on the other end
+func directPeerRole(role string) string {
+	if role == directSenderRole {
+		return directReceiverRole
+	}
+	return directSenderRole
+}
+
+// Open a room for a new transfer, giving its code
+func (d *DirectRooms) Create() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for code, room := range d.rooms {
+		if now.After(room.expires) {
+			delete(d.rooms, code)
+		}
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := randomShareCode()
+		if err != nil {
+			return "", err
+		}
+		if _, taken := d.rooms[code]; taken {
+			continue
+		}
+		d.rooms[code] = &directRoom{
+			expires: now.Add(directRoomTTL),
+			inbox: map[string]chan json.RawMessage{
+				directSenderRole:   make(chan json.RawMessage, directInboxLength),
+				directReceiverRole: make(chan json.RawMessage, directInboxLength),
+			},
+			connected: make(map[string]bool),
+		}
+		return code, nil
+	}
+	return "", errors.New("no free code found")
+}
+
+// Look up an unexpired room. The caller must hold d.mu.
+func (d *DirectRooms) room(code string) (*directRoom, bool) {
+	room, ok := d.rooms[normalizeShareCode(code)]
+	if !ok || time.Now().After(room.expires) {
+		return nil, false
+	}
+	return room, true
+}
+
+// Connect a device to a room in role, receiving the messages of the other
+// device until the returned function is called. The sender is told when the
+// receiver connects, so it knows when to make its offer.
+func (d *DirectRooms) Join(code, role string) (<-chan json.RawMessage, func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	room, ok := d.room(code)
+	if !ok {
+		return nil, nil, errDirectRoomNotFound
+	}
+	if room.connected[role] {
+		return nil, nil, errDirectRoleTaken
+	}
+	room.connected[role] = true
+	if role == directReceiverRole {
+		select {
+		case room.inbox[directSenderRole] <- json.RawMessage(`{"type":"peer-joined"}`):
+		default:
+		}
+	}
+	return room.inbox[role], func() {
+		d.mu.Lock()
+		room.connected[role] = false
+		d.mu.Unlock()
+	}, nil
+}
+
+// Pass a message from the device in role to the other device
+func (d *DirectRooms) Send(code, role string, message json.RawMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	room, ok := d.room(code)
+	if !ok {
+		return errDirectRoomNotFound
+	}
+	select {
+	case room.inbox[directPeerRole(role)] <- message:
+		return nil
+	default:
+		return errDirectInboxFull
+	}
+}
+
+// End all streams, so they don't hold up a graceful shutdown
+func (d *DirectRooms) Close() {
+	d.closeOnce.Do(func() { close(d.closed) })
+}
+
+// Template for the direct transfer page
+const directTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Direct Transfer - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        button {
+            padding: 6px 14px;
+            cursor: pointer;
+        }
+        section {
+            border-bottom: 1px solid #ddd;
+            padding: 10px 0;
+        }
+        progress {
+            width: 100%;
+        }
+        .room-code {
+            font-family: monospace;
+            font-size: 1.6em;
+            letter-spacing: 0.15em;
+        }
+        .muted {
+            color: #777;
+            font-size: 0.9em;
+        }
+    </style>
+</head>
+<body>
+    <h1>Direct Transfer</h1>
+    <p><a href="./">&larr; Back to files</a></p>
+    <p class="muted">Send a file straight from this browser to another one on the network. The file never touches the server, so both devices must stay on this page until it has arrived.</p>
+
+    <section id="send">
+        <h2>Send a file</h2>
+        <input type="file" id="send-file">
+        <button type="button" id="send-button">Send</button>
+        <p id="send-room" style="display: none">
+            On the other device, open Direct Transfer and enter
+            <span class="room-code" id="send-code"></span>, or open <a id="send-link"></a>
+        </p>
+    </section>
+
+    <section id="receive">
+        <h2>Receive a file</h2>
+        <input type="text" id="receive-code" placeholder="Code" maxlength="6" autocomplete="off" autocapitalize="characters" value="{{.}}">
+        <button type="button" id="receive-button">Receive</button>
+    </section>
+
+    <p id="status" class="muted"></p>
+    <progress id="progress" max="1" value="0" style="display: none"></progress>
+    <p id="saved" style="display: none"><a id="saved-link">Save the file again</a></p>
+
+    <script>
+        const chunkSize = 64 * 1024;
+        let room, role, pc, stream;
+        let outgoing = Promise.resolve();
+        let incoming = Promise.resolve();
+        let offered = false;
+        const candidates = [];
+
+        function setStatus(text) {
+            document.getElementById('status').textContent = text;
+        }
+
+        function formatSize(bytes) {
+            const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+            let i = 0;
+            while (bytes >= 1024 && i < units.length - 1) {
+                bytes /= 1024;
+                i++;
+            }
+            return bytes.toFixed(i ? 1 : 0) + ' ' + units[i];
+        }
+
+        function showProgress(done, total, started) {
+            const progress = document.getElementById('progress');
+            progress.style.display = '';
+            progress.max = total || 1;
+            progress.value = done;
+            const seconds = (Date.now() - started) / 1000;
+            const speed = seconds > 0 ? ' at ' + formatSize(done / seconds) + '/s' : '';
+            setStatus(formatSize(done) + ' of ' + formatSize(total) + speed);
+        }
+
+        // Messages for the other device go through the server in order
+        function signal(message) {
+            outgoing = outgoing.then(() => fetch('direct/signal?room=' + room + '&role=' + role, {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify(message)
+            })).catch(() => setStatus('Lost contact with the server'));
+        }
+
+        async function addCandidates() {
+            if (!pc.remoteDescription) {
+                return;
+            }
+            while (candidates.length) {
+                await pc.addIceCandidate(candidates.shift());
+            }
+        }
+
+        async function handleSignal(message) {
+            switch (message.type) {
+            case 'peer-joined':
+                if (role !== 'sender' || offered) {
+                    return;
+                }
+                offered = true;
+                setStatus('Connecting to the other device...');
+                await pc.setLocalDescription(await pc.createOffer());
+                signal({type: 'offer', description: pc.localDescription});
+                break;
+            case 'offer':
+                await pc.setRemoteDescription(message.description);
+                await pc.setLocalDescription(await pc.createAnswer());
+                signal({type: 'answer', description: pc.localDescription});
+                await addCandidates();
+                break;
+            case 'answer':
+                await pc.setRemoteDescription(message.description);
+                await addCandidates();
+                break;
+            case 'candidate':
+                candidates.push(message.candidate);
+                await addCandidates();
+                break;
+            }
+        }
+
+        function connect(code, asRole) {
+            room = code;
+            role = asRole;
+            pc = new RTCPeerConnection();
+            pc.onicecandidate = event => {
+                if (event.candidate) {
+                    signal({type: 'candidate', candidate: event.candidate});
+                }
+            };
+            pc.onconnectionstatechange = () => {
+                if (pc.connectionState === 'failed') {
+                    setStatus('The devices could not reach each other directly');
+                }
+            };
+            stream = new EventSource('direct/events?room=' + room + '&role=' + role);
+            stream.onmessage = event => {
+                const message = JSON.parse(event.data);
+                incoming = incoming.then(() => handleSignal(message)).catch(err => setStatus('Error connecting: ' + err));
+            };
+            stream.onerror = () => {
+                if (stream.readyState === EventSource.CLOSED) {
+                    setStatus('Unknown or expired code');
+                }
+            };
+        }
+
+        async function sendFile(channel, file) {
+            const started = Date.now();
+            channel.send(JSON.stringify({name: file.name, size: file.size, type: file.type}));
+            // Keep the browser's send buffer from swallowing the whole file
+            channel.bufferedAmountLowThreshold = 1 << 20;
+            let offset = 0;
+            while (offset < file.size) {
+                if (channel.bufferedAmount > 8 << 20) {
+                    await new Promise(resolve => channel.addEventListener('bufferedamountlow', resolve, {once: true}));
+                }
+                const chunk = await file.slice(offset, offset + chunkSize).arrayBuffer();
+                channel.send(chunk);
+                offset += chunk.byteLength;
+                showProgress(offset, file.size, started);
+            }
+            channel.send(JSON.stringify({done: true}));
+            setStatus('Waiting for the other device to finish...');
+        }
+
+        document.getElementById('send-button').addEventListener('click', () => {
+            const file = document.getElementById('send-file').files[0];
+            if (!file) {
+                setStatus('Choose a file first');
+                return;
+            }
+            fetch('direct', {method: 'POST'}).then(response => response.json()).then(created => {
+                connect(created.code, 'sender');
+                const channel = pc.createDataChannel('file', {ordered: true});
+                channel.onopen = () => sendFile(channel, file);
+                channel.onmessage = event => {
+                    const reply = JSON.parse(event.data);
+                    setStatus('Sent ' + file.name + ' (' + formatSize(reply.received) + ')');
+                    stream.close();
+                    pc.close();
+                };
+
+                const link = location.origin + location.pathname + '?room=' + created.code;
+                document.getElementById('send-code').textContent = created.code;
+                document.getElementById('send-link').textContent = link;
+                document.getElementById('send-link').href = link;
+                document.getElementById('send-room').style.display = '';
+                document.getElementById('send-button').disabled = true;
+                setStatus('Waiting for the other device...');
+            }).catch(err => setStatus('Error creating room: ' + err));
+        });
+
+        function receive() {
+            const code = document.getElementById('receive-code').value.trim();
+            if (!code) {
+                return;
+            }
+            connect(code, 'receiver');
+            document.getElementById('receive-button').disabled = true;
+            setStatus('Connecting to the other device...');
+
+            pc.ondatachannel = event => {
+                const channel = event.channel;
+                channel.binaryType = 'arraybuffer';
+                let header;
+                let chunks = [];
+                let received = 0;
+                const started = Date.now();
+                channel.onmessage = message => {
+                    if (typeof message.data !== 'string') {
+                        chunks.push(message.data);
+                        received += message.data.byteLength;
+                        showProgress(received, header.size, started);
+                        return;
+                    }
+                    const control = JSON.parse(message.data);
+                    if (!control.done) {
+                        header = control;
+                        return;
+                    }
+                    const blob = new Blob(chunks, {type: header.type || 'application/octet-stream'});
+                    chunks = [];
+                    const link = document.getElementById('saved-link');
+                    link.href = URL.createObjectURL(blob);
+                    link.download = header.name;
+                    document.getElementById('saved').style.display = '';
+                    link.click();
+                    channel.send(JSON.stringify({received: received}));
+                    setStatus('Received ' + header.name + ' (' + formatSize(received) + ')');
+                    stream.close();
+                };
+            };
+        }
+
+        document.getElementById('receive-button').addEventListener('click', receive);
+        if (document.getElementById('receive-code').value) {
+            receive();
+        }
+    </script>
+</body>
+</html>
+`
+
+// Handler for direct transfers between browsers. GET /direct shows the page
+// (with "room" filled in for the receiver), POST /direct opens a room. Each
+// device then listens on /direct/events and posts its WebRTC messages for the
+// other to /direct/signal, both with "room" and "role". Wrong room codes
+// count as failed attempts, like share codes.
+func directHandler(rooms *DirectRooms, lockout *AuthLockout) http.Handler {
+	tmpl := template.Must(template.New("direct").Parse(directTemplate))
+	mux := http.NewServeMux()
+
+	// The room and role of a signaling request, or "" after writing an error
+	roomAndRole := func(w http.ResponseWriter, r *http.Request) (string, string) {
+		query := r.URL.Query()
+		role := query.Get("role")
+		if role != directSenderRole && role != directReceiverRole {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return "", ""
+		}
+		if lockout.reject(w, r) {
+			return "", ""
+		}
+		return query.Get("room"), role
+	}
+
+	// Report a failed room operation, counting unknown codes against the client
+	fail := func(w http.ResponseWriter, r *http.Request, err error) {
+		switch err {
+		case errDirectRoomNotFound:
+			lockout.Fail(clientIP(r))
+			http.Error(w, "Unknown or expired code", http.StatusNotFound)
+		case errDirectRoleTaken:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "Error passing message: "+err.Error(), http.StatusServiceUnavailable)
+		}
+	}
+
+	mux.HandleFunc("/direct", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := tmpl.Execute(w, normalizeShareCode(r.URL.Query().Get("room"))); err != nil {
+				http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+			}
+
+		case "POST":
+			code, err := rooms.Create()
+			if err != nil {
+				http.Error(w, "Error creating room: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			debugf("Direct transfer room %s opened by %s", code, clientIP(r))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"code": code})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/direct/signal", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		code, role := roomAndRole(w, r)
+		if role == "" {
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDirectMessage))
+		if err != nil {
+			http.Error(w, "Error reading message: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Compact, since a line break would end the event on the other side
+		var message bytes.Buffer
+		if err := json.Compact(&message, body); err != nil {
+			http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rooms.Send(code, role, message.Bytes()); err != nil {
+			fail(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/direct/events", func(w http.ResponseWriter, r *http.Request) {
+		code, role := roomAndRole(w, r)
+		if role == "" {
+			return
+		}
+		messages, leave, err := rooms.Join(code, role)
+		if err != nil {
+			fail(w, r, err)
+			return
+		}
+		defer leave()
+		debugf("Direct transfer %s of room %s connected from %s", role, normalizeShareCode(code), clientIP(r))
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		// Comments keep proxies from closing an idle stream
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case message := <-messages:
+				fmt.Fprintf(w, "data: %s\n\n", message)
+			case <-keepalive.C:
+				io.WriteString(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-rooms.closed:
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return mux
+}
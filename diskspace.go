@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Returned by freeDiskSpace where the platform can't report free space
+var errDiskSpaceUnsupported = errors.New("free disk space is not available on this platform")
+
+// Check that every directory's volume has room for need more bytes.
+// Directories whose free space can't be determined are skipped.
+func checkDiskSpace(need int64, dirs ...string) error {
+	if need <= 0 {
+		return nil
+	}
+	for _, dir := range dirs {
+		free, err := freeDiskSpace(dir)
+		if err != nil {
+			continue
+		}
+		if uint64(need) > free {
+			return fmt.Errorf("not enough disk space: the upload needs %s but only %s is free", formatByteSize(need), formatByteSize(int64(free)))
+		}
+	}
+	return nil
+}
+
+// How often the disk monitor checks free space
+const diskCheckInterval = time.Minute
+
+// DiskMonitor watches the free space of the served volume
+type DiskMonitor struct {
+	dir       string
+	threshold int64
+
+	mu   sync.Mutex
+	free int64
+	low  bool
+}
+
+// Start checking dir's volume in the background, publishing a low-disk
+// event whenever free space drops below threshold. A threshold of zero
+// disables monitoring.
+func startDiskMonitor(dir string, threshold int64, events *EventBus) *DiskMonitor {
+	if threshold <= 0 {
+		return nil
+	}
+	m := &DiskMonitor{dir: dir, threshold: threshold}
+	if _, err := freeDiskSpace(dir); err != nil {
+		log.Printf("Not monitoring free disk space: %v", err)
+		return nil
+	}
+
+	m.check(events)
+	go func() {
+		for range time.Tick(diskCheckInterval) {
+			m.check(events)
+		}
+	}()
+	return m
+}
+
+// Update the free space, reporting changes between low and enough space
+func (m *DiskMonitor) check(events *EventBus) {
+	free, err := freeDiskSpace(m.dir)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	wasLow := m.low
+	m.free = int64(free)
+	m.low = m.free < m.threshold
+	low := m.low
+	m.mu.Unlock()
+
+	switch {
+	case low && !wasLow:
+		detail := fmt.Sprintf("only %s free, below %s", formatByteSize(int64(free)), formatByteSize(m.threshold))
+		log.Printf("Warning: low disk space on %s: %s", m.dir, detail)
+		events.Publish(Event{Type: EventLowDisk, Client: "monitor", Detail: detail})
+	case !low && wasLow:
+		logf("Disk space on %s recovered: %s free", m.dir, formatByteSize(int64(free)))
+	}
+}
+
+// Whether free space is below the threshold, and how much is left
+func (m *DiskMonitor) Low() (bool, int64) {
+	if m == nil {
+		return false, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.low, m.free
+}
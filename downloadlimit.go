@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// DownloadLimiter caps how many downloads each client IP runs at once, so
+// a download manager opening many connections can't starve other devices
+type DownloadLimiter struct {
+	limit int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// Create a limiter allowing limit downloads per client, or nil for no limit
+func newDownloadLimiter(limit int) *DownloadLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &DownloadLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// Start a download for ip, unless it already has as many as allowed
+func (d *DownloadLimiter) Acquire(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active[ip] >= d.limit {
+		return false
+	}
+	d.active[ip]++
+	return true
+}
+
+// Finish a download started with Acquire
+func (d *DownloadLimiter) Release(ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active[ip] <= 1 {
+		delete(d.active, ip)
+		return
+	}
+	d.active[ip]--
+}
+
+// Refuse downloads beyond the per-client limit with 429 Too Many Requests,
+// which download managers handle by retrying the extra connections later
+func limitDownloads(next http.Handler, limiter *DownloadLimiter) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if !limiter.Acquire(ip) {
+			debugf("Refused download of %s: %s already has %d running", r.URL.Path, ip, limiter.limit)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Too many simultaneous downloads from this device, try again shortly", http.StatusTooManyRequests)
+			return
+		}
+		defer limiter.Release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pick a free name for a copy next to the original, e.g. "report copy.pdf"
+// then "report copy 2.pdf"
+func duplicateName(path string) (string, error) {
+	dir, name := filepath.Split(path)
+	ext := ""
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		ext = filepath.Ext(name)
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 1; i < 1000; i++ {
+		candidate := stem + " copy" + ext
+		if i > 1 {
+			candidate = fmt.Sprintf("%s copy %d%s", stem, i, ext)
+		}
+		candidate = filepath.Join(dir, candidate)
+		if _, err := os.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("too many copies already exist")
+}
+
+// Copy a file or folder tree to dest, which must not exist. With hardlink
+// set, regular files are hard linked instead of copied, falling back to a
+// real copy where linking fails (for example across volumes). The copy is
+// built under a temporary name so it only appears once complete.
+func duplicatePath(src, dest string, hardlink bool) (copied, linked int, err error) {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dest), ".copy-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmp := filepath.Join(tmpDir, filepath.Base(dest))
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case !info.Mode().IsRegular():
+			// Symlinks and special files are skipped, as for archives
+			return nil
+		}
+
+		if hardlink {
+			if err := os.Link(path, target); err == nil {
+				linked++
+				return nil
+			}
+		}
+		if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return copied, linked, os.Rename(tmp, dest)
+}
+
+// Copy a single regular file, keeping its permissions
+func copyFile(src, dest string, perm fs.FileMode) error {
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := copyFileTo(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Handler for duplicating a file or folder next to the original. Expects
+// the "path" to copy.
+func duplicateHandler(config Config, events *EventBus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		relPath := cleanRelPath(r.FormValue("path"))
+		if relPath == "" {
+			http.Error(w, "Cannot duplicate the root folder", http.StatusBadRequest)
+			return
+		}
+		srcPath, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil {
+			http.Error(w, "Invalid path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(srcPath); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		destPath, err := duplicateName(srcPath)
+		if err != nil {
+			http.Error(w, "Error duplicating: "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		copied, linked, err := duplicatePath(srcPath, destPath, config.HardlinkCopies)
+		if err != nil {
+			http.Error(w, "Error duplicating: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		destRel, _ := filepath.Rel(config.DownloadDir, destPath)
+		destRel = filepath.ToSlash(destRel)
+		logf("Duplicated %s to %s (%d copied, %d hard linked)", relPath, destRel, copied, linked)
+		events.Publish(Event{Type: EventUpload, Path: destRel, Client: clientIP(r), RequestID: requestID(r)})
+
+		redirectURL := "/"
+		if dir := filepath.ToSlash(filepath.Dir(relPath)); dir != "." {
+			redirectURL += "?path=" + url.QueryEscape(dir)
+		}
+		redirect(w, r, redirectURL, http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened to a file
+type EventType string
+
+// Event types published by the server
+const (
+	EventUpload   EventType = "upload"
+	EventDownload EventType = "download"
+	EventDelete   EventType = "delete"
+	EventLowDisk  EventType = "low-disk"
+	// Files created, deleted or renamed on disk, seen by -watch
+	EventChange EventType = "change"
+)
+
+// Event records a single file operation
+type Event struct {
+	Type   EventType `json:"type"`
+	Path   string    `json:"path"`
+	Client string    `json:"client"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+	// ID of the request that caused the event, if any
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// EventBus keeps a bounded history of recent events and fans them out to subscribers
+type EventBus struct {
+	mu          sync.Mutex
+	recent      []Event
+	capacity    int
+	subscribers []func(Event)
+}
+
+// Create an event bus remembering up to capacity recent events
+func newEventBus(capacity int) *EventBus {
+	return &EventBus{capacity: capacity}
+}
+
+// Publish an event to the history and all subscribers
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.capacity {
+		b.recent = b.recent[len(b.recent)-b.capacity:]
+	}
+	subscribers := b.subscribers
+	b.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// Register a function called for every published event. Subscribers run
+// synchronously, so slow work should be handed off to a goroutine.
+func (b *EventBus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Get the recent events, newest first
+func (b *EventBus) Recent() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([]Event, len(b.recent))
+	for i, e := range b.recent {
+		result[len(b.recent)-1-i] = e
+	}
+	return result
+}
+
+// Template for the recent activity page
+const activityTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Recent Activity - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            text-align: left;
+            padding: 8px;
+            border-bottom: 1px solid #ddd;
+        }
+        th {
+            background-color: #f0f0f0;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        .event-upload {
+            color: #2e7d32;
+        }
+        .event-download {
+            color: #0277bd;
+        }
+        .event-delete {
+            color: #c62828;
+        }
+    </style>
+</head>
+<body>
+    <h1>Recent Activity</h1>
+    <p><a href="./">&larr; Back to files</a></p>
+    {{if .}}
+    <table>
+        <tr><th>When</th><th>What</th><th>File</th><th>Who</th></tr>
+        {{range .}}
+        <tr{{if .RequestID}} title="Request {{.RequestID}}"{{end}}>
+            <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+            <td class="event-{{.Type}}">{{.Type}}</td>
+            <td>{{.Path}}{{if and .Path .Detail}} ({{.Detail}}){{else}}{{.Detail}}{{end}}</td>
+            <td>{{.Client}}</td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p>No activity yet.</p>
+    {{end}}
+</body>
+</html>
+`
+
+// Handler for the recent activity page
+func activityHandler(events *EventBus, rules *AccessRules) http.Handler {
+	tmpl := template.Must(template.New("activity").Parse(activityTemplate))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only events about files the client could read themselves are listed
+		var visible []Event
+		for _, event := range events.Recent() {
+			if rules.Allowed(r, event.Path, false) && (rules == nil || path.Base(event.Path) != accessFileName) {
+				visible = append(visible, event)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, visible); err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
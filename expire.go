@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpireRule deletes files under Folder (relative to the download dir) older than TTL
+type ExpireRule struct {
+	Folder string
+	TTL    time.Duration
+}
+
+// ExpireRules is a repeatable -expire-after flag value
+type ExpireRules []ExpireRule
+
+func (e *ExpireRules) String() string {
+	return strings.Join(e.Values(), ",")
+}
+
+// Each rule as given to -expire-after
+func (e *ExpireRules) Values() []string {
+	values := make([]string, len(*e))
+	for i, rule := range *e {
+		if rule.Folder == "" {
+			values[i] = rule.TTL.String()
+		} else {
+			values[i] = rule.Folder + "=" + rule.TTL.String()
+		}
+	}
+	return values
+}
+
+// Set parses "7d" for the whole tree or "folder/sub=12h" for a subfolder
+func (e *ExpireRules) Set(value string) error {
+	folder, ttlText := "", value
+	if i := strings.LastIndex(value, "="); i != -1 {
+		folder, ttlText = value[:i], value[i+1:]
+	}
+
+	ttl, err := parseLongDuration(ttlText)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("expiry must be positive: %s", ttlText)
+	}
+
+	folder = strings.Trim(filepath.ToSlash(filepath.Clean("/"+folder)), "/")
+	*e = append(*e, ExpireRule{Folder: folder, TTL: ttl})
+	return nil
+}
+
+// Parse a duration that may also use d (days) and w (weeks) units, e.g. "7d" or "1w2d"
+func parseLongDuration(s string) (time.Duration, error) {
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && (rest[i] >= '0' && rest[i] <= '9' || rest[i] == '.') {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			break
+		}
+		var unit time.Duration
+		switch rest[i] {
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		default:
+			// Hand the remainder to the standard parser
+			d, err := time.ParseDuration(rest)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return total + d, nil
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += time.Duration(n * float64(unit))
+		rest = rest[i+1:]
+	}
+	if rest != "" || s == "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return total, nil
+}
+
+// Find the most specific rule covering a slash separated relative path
+func (e ExpireRules) ruleFor(relPath string) (ExpireRule, bool) {
+	best, found := ExpireRule{}, false
+	for _, rule := range e {
+		if rule.Folder != "" && relPath != rule.Folder && !strings.HasPrefix(relPath, rule.Folder+"/") {
+			continue
+		}
+		if !found || len(rule.Folder) > len(best.Folder) {
+			best, found = rule, true
+		}
+	}
+	return best, found
+}
+
+// Periodically delete expired files in the background
+func startJanitor(baseDir string, rules ExpireRules, events *EventBus) {
+	if len(rules) == 0 {
+		return
+	}
+
+	// Check often enough relative to the shortest TTL, but not constantly
+	interval := time.Hour
+	for _, rule := range rules {
+		interval = min(interval, rule.TTL/10)
+	}
+	interval = max(interval, time.Minute)
+
+	for _, rule := range rules {
+		folder := rule.Folder
+		if folder == "" {
+			folder = "."
+		}
+		logf("Files in %s expire after %v", folder, rule.TTL)
+	}
+
+	go func() {
+		for {
+			removeExpiredFiles(baseDir, rules, events, time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Delete files older than their rule's TTL and any directories left empty
+func removeExpiredFiles(baseDir string, rules ExpireRules, events *EventBus, now time.Time) {
+	var dirs []string
+	filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		rule, ok := rules.ruleFor(rel)
+		if !ok {
+			return nil
+		}
+
+		if d.IsDir() {
+			// Never remove the folder a rule is attached to
+			if rel != rule.Folder {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || now.Sub(info.ModTime()) < rule.TTL {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing expired file %s: %v", rel, err)
+			return nil
+		}
+		logf("Removed expired file: %s", rel)
+		events.Publish(Event{Type: EventDelete, Path: rel, Client: "janitor"})
+		return nil
+	})
+
+	// Remove emptied directories deepest first; non-empty ones fail harmlessly
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits on what one archive may unpack to, so a small archive can't fill
+// the disk
+const (
+	maxExtractedFiles = 100000
+	maxExtractedSize  = 100 << 30
+)
+
+// What an extraction may still write
+type extractBudget struct {
+	files int
+	bytes int64
+}
+
+// Take a file of size bytes from the budget, refusing it if the archive
+// would unpack past the limits or dir's volume can't hold it
+func (b *extractBudget) take(size int64, dir string) error {
+	if b.files <= 0 {
+		return fmt.Errorf("archive has more than %d files", maxExtractedFiles)
+	}
+	if size < 0 || size > b.bytes {
+		return fmt.Errorf("archive unpacks to more than %s", formatByteSize(maxExtractedSize))
+	}
+	if err := checkDiskSpace(size, dir); err != nil {
+		return err
+	}
+	b.files--
+	b.bytes -= size
+	return nil
+}
+
+// Whether a file name looks like an archive we can extract
+func isExtractableArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract a zip or (gzipped) tar archive into destDir, returning the number
+// of files written. Entries that would land outside destDir, symlinks and
+// other special files are rejected or skipped, and so are .access files.
+// Every file must pass the upload type filter, as if uploaded on its own,
+// and the whole archive must fit the extraction limits and the disk.
+func extractArchive(archivePath, destDir string, types UploadTypeFilter) (int, error) {
+	lower := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return extractZip(archivePath, destDir, types)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		return extractTar(gz, destDir, types)
+	case strings.HasSuffix(lower, ".tar"):
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return extractTar(f, destDir, types)
+	}
+	return 0, fmt.Errorf("unsupported archive type: %s", filepath.Base(archivePath))
+}
+
+// Resolve an archive entry name inside destDir, refusing anything that escapes it
+func archiveEntryPath(destDir, name string) (string, error) {
+	// Archives made on Windows may use backslashes
+	name = strings.ReplaceAll(name, `\`, "/")
+	target, err := safeJoinPath(destDir, name)
+	if err != nil {
+		return "", fmt.Errorf("unsafe path in archive: %s", name)
+	}
+	return target, nil
+}
+
+// Write one extracted file of size bytes, once it has passed the upload
+// type filter and fits the budget
+func writeExtractedFile(target string, r io.Reader, size int64, types UploadTypeFilter, budget *extractBudget) error {
+	r, err := types.Check(filepath.Base(target), r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(target), err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := budget.take(size, filepath.Dir(target)); err != nil {
+		return err
+	}
+	// Write next to the target and rename, so a file being replaced is
+	// never rewritten in place and its hard linked copies keep their content
+	out, err := os.CreateTemp(filepath.Dir(target), ".extract-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	// Never write more than the entry claimed and the budget allowed
+	_, err = io.Copy(out, io.LimitReader(r, size))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(out.Name(), 0644)
+	return os.Rename(out.Name(), target)
+}
+
+func extractZip(archivePath, destDir string, types UploadTypeFilter) (int, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	budget := &extractBudget{files: maxExtractedFiles, bytes: maxExtractedSize}
+	count := 0
+	for _, f := range zr.File {
+		target, err := archiveEntryPath(destDir, f.Name)
+		if err != nil {
+			return count, err
+		}
+
+		mode := f.Mode()
+		switch {
+		case filepath.Base(target) == accessFileName:
+			logf("Skipping access rules in archive: %s", f.Name)
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return count, err
+			}
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return count, err
+			}
+			err = writeExtractedFile(target, rc, int64(f.UncompressedSize64), types, budget)
+			rc.Close()
+			if err != nil {
+				return count, err
+			}
+			count++
+		default:
+			logf("Skipping special file in archive: %s", f.Name)
+		}
+	}
+	return count, nil
+}
+
+func extractTar(r io.Reader, destDir string, types UploadTypeFilter) (int, error) {
+	tr := tar.NewReader(r)
+	budget := &extractBudget{files: maxExtractedFiles, bytes: maxExtractedSize}
+	count := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		target, err := archiveEntryPath(destDir, header.Name)
+		if err != nil {
+			return count, err
+		}
+
+		switch {
+		case filepath.Base(target) == accessFileName:
+			logf("Skipping access rules in archive: %s", header.Name)
+		case header.Typeflag == tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return count, err
+			}
+		case header.Typeflag == tar.TypeReg:
+			if err := writeExtractedFile(target, tr, header.Size, types, budget); err != nil {
+				return count, err
+			}
+			count++
+		default:
+			logf("Skipping special file in archive: %s", header.Name)
+		}
+	}
+}
+
+// Handler for the "extract here" action. Expects the archive "path".
+func extractHandler(config Config, encryption *AtRestEncryption, dedup *DedupStore, uploadTypes UploadTypeFilter, events *EventBus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Extracting may overwrite files next to the archive
+		if config.AppendOnly {
+			http.Error(w, "Cannot extract: "+appendOnlyMessage, http.StatusForbidden)
+			return
+		}
+
+		relPath := cleanRelPath(r.FormValue("path"))
+		archivePath, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if encryption.Covers(relPath) {
+			http.Error(w, "Archives cannot be extracted in the encrypted folder", http.StatusBadRequest)
+			return
+		}
+		if dedup.Covers(relPath) {
+			http.Error(w, "Archives cannot be extracted in the deduplicated folder", http.StatusBadRequest)
+			return
+		}
+		if !isExtractableArchive(archivePath) {
+			http.Error(w, "Not a supported archive", http.StatusBadRequest)
+			return
+		}
+
+		count, err := extractArchive(archivePath, filepath.Dir(archivePath), uploadTypes)
+		if err != nil {
+			http.Error(w, "Error extracting archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logf("Extracted %d file(s) from %s", count, relPath)
+		events.Publish(Event{Type: EventUpload, Path: relPath + " (extracted)", Client: clientIP(r), RequestID: requestID(r)})
+
+		redirectURL := "/"
+		if dir := filepath.ToSlash(filepath.Dir(relPath)); dir != "." {
+			redirectURL += "?path=" + url.QueryEscape(dir)
+		}
+		redirect(w, r, redirectURL, http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Serve the site icon, either the embedded default or a file given with
+// -favicon
+func faviconHandler(config Config) (http.Handler, error) {
+	icon, err := staticFiles.ReadFile("static/favicon.ico")
+	if err != nil {
+		return nil, err
+	}
+	contentType := "image/x-icon"
+	modTime := time.Time{}
+
+	if config.Favicon != "" {
+		data, err := os.ReadFile(config.Favicon)
+		if err != nil {
+			return nil, err
+		}
+		icon = data
+		if t := mime.TypeByExtension(filepath.Ext(config.Favicon)); t != "" {
+			contentType = t
+		} else {
+			contentType = http.DetectContentType(data)
+		}
+		if info, err := os.Stat(config.Favicon); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(icon))
+	}), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// FavoritesStore keeps pinned files and folders per visitor in the state
+// database
+type FavoritesStore struct {
+	db *sql.DB
+}
+
+// Open the favorites store, importing the favorites.json of earlier
+// versions
+func openFavoritesStore(db *sql.DB, dataDir string) (*FavoritesStore, error) {
+	s := &FavoritesStore{db: db}
+
+	favorites := make(map[string][]string) // visitor ID -> pinned paths in pin order
+	err := importJSON(filepath.Join(dataDir, "favorites.json"), &favorites, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for visitor, paths := range favorites {
+				for _, path := range paths {
+					if _, err := tx.Exec("INSERT OR REPLACE INTO favorites (visitor, path) VALUES (?, ?)", visitor, path); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Pin or unpin a path for a visitor. Pinning again moves the path to the
+// end, as rows are listed in the order they were inserted.
+func (s *FavoritesStore) Set(visitor, path string, pinned bool) error {
+	if pinned {
+		_, err := s.db.Exec("INSERT OR REPLACE INTO favorites (visitor, path) VALUES (?, ?)", visitor, path)
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM favorites WHERE visitor = ? AND path = ?", visitor, path)
+	return err
+}
+
+// Paths a visitor pinned, in pin order
+func (s *FavoritesStore) paths(visitor string) []string {
+	rows, err := s.db.Query("SELECT path FROM favorites WHERE visitor = ? ORDER BY rowid", visitor)
+	if err != nil {
+		log.Printf("Error loading favorites: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			log.Printf("Error loading favorites: %v", err)
+			return nil
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Pinned paths of a visitor as a set
+func (s *FavoritesStore) Pinned(visitor string) map[string]bool {
+	set := make(map[string]bool)
+	for _, p := range s.paths(visitor) {
+		set[p] = true
+	}
+	return set
+}
+
+// List a visitor's pinned items that still exist
+func (s *FavoritesStore) List(visitor, baseDir string) []FileInfo {
+	result := []FileInfo{}
+	for _, p := range s.paths(visitor) {
+		fullPath, err := safeJoinPath(baseDir, p)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		fileInfo := newFileInfo(info.Name(), p, info)
+		fileInfo.Favorite = true
+		result = append(result, fileInfo)
+	}
+	return result
+}
+
+// Mark the visitor's pinned items in a listing recursively
+func markFavorites(files []FileInfo, pinned map[string]bool) {
+	for i := range files {
+		files[i].Favorite = pinned[cleanRelPath(files[i].Path)]
+		markFavorites(files[i].Children, pinned)
+	}
+}
+
+// Handler for pinning and unpinning items. Expects "path" and
+// "action" (pin or unpin).
+func favoritesHandler(favorites *FavoritesStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := cleanRelPath(r.FormValue("path"))
+		if path == "" {
+			http.Error(w, "No path specified", http.StatusBadRequest)
+			return
+		}
+
+		visitor := visitorID(w, r)
+		if err := favorites.Set(visitor, path, r.FormValue("action") != "unpin"); err != nil {
+			log.Printf("Error saving favorites: %v", err)
+			http.Error(w, "Error saving favorites: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files of a repository that git's dumb HTTP protocol reads. Anything else,
+// config with its remote URLs in particular, is never served.
+var gitDumbPaths = regexp.MustCompile(`^(HEAD|info/refs|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38,62}|objects/pack/pack-[0-9a-f]{40,64}\.(pack|idx))$`)
+
+// Split a request path like /team/app.git/info/refs into the repository
+// path and the file inside it
+func splitGitPath(urlPath string) (repo, file string, ok bool) {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i, part := range parts {
+		if strings.HasSuffix(part, ".git") && len(part) > len(".git") {
+			return strings.Join(parts[:i+1], "/"), strings.Join(parts[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// Find the git directory for a repository path: either a bare repository
+// named like the path, or the .git folder of a working copy without the
+// .git suffix
+func gitDir(baseDir, repo string) (string, bool) {
+	candidates := []string{repo, filepath.Join(strings.TrimSuffix(repo, ".git"), ".git")}
+	for _, candidate := range candidates {
+		dir, err := safeJoinPath(baseDir, candidate)
+		if err != nil {
+			continue
+		}
+		head, err := os.Stat(filepath.Join(dir, "HEAD"))
+		objects, err2 := os.Stat(filepath.Join(dir, "objects"))
+		if err == nil && err2 == nil && !head.IsDir() && objects.IsDir() {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// List the refs of a repository in the info/refs format, including peeled
+// tags. Uses git when it is installed, otherwise a file left by
+// `git update-server-info`.
+func gitInfoRefs(dir string) ([]byte, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return os.ReadFile(filepath.Join(dir, "info", "refs"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "--git-dir", dir, "show-ref", "--dereference").Output()
+	// show-ref exits with 1 when there are no refs at all
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 && len(out) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing refs: %w", err)
+	}
+	return bytes.ReplaceAll(out, []byte(" "), []byte("\t")), nil
+}
+
+// List the packs of a repository in the objects/info/packs format
+func gitInfoPacks(dir string) []byte {
+	packs, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.pack"))
+	sort.Strings(packs)
+	var buf bytes.Buffer
+	for _, pack := range packs {
+		fmt.Fprintf(&buf, "P %s\n", filepath.Base(pack))
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Serve git repositories read-only over the dumb HTTP protocol, so
+// `git clone http://host:8080/app.git` works for a bare repository app.git
+// or a working copy app in the served folder. Other requests go to next.
+func gitDumbHTTP(next http.Handler, config Config, encryption *AtRestEncryption, dedup *DedupStore, rules *AccessRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, file, ok := splitGitPath(r.URL.Path)
+		if !ok || encryption.Covers(repo) || dedup.Covers(repo) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		dir, ok := gitDir(config.DownloadDir, repo)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed: repositories are served read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		// The git folder may be the .git of a working copy, so check its
+		// rules rather than those of the repository path in the URL
+		if rel, err := filepath.Rel(config.DownloadDir, dir); err == nil && !rules.Allowed(r, filepath.ToSlash(rel), false) {
+			log.Printf("Blocked %s of %s by access rules for %s", r.Method, repo, clientIP(r))
+			http.Error(w, "Access denied: not allowed by the folder's access rules", http.StatusForbidden)
+			return
+		}
+		if !gitDumbPaths.MatchString(file) {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case file == "info/refs":
+			refs, err := gitInfoRefs(dir)
+			if err != nil {
+				log.Printf("Error listing refs of %s: %v", repo, err)
+				http.Error(w, "Error listing refs: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(refs)
+			logf("Git refs of %s fetched by %s", repo, clientIP(r))
+			return
+		case file == "objects/info/packs":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(gitInfoPacks(dir))
+			return
+		case file == "HEAD":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+		case strings.HasSuffix(file, ".pack"):
+			w.Header().Set("Content-Type", "application/x-git-packed-objects")
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		case strings.HasSuffix(file, ".idx"):
+			w.Header().Set("Content-Type", "application/x-git-packed-objects-toc")
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		default:
+			w.Header().Set("Content-Type", "application/x-git-loose-object")
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", info.ModTime(), f)
+	})
+}
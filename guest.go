@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GuestUpload is a link that lets anyone holding it upload into one folder,
+// without seeing or downloading anything
+type GuestUpload struct {
+	Token   string    `json:"token"`
+	Folder  string    `json:"folder"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Uploads int       `json:"uploads"`
+}
+
+// GuestUploadStore keeps the guest upload links in the state database
+type GuestUploadStore struct {
+	db *sql.DB
+}
+
+// Open the guest upload links, importing the guests.json of earlier
+// versions
+func openGuestUploadStore(db *sql.DB, dataDir string) (*GuestUploadStore, error) {
+	s := &GuestUploadStore{db: db}
+
+	links := make(map[string]GuestUpload)
+	err := importJSON(filepath.Join(dataDir, "guests.json"), &links, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for _, link := range links {
+				if err := insertGuestUpload(tx, link); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Store a link, replacing one with the same token
+func insertGuestUpload(tx *sql.Tx, link GuestUpload) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO guest_links (token, folder, note, created, expires, uploads) VALUES (?, ?, ?, ?, ?, ?)",
+		link.Token, link.Folder, link.Note, link.Created.UnixNano(), link.Expires.UnixNano(), link.Uploads)
+	return err
+}
+
+// Create a link for uploading into folder for ttl
+func (s *GuestUploadStore) Create(folder, note string, ttl time.Duration) (GuestUpload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return GuestUpload{}, err
+	}
+	now := time.Now()
+	link := GuestUpload{
+		Token:   hex.EncodeToString(b),
+		Folder:  folder,
+		Note:    note,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+
+	err := inTransaction(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM guest_links WHERE expires < ?", now.UnixNano()); err != nil {
+			return err
+		}
+		return insertGuestUpload(tx, link)
+	})
+	return link, err
+}
+
+// Look up an unexpired link
+func (s *GuestUploadStore) Get(token string) (GuestUpload, bool) {
+	links := s.query("SELECT token, folder, note, created, expires, uploads FROM guest_links WHERE token = ? AND expires > ?",
+		token, time.Now().UnixNano())
+	if len(links) == 0 {
+		return GuestUpload{}, false
+	}
+	return links[0], true
+}
+
+// Count files uploaded through a link
+func (s *GuestUploadStore) Used(token string, files int) error {
+	_, err := s.db.Exec("UPDATE guest_links SET uploads = uploads + ? WHERE token = ?", files, token)
+	return err
+}
+
+// Revoke a link
+func (s *GuestUploadStore) Revoke(token string) error {
+	_, err := s.db.Exec("DELETE FROM guest_links WHERE token = ?", token)
+	return err
+}
+
+// Get the unexpired links, newest first
+func (s *GuestUploadStore) List() []GuestUpload {
+	return s.query("SELECT token, folder, note, created, expires, uploads FROM guest_links WHERE expires > ? ORDER BY created DESC",
+		time.Now().UnixNano())
+}
+
+// Run a query returning guest upload links
+func (s *GuestUploadStore) query(query string, args ...any) []GuestUpload {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error reading guest upload links: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []GuestUpload
+	for rows.Next() {
+		var link GuestUpload
+		var created, expires int64
+		if err := rows.Scan(&link.Token, &link.Folder, &link.Note, &created, &expires, &link.Uploads); err != nil {
+			log.Printf("Error reading guest upload links: %v", err)
+			return nil
+		}
+		link.Created = time.Unix(0, created)
+		link.Expires = time.Unix(0, expires)
+		result = append(result, link)
+	}
+	return result
+}
+
+// Template for the page guests upload from. It shows nothing of the server
+// beyond the note the link was created with.
+const guestUploadTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Upload Files</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 600px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        button {
+            margin-top: 12px;
+            padding: 8px 16px;
+            cursor: pointer;
+        }
+        .notice {
+            background-color: #e8f5e9;
+            border: 1px solid #a5d6a7;
+            padding: 10px;
+            margin: 10px 0;
+        }
+    </style>
+</head>
+<body>
+    <h1>Upload Files</h1>
+    {{if .Note}}<p>{{.Note}}</p>{{end}}
+    {{if .Received}}<div class="notice">Thank you, {{.Received}} file{{if ne .Received 1}}s were{{else}} was{{end}} received.</div>{{end}}
+    <form method="post" enctype="multipart/form-data">
+        <input type="file" name="file" multiple required>
+        <br>
+        <button type="submit">Upload</button>
+    </form>
+    <p>This link works until {{.Expires.Local.Format "2006-01-02 15:04"}}.</p>
+</body>
+</html>
+`
+
+// Handler for guest upload links at /guest/<token>. GET shows an upload
+// form and POST stores the files in the link's folder. Existing files are
+// never replaced: uploads with a taken name get a version suffix. The token
+// is the only credential, so this works from outside the local network and
+// unknown tokens count as failed attempts.
+func (s *Server) guestUploadHandler() http.Handler {
+	tmpl := template.Must(template.New("guest").Parse(guestUploadTemplate))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.lockout.reject(w, r) {
+			return
+		}
+		token := strings.TrimPrefix(r.URL.Path, "/guest/")
+		link, ok := s.guests.Get(token)
+		if !ok {
+			s.lockout.Fail(clientIP(r))
+			http.Error(w, "This upload link is invalid or has expired", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			received, _ := strconv.Atoi(r.URL.Query().Get("received"))
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err := tmpl.Execute(w, struct {
+				Note     string
+				Expires  time.Time
+				Received int
+			}{link.Note, link.Expires, received})
+			if err != nil {
+				http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+			}
+
+		case "POST":
+			transfer := s.transfers.Start("", "upload", link.Folder, clientIP(r), r.ContentLength)
+			defer s.transfers.Finish(transfer)
+			r.Body = countingReader{r.Body, transfer}
+
+			dirs := []string{s.config.DownloadDir}
+			if s.quarantine != nil {
+				dirs = append(dirs, s.config.DataDir)
+			}
+			if err := checkDiskSpace(r.ContentLength, dirs...); err != nil {
+				log.Printf("Rejected guest upload from %s: %v", clientIP(r), err)
+				http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+
+			reader, err := r.MultipartReader()
+			if err != nil {
+				http.Error(w, "Error reading upload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			received := 0
+			defer func() {
+				if err := s.guests.Used(link.Token, received); err != nil {
+					log.Printf("Error saving guest upload links: %v", err)
+				}
+			}()
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					http.Error(w, "Error reading upload: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				if part.FormName() != "file" || part.FileName() == "" {
+					part.Close()
+					continue
+				}
+				status, err := s.storeGuestUpload(r, link, part.FileName(), part)
+				part.Close()
+				if err != nil {
+					log.Printf("Rejected guest upload of %s from %s: %v", part.FileName(), clientIP(r), err)
+					http.Error(w, "Upload rejected: "+err.Error(), status)
+					return
+				}
+				received++
+			}
+			if received == 0 {
+				http.Error(w, "No files uploaded", http.StatusBadRequest)
+				return
+			}
+			redirect(w, r, fmt.Sprintf("/guest/%s?received=%d", link.Token, received), http.StatusSeeOther)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// Store one file uploaded through a guest link, giving the HTTP status to
+// report if it fails
+func (s *Server) storeGuestUpload(r *http.Request, link GuestUpload, name string, body io.Reader) (int, error) {
+	filename, err := sanitizeFilename(name)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if s.rules != nil && filename == accessFileName {
+		return http.StatusForbidden, errors.New("access files can't be uploaded")
+	}
+	upload, err := s.uploadTypes.Check(filename, body)
+	if err != nil {
+		return http.StatusUnsupportedMediaType, err
+	}
+	uploadDir, err := safeJoinPath(s.config.DownloadDir, link.Folder)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := runHooks(&HookEvent{
+		Point:  HookPreUpload,
+		Path:   cleanRelPath(filepath.Join(link.Folder, filename)),
+		Client: clientIP(r),
+		Size:   -1,
+	}); err != nil {
+		return http.StatusForbidden, err
+	}
+
+	if s.quarantine != nil {
+		item, err := s.quarantine.Add(upload, filename, link.Folder, clientIP(r), 0, false)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		logf("Guest upload held for approval: %s to %s (%s)", item.Filename, link.Folder, item.ID)
+		return http.StatusOK, nil
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	fullPath, err := versionedName(filepath.Join(uploadDir, filename))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	relPath := cleanRelPath(filepath.Join(link.Folder, filepath.Base(fullPath)))
+
+	// Claim the name before writing, so concurrent uploads don't collide
+	out, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var size int64
+	if s.encryption.Covers(relPath) {
+		size, err = s.encryption.Encrypt(out, upload)
+	} else if s.dedup.Covers(relPath) {
+		size, err = s.dedup.Store(out, upload)
+	} else {
+		size, err = io.Copy(out, upload)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fullPath)
+		return http.StatusInternalServerError, err
+	}
+
+	logf("Guest upload saved: %s (%d bytes) from %s", relPath, size, clientIP(r))
+	s.events.Publish(Event{Type: EventUpload, Path: relPath, Client: clientIP(r), RequestID: requestID(r), Detail: "guest link"})
+	go runHooks(&HookEvent{Point: HookPostUpload, Path: relPath, Client: clientIP(r), Size: size})
+	return http.StatusOK, nil
+}
+
+// Template for managing guest upload links in the admin dashboard
+const guestAdminTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Guest Uploads - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            text-align: left;
+            padding: 8px;
+            border-bottom: 1px solid #ddd;
+        }
+        th {
+            background-color: #f0f0f0;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        form {
+            display: inline;
+        }
+        .link {
+            font-family: monospace;
+            word-break: break-all;
+        }
+        .muted {
+            color: #777;
+        }
+    </style>
+</head>
+<body>
+    <h1>Guest Uploads</h1>
+    <p><a href="../admin">&larr; Back to admin</a></p>
+    <p>A guest upload link lets anyone who has it upload files into one folder, even from outside the local network. They cannot see, download or replace anything.</p>
+    <form method="post" action="guests">
+        <input type="text" name="folder" placeholder="Folder, e.g. inbox/acme" required>
+        <input type="text" name="note" placeholder="Note shown to guests (optional)">
+        <select name="ttl">
+            <option value="24h">1 day</option>
+            <option value="168h" selected>1 week</option>
+            <option value="720h">30 days</option>
+        </select>
+        <button type="submit">Create link</button>
+    </form>
+    {{if .}}
+    <table>
+        <tr><th>Folder</th><th>Link</th><th>Expires</th><th>Uploads</th><th></th></tr>
+        {{range .}}
+        <tr>
+            <td>{{.Folder}}{{if .Note}}<br><span class="muted">{{.Note}}</span>{{end}}</td>
+            <td class="link"><a href="{{.URL}}">{{.URL}}</a></td>
+            <td>{{.Expires.Local.Format "2006-01-02 15:04"}}</td>
+            <td>{{.Uploads}}</td>
+            <td>
+                <form method="post" action="guests/revoke">
+                    <input type="hidden" name="token" value="{{.Token}}">
+                    <button type="submit">Revoke</button>
+                </form>
+            </td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p class="muted">No guest upload links yet.</p>
+    {{end}}
+</body>
+</html>
+`
+
+// Admin handler for guest upload links. GET lists them (format=json for
+// scripts), POST creates one from "folder", "note" and "ttl", and
+// /admin/guests/revoke revokes the one in "token".
+func guestUploadsHandler(config Config, guests *GuestUploadStore) http.Handler {
+	tmpl := template.Must(template.New("guests").Parse(guestAdminTemplate))
+	type linkView struct {
+		GuestUpload
+		URL string `json:"url"`
+	}
+	views := func(r *http.Request) []linkView {
+		var result []linkView
+		for _, link := range guests.List() {
+			result = append(result, linkView{link, externalURL(r, "/guest/"+link.Token).String()})
+		}
+		return result
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/guests", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("format") == "json" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(views(r))
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := tmpl.Execute(w, views(r)); err != nil {
+				http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+			}
+
+		case "POST":
+			folder := cleanRelPath(r.FormValue("folder"))
+			if _, err := safeJoinPath(config.DownloadDir, folder); err != nil || folder == "" {
+				http.Error(w, "Invalid folder", http.StatusBadRequest)
+				return
+			}
+			ttl, err := time.ParseDuration(r.FormValue("ttl"))
+			if err != nil || ttl <= 0 {
+				ttl = 7 * 24 * time.Hour
+			}
+			link, err := guests.Create(folder, strings.TrimSpace(r.FormValue("note")), ttl)
+			if err != nil {
+				http.Error(w, "Error creating link: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logf("Guest upload link for %s created by %s", folder, clientIP(r))
+			if r.URL.Query().Get("format") == "json" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(linkView{link, externalURL(r, "/guest/"+link.Token).String()})
+				return
+			}
+			redirect(w, r, "/admin/guests", http.StatusSeeOther)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/admin/guests/revoke", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := guests.Revoke(r.FormValue("token")); err != nil {
+			http.Error(w, "Error revoking link: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logf("Guest upload link revoked by %s", clientIP(r))
+		redirect(w, r, "/admin/guests", http.StatusSeeOther)
+	})
+
+	return mux
+}
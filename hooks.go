@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HookPoint names a place in request handling where hooks run
+type HookPoint string
+
+const (
+	HookPreUpload   HookPoint = "pre-upload"
+	HookPostUpload  HookPoint = "post-upload"
+	HookPreDownload HookPoint = "pre-download"
+	HookOnList      HookPoint = "on-list"
+)
+
+// HookEvent describes what a hook is being run for
+type HookEvent struct {
+	Point  HookPoint `json:"hook"`
+	Path   string    `json:"path"`
+	Client string    `json:"client"`
+	Size   int64     `json:"size,omitempty"`
+
+	// The listing about to be shown, for on-list hooks. Go hooks may remove
+	// or change entries.
+	Files []FileInfo `json:"-"`
+}
+
+// Hook is custom behavior run at a hook point. Returning an error from a
+// pre-upload, pre-download or on-list hook rejects the request; errors from
+// post-upload hooks are only logged.
+type Hook func(event *HookEvent) error
+
+var (
+	hooksMu sync.RWMutex
+	hooks   = make(map[HookPoint][]Hook)
+)
+
+// Register a hook, typically from an init function in a separate file
+// compiled into the server
+func registerHook(point HookPoint, hook Hook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks[point] = append(hooks[point], hook)
+}
+
+// Run the hooks for an event's hook point in registration order, stopping
+// at the first error
+func runHooks(event *HookEvent) error {
+	hooksMu.RLock()
+	registered := hooks[event.Point]
+	hooksMu.RUnlock()
+
+	for _, hook := range registered {
+		if err := hook(event); err != nil {
+			if event.Point == HookPostUpload {
+				log.Printf("Hook %s for %s failed: %v", event.Point, event.Path, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// How long an external hook process may run
+const hookTimeout = 30 * time.Second
+
+// Hook running an external command with the hook point as its argument and
+// the event as JSON on stdin. A non-zero exit rejects the request, with the
+// first line of output as the reason.
+func externalHook(command string) Hook {
+	return func(event *HookEvent) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, command, string(event.Point))
+		cmd.Stdin = bytes.NewReader(payload)
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			return nil
+		}
+
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("running hook: %w", err)
+		}
+		reason, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		if reason == "" {
+			reason = fmt.Sprintf("hook exited with status %d", exitErr.ExitCode())
+		}
+		return errors.New(reason)
+	}
+}
+
+// Register an external hook command for every hook point
+func registerExternalHook(command string) {
+	hook := externalHook(command)
+	for _, point := range []HookPoint{HookPreUpload, HookPostUpload, HookPreDownload, HookOnList} {
+		registerHook(point, hook)
+	}
+}
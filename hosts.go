@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HostAllowlist holds the host names the server answers to. IP addresses
+// and localhost are always allowed; other names must be listed, which stops
+// DNS rebinding attacks where a malicious site points its own name at this
+// server to read files through a visitor's browser.
+type HostAllowlist struct {
+	mu    sync.RWMutex
+	names map[string]bool
+	any   bool
+}
+
+// Create an allowlist with this machine's host name plus a comma separated
+// list of extra names. A name starting with "." also allows its subdomains
+// and "*" allows any host.
+func newHostAllowlist(extra string) *HostAllowlist {
+	h := &HostAllowlist{names: make(map[string]bool)}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		h.Allow(hostname)
+		h.Allow(hostname + ".local")
+	}
+	for _, name := range strings.Split(extra, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			h.any = true
+		} else if name != "" {
+			h.Allow(name)
+		}
+	}
+	return h
+}
+
+// Normalize a host name for comparison
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Allow requests for a host name
+func (h *HostAllowlist) Allow(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.names[normalizeHost(host)] = true
+}
+
+// Whether a Host header names this server
+func (h *HostAllowlist) Allowed(hostHeader string) bool {
+	if h.any || hostHeader == "" {
+		return true
+	}
+
+	host := hostHeader
+	if name, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = name
+	}
+	host = normalizeHost(strings.Trim(host, "[]"))
+
+	// Rebinding needs a name, so addresses are always safe
+	if net.ParseIP(host) != nil || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.names[host] {
+		return true
+	}
+	for name := range h.names {
+		if strings.HasPrefix(name, ".") && (strings.HasSuffix(host, name) || host == name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejecting requests whose Host header isn't allowed
+func hostFilter(next http.Handler, hosts *HostAllowlist) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hosts.Allowed(r.Host) {
+			log.Printf("Rejected request from %s for unknown host %q", clientIP(r), r.Host)
+			http.Error(w, "Access denied: unknown host name (add it with -allowed-hosts)", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware rejecting requests that change something when a browser sent
+// them on behalf of another site, so a page the owner visits can't approve
+// uploads or change permissions here. Browsers say where a request comes
+// from in Sec-Fetch-Site, or in Origin if they are older; scripts and other
+// clients send neither and pass.
+func crossSiteFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		crossSite := false
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+			crossSite = site != "same-origin" && site != "none"
+		} else if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			crossSite = err != nil || !strings.EqualFold(u.Host, r.Host)
+		}
+		if crossSite {
+			log.Printf("Rejected cross-site %s %s from %s", r.Method, r.URL.Path, clientIP(r))
+			http.Error(w, "Access denied: cross-site request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceHours is the daily window, in the server's local time, in which
+// the server answers requests. A window may run past midnight, e.g.
+// 22:00-06:00.
+type ServiceHours struct {
+	// Offsets from midnight
+	open, close time.Duration
+}
+
+// Parse "HH:MM-HH:MM", or return nil for an empty string
+func parseServiceHours(s string) (*ServiceHours, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	opens, err := parseClockTime(from)
+	if err != nil {
+		return nil, err
+	}
+	closes, err := parseClockTime(to)
+	if err != nil {
+		return nil, err
+	}
+	if opens == closes {
+		return nil, fmt.Errorf("the window %q is empty", s)
+	}
+	return &ServiceHours{open: opens, close: closes}, nil
+}
+
+// Parse "HH:MM" as an offset from midnight
+func parseClockTime(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(s), ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Whether the server answers at t
+func (h *ServiceHours) Open(t time.Time) bool {
+	if h == nil {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	if h.open < h.close {
+		return now >= h.open && now < h.close
+	}
+	return now >= h.open || now < h.close
+}
+
+// When the server next opens after t
+func (h *ServiceHours) NextOpening(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	opens := midnight.Add(h.open)
+	if !opens.After(t) {
+		// Counting days rather than adding 24 hours keeps the time of day
+		// across daylight saving changes
+		opens = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(h.open)
+	}
+	return opens
+}
+
+// Parse a date, or a date and time, in local time
+func parseLocalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected YYYY-MM-DD or YYYY-MM-DDTHH:MM, got %q", s)
+}
+
+// Template for the page shown when the server or a link isn't available yet
+const comeBackLaterTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Come Back Later - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 600px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+    </style>
+</head>
+<body>
+    <h1>Come back later</h1>
+    <p>{{.Message}}</p>
+    <p>Available from <strong>{{.Opens.Format "Monday, 2 January at 15:04"}}</strong>.</p>
+</body>
+</html>
+`
+
+var comeBackLaterPage = template.Must(template.New("later").Parse(comeBackLaterTemplate))
+
+// Tell the client to come back once something opens, with a page for
+// browsers and a line of text for everyone else
+func writeComeBackLater(w http.ResponseWriter, r *http.Request, code int, message string, opens time.Time) {
+	if wait := time.Until(opens); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		comeBackLaterPage.Execute(w, struct {
+			Message string
+			Opens   time.Time
+		}{message, opens})
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s Available from %s.", message, opens.Format(time.RFC3339)), code)
+}
+
+// Middleware turning requests away outside the service hours. The machine
+// itself is always served, so it can still be managed, unless a tunnel
+// brings other visitors in through localhost.
+func serviceHoursFilter(next http.Handler, hours *ServiceHours) http.Handler {
+	if hours == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if hours.Open(now) || fromThisMachine(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		debugf("Turned away %s outside service hours", clientIP(r))
+		writeComeBackLater(w, r, http.StatusServiceUnavailable, "The file server is closed at the moment.", hours.NextOpening(now))
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FolderStats is the total size and number of files below a folder
+type FolderStats struct {
+	Size  int64
+	Files int
+}
+
+// TreeIndex walks the served tree in the background at startup and then
+// periodically. The walk loads every folder into the operating system's
+// cache, so the first listing after boot doesn't wait on a cold disk, and
+// records the total size of each folder for the listing's details.
+type TreeIndex struct {
+	root     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	folders map[string]FolderStats
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start indexing root every interval, or return nil if interval is zero
+func startTreeIndex(root string, interval time.Duration) *TreeIndex {
+	if interval <= 0 {
+		return nil
+	}
+	t := &TreeIndex{
+		root:     root,
+		interval: interval,
+		folders:  make(map[string]FolderStats),
+		stop:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *TreeIndex) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.build()
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Walk the whole tree and replace the index with what was found
+func (t *TreeIndex) build() {
+	started := time.Now()
+	folders := map[string]FolderStats{"": {}}
+	err := filepath.WalkDir(t.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable folders are left out rather than ending the walk
+			if d != nil && d.IsDir() && p != t.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		select {
+		case <-t.stop:
+			return filepath.SkipAll
+		default:
+		}
+
+		rel, err := filepath.Rel(t.root, p)
+		if err != nil {
+			return err
+		}
+		rel = cleanRelPath(filepath.ToSlash(rel))
+		if d.IsDir() {
+			if _, ok := folders[rel]; !ok {
+				folders[rel] = FolderStats{}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		// Count the file in every folder above it
+		for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+			if dir == "." {
+				dir = ""
+			}
+			stats := folders[dir]
+			stats.Size += info.Size()
+			stats.Files++
+			folders[dir] = stats
+			if dir == "" {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error indexing %s: %v", t.root, err)
+		return
+	}
+
+	t.mu.Lock()
+	t.folders = folders
+	t.mu.Unlock()
+	root := folders[""]
+	debugf("Indexed %d folder(s) and %d file(s), %s, in %v", len(folders), root.Files, formatByteSize(root.Size), time.Since(started).Round(time.Millisecond))
+}
+
+// Get the stats of a folder from the last walk
+func (t *TreeIndex) Folder(relPath string) (FolderStats, bool) {
+	if t == nil {
+		return FolderStats{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	stats, ok := t.folders[cleanRelPath(relPath)]
+	return stats, ok
+}
+
+// Fill in the total size of the folders in a listing, recursively
+func (t *TreeIndex) Annotate(files []FileInfo) {
+	if t == nil {
+		return
+	}
+	for i := range files {
+		if !files[i].IsDir {
+			continue
+		}
+		if stats, ok := t.Folder(files[i].Path); ok {
+			files[i].TreeSize = stats.Size
+			files[i].TreeFiles = stats.Files
+		}
+		t.Annotate(files[i].Children)
+	}
+}
+
+// Stop indexing
+func (t *TreeIndex) Close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
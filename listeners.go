@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ListenAddr is an address the server listens on along with what sets it
+// apart from the others
+type ListenAddr struct {
+	Addr string
+	// Serve HTTPS with the -tls-cert certificate
+	TLS bool
+	// Let requests in without the -password login
+	NoAuth bool
+	// Override -local for connections on this address, if set
+	LocalOnly *bool
+}
+
+// ListenAddrs is a repeatable -listen flag value
+type ListenAddrs []ListenAddr
+
+func (l *ListenAddrs) String() string {
+	return strings.Join(l.Values(), " ")
+}
+
+// Each address as given to -listen
+func (l *ListenAddrs) Values() []string {
+	values := make([]string, len(*l))
+	for i, listen := range *l {
+		values[i] = listen.String()
+	}
+	return values
+}
+
+func (l ListenAddr) String() string {
+	s := l.Addr
+	if l.TLS {
+		s += ",tls"
+	}
+	if l.NoAuth {
+		s += ",noauth"
+	}
+	if l.LocalOnly != nil {
+		if *l.LocalOnly {
+			s += ",local"
+		} else {
+			s += ",remote"
+		}
+	}
+	return s
+}
+
+// Set parses "host:port" followed by comma separated options: tls, noauth,
+// and local or remote to override -local
+func (l *ListenAddrs) Set(value string) error {
+	fields := strings.Split(value, ",")
+	listen := ListenAddr{Addr: strings.TrimSpace(fields[0])}
+	if _, port, err := net.SplitHostPort(listen.Addr); err != nil {
+		return err
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in %q", listen.Addr)
+	}
+	for _, option := range fields[1:] {
+		localOnly := false
+		switch strings.TrimSpace(option) {
+		case "tls":
+			listen.TLS = true
+		case "noauth":
+			listen.NoAuth = true
+		case "local":
+			localOnly = true
+			listen.LocalOnly = &localOnly
+		case "remote":
+			listen.LocalOnly = &localOnly
+		default:
+			return fmt.Errorf("unknown listen option %q", option)
+		}
+	}
+	*l = append(*l, listen)
+	return nil
+}
+
+// The port part of the address
+func (l ListenAddr) Port() int {
+	_, port, _ := net.SplitHostPort(l.Addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+type listenAddrKey struct{}
+
+// Listener handing out connections that remember which address they were
+// accepted on
+type policyListener struct {
+	net.Listener
+	listen ListenAddr
+}
+
+type policyConn struct {
+	net.Conn
+	listen ListenAddr
+}
+
+func (l policyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return policyConn{conn, l.listen}, nil
+}
+
+// Wrap a listener opened for listen, adding TLS if the address asks for it
+func wrapListener(listener net.Listener, listen ListenAddr, tlsConfig *tls.Config) net.Listener {
+	listener = policyListener{listener, listen}
+	if listen.TLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener
+}
+
+// Record the address a connection was accepted on in its requests' context.
+// Used as the http.Server's ConnContext.
+func listenContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(policyConn); ok {
+		return context.WithValue(ctx, listenAddrKey{}, pc.listen)
+	}
+	return ctx
+}
+
+// Get the address a request arrived on, if it came through a listener
+func listenAddr(r *http.Request) (ListenAddr, bool) {
+	listen, ok := r.Context().Value(listenAddrKey{}).(ListenAddr)
+	return listen, ok
+}
+
+// The URLs to reach the server on each address. Addresses listening on all
+// interfaces are listed with this machine's LAN addresses and localhost.
+func accessURLs(listens ListenAddrs, base string) []string {
+	var urls []string
+	for _, listen := range listens {
+		scheme := "http"
+		if listen.TLS {
+			scheme = "https"
+		}
+		host, _, _ := net.SplitHostPort(listen.Addr)
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			urls = append(urls, serverURL(scheme, host, listen.Port(), base))
+			continue
+		}
+		for _, ip := range lanAddresses() {
+			urls = append(urls, serverURL(scheme, ip.String(), listen.Port(), base))
+		}
+		urls = append(urls, serverURL(scheme, "localhost", listen.Port(), base))
+	}
+	return urls
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Entries rendered with the page; the rest are fetched from /list as the
+// visitor scrolls
+const listingPageSize = 200
+
+// Upper bound on the entries a single /list request may ask for
+const maxListingPageSize = 1000
+
+// ListingPage is one slice of a folder's entries
+type ListingPage struct {
+	Path    string     `json:"path"`
+	Entries []FileInfo `json:"entries"`
+	Offset  int        `json:"offset"`
+	Total   int        `json:"total"`
+	// Offset of the following page, or -1 after the last one
+	Next int `json:"next"`
+}
+
+// List one page of a folder. Only the entries on the page are read
+// recursively, to depth levels, so huge folders stay cheap to open.
+func (s *Server) listingPage(w http.ResponseWriter, r *http.Request, requestedPath string, offset, limit, depth int) (ListingPage, error) {
+	dir := cleanRelPath(requestedPath)
+	entries, err := listFilesRecursive(s.files, dir, 0)
+	if err != nil {
+		return ListingPage{}, err
+	}
+	entries = s.rules.Filter(r, entries)
+
+	page := ListingPage{Path: dir, Offset: offset, Total: len(entries), Next: -1}
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	end := offset + limit
+	if end < len(entries) {
+		page.Next = end
+	} else {
+		end = len(entries)
+	}
+	files := entries[offset:end]
+
+	if depth > 0 {
+		var wg sync.WaitGroup
+		for i := range files {
+			if !files[i].IsDir {
+				continue
+			}
+			goList(&wg, func() {
+				if children, err := listFilesRecursive(s.files, files[i].Path, depth-1); err == nil {
+					files[i].Children = children
+				}
+			})
+		}
+		wg.Wait()
+		for i := range files {
+			if files[i].IsDir {
+				files[i].Children = s.rules.Filter(r, files[i].Children)
+			}
+		}
+	}
+
+	// Hooks may hide entries or refuse the listing altogether
+	listEvent := &HookEvent{Point: HookOnList, Path: dir, Client: clientIP(r), Files: files}
+	if err := runHooks(listEvent); err != nil {
+		return ListingPage{}, &hookError{err}
+	}
+	files = listEvent.Files
+
+	s.tags.Annotate(files)
+	s.thumbs.Annotate(files)
+	s.index.Annotate(files)
+	s.torrents.Annotate(files)
+	s.dedup.Annotate(files)
+	markFavorites(files, s.favorites.Pinned(visitorID(w, r)))
+	markNew(files, s.visits.Since(visitorID(w, r)))
+	page.Entries = files
+	return page, nil
+}
+
+// Marks a listing refused by a hook, as opposed to one that failed
+type hookError struct {
+	err error
+}
+
+func (e *hookError) Error() string {
+	return e.err.Error()
+}
+
+// Handler serving folder listings page by page as JSON, used by the
+// browser to load more entries while scrolling. Accepts "path", "offset"
+// and "limit".
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = listingPageSize
+	}
+	if limit > maxListingPageSize {
+		limit = maxListingPageSize
+	}
+
+	page, err := s.listingPage(w, r, query.Get("path"), offset, limit, 0)
+	if err != nil {
+		writeListingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func writeListingError(w http.ResponseWriter, err error) {
+	if _, refused := err.(*hookError); refused {
+		http.Error(w, "Access denied: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, "Error reading directory: "+err.Error(), http.StatusInternalServerError)
+}
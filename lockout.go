@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuthLockout tracks failed credential attempts per client IP and blocks
+// clients that fail too often
+type AuthLockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	clients     map[string]*authFailures
+}
+
+type authFailures struct {
+	count        int
+	first        time.Time
+	blockedUntil time.Time
+}
+
+// Create a lockout that blocks a client for duration after maxFailures
+// failed attempts within window. A maxFailures of zero disables it.
+func newAuthLockout(maxFailures int, window, duration time.Duration) *AuthLockout {
+	if maxFailures <= 0 {
+		return nil
+	}
+	return &AuthLockout{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		clients:     make(map[string]*authFailures),
+	}
+}
+
+// How much longer a client is blocked for, or zero if it isn't
+func (l *AuthLockout) Blocked(ip string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.clients[ip]; ok {
+		if remaining := time.Until(f.blockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// Record a failed attempt, blocking the client once it hits the limit
+func (l *AuthLockout) Fail(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	f, ok := l.clients[ip]
+	if !ok || now.Sub(f.first) > l.window {
+		f = &authFailures{first: now}
+		l.clients[ip] = f
+	}
+	f.count++
+	if f.count >= l.maxFailures {
+		f.blockedUntil = now.Add(l.duration)
+		f.count = 0
+		f.first = now
+		log.Printf("Locked out %s for %v after %d failed authentication attempts", ip, l.duration, l.maxFailures)
+	}
+}
+
+// Clear a client's failures after a successful attempt
+func (l *AuthLockout) Succeed(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+}
+
+// Drop entries that are neither blocked nor inside the failure window
+func (l *AuthLockout) prune(now time.Time) {
+	for ip, f := range l.clients {
+		if now.After(f.blockedUntil) && now.Sub(f.first) > l.window {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Reject a request from a locked out client, returning whether it was
+func (l *AuthLockout) reject(w http.ResponseWriter, r *http.Request) bool {
+	remaining := l.Blocked(clientIP(r))
+	if remaining == 0 {
+		return false
+	}
+	seconds := int(remaining.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %v", remaining.Round(time.Second)), http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long a lock lasts unless refreshed, and the longest a client may ask for
+const (
+	defaultLockTTL = 5 * time.Minute
+	maxLockTTL     = time.Hour
+)
+
+// FileLock is an advisory lock on a file, held while someone edits it
+type FileLock struct {
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Token   string    `json:"token,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockStore keeps advisory locks in memory. Locks expire on their own, so a
+// closed browser tab or a restart never leaves a file locked for good.
+type LockStore struct {
+	mu    sync.Mutex
+	locks map[string]*FileLock // relative path -> lock
+}
+
+func newLockStore() *LockStore {
+	return &LockStore{locks: make(map[string]*FileLock)}
+}
+
+// The unexpired lock on a path, if any
+func (s *LockStore) activeLocked(path string) *FileLock {
+	lock, ok := s.locks[path]
+	if ok && time.Now().After(lock.Expires) {
+		delete(s.locks, path)
+		return nil
+	}
+	return lock
+}
+
+// Lock a path, or refresh the lock when token matches the current one.
+// Returns the lock, or the conflicting lock held by someone else.
+func (s *LockStore) Acquire(path, owner, token string, ttl time.Duration) (*FileLock, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lock := s.activeLocked(path); lock != nil {
+		if lock.Token != token {
+			return lock, false
+		}
+		lock.Expires = time.Now().Add(ttl)
+		return lock, true
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, false
+	}
+	lock := &FileLock{Path: path, Owner: owner, Token: id, Expires: time.Now().Add(ttl)}
+	s.locks[path] = lock
+	return lock, true
+}
+
+// Release a lock held with token
+func (s *LockStore) Release(path, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock := s.activeLocked(path)
+	if lock == nil || lock.Token != token {
+		return false
+	}
+	delete(s.locks, path)
+	return true
+}
+
+// Get the lock someone other than the holder of token has on a path, or nil
+// when the path may be written
+func (s *LockStore) Conflict(path, token string) *FileLock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock := s.activeLocked(path)
+	if lock == nil || lock.Token == token {
+		return nil
+	}
+	return lock
+}
+
+// Lock token sent with a write, either as a header or a form field
+func lockToken(r *http.Request) string {
+	if token := r.Header.Get("X-Lock-Token"); token != "" {
+		return token
+	}
+	// Only look at the body if it was parsed already, so binary uploads
+	// are never read as a form
+	if r.Form != nil {
+		return r.Form.Get("lock_token")
+	}
+	return r.URL.Query().Get("lock_token")
+}
+
+// Reply to a write that collides with someone else's lock
+func writeLockConflict(w http.ResponseWriter, lock *FileLock) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	json.NewEncoder(w).Encode(FileLock{Path: lock.Path, Owner: lock.Owner, Expires: lock.Expires})
+}
+
+// Handler for advisory locks. GET shows the lock on "path"; POST takes or,
+// with the current "token", refreshes it for "ttl" seconds; DELETE releases
+// it. Writes to a locked file without its token are refused with 423.
+func lockHandler(locks *LockStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := cleanRelPath(r.FormValue("path"))
+		if path == "" {
+			http.Error(w, "No path specified", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			lock := locks.Conflict(path, "")
+			if lock == nil {
+				http.Error(w, "Not locked", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(FileLock{Path: lock.Path, Owner: lock.Owner, Expires: lock.Expires})
+
+		case "POST":
+			ttl := defaultLockTTL
+			if v := r.FormValue("ttl"); v != "" {
+				seconds, err := strconv.Atoi(v)
+				if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxLockTTL {
+					http.Error(w, fmt.Sprintf("Invalid ttl: must be between 1 and %d seconds", int(maxLockTTL.Seconds())), http.StatusBadRequest)
+					return
+				}
+				ttl = time.Duration(seconds) * time.Second
+			}
+			owner := r.FormValue("owner")
+			if owner == "" {
+				owner = clientIP(r)
+			}
+
+			lock, ok := locks.Acquire(path, owner, r.FormValue("token"), ttl)
+			if lock == nil {
+				http.Error(w, "Error creating lock", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				writeLockConflict(w, lock)
+				return
+			}
+			debugf("Lock on %s held by %s until %s", path, lock.Owner, lock.Expires.Format(time.RFC3339))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(lock)
+
+		case "DELETE":
+			if !locks.Release(path, r.FormValue("token")) {
+				http.Error(w, "Not locked with this token", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Log levels: quiet keeps only errors and warnings, verbose adds per-request
+// detail on top of the normal activity log
+const (
+	LogQuiet = iota
+	LogNormal
+	LogVerbose
+)
+
+var logLevel = LogNormal
+
+// Pick the log level from the -quiet and -verbose flags
+func setLogLevel(quiet, verbose bool) {
+	switch {
+	case quiet:
+		logLevel = LogQuiet
+	case verbose:
+		logLevel = LogVerbose
+	default:
+		logLevel = LogNormal
+	}
+}
+
+// Log routine activity, suppressed by -quiet. Errors and warnings keep using
+// log.Printf so they always show.
+func logf(format string, args ...any) {
+	if logLevel >= LogNormal {
+		log.Printf(format, args...)
+	}
+}
+
+// Log per-request detail, shown only with -verbose
+func debugf(format string, args ...any) {
+	if logLevel >= LogVerbose {
+		log.Printf(format, args...)
+	}
+}
+
+// Records the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Keep sendfile working for downloads when the access log is on
+func (w *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+	}
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Log every request with its outcome when running with -verbose, and
+// requests that failed on the server's side always
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if logLevel >= LogVerbose || rec.status >= 500 {
+			log.Printf("[%s] %s %s %s %q %d %d bytes %v %q", requestID(r), clientIP(r), r.Method, r.Host, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start).Round(time.Millisecond), r.UserAgent())
+		}
+	})
+}
+
+type requestIDKey struct{}
+
+// Give each request an ID, returned in the X-Request-ID header and recorded
+// in the access log and activity events, so one failed request can be
+// traced through them. An ID set by a proxy in front is kept if it follows
+// the rules for upload IDs.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := transferID(r.Header.Get("X-Request-ID"))
+		if id == "" {
+			id, _ = randomID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// The ID given to a request by requestIDs
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"html/template"
-	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Version information
@@ -23,10 +27,105 @@ var (
 // Configuration for the file server
 type Config struct {
 	Port        int
+	IPVersion   string
+	Listen      ListenAddrs
+	TLSCert     string
+	TLSKey      string
+	ACME        string
+	ACMEEmail   string
 	DownloadDir string
 	LocalOnly   bool
 	ShowVersion bool
 	ShowHelp    bool
+	Stdin       bool
+	StdinName   string
+	Expose      bool
+	ExposeTTL   time.Duration
+	Tunnel      string
+	TunnelPort  int
+	DataDir     string
+
+	NotifySlack   string
+	NotifyDiscord string
+	NotifyMatrix  string
+	NotifyEvents  string
+
+	ExpireAfter ExpireRules
+	Quarantine  bool
+
+	EncryptDir     string
+	EncryptKeyFile string
+	DedupDir       string
+
+	URLSecret string
+	Sign      string
+	SignTTL   time.Duration
+	SignStart string
+	SignPost  bool
+
+	APIKeysFile     string
+	LockoutAttempts int
+	LockoutDuration time.Duration
+
+	Password string
+	TOTP     bool
+	Public   string
+
+	Verify bool
+
+	AccessFiles bool
+
+	Debug     bool
+	DebugAddr string
+
+	Hook string
+
+	Favicon string
+
+	HardlinkCopies bool
+
+	Git bool
+
+	AppendOnly bool
+
+	Torrent bool
+
+	Mirror         string
+	MirrorKey      string
+	MirrorInterval time.Duration
+
+	S3          bool
+	S3AccessKey string
+	S3SecretKey string
+
+	MinFreeSpace string
+
+	IndexInterval time.Duration
+	Watch         bool
+
+	MaxClientDownloads int
+	MaxBandwidth       string
+	MaxBytes           string
+	MaxBytesExit       bool
+	MmapCache          string
+	ThumbnailCache     string
+	Transcode          bool
+	TranscodeJobs      int
+
+	AllowedHosts string
+	Hours        string
+
+	BasePath string
+
+	Quiet   bool
+	Verbose bool
+	TUI     bool
+
+	CopyURL bool
+	Tray    bool
+
+	AllowUploadTypes string
+	DenyUploadTypes  string
 }
 
 // Usage information for the program
@@ -36,14 +135,159 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("  local-fileserver [options]")
+	fmt.Println("  local-fileserver config export [options] > settings.json")
+	fmt.Println("  local-fileserver config import [options] settings.json")
+	fmt.Println("  local-fileserver put [-key key] <file or folder>... <url>")
+	fmt.Println("  local-fileserver get [-key key] [-o dest] <url>")
+	fmt.Println("  local-fileserver ls [-key key] [-l] <url>")
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -port int")
 	fmt.Println("        Port to serve on (default 8080)")
+	fmt.Println("  -listen value")
+	fmt.Println("        Listen on host:port instead of -port, followed by options tls, noauth, local or remote, e.g. localhost:8080,noauth (repeatable)")
+	fmt.Println("  -tls-cert string")
+	fmt.Println("        Certificate file for serving HTTPS")
+	fmt.Println("  -tls-key string")
+	fmt.Println("        Private key file for -tls-cert")
+	fmt.Println("  -acme string")
+	fmt.Println("        Comma separated host names to get HTTPS certificates for from Let's Encrypt, serving on port 443 unless -port or -listen is set")
+	fmt.Println("  -acme-email string")
+	fmt.Println("        Contact address for Let's Encrypt expiry notices")
+	fmt.Println("  -ip-version string")
+	fmt.Println("        Listen on IPv4 only (4), IPv6 only (6) or both (dual) (default \"dual\")")
 	fmt.Println("  -dir string")
 	fmt.Println("        Directory to serve files from (default is ~/Downloads)")
+	fmt.Println("  -data-dir string")
+	fmt.Println("        Directory for server state such as download statistics (default is ~/.local-fileserver)")
 	fmt.Println("  -local")
 	fmt.Println("        Restrict access to local network only (default true)")
+	fmt.Println("  -stdin")
+	fmt.Println("        Serve data piped from stdin as a single downloadable file")
+	fmt.Println("  -name string")
+	fmt.Println("        File name to use for data read with -stdin (default \"stdin\")")
+	fmt.Println("  -expose")
+	fmt.Println("        Request a temporary port mapping on the router via NAT-PMP or UPnP")
+	fmt.Println("  -expose-ttl duration")
+	fmt.Println("        How long the router port mapping should last (default 1h0m0s)")
+	fmt.Println("  -tunnel string")
+	fmt.Println("        Open a reverse SSH tunnel to user@host (e.g. nokey@localhost.run) for public sharing")
+	fmt.Println("  -tunnel-port int")
+	fmt.Println("        Remote port to forward through the tunnel (default 80)")
+	fmt.Println("  -notify-slack string")
+	fmt.Println("        Slack incoming webhook URL to notify about file events")
+	fmt.Println("  -notify-discord string")
+	fmt.Println("        Discord webhook URL to notify about file events")
+	fmt.Println("  -notify-matrix string")
+	fmt.Println("        Matrix room send URL (.../rooms/{room}/send/m.room.message?access_token=...) to notify about file events")
+	fmt.Println("  -notify-events string")
+	fmt.Println("        Comma separated event types to notify about: upload, download, delete, low-disk, change (default \"upload,low-disk\")")
+	fmt.Println("  -expire-after value")
+	fmt.Println("        Delete files older than this, e.g. 7d, or only in a subfolder with folder=12h (repeatable)")
+	fmt.Println("  -quarantine")
+	fmt.Println("        Hold uploads for approval in the admin dashboard (/admin, localhost only) before they become visible")
+	fmt.Println("  -allow-upload-types string")
+	fmt.Println("        Comma separated extensions and MIME types that may be uploaded, e.g. .jpg,image/*")
+	fmt.Println("  -deny-upload-types string")
+	fmt.Println("        Comma separated extensions and MIME types that may not be uploaded, e.g. .exe,.sh")
+	fmt.Println("  -encrypt-dir string")
+	fmt.Println("        Subfolder whose uploads are encrypted at rest and decrypted on download")
+	fmt.Println("  -encrypt-key-file string")
+	fmt.Println("        File holding the hex encoded AES-256 key for -encrypt-dir, generated if missing (default is <data-dir>/encryption.key)")
+	fmt.Println("  -dedup-dir string")
+	fmt.Println("        Subfolder whose uploads are stored as deduplicated chunks in the data directory")
+	fmt.Println("  -url-secret string")
+	fmt.Println("        Shared secret for HMAC signed URLs, which work even from outside the local network (or set LOCAL_FILESERVER_URL_SECRET)")
+	fmt.Println("  -sign string")
+	fmt.Println("        Print a signed URL for this path (e.g. /download/file.txt, or /?path=folder for uploads) and exit")
+	fmt.Println("  -sign-ttl duration")
+	fmt.Println("        How long a URL printed by -sign stays valid (default 24h0m0s)")
+	fmt.Println("  -sign-start string")
+	fmt.Println("        When a URL printed by -sign becomes valid, e.g. 2024-06-08 or 2024-06-08T18:00 in local time (default now)")
+	fmt.Println("  -sign-upload")
+	fmt.Println("        Sign the URL given to -sign for uploading (POST) instead of downloading")
+	fmt.Println("  -verify")
+	fmt.Println("        Re-hash the served files, report any that changed since their checksums were recorded, and exit")
+	fmt.Println("  -api-keys string")
+	fmt.Println("        JSON file of API keys with read/write/admin scopes, sent as X-API-Key or a bearer token")
+	fmt.Println("  -password string")
+	fmt.Println("        Require logging in with this password (or set LOCAL_FILESERVER_PASSWORD)")
+	fmt.Println("  -totp")
+	fmt.Println("        Also require a code from an authenticator app when logging in (secret in <data-dir>/totp.secret)")
+	fmt.Println("  -public string")
+	fmt.Println("        Comma separated folders anyone may browse and download from without the password")
+	fmt.Println("  -access-files")
+	fmt.Println("        Enforce per-folder .access files listing who may read or write each subtree")
+	fmt.Println("  -lockout-attempts int")
+	fmt.Println("        Failed API key or signature attempts before a client is locked out, 0 to disable (default 5)")
+	fmt.Println("  -lockout-duration duration")
+	fmt.Println("        How long locked out clients are blocked (default 15m0s)")
+	fmt.Println("  -debug")
+	fmt.Println("        Serve pprof profiling endpoints on a localhost-only listener")
+	fmt.Println("  -debug-addr string")
+	fmt.Println("        Loopback address for the -debug listener (default \"127.0.0.1:6060\")")
+	fmt.Println("  -hook string")
+	fmt.Println("        Command run at pre-upload, post-upload, pre-download and on-list, with the event as JSON on stdin")
+	fmt.Println("  -favicon string")
+	fmt.Println("        Icon file (.ico, .png or .svg) to serve instead of the built-in favicon")
+	fmt.Println("  -hardlink-copies")
+	fmt.Println("        Duplicate files as hard links when possible, making copies instant (copies then share content)")
+	fmt.Println("  -min-free-space string")
+	fmt.Println("        Warn in the page and notifications when free disk space drops below this, 0 to disable (default \"1GB\")")
+	fmt.Println("  -index-interval duration")
+	fmt.Println("        Walk the folder at startup and then this often to warm caches and total up folder sizes, 0 to disable")
+	fmt.Println("  -watch")
+	fmt.Println("        Follow changes on disk to update open pages and notify about files added by other programs")
+	fmt.Println("  -max-client-downloads int")
+	fmt.Println("        Simultaneous downloads allowed per client IP, 0 for no limit")
+	fmt.Println("  -max-bandwidth string")
+	fmt.Println("        Total download rate per second, e.g. 10MB, shared evenly by running downloads (default \"0\", no limit)")
+	fmt.Println("  -max-bytes string")
+	fmt.Println("        Total bytes downloads may send, e.g. 50GB, after which further downloads are refused (default \"0\", no limit)")
+	fmt.Println("  -max-bytes-exit")
+	fmt.Println("        Shut the server down once -max-bytes is used up instead of only refusing downloads")
+	fmt.Println("  -mmap-cache string")
+	fmt.Println("        Memory for keeping small files such as thumbnails mapped, e.g. 64MB (default \"0\", disabled)")
+	fmt.Println("  -thumbnail-cache string")
+	fmt.Println("        Most disk space video thumbnails and converted photos may take up, e.g. 500MB, 0 for no limit (default \"1GB\")")
+	fmt.Println("  -transcode")
+	fmt.Println("        Convert videos the browser can't play, such as HEVC in MKV, with ffmpeg when they are played")
+	fmt.Println("  -transcode-jobs int")
+	fmt.Println("        Conversions each visitor may have running at once with -transcode (default 2)")
+	fmt.Println("  -allowed-hosts string")
+	fmt.Println("        Comma separated extra host names the server answers to (.example.com includes subdomains, * allows any)")
+	fmt.Println("  -hours string")
+	fmt.Println("        Only answer other machines during this daily window in local time, e.g. 08:00-22:00")
+	fmt.Println("  -base-path string")
+	fmt.Println("        URL prefix the server is mounted under behind a reverse proxy, e.g. /files")
+	fmt.Println("  -git")
+	fmt.Println("        Serve git repositories in the folder read-only, for git clone http://host:port/repo.git")
+	fmt.Println("  -append-only")
+	fmt.Println("        Never overwrite or delete files: uploads with an existing name get a version suffix")
+	fmt.Println("  -torrent")
+	fmt.Println("        Offer .torrent files of big files with this server as web seed and LAN tracker")
+	fmt.Println("  -mirror string")
+	fmt.Println("        Periodically pull new and changed files from another instance, e.g. http://other-host:8080")
+	fmt.Println("  -mirror-interval duration")
+	fmt.Println("        How often to pull from the -mirror instance (default 5m)")
+	fmt.Println("  -mirror-key string")
+	fmt.Println("        API key to send to the -mirror instance")
+	fmt.Println("  -s3")
+	fmt.Println("        Serve a minimal S3 compatible API: top-level folders are buckets")
+	fmt.Println("  -s3-access-key string")
+	fmt.Println("        Access key S3 clients must sign with (requires -s3-secret-key)")
+	fmt.Println("  -s3-secret-key string")
+	fmt.Println("        Secret key S3 requests are verified against; without it any signature is accepted")
+	fmt.Println("  -copy-url")
+	fmt.Println("        Copy the server's LAN URL to the system clipboard at startup")
+	fmt.Println("  -quiet")
+	fmt.Println("        Only log errors and warnings")
+	fmt.Println("  -verbose")
+	fmt.Println("        Log every request with its status, size and timing")
+	fmt.Println("  -tui")
+	fmt.Println("        Show a live dashboard of transfers, clients and events in the terminal instead of log lines")
+	fmt.Println("  -tray")
+	fmt.Println("        Control the server from a system tray icon (builds with -tags tray only)")
 	fmt.Println("  -version")
 	fmt.Println("        Show version information")
 	fmt.Println("  -help")
@@ -51,6 +295,7 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Example:")
 	fmt.Println("  local-fileserver -port 9000 -dir /path/to/files -local=false")
+	fmt.Println("  tar cz mydir | local-fileserver -stdin -name backup.tgz")
 	fmt.Println()
 }
 
@@ -61,348 +306,107 @@ const htmlTemplate = `
 <head>
     <title>Local File Server</title>
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            max-width: 800px;
-            margin: 0 auto;
-            padding: 20px;
-        }
-        h1 {
-            color: #333;
-        }
-        .file {
-            margin: 5px 0;
-            padding: 8px;
-            background-color: #f5f5f5;
-            border-radius: 4px;
-        }
-        .file a {
-            text-decoration: none;
-            color: #0066cc;
-        }
-        .file a:hover {
-            text-decoration: underline;
-        }
-        .folder {
-            margin: 5px 0;
-            padding: 8px;
-            background-color: #e1f5fe;
-            border-radius: 4px;
-            cursor: pointer;
-        }
-        .folder-name {
-            font-weight: bold;
-            color: #0277bd;
-        }
-        .folder-icon:before {
-            content: "📁 ";
-        }
-        .folder-expanded .folder-icon:before {
-            content: "📂 ";
-        }
-        .children {
-            margin-left: 20px;
-            border-left: 1px solid #ccc;
-            padding-left: 10px;
-        }
-        .upload-form {
-            margin: 20px 0;
-            padding: 15px;
-            background-color: #e9e9e9;
-            border-radius: 5px;
-        }
-        .upload-button {
-            margin-top: 10px;
-            padding: 8px 16px;
-            background-color: #4CAF50;
-            color: white;
-            border: none;
-            border-radius: 4px;
-            cursor: pointer;
-        }
-        .upload-button:hover {
-            background-color: #45a049;
-        }
-        .breadcrumb {
-            margin-bottom: 15px;
-            padding: 8px;
-            background-color: #f0f0f0;
-            border-radius: 4px;
-        }
-        .breadcrumb a {
-            text-decoration: none;
-            color: #0066cc;
-        }
-        .breadcrumb a:hover {
-            text-decoration: underline;
-        }
-        .search-container {
-            margin: 15px 0;
-            display: flex;
-            align-items: center;
-        }
-        .search-input {
-            flex: 1;
-            padding: 8px 12px;
-            border: 1px solid #ccc;
-            border-radius: 4px;
-            font-size: 14px;
-        }
-        .search-input:focus {
-            border-color: #0066cc;
-            outline: none;
-        }
-        .clear-search {
-            margin-left: 8px;
-            padding: 8px 12px;
-            background-color: #f0f0f0;
-            border: none;
-            border-radius: 4px;
-            cursor: pointer;
-            font-size: 14px;
-        }
-        .clear-search:hover {
-            background-color: #e0e0e0;
-        }
-        .hidden {
-            display: none !important;
-        }
-        .folder-actions {
-            margin: 15px 0;
-            display: flex;
-            justify-content: flex-start;
-        }
-        .toggle-folders-button {
-            padding: 8px 16px;
-            background-color: #0277bd;
-            color: white;
-            border: none;
-            border-radius: 4px;
-            cursor: pointer;
-            font-size: 14px;
-        }
-        .toggle-folders-button:hover {
-            background-color: #015384;
-        }
-    </style>
-    <script>
-        function toggleFolder(path, event) {
-            // Stop event propagation to prevent parent folders from toggling
-            if (event) {
-                event.stopPropagation();
-            }
-            
-            const folder = document.getElementById('folder-' + path);
-            const children = document.getElementById('children-' + path);
-            
-            if (children.style.display === 'none') {
-                children.style.display = 'block';
-                folder.classList.add('folder-expanded');
-            } else {
-                children.style.display = 'none';
-                folder.classList.remove('folder-expanded');
-            }
-        }
-
-        // Function to filter files and folders as user types
-        function filterFileList() {
-            const searchTerm = document.getElementById('search-input').value.toLowerCase().trim();
-            const fileElements = document.querySelectorAll('.file');
-            const folderElements = document.querySelectorAll('.folder');
-            const noResultsMessage = document.getElementById('no-search-results');
-            const toggleButton = document.getElementById('toggle-folders-button');
-            
-            let visibleItems = 0;
-            let expandedFolders = 0;
-            let totalFolders = 0;
-            
-            // Function to check if text contains search term
-            const matchesSearch = (text) => text.toLowerCase().includes(searchTerm);
-            
-            // Filter files
-            fileElements.forEach(file => {
-                const fileName = file.querySelector('a').textContent;
-                const isMatch = searchTerm === '' || matchesSearch(fileName);
-                file.classList.toggle('hidden', !isMatch);
-                if (isMatch) visibleItems++;
-            });
-            
-            // Filter folders and their children
-            folderElements.forEach(folder => {
-                totalFolders++;
-                const folderName = folder.querySelector('.folder-name').textContent;
-                const isMatch = searchTerm === '' || matchesSearch(folderName);
-                const childrenContainer = document.getElementById('children-' + folder.id.substring(7)); // Remove 'folder-' prefix
-                
-                // Check if any children are visible when searching
-                let hasVisibleChildren = false;
-                if (childrenContainer) {
-                    const childFiles = childrenContainer.querySelectorAll('.file');
-                    const childFolders = childrenContainer.querySelectorAll('.folder');
-                    
-                    // Check child files
-                    childFiles.forEach(childFile => {
-                        const childFileName = childFile.querySelector('a').textContent;
-                        const childMatch = searchTerm === '' || matchesSearch(childFileName);
-                        childFile.classList.toggle('hidden', !childMatch);
-                        hasVisibleChildren = hasVisibleChildren || childMatch;
-                    });
-                    
-                    // Check child folders
-                    childFolders.forEach(childFolder => {
-                        const childFolderName = childFolder.querySelector('.folder-name').textContent;
-                        const childMatch = searchTerm === '' || matchesSearch(childFolderName);
-                        hasVisibleChildren = hasVisibleChildren || childMatch;
-                    });
-                }
-                
-                // Show folder if it matches search or has matching children
-                folder.classList.toggle('hidden', !isMatch && !hasVisibleChildren);
-                
-                // Expand folder if we're searching and there are matches inside
-                if (searchTerm !== '' && hasVisibleChildren) {
-                    childrenContainer.style.display = 'block';
-                    folder.classList.add('folder-expanded');
-                    expandedFolders++;
-                } else if (searchTerm === '') {
-                    // Restore collapsed state when search is cleared
-                    childrenContainer.style.display = 'none';
-                    folder.classList.remove('folder-expanded');
-                } else if (childrenContainer.style.display === 'block') {
-                    // Count already expanded folders
-                    expandedFolders++;
-                }
-                
-                if (isMatch || hasVisibleChildren) visibleItems++;
-            });
-            
-            // Update the global state and button text based on the actual state of folders
-            if (totalFolders > 0) {
-                // Update allFoldersExpanded based on if all folders are expanded
-                allFoldersExpanded = (expandedFolders === totalFolders);
-                
-                // Update button text to match current state
-                if (toggleButton) {
-                    toggleButton.textContent = allFoldersExpanded ? 'Collapse All Folders' : 'Expand All Folders';
-                }
-            }
-            
-            // Show a message if no results found
-            if (noResultsMessage) {
-                noResultsMessage.style.display = visibleItems > 0 ? 'none' : 'block';
-            }
-        }
-        
-        function clearSearch() {
-            const searchInput = document.getElementById('search-input');
-            searchInput.value = '';
-            filterFileList();
-            searchInput.focus();
-        }
-        
-        // Initialize search when the page loads
-        document.addEventListener('DOMContentLoaded', function() {
-            const searchInput = document.getElementById('search-input');
-            if (searchInput) {
-                searchInput.addEventListener('input', filterFileList);
-                searchInput.addEventListener('keydown', function(e) {
-                    // Clear search on Escape key
-                    if (e.key === 'Escape') {
-                        clearSearch();
-                    }
-                });
-            }
-            
-            const clearButton = document.getElementById('clear-search');
-            if (clearButton) {
-                clearButton.addEventListener('click', clearSearch);
-            }
-            
-            // Set up expand/collapse button functionality
-            const toggleFoldersButton = document.getElementById('toggle-folders-button');
-            if (toggleFoldersButton) {
-                toggleFoldersButton.addEventListener('click', toggleAllFolders);
-            }
-        });
-        
-        // Global variable to track current folder expansion state
-        let allFoldersExpanded = false;
-        
-        // Function to toggle all folders
-        function toggleAllFolders() {
-            const folderElements = document.querySelectorAll('.folder');
-            const toggleButton = document.getElementById('toggle-folders-button');
-            
-            // Toggle the global state
-            allFoldersExpanded = !allFoldersExpanded;
-            
-            // Update button text
-            if (toggleButton) {
-                toggleButton.textContent = allFoldersExpanded ? 'Collapse All Folders' : 'Expand All Folders';
-            }
-            
-            // For each folder, expand or collapse based on new state
-            folderElements.forEach(folder => {
-                const folderId = folder.id;
-                const folderPath = folderId.substring(7); // Remove 'folder-' prefix
-                const childrenContainer = document.getElementById('children-' + folderPath);
-                
-                if (childrenContainer) {
-                    childrenContainer.style.display = allFoldersExpanded ? 'block' : 'none';
-                    
-                    if (allFoldersExpanded) {
-                        folder.classList.add('folder-expanded');
-                    } else {
-                        folder.classList.remove('folder-expanded');
-                    }
-                }
-            });
-        }
-    </script>
+    <link rel="stylesheet" href="{{static "app.css"}}">
+    <script src="{{static "app.js"}}"></script>
 </head>
 <body>
     <h1>Local File Server</h1>
+
+    {{if .LowDisk}}
+    <div class="notice low-disk">
+        ⚠️ The server is running out of disk space: only {{.FreeSpace}} left. Uploads may fail.
+    </div>
+    {{end}}
+    {{if .Watch}}
+    <div id="changes-notice" class="notice" hidden>
+        Files in this folder changed. <a href="">Reload</a>
+    </div>
+    {{end}}
     
     <div class="upload-form">
-        <h3>Upload File</h3>
-        <form method="post" enctype="multipart/form-data">
-            <input type="file" name="file" required>
+        <h3>Upload Files</h3>
+        <form id="upload-form" method="post" enctype="multipart/form-data">
+            <input type="file" name="file" multiple required>
             <input type="hidden" name="path" value="{{.CurrentPath}}">
             <br>
+            <label>Delete after <input type="number" name="max_downloads" min="1" placeholder="∞" style="width: 60px;"> downloads</label>
+            <br>
+            <label><input type="checkbox" name="extract" value="1"> Extract zip/tar.gz archives after upload</label>
+            <br>
+            <label><input type="checkbox" name="share_code" value="1"> Get a code to receive it on another device</label>
+            <br>
+            <label>Send <input type="number" id="upload-parallel" min="1" max="8" value="2" style="width: 40px;"> files at a time</label>
+            <br>
             <button type="submit" class="upload-button">Upload</button>
         </form>
+        <ul id="upload-queue" class="upload-queue hidden"></ul>
+    </div>
+
+    {{with .ShareCode}}
+    <div class="notice share-code">
+        Enter <strong class="share-code-value">{{.Code}}</strong> under "Receive a file" on another device to get {{.Path}}. The code works until {{.Expires.Local.Format "15:04"}}.
+    </div>
+    {{end}}
+
+    <form class="receive-form" action="code" method="get">
+        <label>Receive a file: <input type="text" name="c" maxlength="8" placeholder="Code" autocomplete="off" autocapitalize="characters" required></label>
+        <button type="submit">Get</button>
+    </form>
+
+    <div id="pending-notice" class="notice hidden">
+        Your upload was received and is waiting for approval before it appears here.
     </div>
 
     {{if .CurrentPath}}
     <div class="breadcrumb">
-        <a href="/?path=">Home</a>
+        <a href="./?path=">Home</a>
         {{range $index, $part := .Breadcrumbs}}
-            / <a href="/?path={{$part.Path}}">{{$part.Name}}</a>
+            / <a href="./?path={{$part.Path}}">{{$part.Name}}</a>
         {{end}}
     </div>
     {{end}}
 
     <h3>Files and Folders</h3>
+    <p><a href="recent">Recently modified</a> | <a href="activity">Recent activity</a> | <a href="stats">Download statistics</a> | <a href="clipboard">Clipboard</a> | <a href="direct">Direct transfer</a>{{if .LoggedIn}} | <form class="logout-form" method="post" action="logout"><button type="submit">Log out</button></form>{{end}}</p>
     
-    <div class="search-container">
-        <input type="text" id="search-input" class="search-input" placeholder="Search files and folders..." autocomplete="off">
-        <button id="clear-search" class="clear-search" title="Clear search">✕</button>
-    </div>
+    <form class="search-container" action="search" method="get" title="Press Enter to search all subfolders">
+        <input type="text" id="search-input" name="q" class="search-input" placeholder="Search files and folders... (Enter searches all subfolders)" autocomplete="off">
+        <input type="hidden" name="path" value="{{.CurrentPath}}">
+        <button type="button" id="clear-search" class="clear-search" title="Clear search">✕</button>
+    </form>
     
     <div id="no-search-results" style="display: none;">
         <p>No files or folders match your search.</p>
     </div>
     
     <div class="folder-actions">
-        <button id="toggle-folders-button" class="toggle-folders-button">Expand All Folders</button>
+        {{if eq .View "list"}}<button id="toggle-folders-button" class="toggle-folders-button">Expand All Folders</button>{{end}}
+        <a href="checksums/{{.CurrentPath}}" class="extract-button" title="SHA-256 of every file in this folder, for sha256sum -c">SHA256SUMS</a>
+        <span class="view-switch">
+            View:
+            <a href="./?path={{.CurrentPath}}&view=list" class="{{if eq .View "list"}}active{{end}}" title="Details list">☰ List</a>
+            <a href="./?path={{.CurrentPath}}&view=grid" class="{{if eq .View "grid"}}active{{end}}" title="Icon grid">▦ Grid</a>
+        </span>
     </div>
     
     {{define "file_item"}}
         {{if .IsDir}}
             <div id="folder-{{.Path}}" class="folder" onclick="toggleFolder('{{.Path}}', event)">
+                <input type="checkbox" class="select-item" value="{{.Path}}" onclick="event.stopPropagation()">
                 <span class="folder-icon"></span>
-                <a href="/?path={{.Path}}" class="folder-name">{{.Name}}</a>
+                <a href="./?path={{.Path}}" class="folder-name">{{.Name}}</a>{{template "new_badge" .}}
+                <a href="archive/{{.Path}}" class="extract-button" title="Download this folder as a .zip" onclick="event.stopPropagation()">Download .zip</a>
+                <form method="post" action="compress" class="inline-form" onclick="event.stopPropagation()">
+                    <input type="hidden" name="path" value="{{.Path}}">
+                    <button type="submit" name="format" value="zip" class="extract-button" title="Save a .zip of this folder next to it">Create .zip</button>
+                </form>
+                <form method="post" action="duplicate" class="inline-form" onclick="event.stopPropagation()">
+                    <input type="hidden" name="path" value="{{.Path}}">
+                    <button type="submit" class="extract-button" title="Copy this folder next to it">Duplicate</button>
+                </form>
+                {{template "favorite_button" .}}
+                {{template "tag_list" .Tags}}
+                {{template "file_details" .}}
             </div>
             <div id="children-{{.Path}}" class="children" style="display: {{if .Expanded}}block{{else}}none{{end}};">
                 {{range .Children}}
@@ -411,28 +415,123 @@ const htmlTemplate = `
             </div>
         {{else}}
             <div class="file">
-                <a href="/download/{{.Path}}">{{.Name}}</a> ({{.Size}} bytes)
+                <input type="checkbox" class="select-item" value="{{.Path}}">
+                {{if .Thumbnail}}<img class="thumbnail" src="thumb/{{.Path}}" alt="" loading="lazy" onerror="thumbnailFailed(this)">{{else}}<span class="file-icon"></span>{{end}}
+                <a href="download/{{.Path}}">{{.Name}}</a>{{template "new_badge" .}} ({{.Size}} bytes)
+                {{if isVideo .Name}}<a href="play?path={{.Path}}" class="play-link" title="Play in the browser">▶ Play</a>{{end}}
+                {{if and .Thumbnail (isHEIC .Name)}}<a href="preview/{{.Path}}" class="play-link" title="View as JPEG; the original stays HEIC">▣ View</a>{{end}}
+                <a href="#" class="qr-link" title="Show QR code" onclick="showQR('{{.Path}}', event)">▦ QR</a>
+                {{if .Torrent}}<a href="torrent/{{.Path}}" class="torrent-link" title="Download with BitTorrent, sharing pieces with other receivers">⇶ Torrent</a>{{end}}
+                {{if isArchive .Name}}
+                <form method="post" action="extract" class="inline-form">
+                    <input type="hidden" name="path" value="{{.Path}}">
+                    <button type="submit" class="extract-button" title="Extract into this folder">Extract here</button>
+                </form>
+                {{end}}
+                <form method="post" action="duplicate" class="inline-form">
+                    <input type="hidden" name="path" value="{{.Path}}">
+                    <button type="submit" class="extract-button" title="Copy this file next to it">Duplicate</button>
+                </form>
+                {{template "favorite_button" .}}
+                {{template "tag_list" .Tags}}
+                {{template "file_details" .}}
             </div>
         {{end}}
     {{end}}
+
+    {{define "file_details"}}
+        <button class="details-button" title="Show details" onclick="toggleDetails(this, event)">ⓘ</button>
+        <dl class="details hidden" onclick="event.stopPropagation()">
+            <dt>Modified</dt><dd>{{.ModTime.Format "2006-01-02 15:04:05"}}</dd>
+            <dt>Permissions</dt><dd><code>{{.Mode}}</code></dd>
+            {{if .Owner}}<dt>Owner</dt><dd>{{.Owner}}</dd>{{end}}
+            {{if .MimeType}}<dt>Type</dt><dd>{{.MimeType}}</dd>{{end}}
+            {{if not .IsDir}}<dt>Size</dt><dd>{{.Size}} bytes</dd>{{else if .TreeFiles}}<dt>Size</dt><dd>{{.TreeSize}} bytes in {{.TreeFiles}} file(s)</dd>{{end}}
+        </dl>
+    {{end}}
+
+    {{define "favorite_button"}}
+        <button class="favorite-button" title="{{if .Favorite}}Unpin from{{else}}Pin to{{end}} favorites" onclick="toggleFavorite('{{.Path}}', {{.Favorite}}, event)">{{if .Favorite}}★{{else}}☆{{end}}</button>
+    {{end}}
+
+    {{define "new_badge"}}
+        {{if .New}}<span class="new-badge" title="Added or changed since your last visit">new</span>{{end}}
+    {{end}}
+
+    {{define "tag_list"}}
+        {{range .}}<a href="search?tag={{.}}" class="tag" onclick="event.stopPropagation()">#{{.}}</a>{{end}}
+    {{end}}
+
+    <form id="bulk-tag-form" class="bulk-actions hidden" method="post" action="tags" onsubmit="return collectSelection(this)">
+        <span id="selection-count"></span>
+        <input type="text" name="add" placeholder="Add tags (comma separated)">
+        <input type="text" name="remove" placeholder="Remove tags">
+        <input type="hidden" name="current" value="{{.CurrentPath}}">
+        <button type="submit" class="toggle-folders-button">Apply tags</button>
+    </form>
     
+    {{if .Favorites}}
+    <div class="favorites">
+        <h4>★ Favorites</h4>
+        {{range .Favorites}}
+            {{if .IsDir}}
+            <div class="favorite-item">
+                📁 <a href="./?path={{.Path}}" class="folder-name">{{.Name}}</a>
+                {{template "favorite_button" .}}
+                {{template "tag_list" .Tags}}
+            </div>
+            {{else}}
+            <div class="favorite-item">
+                <a href="download/{{.Path}}">{{.Name}}</a>{{template "new_badge" .}} ({{.Size}} bytes)
+                {{template "favorite_button" .}}
+                {{template "tag_list" .Tags}}
+            </div>
+            {{end}}
+        {{end}}
+    </div>
+    {{end}}
+
+    <div id="file-listing" class="listing view-{{.View}}" data-path="{{.CurrentPath}}" data-next="{{.Next}}">
     {{range .Files}}
         {{template "file_item" .}}
     {{else}}
         <p>No files found</p>
     {{end}}
+    </div>
+    {{if ge .Next 0}}
+    <div id="listing-more" class="listing-more">Loading more...</div>
+    {{end}}
+
+    <div id="qr-modal" class="qr-modal hidden" onclick="hideQR()">
+        <div class="qr-box">
+            <img id="qr-image" alt="QR code">
+            <p id="qr-name"></p>
+        </div>
+    </div>
 </body>
 </html>
 `
 
 // FileInfo represents a file or directory in the downloads directory
 type FileInfo struct {
-	Name     string
-	Size     int64
-	IsDir    bool
-	Path     string
-	Children []FileInfo
-	Expanded bool
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	IsDir     bool       `json:"is_dir"`
+	Path      string     `json:"path"`
+	Children  []FileInfo `json:"children,omitempty"`
+	Expanded  bool       `json:"-"`
+	Tags      []string   `json:"tags,omitempty"`
+	Favorite  bool       `json:"favorite"`
+	New       bool       `json:"new,omitempty"`
+	Thumbnail bool       `json:"thumbnail,omitempty"`
+	TreeSize  int64      `json:"tree_size,omitempty"`
+	TreeFiles int        `json:"tree_files,omitempty"`
+	Torrent   bool       `json:"torrent,omitempty"`
+	ModTime   time.Time  `json:"mod_time"`
+	Mode      string     `json:"mode"`
+	Owner     string     `json:"owner,omitempty"`
+	MimeType  string     `json:"mime_type,omitempty"`
+	Snippet   *Snippet   `json:"snippet,omitempty"`
 }
 
 // BreadcrumbItem represents a path segment for navigation
@@ -464,9 +563,61 @@ func safeJoinPath(baseDir, userPath string) (string, error) {
 		return "", fmt.Errorf("path escapes the base directory")
 	}
 
+	// Windows maps device names to devices in any folder and ignores
+	// trailing dots and spaces, so such components would not name the
+	// file they appear to
+	if windowsPaths && relPath != "." {
+		for _, part := range strings.Split(relPath, string(filepath.Separator)) {
+			if isWindowsReservedName(part) {
+				return "", fmt.Errorf("%q is a reserved device name", part)
+			}
+			if strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+				return "", fmt.Errorf("%q ends with a dot or space", part)
+			}
+		}
+	}
+
 	return fullPath, nil
 }
 
+// Normalize a user supplied relative path to a clean slash separated form
+// without leading or trailing slashes, for use as a key in persistent stores
+func cleanRelPath(p string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean("/"+p)), "/")
+}
+
+// Build a Content-Disposition header that works for any file name: a plain
+// ASCII fallback for old clients plus the RFC 5987 UTF-8 encoded form
+func contentDisposition(disposition, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	for _, b := range []byte(filename) {
+		if isRFC5987AttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), encoded.String())
+}
+
+// Characters allowed unencoded in an RFC 5987 ext-value
+func isRFC5987AttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) != -1
+}
+
 // Generate breadcrumb items for navigation
 func generateBreadcrumbs(path string) []BreadcrumbItem {
 	if path == "" {
@@ -504,14 +655,39 @@ func generateBreadcrumbs(path string) []BreadcrumbItem {
 	return result
 }
 
-// List files and directories with their children recursively up to a specified depth
-func listFilesRecursive(baseDir, relativePath string, depth int) ([]FileInfo, error) {
-	currentPath, err := safeJoinPath(baseDir, relativePath)
-	if err != nil {
-		return nil, err
+// Folders read at the same time across all listings. Reading a folder waits
+// on the disk or, for an NFS or SMB mount, on the network, so this is well
+// above the number of cores of a small board.
+const listWorkers = 16
+
+var listSlots = make(chan struct{}, listWorkers)
+
+// Run fn on a free listing worker, or in the calling goroutine when all are
+// busy so nested walks never wait on each other for a worker
+func goList(wg *sync.WaitGroup, fn func()) {
+	select {
+	case listSlots <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-listSlots }()
+			fn()
+		}()
+	default:
+		fn()
+	}
+}
+
+// List files and directories with their children recursively up to a
+// specified depth. Subfolders are read concurrently.
+func listFilesRecursive(fsys fs.FS, relativePath string, depth int) ([]FileInfo, error) {
+	// Rooting the path keeps it inside fsys
+	dir := cleanRelPath(relativePath)
+	if dir == "" {
+		dir = "."
 	}
 
-	entries, err := os.ReadDir(currentPath)
+	entries, err := fs.ReadDir(fsys, dir)
 	if err != nil {
 		return nil, err
 	}
@@ -528,24 +704,25 @@ func listFilesRecursive(baseDir, relativePath string, depth int) ([]FileInfo, er
 			entryPath = entry.Name()
 		}
 
-		fileInfo := FileInfo{
-			Name:     entry.Name(),
-			Size:     info.Size(),
-			IsDir:    entry.IsDir(),
-			Path:     entryPath,
-			Expanded: false,
-			Children: []FileInfo{},
-		}
+		fileInfo := newFileInfo(entry.Name(), entryPath, info)
+		fileInfo.Children = []FileInfo{}
+		result = append(result, fileInfo)
+	}
 
-		// If it's a directory and we haven't reached the max depth, get its children
-		if entry.IsDir() && depth > 0 {
-			children, err := listFilesRecursive(baseDir, entryPath, depth-1)
-			if err == nil {
-				fileInfo.Children = children
+	// If we haven't reached the max depth, get the children of directories
+	if depth > 0 {
+		var wg sync.WaitGroup
+		for i := range result {
+			if !result[i].IsDir {
+				continue
 			}
+			goList(&wg, func() {
+				if children, err := listFilesRecursive(fsys, result[i].Path, depth-1); err == nil {
+					result[i].Children = children
+				}
+			})
 		}
-
-		result = append(result, fileInfo)
+		wg.Wait()
 	}
 
 	return result, nil
@@ -560,7 +737,7 @@ func isLocalIP(addr string) bool {
 
 	// Localhost
 	if ip.IsLoopback() {
-		log.Printf("IP %v is loopback", ip)
+		debugf("IP %v is loopback", ip)
 		return true
 	}
 
@@ -571,11 +748,12 @@ func isLocalIP(addr string) bool {
 		mustParseCIDR("192.168.0.0/16"), // RFC1918
 		mustParseCIDR("169.254.0.0/16"), // RFC3927 (Link-local)
 		mustParseCIDR("fd00::/8"),       // RFC4193 (Unique local IPv6)
+		mustParseCIDR("fe80::/10"),      // RFC4291 (Link-local IPv6)
 	}
 
 	for _, block := range privateIPBlocks {
 		if block.Contains(ip) {
-			log.Printf("IP %v is in private range %v", ip, block)
+			debugf("IP %v is in private range %v", ip, block)
 			return true
 		}
 	}
@@ -583,6 +761,17 @@ func isLocalIP(addr string) bool {
 	return false
 }
 
+// Whether a flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // Helper function to parse CIDR strings
 func mustParseCIDR(s string) *net.IPNet {
 	_, block, err := net.ParseCIDR(s)
@@ -592,17 +781,92 @@ func mustParseCIDR(s string) *net.IPNet {
 	return block
 }
 
-// Local network filtering middleware
+// Network the server listens on: "tcp" for both IPv4 and IPv6, or "tcp4"
+// or "tcp6" for one of them
+var listenNetwork = "tcp"
+
+// Pick the listening network from -ip-version
+func setListenNetwork(version string) error {
+	switch version {
+	case "dual", "":
+		listenNetwork = "tcp"
+	case "4":
+		listenNetwork = "tcp4"
+	case "6":
+		listenNetwork = "tcp6"
+	default:
+		return fmt.Errorf("invalid -ip-version %q: use 4, 6 or dual", version)
+	}
+	return nil
+}
+
+// Get the non-loopback addresses of this machine the server listens on,
+// IPv4 first. IPv6 link-local addresses are left out as they only work in
+// a URL along with the interface name.
+func lanAddresses() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Error getting network interfaces: %v", err)
+		return nil
+	}
+
+	var ips, ipv6 []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		switch {
+		case ipnet.IP.To4() != nil:
+			if listenNetwork != "tcp6" {
+				ips = append(ips, ipnet.IP)
+			}
+		case !ipnet.IP.IsLinkLocalUnicast():
+			if listenNetwork != "tcp4" {
+				ipv6 = append(ipv6, ipnet.IP)
+			}
+		}
+	}
+	return append(ips, ipv6...)
+}
+
+// URL of the server at host, which may be an IPv6 address
+func serverURL(scheme, host string, port int, base string) string {
+	return fmt.Sprintf("%s://%s%s/", scheme, net.JoinHostPort(host, strconv.Itoa(port)), base)
+}
+
+// Get client IP by stripping port number if present, along with the
+// brackets and zone of an IPv6 address
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if i := strings.Index(ip, "%"); i != -1 {
+		ip = ip[:i]
+	}
+	return ip
+}
+
+// Check if r comes from this machine, which is trusted to manage the
+// server. Never true while a tunnel forwards the internet to localhost.
+func fromThisMachine(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && ip.IsLoopback() && !tunnelOpen.Load()
+}
+
+// Local network filtering middleware. Requests authorized by a signed URL
+// or API key are allowed from anywhere, and -listen can turn the filter on
+// or off for one address.
 func localNetworkFilter(next http.Handler, localOnly bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localOnly := localOnly
+		if addr, ok := listenAddr(r); ok && addr.LocalOnly != nil {
+			localOnly = *addr.LocalOnly
+		}
 		if localOnly {
-			// Get client IP by stripping port number if present
-			clientIP := r.RemoteAddr
-			if i := strings.LastIndex(clientIP, ":"); i != -1 {
-				clientIP = clientIP[:i]
-			}
-
-			if !isLocalIP(clientIP) {
+			clientIP := clientIP(r)
+			if _, granted := accessGrant(r); !isLocalIP(clientIP) && !granted {
 				http.Error(w, "Access denied: only local network connections are allowed", http.StatusForbidden)
 				log.Printf("Blocked access from non-local IP: %s", clientIP)
 				return
@@ -613,6 +877,17 @@ func localNetworkFilter(next http.Handler, localOnly bool) http.Handler {
 }
 
 func main() {
+	// put, get and ls talk to another server instead of running one
+	if len(os.Args) > 1 {
+		switch command := os.Args[1]; command {
+		case "put", "get", "ls":
+			if err := runClientCommand(command, os.Args[2:]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
+
 	// Set up configuration with flags
 	config := Config{}
 
@@ -626,11 +901,106 @@ func main() {
 	downloadsDir := filepath.Join(usr.HomeDir, "Downloads")
 
 	flag.IntVar(&config.Port, "port", 8080, "Port to serve on")
+	flag.Var(&config.Listen, "listen", "Listen on host:port instead of -port, followed by options tls, noauth, local or remote, e.g. localhost:8080,noauth (repeatable)")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "Certificate file for serving HTTPS")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "Private key file for -tls-cert")
+	flag.StringVar(&config.ACME, "acme", "", "Comma separated host names to get HTTPS certificates for from Let's Encrypt, serving on port 443 unless -port or -listen is set")
+	flag.StringVar(&config.ACMEEmail, "acme-email", "", "Contact address for Let's Encrypt expiry notices")
+	flag.StringVar(&config.IPVersion, "ip-version", "dual", "Listen on IPv4 only (4), IPv6 only (6) or both (dual)")
 	flag.StringVar(&config.DownloadDir, "dir", downloadsDir, "Directory to serve files from")
+	flag.StringVar(&config.DataDir, "data-dir", filepath.Join(usr.HomeDir, ".local-fileserver"), "Directory for server state such as download statistics")
 	flag.BoolVar(&config.LocalOnly, "local", true, "Restrict access to local network only")
+	flag.BoolVar(&config.Stdin, "stdin", false, "Serve data piped from stdin as a single downloadable file")
+	flag.StringVar(&config.StdinName, "name", defaultStdinName, "File name to use for data read with -stdin")
+	flag.BoolVar(&config.Expose, "expose", false, "Request a temporary port mapping on the router via NAT-PMP or UPnP")
+	flag.DurationVar(&config.ExposeTTL, "expose-ttl", time.Hour, "How long the router port mapping should last")
+	flag.StringVar(&config.Tunnel, "tunnel", "", "Open a reverse SSH tunnel to user@host for public sharing")
+	flag.IntVar(&config.TunnelPort, "tunnel-port", 80, "Remote port to forward through the tunnel")
+	flag.StringVar(&config.NotifySlack, "notify-slack", "", "Slack incoming webhook URL to notify about file events")
+	flag.StringVar(&config.NotifyDiscord, "notify-discord", "", "Discord webhook URL to notify about file events")
+	flag.StringVar(&config.NotifyMatrix, "notify-matrix", "", "Matrix room send URL to notify about file events")
+	flag.StringVar(&config.NotifyEvents, "notify-events", "upload,low-disk", "Comma separated event types to notify about: upload, download, delete, low-disk, change")
+	flag.Var(&config.ExpireAfter, "expire-after", "Delete files older than this, e.g. 7d, or only in a subfolder with folder=12h (repeatable)")
+	flag.BoolVar(&config.Quarantine, "quarantine", false, "Hold uploads for approval in the admin dashboard before they become visible")
+	flag.StringVar(&config.AllowUploadTypes, "allow-upload-types", "", "Comma separated extensions and MIME types that may be uploaded")
+	flag.StringVar(&config.DenyUploadTypes, "deny-upload-types", "", "Comma separated extensions and MIME types that may not be uploaded")
+	flag.StringVar(&config.EncryptDir, "encrypt-dir", "", "Subfolder whose uploads are encrypted at rest and decrypted on download")
+	flag.StringVar(&config.EncryptKeyFile, "encrypt-key-file", "", "File holding the hex encoded AES-256 key for -encrypt-dir, generated if missing")
+	flag.StringVar(&config.DedupDir, "dedup-dir", "", "Subfolder whose uploads are stored as deduplicated chunks in the data directory")
+	flag.StringVar(&config.URLSecret, "url-secret", os.Getenv("LOCAL_FILESERVER_URL_SECRET"), "Shared secret for HMAC signed URLs")
+	flag.StringVar(&config.Sign, "sign", "", "Print a signed URL for this path and exit")
+	flag.DurationVar(&config.SignTTL, "sign-ttl", 24*time.Hour, "How long a URL printed by -sign stays valid")
+	flag.StringVar(&config.SignStart, "sign-start", "", "When a URL printed by -sign becomes valid, e.g. 2024-06-08T18:00 in local time")
+	flag.BoolVar(&config.SignPost, "sign-upload", false, "Sign the URL given to -sign for uploading (POST) instead of downloading")
+	flag.BoolVar(&config.Verify, "verify", false, "Re-hash the served files, report any that changed since their checksums were recorded, and exit")
+	flag.StringVar(&config.APIKeysFile, "api-keys", "", "JSON file of API keys with read/write/admin scopes")
+	flag.StringVar(&config.Password, "password", os.Getenv("LOCAL_FILESERVER_PASSWORD"), "Require logging in with this password")
+	flag.BoolVar(&config.TOTP, "totp", false, "Also require a code from an authenticator app when logging in")
+	flag.StringVar(&config.Public, "public", "", "Comma separated folders anyone may browse and download from without the password")
+	flag.BoolVar(&config.AccessFiles, "access-files", false, "Enforce per-folder .access files listing who may read or write each subtree")
+	flag.IntVar(&config.LockoutAttempts, "lockout-attempts", 5, "Failed authentication attempts before a client is locked out, 0 to disable")
+	flag.DurationVar(&config.LockoutDuration, "lockout-duration", 15*time.Minute, "How long locked out clients are blocked")
+	flag.BoolVar(&config.Debug, "debug", false, "Serve pprof profiling endpoints on a localhost-only listener")
+	flag.StringVar(&config.DebugAddr, "debug-addr", "127.0.0.1:6060", "Loopback address for the -debug listener")
+	flag.StringVar(&config.Hook, "hook", "", "Command run at upload, download and listing hook points")
+	flag.StringVar(&config.Favicon, "favicon", "", "Icon file to serve instead of the built-in favicon")
+	flag.BoolVar(&config.HardlinkCopies, "hardlink-copies", false, "Duplicate files as hard links when possible")
+	flag.StringVar(&config.MinFreeSpace, "min-free-space", "1GB", "Warn when free disk space drops below this, 0 to disable")
+	flag.DurationVar(&config.IndexInterval, "index-interval", 0, "Walk the folder at startup and then this often to warm caches and total up folder sizes")
+	flag.BoolVar(&config.Watch, "watch", false, "Follow changes on disk to update open pages and notify about files added by other programs")
+	flag.IntVar(&config.MaxClientDownloads, "max-client-downloads", 0, "Simultaneous downloads allowed per client IP, 0 for no limit")
+	flag.StringVar(&config.MaxBandwidth, "max-bandwidth", "0", "Total download rate per second, shared evenly by running downloads, 0 for no limit")
+	flag.StringVar(&config.MaxBytes, "max-bytes", "0", "Total bytes downloads may send, after which further downloads are refused, 0 for no limit")
+	flag.BoolVar(&config.MaxBytesExit, "max-bytes-exit", false, "Shut the server down once -max-bytes is used up instead of only refusing downloads")
+	flag.StringVar(&config.ThumbnailCache, "thumbnail-cache", "1GB", "Most disk space video thumbnails and converted photos may take up, e.g. 500MB, 0 for no limit")
+	flag.BoolVar(&config.Transcode, "transcode", false, "Convert videos the browser can't play with ffmpeg when they are played")
+	flag.IntVar(&config.TranscodeJobs, "transcode-jobs", 2, "Conversions each visitor may have running at once with -transcode")
+	flag.StringVar(&config.MmapCache, "mmap-cache", "0", "Memory for keeping small files such as thumbnails mapped, 0 to disable")
+	flag.StringVar(&config.AllowedHosts, "allowed-hosts", "", "Comma separated extra host names the server answers to, * for any")
+	flag.StringVar(&config.Hours, "hours", "", "Only answer other machines during this daily window in local time, e.g. 08:00-22:00")
+	flag.StringVar(&config.BasePath, "base-path", "", "URL prefix the server is mounted under, e.g. /files")
+	flag.BoolVar(&config.Git, "git", false, "Serve git repositories in the folder read-only over git's dumb HTTP protocol")
+	flag.BoolVar(&config.AppendOnly, "append-only", false, "Never overwrite or delete files; uploads with an existing name are versioned")
+	flag.BoolVar(&config.Torrent, "torrent", false, "Offer .torrent files with this server as web seed and tracker")
+	flag.StringVar(&config.Mirror, "mirror", "", "Periodically pull new and changed files from another instance")
+	flag.DurationVar(&config.MirrorInterval, "mirror-interval", 5*time.Minute, "How often to pull from the -mirror instance")
+	flag.StringVar(&config.MirrorKey, "mirror-key", "", "API key to send to the -mirror instance")
+	flag.BoolVar(&config.S3, "s3", false, "Serve a minimal S3 compatible API with top-level folders as buckets")
+	flag.StringVar(&config.S3AccessKey, "s3-access-key", "", "Access key S3 clients must sign with")
+	flag.StringVar(&config.S3SecretKey, "s3-secret-key", "", "Secret key S3 request signatures are verified against")
+	flag.BoolVar(&config.CopyURL, "copy-url", false, "Copy the server's LAN URL to the system clipboard at startup")
+	flag.BoolVar(&config.Quiet, "quiet", false, "Only log errors and warnings")
+	flag.BoolVar(&config.Verbose, "verbose", false, "Log every request with its status, size and timing")
+	flag.BoolVar(&config.TUI, "tui", false, "Show a live dashboard in the terminal instead of log lines")
+	flag.BoolVar(&config.Tray, "tray", false, "Control the server from a system tray icon")
 	flag.BoolVar(&config.ShowVersion, "version", false, "Show version information")
 	flag.BoolVar(&config.ShowHelp, "help", false, "Show this help message")
-	flag.Parse()
+
+	// "config export" and "config import" take the same options as the
+	// server, so they see the configuration it would run with
+	args, configCmd := os.Args[1:], ""
+	if len(args) > 0 && args[0] == "config" {
+		if len(args) < 2 {
+			log.Fatalf("Usage: local-fileserver config export|import [options]")
+		}
+		configCmd, args = args[1], args[2:]
+	}
+	flag.CommandLine.Parse(args)
+
+	// Settings saved with "config import" fill in what the command line
+	// and the environment leave out. Importing replaces them, so a broken
+	// file can be fixed that way.
+	if configCmd != "import" {
+		if err := loadConfigFile(config.DataDir); err != nil {
+			log.Fatalf("Error loading %s: %v", filepath.Join(config.DataDir, configFileName), err)
+		}
+	}
+	if configCmd != "" {
+		if err := runConfigCommand(configCmd, flag.Args(), config.DataDir); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
 
 	// Show version information and exit if requested
 	if config.ShowVersion {
@@ -644,185 +1014,239 @@ func main() {
 		return
 	}
 
-	// Ensure the download directory exists
-	if _, err := os.Stat(config.DownloadDir); os.IsNotExist(err) {
-		log.Fatalf("Download directory does not exist: %s", config.DownloadDir)
+	if config.Quiet && config.Verbose {
+		log.Fatalf("-quiet and -verbose cannot be used together")
 	}
-
-	// Parse the HTML template
-	tmpl, err := template.New("fileList").Parse(htmlTemplate)
-	if err != nil {
-		log.Fatalf("Error parsing template: %v", err)
+	setLogLevel(config.Quiet, config.Verbose)
+	if err := setListenNetwork(config.IPVersion); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
 
-	// Set up handlers
-
-	// Handler for the home page (file listing and upload form)
-	homeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
+	// Without -listen, serve on -port on all interfaces
+	domains := acmeDomains(config.ACME)
+	if len(config.Listen) == 0 {
+		// Let's Encrypt only checks domains on port 443
+		if len(domains) > 0 && !flagSet("port") {
+			config.Port = 443
 		}
-
-		// Get the requested path from query parameter
-		requestedPath := r.URL.Query().Get("path")
-		// Clean and validate the path
-		requestedPath = strings.TrimPrefix(requestedPath, "/")
-
-		if r.Method == "POST" {
-			// Handle file upload
-			file, header, err := r.FormFile("file")
-			if err != nil {
-				http.Error(w, "Error retrieving file from form: "+err.Error(), http.StatusBadRequest)
-				return
-			}
-			defer file.Close()
-
-			// Get the target path for uploading
-			targetPath := r.FormValue("path")
-
-			// Create the target directory if it doesn't exist yet
-			uploadDir, err := safeJoinPath(config.DownloadDir, targetPath)
-			if err != nil {
-				http.Error(w, "Invalid upload path: "+err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			// Make sure the directory exists
-			err = os.MkdirAll(uploadDir, 0755)
-			if err != nil {
-				http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// Create a new file in the target directory
-			filename := filepath.Join(uploadDir, header.Filename)
-			out, err := os.Create(filename)
-			if err != nil {
-				http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer out.Close()
-
-			// Copy the uploaded file to the destination file
-			_, err = io.Copy(out, file)
-			if err != nil {
-				http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
-				return
+		config.Listen = ListenAddrs{{Addr: fmt.Sprintf(":%d", config.Port), TLS: config.TLSCert != "" || len(domains) > 0}}
+	} else {
+		// Port mappings and tunnels forward to the first address
+		config.Port = config.Listen[0].Port()
+	}
+	var tlsConfig *tls.Config
+	if len(domains) > 0 {
+		if config.TLSCert != "" {
+			log.Fatalf("-acme and -tls-cert cannot be used together")
+		}
+		if config.LocalOnly {
+			log.Printf("Warning: -acme is set but -local is true, so visitors from the internet will be blocked")
+		}
+		tlsConfig = acmeTLSConfig(domains, config.ACMEEmail, config.DataDir)
+	}
+	for _, addr := range config.Listen {
+		if addr.TLS && tlsConfig == nil {
+			if tlsConfig, err = loadTLSConfig(config.TLSCert, config.TLSKey); err != nil {
+				log.Fatalf("Error loading TLS certificate: %v", err)
 			}
+		}
+	}
 
-			log.Printf("File uploaded successfully: %s to %s", header.Filename, targetPath)
-
-			// Redirect back to the same path
-			redirectURL := "/"
-			if targetPath != "" {
-				redirectURL += "?path=" + targetPath
+	// Print a signed URL and exit if requested
+	if config.Sign != "" {
+		if config.URLSecret == "" {
+			log.Fatalf("-sign requires -url-secret")
+		}
+		method := "GET"
+		if config.SignPost {
+			method = "POST"
+		}
+		var starts time.Time
+		if config.SignStart != "" {
+			var err error
+			if starts, err = parseLocalTime(config.SignStart); err != nil {
+				log.Fatalf("Invalid -sign-start: %v", err)
 			}
-			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
-			return
 		}
-
-		// For GET requests, list files and directories
-		files, err := listFilesRecursive(config.DownloadDir, requestedPath, 10)
+		signed, err := newURLSigner(config.URLSecret).Sign(method, config.Sign, starts, config.SignTTL)
 		if err != nil {
-			http.Error(w, "Error reading directory: "+err.Error(), http.StatusInternalServerError)
-			return
+			log.Fatalf("Error signing URL: %v", err)
 		}
+		// Paths are signed as seen after the prefix is stripped
+		if strings.HasPrefix(signed, "/") {
+			signed = cleanBasePath(config.BasePath) + signed
+		}
+		fmt.Println(signed)
+		return
+	}
 
-		// Generate breadcrumbs for navigation
-		breadcrumbs := generateBreadcrumbs(requestedPath)
-
-		// Render the template
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		err = tmpl.Execute(w, struct {
-			Files       []FileInfo
-			CurrentPath string
-			Breadcrumbs []BreadcrumbItem
-		}{
-			Files:       files,
-			CurrentPath: requestedPath,
-			Breadcrumbs: breadcrumbs,
-		})
-
+	// Check the served files against their recorded checksums and exit,
+	// failing if any are corrupted or missing
+	if config.Verify {
+		if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+			log.Fatalf("Error creating data directory: %v", err)
+		}
+		checksums, err := openChecksumStore(config.DataDir)
 		if err != nil {
-			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
-			return
+			log.Fatalf("Error loading checksums: %v", err)
 		}
-	})
-
-	// Handler for downloading files
-	downloadHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		filePath := strings.TrimPrefix(r.URL.Path, "/download/")
-		if filePath == "" {
-			http.Error(w, "No file specified", http.StatusBadRequest)
-			return
+		report, err := checksums.Verify(config.DownloadDir, "")
+		if err != nil {
+			log.Fatalf("Error verifying files: %v", err)
 		}
+		report.WriteText(os.Stdout)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		return
+	}
 
-		// Get the full path in a safe way, preventing directory traversal
-		fullPath, err := safeJoinPath(config.DownloadDir, filePath)
-		if err != nil {
-			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
-			return
+	// The tray icon runs the server itself, with the same options
+	if config.Tray {
+		if config.Stdin {
+			log.Fatalf("-tray and -stdin cannot be used together")
 		}
+		if err := runTray(config, args); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
 
-		// Check if the file exists
-		fileInfo, err := os.Stat(fullPath)
+	// Spool piped data into a temporary directory and serve that instead
+	if config.Stdin {
+		stdinDir, err := spoolStdin(os.Stdin, config.StdinName)
 		if err != nil {
-			if os.IsNotExist(err) {
-				http.Error(w, "File not found", http.StatusNotFound)
-			} else {
-				http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
-			}
-			return
+			log.Fatalf("Error reading from stdin: %v", err)
 		}
+		config.DownloadDir = stdinDir
+		onExit(func() { os.RemoveAll(stdinDir) })
+	}
 
-		// Check if it's a regular file
-		if fileInfo.IsDir() {
-			http.Error(w, "Cannot download directories", http.StatusBadRequest)
-			return
-		}
+	// External hook process for custom behavior
+	if config.Hook != "" {
+		registerExternalHook(config.Hook)
+	}
 
-		// Set headers for file download
-		filename := filepath.Base(filePath)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	server, err := NewServer(config, nil)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Visitors arrive with the names the certificates are for
+	for _, domain := range domains {
+		server.AllowHost(domain)
+	}
 
-		// Serve the file
-		http.ServeFile(w, r, fullPath)
-		log.Printf("File downloaded: %s", filePath)
-	})
+	// A used up transfer budget ends the process rather than waiting
+	// for a restart to reset it
+	if config.MaxBytesExit && server.budget != nil {
+		go func() {
+			<-server.budget.Done()
+			logf("Shutting down: transfer budget used up")
+			runCleanup()
+			os.Exit(0)
+		}()
+	}
 
-	// Set up the server with local network filtering
-	mux := http.NewServeMux()
-	mux.Handle("/", localNetworkFilter(homeHandler, config.LocalOnly))
-	mux.Handle("/download/", localNetworkFilter(downloadHandler, config.LocalOnly))
+	logf("Starting file server on %s", &config.Listen)
+	logf("Serving files from: %s", config.DownloadDir)
+	logf("Local network access only: %v", config.LocalOnly)
+
+	// Print potential URLs to access the server, with localhost always
+	// shown as an option. Certificates from Let's Encrypt only cover the
+	// -acme names, so those come first.
+	base := cleanBasePath(config.BasePath)
+	var urls []string
+	for _, domain := range domains {
+		urls = append(urls, serverURL("https", domain, config.Port, base))
+	}
+	urls = append(urls, accessURLs(config.Listen, base)...)
+	for _, u := range urls {
+		logf("Access the server at: %s", u)
+	}
 
-	// Get the IP address of this machine to display in the startup message
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		log.Printf("Error getting network interfaces: %v", err)
+	// Put the URL other devices can use on the clipboard, ready to paste
+	if config.CopyURL {
+		copied := urls[0]
+		if err := copyToClipboard(copied); err != nil {
+			log.Printf("Error copying URL to the clipboard: %v", err)
+		} else {
+			logf("Copied %s to the clipboard", copied)
+		}
 	}
 
-	log.Printf("Starting file server on port %d", config.Port)
-	log.Printf("Serving files from: %s", config.DownloadDir)
-	log.Printf("Local network access only: %v", config.LocalOnly)
+	// Ask the router to forward a port for off-LAN sharing
+	if config.Expose {
+		if config.LocalOnly {
+			log.Printf("Warning: -expose is set but -local is true, so external visitors will be blocked")
+		}
+		mapping, err := exposePort(config.Port, config.ExposeTTL)
+		if err != nil {
+			log.Printf("Error requesting port mapping: %v", err)
+		} else {
+			logf("Port mapping created via %s for %v", mapping.Method, mapping.TTL)
+			if mapping.ExternalIP != nil {
+				logf("Access the server externally at: http://%s:%d", mapping.ExternalIP, mapping.ExternalPort)
+			} else {
+				log.Printf("External port %d mapped, but the router did not report its external IP", mapping.ExternalPort)
+			}
+			onExit(func() {
+				if err := mapping.Remove(); err != nil {
+					log.Printf("Error removing port mapping: %v", err)
+				}
+			})
+		}
+	}
 
-	// Print potential URLs to access the server
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-			log.Printf("Access the server at: http://%s:%d", ipnet.IP.String(), config.Port)
+	// Open an outbound tunnel for sharing outside the local network
+	if config.Tunnel != "" {
+		// Tunneled connections arrive from localhost, so -local cannot filter them
+		log.Printf("Warning: visitors through the tunnel appear as localhost and bypass -local")
+		tunnel, err := openTunnel(config.Tunnel, config.TunnelPort, config.Port, func(publicURL string) {
+			// Visitors arrive with the tunnel's public host name
+			if u, err := url.Parse(publicURL); err == nil {
+				server.AllowHost(u.Hostname())
+			}
+		})
+		if err != nil {
+			log.Printf("Error opening tunnel: %v", err)
+		} else {
+			onExit(func() { tunnel.Close() })
 		}
 	}
 
-	// Always show localhost as an option
-	log.Printf("Access the server at: http://localhost:%d", config.Port)
+	// Profiling endpoints for diagnosing memory and CPU usage
+	if config.Debug {
+		if err := startDebugServer(config.DebugAddr); err != nil {
+			log.Fatalf("Error starting debug server: %v", err)
+		}
+	}
 
 	// Start the server
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Port),
-		Handler: mux,
+	var listeners, sockets []net.Listener
+	for _, addr := range config.Listen {
+		socket, err := listen(listenNetwork, addr.Addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", addr.Addr, err)
+		}
+		sockets = append(sockets, socket)
+		listeners = append(listeners, wrapListener(socket, addr, tlsConfig))
+	}
+	// Live dashboard in place of the scrolling log
+	if config.TUI {
+		if _, _, ok := terminalSize(os.Stdout); ok {
+			dashboard := startDashboard(server, os.Stdout)
+			onExit(dashboard.Close)
+		} else {
+			log.Printf("Warning: -tui needs a terminal, logging normally")
+		}
 	}
 
-	log.Fatal(server.ListenAndServe())
+	drained := watchRestart(server, sockets, !config.Stdin)
+	signalReady()
+
+	if err := server.Start(listeners...); err != nil {
+		log.Fatal(err)
+	}
+	<-drained
+	logf("All requests finished, exiting")
 }
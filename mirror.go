@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modification times closer than this count as equal, since not every
+// file system keeps them exactly
+const mirrorTimeSlack = 2 * time.Second
+
+// Mirror pulls new and changed files from another instance into the local
+// folder. Files that are newer locally are left alone, so two instances
+// mirroring each other converge.
+type Mirror struct {
+	source *url.URL
+	apiKey string
+	dir    string
+	client *http.Client
+	// Only pull files that do not exist here yet
+	appendOnly bool
+}
+
+// Set up mirroring from source, or return nil when source is empty
+func newMirror(source, apiKey, dir string, appendOnly bool) (*Mirror, error) {
+	if source == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", source)
+	}
+	// Resolve API paths below any prefix the other instance is served under
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &Mirror{source: u, apiKey: apiKey, dir: dir, client: &http.Client{}, appendOnly: appendOnly}, nil
+}
+
+// Sync now and then every interval, in the background
+func (m *Mirror) Start(interval time.Duration) {
+	if m == nil {
+		return
+	}
+	logf("Mirroring %s every %v", m.source, interval)
+	go func() {
+		for {
+			start := time.Now()
+			pulled, err := m.Sync(context.Background())
+			if err != nil {
+				log.Printf("Error mirroring %s: %v", m.source, err)
+			}
+			if pulled > 0 {
+				logf("Mirrored %d file(s) from %s in %v", pulled, m.source, time.Since(start).Round(time.Second))
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Send a request to the other instance
+func (m *Mirror) get(ctx context.Context, apiPath string, query url.Values) (*http.Response, error) {
+	u := m.source.ResolveReference(&url.URL{Path: apiPath, RawQuery: query.Encode()})
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.apiKey != "" {
+		req.Header.Set("X-API-Key", m.apiKey)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s %s", u.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// List a folder of the other instance page by page
+func (m *Mirror) list(ctx context.Context, dir string) ([]FileInfo, error) {
+	var entries []FileInfo
+	for offset := 0; offset >= 0; {
+		resp, err := m.get(ctx, "list", url.Values{"path": {dir}, "offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(maxListingPageSize)}})
+		if err != nil {
+			return nil, err
+		}
+		var page ListingPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading listing of %q: %w", dir, err)
+		}
+		entries = append(entries, page.Entries...)
+		offset = page.Next
+	}
+	return entries, nil
+}
+
+// Pull everything that is missing or older here, walking the other
+// instance's folders recursively. Returns the number of files pulled.
+func (m *Mirror) Sync(ctx context.Context) (int, error) {
+	pulled := 0
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		entries, err := m.list(ctx, dir)
+		if err != nil {
+			return pulled, err
+		}
+		for _, entry := range entries {
+			relPath := cleanRelPath(entry.Path)
+			if entry.IsDir {
+				dirs = append(dirs, relPath)
+				continue
+			}
+			if strings.HasPrefix(entry.Name, ".mirror-") {
+				continue
+			}
+
+			fullPath, err := safeJoinPath(m.dir, relPath)
+			if err != nil {
+				continue
+			}
+			if info, err := os.Stat(fullPath); err == nil {
+				if info.IsDir() || m.appendOnly {
+					continue
+				}
+				// Skip files that are up to date or were changed here later
+				diff := info.ModTime().Sub(entry.ModTime)
+				if diff > mirrorTimeSlack || diff > -mirrorTimeSlack && info.Size() == entry.Size {
+					continue
+				}
+			}
+
+			if err := m.pull(ctx, entry, fullPath); err != nil {
+				log.Printf("Error mirroring %s: %v", relPath, err)
+				continue
+			}
+			pulled++
+		}
+	}
+	return pulled, nil
+}
+
+// Download one file next to its destination, then move it into place with
+// the other instance's modification time
+func (m *Mirror) pull(ctx context.Context, entry FileInfo, fullPath string) error {
+	if err := checkDiskSpace(entry.Size, filepath.Dir(fullPath)); err != nil {
+		return err
+	}
+
+	resp, err := m.get(ctx, "download/"+cleanRelPath(entry.Path), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(fullPath), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Chmod(out.Name(), 0644)
+	if err := os.Chtimes(out.Name(), entry.ModTime, entry.ModTime); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), fullPath)
+}
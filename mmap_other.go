@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// Memory mapping isn't used here, so the file is read into memory instead
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Nothing to release for a file read by mapFile
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Notifier posts event messages to a chat webhook
+type Notifier struct {
+	Kind string // slack, discord or matrix
+	URL  string
+}
+
+var (
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+	matrixTxnID  atomic.Int64
+)
+
+// Send a message to the webhook
+func (n Notifier) Send(message string) error {
+	method := "POST"
+	target := n.URL
+	var payload interface{}
+
+	switch n.Kind {
+	case "slack":
+		payload = map[string]string{"text": message}
+	case "discord":
+		payload = map[string]string{"content": message}
+	case "matrix":
+		// Matrix expects a PUT with a unique transaction ID appended to
+		// .../rooms/{roomId}/send/m.room.message
+		method = "PUT"
+		base, query, _ := strings.Cut(target, "?")
+		target = fmt.Sprintf("%s/%d-%d", strings.TrimSuffix(base, "/"), time.Now().UnixNano(), matrixTxnID.Add(1))
+		if query != "" {
+			target += "?" + query
+		}
+		payload = map[string]string{"msgtype": "m.text", "body": message}
+	default:
+		return fmt.Errorf("unknown notifier kind %q", n.Kind)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Parse a comma separated list of event types, e.g. "upload,download"
+func parseEventTypes(list string) (map[EventType]bool, error) {
+	types := make(map[EventType]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		switch t := EventType(name); t {
+		case EventUpload, EventDownload, EventDelete, EventLowDisk, EventChange:
+			types[t] = true
+		default:
+			return nil, fmt.Errorf("unknown event type %q", name)
+		}
+	}
+	return types, nil
+}
+
+// Format an event as a short chat message
+func formatEventMessage(e Event) string {
+	if e.Type == EventLowDisk {
+		return fmt.Sprintf("%s: low disk space, %s", AppName, e.Detail)
+	}
+	if e.Type == EventChange {
+		return fmt.Sprintf("%s: %s %s", AppName, e.Path, e.Detail)
+	}
+	verbs := map[EventType]string{
+		EventUpload:   "uploaded",
+		EventDownload: "downloaded",
+		EventDelete:   "deleted",
+	}
+	return fmt.Sprintf("%s: %s %s %s", AppName, e.Client, verbs[e.Type], e.Path)
+}
+
+// Subscribe notifiers to the event bus for the selected event types
+func subscribeNotifiers(events *EventBus, notifiers []Notifier, types map[EventType]bool) {
+	if len(notifiers) == 0 {
+		return
+	}
+	events.Subscribe(func(e Event) {
+		if !types[e.Type] {
+			return
+		}
+		message := formatEventMessage(e)
+		for _, n := range notifiers {
+			go func(n Notifier) {
+				if err := n.Send(message); err != nil {
+					log.Printf("Error sending %s notification: %v", n.Kind, err)
+				}
+			}(n)
+		}
+	})
+}
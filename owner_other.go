@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// File ownership is not reported on this platform
+func fileOwner(info fs.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"strconv"
+	"syscall"
+)
+
+// Name of the user owning a file
+func fileOwner(info fs.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return ownerName(strconv.FormatUint(uint64(stat.Uid), 10))
+}
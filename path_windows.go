@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// Served paths live on a Windows filesystem, which treats device names and
+// trailing dots or spaces specially
+const windowsPaths = true
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// PortMapping describes a port forwarded on the home router
+type PortMapping struct {
+	Method       string
+	ExternalIP   net.IP
+	ExternalPort int
+	TTL          time.Duration
+	remove       func() error
+}
+
+// Remove the mapping from the router
+func (m *PortMapping) Remove() error {
+	if m.remove == nil {
+		return nil
+	}
+	return m.remove()
+}
+
+// Ask the router to forward an external TCP port to the given local port for
+// ttl, trying NAT-PMP first and falling back to UPnP IGD
+func exposePort(port int, ttl time.Duration) (*PortMapping, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("finding default gateway: %w", err)
+	}
+
+	mapping, pmpErr := natpmpMap(gateway, port, ttl)
+	if pmpErr == nil {
+		return mapping, nil
+	}
+
+	mapping, upnpErr := upnpMap(gateway, port, ttl)
+	if upnpErr == nil {
+		return mapping, nil
+	}
+
+	return nil, fmt.Errorf("NAT-PMP: %v; UPnP: %v", pmpErr, upnpErr)
+}
+
+// Find the IPv4 default gateway, reading the kernel routing table where
+// available and otherwise guessing the .1 address of the local subnet
+func defaultGateway() (net.IP, error) {
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			raw, err := hex.DecodeString(fields[2])
+			if err != nil || len(raw) != 4 {
+				continue
+			}
+			// The routing table stores addresses in host (little-endian) order
+			return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil && isLocalIP(ip4.String()) {
+			gw := ip4.Mask(ipnet.Mask)
+			gw[3] |= 1
+			return gw, nil
+		}
+	}
+
+	return nil, errors.New("no private IPv4 network found")
+}
+
+// Find the local address used to reach the gateway
+func localAddrFor(gateway net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(gateway.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// NAT-PMP (RFC 6886)
+
+const natpmpPort = 5351
+
+// Send a NAT-PMP request and wait for its response, retrying with the
+// back-off schedule recommended by the RFC
+func natpmpCall(gateway net.IP, request []byte, responseSize int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := 250 * time.Millisecond
+	buf := make([]byte, 16)
+	for attempt := 0; attempt < 4; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if n < responseSize || buf[1] != request[1]+128 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("gateway returned result code %d", code)
+		}
+		return buf[:n], nil
+	}
+
+	return nil, errors.New("no response from gateway")
+}
+
+// Request a TCP mapping over NAT-PMP
+func natpmpMap(gateway net.IP, port int, ttl time.Duration) (*PortMapping, error) {
+	resp, err := natpmpCall(gateway, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	externalIP := net.IPv4(resp[8], resp[9], resp[10], resp[11])
+
+	mapRequest := func(lifetime uint32) ([]byte, error) {
+		req := make([]byte, 12)
+		req[1] = 2 // map TCP
+		binary.BigEndian.PutUint16(req[4:6], uint16(port))
+		binary.BigEndian.PutUint16(req[6:8], uint16(port))
+		binary.BigEndian.PutUint32(req[8:12], lifetime)
+		return natpmpCall(gateway, req, 16)
+	}
+
+	resp, err = mapRequest(uint32(ttl.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PortMapping{
+		Method:       "NAT-PMP",
+		ExternalIP:   externalIP,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:12])),
+		TTL:          time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+		remove: func() error {
+			// A lifetime of zero deletes the mapping
+			_, err := mapRequest(0)
+			return err
+		},
+	}, nil
+}
+
+// UPnP Internet Gateway Device
+
+const ssdpAddr = "239.255.255.250:1900"
+
+// Service types that can create port mappings
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// Subset of the UPnP device description we care about
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// Find the first port mapping service in a device tree
+func (d upnpDevice) findService() (serviceType, controlURL string) {
+	for _, want := range upnpServiceTypes {
+		for _, s := range d.Services {
+			if s.ServiceType == want {
+				return s.ServiceType, s.ControlURL
+			}
+		}
+	}
+	for _, child := range d.Devices {
+		if st, cu := child.findService(); st != "" {
+			return st, cu
+		}
+	}
+	return "", ""
+}
+
+// Discover the gateway's port mapping service via SSDP
+func upnpDiscover(gateway net.IP) (serviceType, controlURL string, err error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", "", err
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dest); err != nil {
+		return "", "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", "", errors.New("no internet gateway device found")
+		}
+		// Prefer the device that is actually our default gateway
+		if !from.IP.Equal(gateway) {
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		serviceType, controlURL, err := upnpDescribe(location)
+		if err != nil {
+			continue
+		}
+		return serviceType, controlURL, nil
+	}
+}
+
+// Fetch a device description and resolve its control URL
+func upnpDescribe(location string) (serviceType, controlURL string, err error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return "", "", err
+	}
+
+	serviceType, control := root.Device.findService()
+	if serviceType == "" {
+		return "", "", errors.New("device has no port mapping service")
+	}
+
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+	controlRef, err := url.Parse(control)
+	if err != nil {
+		return "", "", err
+	}
+
+	return serviceType, baseURL.ResolveReference(controlRef).String(), nil
+}
+
+// Invoke a SOAP action on the gateway and return the raw response body
+func upnpCall(controlURL, serviceType, action, args string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + serviceType + `">` + args + `</u:` + action + `></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest("POST", controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+"#"+action+`"`)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return data, nil
+}
+
+// Request a TCP mapping over UPnP
+func upnpMap(gateway net.IP, port int, ttl time.Duration) (*PortMapping, error) {
+	serviceType, controlURL, err := upnpDiscover(gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	localIP, err := localAddrFor(gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	args := fmt.Sprintf("<NewRemoteHost></NewRemoteHost>"+
+		"<NewExternalPort>%d</NewExternalPort>"+
+		"<NewProtocol>TCP</NewProtocol>"+
+		"<NewInternalPort>%d</NewInternalPort>"+
+		"<NewInternalClient>%s</NewInternalClient>"+
+		"<NewEnabled>1</NewEnabled>"+
+		"<NewPortMappingDescription>%s</NewPortMappingDescription>"+
+		"<NewLeaseDuration>%d</NewLeaseDuration>",
+		port, port, localIP, AppName, int(ttl.Seconds()))
+	if _, err := upnpCall(controlURL, serviceType, "AddPortMapping", args); err != nil {
+		return nil, err
+	}
+
+	mapping := &PortMapping{
+		Method:       "UPnP",
+		ExternalPort: port,
+		TTL:          ttl,
+		remove: func() error {
+			args := fmt.Sprintf("<NewRemoteHost></NewRemoteHost>"+
+				"<NewExternalPort>%d</NewExternalPort>"+
+				"<NewProtocol>TCP</NewProtocol>", port)
+			_, err := upnpCall(controlURL, serviceType, "DeletePortMapping", args)
+			return err
+		},
+	}
+
+	if data, err := upnpCall(controlURL, serviceType, "GetExternalIPAddress", ""); err == nil {
+		var resp struct {
+			IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+		}
+		if xml.Unmarshal(data, &resp) == nil {
+			mapping.ExternalIP = net.ParseIP(resp.IP)
+		}
+	}
+
+	return mapping, nil
+}
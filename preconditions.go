@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Whether an ETag list from If-Match or If-None-Match matches a file. Only
+// strong ETags match, as required for writes.
+func etagListMatches(list string, info fs.FileInfo) bool {
+	if info == nil {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	etag := fileETag(info)
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimSpace(candidate) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the conditional headers of a write against the file it would
+// replace, so API clients can update a file only if nobody changed it since
+// they read it. info is nil when the file does not exist yet. If-Match takes
+// precedence over If-Unmodified-Since; If-None-Match: * allows creating a
+// file but not replacing one.
+func writePreconditionsMet(r *http.Request, info fs.FileInfo) bool {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !etagListMatches(match, info) {
+			return false
+		}
+	} else if since := r.Header.Get("If-Unmodified-Since"); since != "" && info != nil {
+		t, err := http.ParseTime(since)
+		if err == nil && info.ModTime().Truncate(time.Second).After(t) {
+			return false
+		}
+	}
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" && etagListMatches(noneMatch, info) {
+		return false
+	}
+	return true
+}
+
+// Stat the destination of a write for writePreconditionsMet, giving nil if it
+// does not exist
+func writeTarget(fullPath string) fs.FileInfo {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil
+	}
+	return info
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Endpoints that read a single file or folder named in the URL, which
+// visitors may use on public folders without logging in
+var publicPrefixes = []string{"/download/", "/archive/", "/checksums/", "/segments/", "/thumb/", "/preview/", "/transcode/"}
+
+// PublicFolders are folders anyone may browse and download from without
+// logging in, while the rest of the tree still requires the password
+type PublicFolders []string
+
+// Parse a comma separated list of folders. The root is never public; leave
+// out -password for that.
+func parsePublicFolders(list string) PublicFolders {
+	var folders PublicFolders
+	for _, folder := range strings.Split(list, ",") {
+		if folder = cleanRelPath(strings.TrimSpace(folder)); folder != "" {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// Whether a request only reads from a public folder. The stylesheets and
+// scripts of the pages are public too.
+func (p PublicFolders) Allows(r *http.Request) bool {
+	if len(p) == 0 || r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if strings.HasPrefix(r.URL.Path, "/static/") {
+		return true
+	}
+
+	target, ok := "", false
+	if r.URL.Path == "/" || r.URL.Path == "/list" || r.URL.Path == "/play" {
+		target, ok = cleanRelPath(r.URL.Query().Get("path")), true
+	}
+	for _, prefix := range publicPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			target, ok = cleanRelPath(strings.TrimPrefix(r.URL.Path, prefix)), true
+		}
+	}
+	if !ok {
+		return false
+	}
+	for _, folder := range p {
+		if target == folder || strings.HasPrefix(target, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PendingUpload is an upload waiting for admin approval
+type PendingUpload struct {
+	ID           string    `json:"id"`
+	Filename     string    `json:"filename"`
+	TargetPath   string    `json:"target_path"`
+	Client       string    `json:"client"`
+	Size         int64     `json:"size"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Extract      bool      `json:"extract,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// QuarantineStore holds incoming uploads outside the download directory
+// until they are approved or rejected
+type QuarantineStore struct {
+	mu    sync.Mutex
+	dir   string
+	items map[string]*PendingUpload
+}
+
+// Open the quarantine area in the data directory
+func openQuarantine(dataDir string) (*QuarantineStore, error) {
+	q := &QuarantineStore{
+		dir:   filepath.Join(dataDir, "pending"),
+		items: make(map[string]*PendingUpload),
+	}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var items []*PendingUpload
+	if err := loadJSON(q.indexPath(), &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		q.items[item.ID] = item
+	}
+	return q, nil
+}
+
+func (q *QuarantineStore) indexPath() string {
+	return filepath.Join(q.dir, "pending.json")
+}
+
+// Store an upload for later review
+func (q *QuarantineStore) Add(src io.Reader, filename, targetPath, client string, maxDownloads int, extract bool) (*PendingUpload, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.Create(filepath.Join(q.dir, id))
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(out, src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return nil, err
+	}
+
+	item := &PendingUpload{
+		ID:           id,
+		Filename:     filename,
+		TargetPath:   cleanRelPath(targetPath),
+		Client:       client,
+		Size:         size,
+		MaxDownloads: maxDownloads,
+		Extract:      extract,
+		Time:         time.Now(),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items[id] = item
+	return item, q.saveLocked()
+}
+
+// Get pending uploads, oldest first
+func (q *QuarantineStore) List() []PendingUpload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result := make([]PendingUpload, 0, len(q.items))
+	for _, item := range q.items {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result
+}
+
+// Move an approved upload into the download directory, returning it along
+// with its path relative to baseDir. Uploads into the encrypted folder are
+// encrypted on the way, and those into the deduplicated folder split into
+// chunks. With appendOnly an existing file is kept and the upload stored
+// under a versioned name.
+func (q *QuarantineStore) Approve(id, baseDir string, encryption *AtRestEncryption, dedup *DedupStore, appendOnly bool) (*PendingUpload, string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[id]
+	if !ok {
+		return nil, "", errors.New("no such pending upload")
+	}
+
+	targetDir, err := safeJoinPath(baseDir, item.TargetPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return nil, "", err
+	}
+	src, dst := filepath.Join(q.dir, id), filepath.Join(targetDir, item.Filename)
+	if appendOnly {
+		if dst, err = versionedName(dst); err != nil {
+			return nil, "", err
+		}
+	}
+	relPath := cleanRelPath(filepath.Join(item.TargetPath, filepath.Base(dst)))
+	if encryption.Covers(relPath) {
+		err = encryptFile(src, dst, encryption)
+	} else if dedup.Covers(relPath) {
+		err = dedupFile(src, dst, dedup)
+	} else {
+		err = moveFile(src, dst)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	delete(q.items, id)
+	return item, relPath, q.saveLocked()
+}
+
+// Discard a pending upload
+func (q *QuarantineStore) Reject(id string) (*PendingUpload, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[id]
+	if !ok {
+		return nil, errors.New("no such pending upload")
+	}
+	if err := os.Remove(filepath.Join(q.dir, id)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	delete(q.items, id)
+	return item, q.saveLocked()
+}
+
+func (q *QuarantineStore) saveLocked() error {
+	items := make([]*PendingUpload, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+	return saveJSON(q.indexPath(), items)
+}
+
+// Generate a random hex identifier
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Move a file, falling back to copy and delete across filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Copy next to dst and rename, so a file being replaced is never
+	// rewritten in place and its hard linked copies keep their content
+	out, err := os.CreateTemp(filepath.Dir(dst), ".move-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(out.Name(), 0644)
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+
+	in.Close()
+	return os.Remove(src)
+}
+
+// Encrypt a file into dst and remove the plaintext original
+func encryptFile(src, dst string, encryption *AtRestEncryption) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Like moveFile, replace dst rather than rewriting it
+	out, err := os.CreateTemp(filepath.Dir(dst), ".encrypt-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = encryption.Encrypt(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(out.Name(), 0644)
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Number of files the recent view shows unless asked for another number,
+// and the most it will show
+const (
+	defaultRecentFiles = 50
+	maxRecentFiles     = 1000
+)
+
+// Min-heap of files by modification time, holding the newest seen so far
+type recentHeap []FileInfo
+
+func (h recentHeap) Len() int           { return len(h) }
+func (h recentHeap) Less(i, j int) bool { return h[i].ModTime.Before(h[j].ModTime) }
+func (h recentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x any)        { *h = append(*h, x.(FileInfo)) }
+func (h *recentHeap) Pop() any {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// Find the limit most recently modified files below relativePath, newest
+// first, skipping the folders canRead refuses. Uploads are new files, so
+// this is also what was uploaded last.
+func recentFiles(baseDir, relativePath string, limit int, tags *TagStore, canRead func(string) bool) ([]FileInfo, error) {
+	root, err := safeJoinPath(baseDir, relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	newest := &recentHeap{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if !canRead(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || d.Name() == accessFileName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if newest.Len() == limit {
+			if !info.ModTime().After((*newest)[0].ModTime) {
+				return nil
+			}
+			heap.Pop(newest)
+		}
+		heap.Push(newest, newFileInfo(d.Name(), rel, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FileInfo(*newest)
+	sort.Slice(results, func(i, j int) bool { return results[i].ModTime.After(results[j].ModTime) })
+	for i := range results {
+		results[i].Tags = tags.Get(results[i].Path)
+	}
+	return results, nil
+}
+
+// Template for the recently modified files page
+const recentTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Recently Modified - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        .error {
+            color: #c62828;
+        }
+        .result {
+            margin: 5px 0;
+            padding: 8px;
+            background-color: #f5f5f5;
+            border-radius: 4px;
+        }
+        .tag {
+            display: inline-block;
+            margin-left: 6px;
+            padding: 1px 6px;
+            font-size: 12px;
+            background-color: #fff3e0;
+            color: #e65100;
+            border-radius: 10px;
+        }
+        .result-path {
+            color: #666;
+            font-size: 12px;
+        }
+    </style>
+</head>
+<body>
+    <h1>Recently Modified</h1>
+    <p><a href="./?path={{.Path}}">&larr; Back to files</a></p>
+    {{if .Error}}
+    <p class="error">{{.Error}}</p>
+    {{else}}
+    <p>The {{len .Results}} most recently added or modified file(s){{if .Path}} in /{{.Path}}{{end}}</p>
+    {{range .Results}}
+    <div class="result">
+        <a href="download/{{.Path}}">{{.Name}}</a> ({{size .Size}})
+        {{range .Tags}}<a href="search?tag={{.}}" class="tag">#{{.}}</a>{{end}}
+        <div class="result-path">/{{.Path}} &middot; {{.ModTime.Format "2006-01-02 15:04"}}</div>
+    </div>
+    {{end}}
+    {{end}}
+</body>
+</html>
+`
+
+// Handler listing the most recently modified files across the tree, or
+// below the folder given as "path". "limit" sets how many (50 by default);
+// format=json returns them as JSON.
+func recentHandler(config Config, tags *TagStore, rules *AccessRules) http.Handler {
+	tmpl := template.Must(template.New("recent").Funcs(template.FuncMap{
+		"size": formatByteSize,
+	}).Parse(recentTemplate))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		path := cleanRelPath(values.Get("path"))
+		limit := defaultRecentFiles
+		if v := values.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit: "+v, http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxRecentFiles)
+		}
+
+		started := time.Now()
+		canRead := func(rel string) bool { return rules.Allowed(r, rel, false) }
+		results, err := recentFiles(config.DownloadDir, path, limit, tags, canRead)
+		debugf("Found the %d most recent file(s) in /%s in %v", len(results), path, time.Since(started).Round(time.Millisecond))
+
+		if values.Get("format") == "json" {
+			if err != nil {
+				http.Error(w, "Error listing recent files: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+
+		var errMessage string
+		if err != nil {
+			errMessage = err.Error()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = tmpl.Execute(w, struct {
+			Path    string
+			Results []FileInfo
+			Error   string
+		}{
+			Path:    path,
+			Results: results,
+			Error:   errMessage,
+		})
+		if err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Widths asked for with ?w= are rounded up to a multiple of this, so a
+// photo has a handful of resized copies rather than one per pixel
+const resizeStep = 100
+
+// Widest copy a photo is resized to
+const maxResizeWidth = 4000
+
+// Check if a file is a photo that can be downloaded resized
+func canResize(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".webp", ".bmp", ".tif", ".tiff", ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// Parse the ?w= width of a resized download, rounded up to resizeStep
+func parseResizeWidth(value string) (int, error) {
+	width, err := strconv.Atoi(value)
+	if err != nil || width < 1 {
+		return 0, fmt.Errorf("invalid width %q", value)
+	}
+	width = (width + resizeStep - 1) / resizeStep * resizeStep
+	return min(width, maxResizeWidth), nil
+}
+
+// Get a JPEG copy of a photo at most width pixels wide, making it on first
+// use. Photos narrower than that keep their size.
+func (c *ThumbnailCache) Resized(fullPath string, info os.FileInfo, width int) (string, error) {
+	return c.cached(fullPath, info, fmt.Sprintf("w%d", width), func(dest string) error {
+		src := fullPath
+		if isHEIC(fullPath) {
+			tmp, err := os.CreateTemp(c.dir, "thumb-*.jpg")
+			if err != nil {
+				return err
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+			if err := c.convertHEIC(fullPath, tmp.Name()); err != nil {
+				return err
+			}
+			src = tmp.Name()
+		}
+
+		// Not every ffmpeg turns photos the way their EXIF data says, so
+		// the copy is turned here, with ffmpeg's own turning off, and has
+		// no EXIF data left to turn it again
+		filter := fmt.Sprintf("scale='min(%d,iw)':-2", width)
+		if turn := orientationFilter(jpegOrientation(src)); turn != "" {
+			filter = turn + "," + filter
+		}
+		return c.ffmpegImage(src, dest, []string{"-noautorotate"}, []string{"-vf", filter, "-q:v", "3"})
+	})
+}
+
+// The ffmpeg filter undoing an EXIF orientation, "" for none
+func orientationFilter(orientation int) string {
+	switch orientation {
+	case 2:
+		return "hflip"
+	case 3:
+		return "hflip,vflip"
+	case 4:
+		return "vflip"
+	case 5:
+		return "transpose=0"
+	case 6:
+		return "transpose=1"
+	case 7:
+		return "transpose=3"
+	case 8:
+		return "transpose=2"
+	}
+	return ""
+}
+
+// Read the EXIF orientation of a JPEG file, 0 if it has none
+func jpegOrientation(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	// The EXIF segment comes right after the start of the image
+	head := make([]byte, 64<<10)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+	if len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return 0
+	}
+	for pos := 2; pos+4 <= len(head) && head[pos] == 0xFF; {
+		marker := head[pos+1]
+		length := int(binary.BigEndian.Uint16(head[pos+2:]))
+		segment := head[pos+4 : min(pos+2+length, len(head))]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		if marker == 0xDA {
+			break
+		}
+		pos += 2 + length
+	}
+	return 0
+}
+
+// Find the orientation tag in the first directory of EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+)
+
+// Open one of the server's listeners
+func listen(network, addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+// Graceful restart relies on passing file descriptors, which needs unix
+func signalReady() {}
+
+// Graceful restart is not supported on this platform; the returned channel
+// is already closed
+func watchRestart(server *Server, listeners []net.Listener, enabled bool) <-chan struct{} {
+	drained := make(chan struct{})
+	close(drained)
+	return drained
+}
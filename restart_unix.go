@@ -0,0 +1,182 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables telling a restarted process which inherited file
+// descriptors hold the listeners, separated by spaces in the order they
+// are opened, and the readiness pipe
+const (
+	listenFDEnv = "LFS_LISTEN_FD"
+	readyFDEnv  = "LFS_READY_FD"
+)
+
+// How long to wait for the new process before giving up on a restart
+const restartTimeout = 30 * time.Second
+
+// Open one of the server's listeners, inheriting the next one from the
+// previous process when started by a graceful restart
+func listen(network, addr string) (net.Listener, error) {
+	fds := strings.Fields(os.Getenv(listenFDEnv))
+	if len(fds) == 0 {
+		return net.Listen(network, addr)
+	}
+	fd := fds[0]
+	if len(fds) > 1 {
+		os.Setenv(listenFDEnv, strings.Join(fds[1:], " "))
+	} else {
+		os.Unsetenv(listenFDEnv)
+	}
+
+	var n uintptr
+	if _, err := fmt.Sscan(fd, &n); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", listenFDEnv, err)
+	}
+	file := os.NewFile(n, "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	logf("Inherited listener on %s from the previous process", listener.Addr())
+	return listener, nil
+}
+
+// Tell the previous process that this one is serving, if it started us
+func signalReady() {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+
+	var n uintptr
+	if _, err := fmt.Sscan(fd, &n); err != nil {
+		return
+	}
+	pipe := os.NewFile(n, "ready")
+	pipe.Write([]byte{1})
+	pipe.Close()
+}
+
+// Restart gracefully on SIGUSR2: start the (possibly upgraded) binary with
+// the same arguments, hand it the listener, then stop accepting connections
+// and let in-flight transfers finish. The returned channel is closed once
+// they have.
+func watchRestart(server *Server, listeners []net.Listener, enabled bool) <-chan struct{} {
+	drained := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	go func() {
+		for range sigs {
+			if !enabled {
+				log.Printf("Ignoring restart request: serving piped stdin cannot be restarted")
+				continue
+			}
+			if err := startSuccessor(listeners); err != nil {
+				log.Printf("Restart failed, continuing to serve: %v", err)
+				continue
+			}
+
+			signal.Stop(sigs)
+			logf("New process is serving; waiting for in-flight requests to finish")
+			server.Stop(context.Background())
+			close(drained)
+			return
+		}
+	}()
+
+	return drained
+}
+
+// Start a new copy of this program sharing the listeners and wait for it
+// to report that it is serving
+func startSuccessor(listeners []net.Listener) error {
+	var files []*os.File
+	var fds []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener cannot be shared")
+		}
+		file, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		// Inherited files are numbered from 3
+		fds = append(fds, strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	// Port mappings and tunnels are released here and set up again by the
+	// new process
+	runCleanup()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(), listenFDEnv+"="+strings.Join(fds, " "), readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	logf("Started new process %d from %s", cmd.Process.Pid, executable)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- errors.New("new process exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+		} else {
+			go cmd.Wait()
+		}
+		return err
+	case <-time.After(restartTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process was not ready after %v", restartTimeout)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the per-folder file listing who may read or write a subtree
+const accessFileName = ".access"
+
+// Directives an access file may contain
+const (
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+// A parsed access file: the subjects allowed for each directive it sets
+type accessFile struct {
+	modTime    time.Time
+	size       int64
+	directives map[string][]string
+}
+
+// AccessRules decides which clients may read or write each subtree from
+// .access files in the served folders. A file applies to its folder and
+// everything below it, until a deeper file sets the same directive:
+//
+//	# Only the family's devices and the tablet's API key
+//	read  192.168.1.0/24 key:tablet
+//	write 192.168.1.10 login
+//
+// Subjects are IP addresses, CIDR ranges, "local" for any private network
+// address, "login" for a -password session, "key:<name>" for an API key
+// and "*" for everyone. A directive no file sets is unrestricted.
+type AccessRules struct {
+	root string
+	auth *PasswordAuth
+
+	mu    sync.Mutex
+	files map[string]*accessFile
+}
+
+// Create access rules for the tree at root
+func newAccessRules(root string, auth *PasswordAuth) *AccessRules {
+	return &AccessRules{root: root, auth: auth, files: make(map[string]*accessFile)}
+}
+
+// Get the parsed access file of a folder, or nil if it has none. Files are
+// parsed again whenever they change on disk.
+func (a *AccessRules) load(dir string) *accessFile {
+	file := filepath.Join(a.root, filepath.FromSlash(dir), accessFileName)
+	info, err := os.Stat(file)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil || info.IsDir() {
+		delete(a.files, dir)
+		return nil
+	}
+	if cached := a.files[dir]; cached != nil && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached
+	}
+
+	parsed, err := parseAccessFile(file)
+	if err != nil {
+		// Deny everyone rather than silently opening the folder up
+		log.Printf("Error reading %s: %v", file, err)
+		parsed = map[string][]string{accessRead: nil, accessWrite: nil}
+	}
+	a.files[dir] = &accessFile{modTime: info.ModTime(), size: info.Size(), directives: parsed}
+	return a.files[dir]
+}
+
+// Parse an access file into its directives
+func parseAccessFile(file string) (map[string][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	directives := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch directive := strings.ToLower(fields[0]); directive {
+		case accessRead, accessWrite:
+			directives[directive] = append(directives[directive], fields[1:]...)
+		default:
+			log.Printf("Ignoring unknown directive %q in %s line %d", fields[0], file, line)
+		}
+	}
+	return directives, scanner.Err()
+}
+
+// Whether the client of r may read, or with write set change, relPath.
+// This machine, signed URLs and admin API keys are always allowed.
+func (a *AccessRules) Allowed(r *http.Request, relPath string, write bool) bool {
+	if a == nil {
+		return true
+	}
+	grant, granted := accessGrant(r)
+	if granted && (grant.Via == "signed-url" || grant.Scopes[ScopeAdmin]) {
+		return true
+	}
+	if fromThisMachine(r) {
+		return true
+	}
+
+	directive := accessRead
+	if write {
+		directive = accessWrite
+	}
+	dir := cleanRelPath(relPath)
+	for {
+		if file := a.load(dir); file != nil {
+			if subjects, ok := file.directives[directive]; ok {
+				return a.matches(r, grant, subjects)
+			}
+		}
+		if dir == "" {
+			return true
+		}
+		if dir = path.Dir(dir); dir == "." {
+			dir = ""
+		}
+	}
+}
+
+// Whether the client of r is one of subjects
+func (a *AccessRules) matches(r *http.Request, grant AccessGrant, subjects []string) bool {
+	ip := net.ParseIP(clientIP(r))
+	for _, subject := range subjects {
+		switch {
+		case subject == "*":
+			return true
+		case subject == "local":
+			if isLocalIP(clientIP(r)) {
+				return true
+			}
+		case subject == "login":
+			if a.auth.LoggedIn(r) {
+				return true
+			}
+		case strings.HasPrefix(subject, "key:"):
+			if grant.Via == "api-key:"+strings.TrimPrefix(subject, "key:") {
+				return true
+			}
+		case strings.Contains(subject, "/"):
+			if _, block, err := net.ParseCIDR(subject); err == nil && ip != nil && block.Contains(ip) {
+				return true
+			}
+		default:
+			if allowed := net.ParseIP(subject); allowed != nil && allowed.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the client of r may read every folder of the tree at relPath, as
+// an archive of it would hand out all of them
+func (a *AccessRules) ReadableTree(r *http.Request, relPath string) bool {
+	if a == nil {
+		return true
+	}
+	root := filepath.Join(a.root, filepath.FromSlash(relPath))
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(a.root, path)
+		if !a.Allowed(r, filepath.ToSlash(rel), false) {
+			return fs.ErrPermission
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// Drop the entries, and their children, the client of r may not read.
+// Access files themselves are never listed.
+func (a *AccessRules) Filter(r *http.Request, files []FileInfo) []FileInfo {
+	if a == nil {
+		return files
+	}
+	visible := files[:0]
+	for _, file := range files {
+		if file.Name == accessFileName {
+			continue
+		}
+		// Files share the rules of the folder being listed, which the
+		// client could already read; only folders can bring new ones
+		if file.IsDir {
+			if !a.Allowed(r, file.Path, false) {
+				continue
+			}
+			file.Children = a.Filter(r, file.Children)
+		}
+		visible = append(visible, file)
+	}
+	return visible
+}
+
+// The file or folder a request reads or changes, if it names one: the rest
+// of the URL for per-file endpoints, otherwise the "path" parameter
+func accessTarget(r *http.Request) (string, bool) {
+	for _, prefix := range []string{"/download/", "/archive/", "/checksums/", "/segments/", "/delta/", "/upload/", "/append/", "/thumb/", "/preview/", "/transcode/", "/torrent/", "/qr/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return cleanRelPath(strings.TrimPrefix(r.URL.Path, prefix)), true
+		}
+	}
+	if r.URL.Query().Has("path") {
+		return cleanRelPath(r.URL.Query().Get("path")), true
+	}
+	// Uploads are checked by the home page handler once it has read the
+	// form, so the body is still streamed rather than parsed up front
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if target := r.PostFormValue("path"); target != "" {
+			return cleanRelPath(target), true
+		}
+	}
+	return "", false
+}
+
+// Refuse requests for files or folders whose .access rules don't include
+// the client. Pinning favorites and creating share codes only read.
+func accessRulesFilter(next http.Handler, rules *AccessRules) http.Handler {
+	if rules == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := accessTarget(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if path.Base(target) == accessFileName {
+			http.NotFound(w, r)
+			return
+		}
+		write := requiredScope(r) == ScopeWrite && r.URL.Path != "/favorites" && r.URL.Path != "/code"
+		if !rules.Allowed(r, target, write) {
+			log.Printf("Blocked %s of %s by access rules for %s", r.Method, target, clientIP(r))
+			http.Error(w, "Access denied: not allowed by the folder's access rules", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal S3 compatible API over the served folder, for tools that only
+// speak S3. Top-level folders are buckets and the files below them are
+// objects. Supported: ListBuckets, HeadBucket, ListObjects (v1 and v2),
+// GetObject, HeadObject and PutObject.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// How far a signed request's clock may be off
+const s3MaxClockSkew = 15 * time.Minute
+
+// Requests signed with AWS Signature Version 4, as every S3 client does
+func isS3Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") ||
+		r.URL.Query().Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256"
+}
+
+// Send S3 signed requests to the S3 API and everything else to next
+func s3Dispatch(next, s3 http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isS3Request(r) {
+			s3.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// S3Error is an error in the form S3 clients expect
+type S3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+	status   int
+}
+
+func (e *S3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func s3Err(status int, code, message string) *S3Error {
+	return &S3Error{Code: code, Message: message, status: status}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err *S3Error) {
+	err.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.status)
+	if r.Method != "HEAD" {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(err)
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// Verify a Signature Version 4 signature made with the configured key.
+// Chunk signatures of streamed uploads are not checked.
+func verifyS3Signature(r *http.Request, accessKey, secretKey string, now time.Time) *S3Error {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := query.Get("X-Amz-Algorithm") != ""
+	if presigned {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+	} else {
+		fields := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ",")
+		for _, field := range fields {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+	}
+
+	// Credential is KEY/DATE/REGION/SERVICE/aws4_request
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The credential is malformed")
+	}
+	if !hmac.Equal([]byte(scope[0]), []byte(accessKey)) {
+		return s3Err(http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist")
+	}
+
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return s3Err(http.StatusForbidden, "AccessDenied", "Missing or invalid X-Amz-Date")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || now.After(signedAt.Add(time.Duration(expires)*time.Second)) {
+			return s3Err(http.StatusForbidden, "AccessDenied", "Request has expired")
+		}
+	} else if d := now.Sub(signedAt); d > s3MaxClockSkew || d < -s3MaxClockSkew {
+		return s3Err(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+	}
+
+	// Canonical request, built from the path exactly as the client sent it
+	rawPath, _, _ := strings.Cut(r.RequestURI, "?")
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		rawPath,
+		s3CanonicalQuery(query),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		strings.Join(scope[1:], "/"),
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range scope[1:] {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sorted, AWS style encoded query string without the signature itself
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Percent-encode everything but the characters AWS leaves alone
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// Decodes the aws-chunked body encoding used by streaming uploads:
+// "size;chunk-signature=...\r\n" data "\r\n", a zero sized final chunk and
+// optional trailing checksums
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("malformed aws-chunked body")
+		}
+		if size == 0 {
+			// Skip trailers up to the closing empty line
+			for {
+				line, err := c.r.ReadString('\n')
+				if err != nil || strings.TrimSpace(line) == "" {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining == 0 {
+		if _, err := c.r.Discard(2); err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Handler for S3 requests
+func (s *Server) handleS3(w http.ResponseWriter, r *http.Request) {
+	if s.config.S3SecretKey != "" {
+		if err := verifyS3Signature(r, s.config.S3AccessKey, s.config.S3SecretKey, time.Now()); err != nil {
+			log.Printf("Rejected S3 request from %s: %v", clientIP(r), err)
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	// The S3 API is outside the access rules filter, so apply them here
+	if bucket != "" && s.rules != nil {
+		target := cleanRelPath(bucket + "/" + key)
+		if path.Base(target) == accessFileName {
+			writeS3Error(w, r, s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist"))
+			return
+		}
+		if !s.rules.Allowed(r, target, r.Method == "PUT") {
+			log.Printf("Blocked S3 %s of %s by access rules for %s", r.Method, target, clientIP(r))
+			writeS3Error(w, r, s3Err(http.StatusForbidden, "AccessDenied", "Not allowed by the folder's access rules"))
+			return
+		}
+	}
+
+	var err *S3Error
+	switch {
+	case bucket == "" && r.Method == "GET":
+		err = s.s3ListBuckets(w, r)
+	case bucket == "":
+		err = s3Err(http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed on this resource")
+	case key == "" && r.Method == "HEAD":
+		_, err = s.s3BucketDir(bucket)
+	case key == "" && r.Method == "GET" && r.URL.Query().Has("location"):
+		if _, err = s.s3BucketDir(bucket); err == nil {
+			writeS3XML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		}
+	case key == "" && r.Method == "GET":
+		err = s.s3ListObjects(w, r, bucket)
+	case key != "" && (r.Method == "GET" || r.Method == "HEAD"):
+		err = s.s3GetObject(w, r, bucket, key)
+	case key != "" && r.Method == "PUT":
+		err = s.s3PutObject(w, r, bucket, key)
+	default:
+		err = s3Err(http.StatusNotImplemented, "NotImplemented", "Only listing, getting and putting objects is supported")
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+// Folder of a bucket, which must be an existing top-level folder
+func (s *Server) s3BucketDir(bucket string) (string, *S3Error) {
+	dir, err := safeJoinPath(s.config.DownloadDir, bucket)
+	if err != nil || strings.Contains(bucket, "/") {
+		return "", s3Err(http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", s3Err(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	}
+	return dir, nil
+}
+
+// Resolve an object key to its file, refusing the encrypted folder whose
+// files are not stored as they would be served
+func (s *Server) s3ObjectPath(bucket, key string) (string, string, *S3Error) {
+	bucketDir, s3e := s.s3BucketDir(bucket)
+	if s3e != nil {
+		return "", "", s3e
+	}
+	relPath := cleanRelPath(bucket + "/" + key)
+	if s.encryption.Covers(relPath) {
+		return "", "", s3Err(http.StatusForbidden, "AccessDenied", "Objects in the encrypted folder are not available over S3")
+	}
+	if s.dedup.Covers(relPath) {
+		return "", "", s3Err(http.StatusForbidden, "AccessDenied", "Objects in the deduplicated folder are not available over S3")
+	}
+	fullPath, err := safeJoinPath(bucketDir, key)
+	if err != nil || fullPath == bucketDir {
+		return "", "", s3Err(http.StatusBadRequest, "InvalidArgument", "The object key is not valid")
+	}
+	return fullPath, relPath, nil
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (s *Server) s3ListBuckets(w http.ResponseWriter, r *http.Request) *S3Error {
+	entries, err := os.ReadDir(s.config.DownloadDir)
+	if err != nil {
+		return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	result := struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   s3Owner    `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner{ID: "local-fileserver", DisplayName: "local-fileserver"}}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || !s.rules.Allowed(r, entry.Name(), false) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(info.ModTime())})
+	}
+	writeS3XML(w, result)
+	return nil
+}
+
+// An object or, with a delimiter, a common prefix in a listing
+type s3Entry struct {
+	Name     string
+	IsPrefix bool
+	Info     fs.FileInfo
+}
+
+// Collect the objects of a bucket under a prefix, grouping keys into common
+// prefixes at the delimiter. Only folders that can hold matching keys are
+// walked, and with "/" as the delimiter none below the first level.
+// Folders for which allowed, given their key, is false are left out.
+func listS3Entries(bucketDir, prefix, delimiter string, allowed func(dir string) bool) ([]s3Entry, error) {
+	start := bucketDir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, err := safeJoinPath(bucketDir, prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		start = dir
+	}
+
+	var entries []s3Entry
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		rel, err := filepath.Rel(bucketDir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		if d.IsDir() && !allowed(rel) {
+			return filepath.SkipDir
+		}
+		if rel == "" || d.Name() == accessFileName {
+			return nil
+		}
+
+		if d.IsDir() {
+			dirKey := rel + "/"
+			if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+				return filepath.SkipDir
+			}
+			if delimiter == "/" && strings.HasPrefix(dirKey, prefix) {
+				entries = append(entries, s3Entry{Name: dirKey, IsPrefix: true})
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(rel[len(prefix):], delimiter); i >= 0 {
+				common := rel[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					entries = append(entries, s3Entry{Name: common, IsPrefix: true})
+				}
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, s3Entry{Name: rel, Info: info})
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, err
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+func (s *Server) s3ListObjects(w http.ResponseWriter, r *http.Request, bucket string) *S3Error {
+	bucketDir, s3e := s.s3BucketDir(bucket)
+	if s3e != nil {
+		return s3e
+	}
+
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	maxKeys := 1000
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+		}
+		maxKeys = min(n, 1000)
+	}
+
+	// Keys are listed after the marker (v1) or the continuation token or
+	// start-after key (v2)
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.URLEncoding.DecodeString(token)
+			if err != nil {
+				return s3Err(http.StatusBadRequest, "InvalidArgument", "The continuation token is not valid")
+			}
+			after = string(decoded)
+		}
+	}
+
+	entries, err := listS3Entries(bucketDir, prefix, delimiter, func(dir string) bool {
+		return s.rules.Allowed(r, bucket+"/"+dir, false)
+	})
+	if err != nil {
+		return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	encode := func(s string) string { return s }
+	result := s3ListResult{Xmlns: s3Namespace, Name: bucket, MaxKeys: maxKeys, Delimiter: delimiter}
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+		result.EncodingType = "url"
+	}
+	result.Prefix = encode(prefix)
+	result.Delimiter = encode(delimiter)
+
+	last := ""
+	count := 0
+	for _, entry := range entries {
+		if entry.Name <= after {
+			continue
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if entry.IsPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.Name)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(entry.Name),
+				LastModified: s3Time(entry.Info.ModTime()),
+				ETag:         fileETag(entry.Info),
+				Size:         entry.Info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		last = entry.Name
+		count++
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = encode(query.Get("start-after"))
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		result.Marker = &marker
+		if result.IsTruncated && delimiter != "" {
+			result.NextMarker = encode(last)
+		}
+	}
+	writeS3XML(w, result)
+	return nil
+}
+
+func (s *Server) s3GetObject(w http.ResponseWriter, r *http.Request, bucket, key string) *S3Error {
+	fullPath, relPath, s3e := s.s3ObjectPath(bucket, key)
+	if s3e != nil {
+		return s3e
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	}
+
+	if err := runHooks(&HookEvent{Point: HookPreDownload, Path: relPath, Client: clientIP(r), Size: info.Size()}); err != nil {
+		return s3Err(http.StatusForbidden, "AccessDenied", err.Error())
+	}
+
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Content-Type", mimeType(key))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+
+	if r.Method == "GET" && r.Header.Get("Range") == "" {
+		s.stats.RecordDownload(relPath)
+		s.events.Publish(Event{Type: EventDownload, Path: relPath, Client: clientIP(r), RequestID: requestID(r)})
+	}
+	return nil
+}
+
+func (s *Server) s3PutObject(w http.ResponseWriter, r *http.Request, bucket, key string) *S3Error {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3Err(http.StatusNotImplemented, "NotImplemented", "Copying objects is not supported")
+	}
+	fullPath, relPath, s3e := s.s3ObjectPath(bucket, key)
+	if s3e != nil {
+		return s3e
+	}
+
+	// Streaming uploads wrap the data in aws-chunked framing
+	body := io.Reader(r.Body)
+	size := r.ContentLength
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(payloadHash, "STREAMING-") || strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		body = &awsChunkedReader{r: bufio.NewReader(r.Body)}
+		size, _ = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	}
+
+	// A key ending in a slash is a folder marker
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		return nil
+	}
+
+	transfer := s.transfers.Start("", "upload", relPath, clientIP(r), size)
+	defer s.transfers.Finish(transfer)
+	body = countingReader{io.NopCloser(body), transfer}
+
+	dirs := []string{s.config.DownloadDir}
+	if s.quarantine != nil {
+		dirs = append(dirs, s.config.DataDir)
+	}
+	if err := checkDiskSpace(size, dirs...); err != nil {
+		log.Printf("Rejected S3 upload from %s: %v", clientIP(r), err)
+		return s3Err(http.StatusInsufficientStorage, "EntityTooLarge", err.Error())
+	}
+
+	filename, err := sanitizeFilename(filepath.Base(fullPath))
+	if err != nil || filename != filepath.Base(fullPath) {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "The object key is not a valid file name")
+	}
+	if lock := s.locks.Conflict(relPath, lockToken(r)); lock != nil {
+		return s3Err(http.StatusConflict, "OperationAborted", fmt.Sprintf("The object is locked for editing by %s until %s", lock.Owner, lock.Expires.Format(time.RFC3339)))
+	}
+	if !writePreconditionsMet(r, writeTarget(fullPath)) {
+		return s3Err(http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+	upload, err := s.uploadTypes.Check(filename, body)
+	if err != nil {
+		log.Printf("Rejected S3 upload of %s from %s: %v", relPath, clientIP(r), err)
+		return s3Err(http.StatusForbidden, "AccessDenied", "Upload rejected: "+err.Error())
+	}
+	if err := runHooks(&HookEvent{Point: HookPreUpload, Path: relPath, Client: clientIP(r), Size: size}); err != nil {
+		log.Printf("S3 upload of %s from %s rejected by hook: %v", relPath, clientIP(r), err)
+		return s3Err(http.StatusForbidden, "AccessDenied", "Upload rejected: "+err.Error())
+	}
+
+	// Check the content against the hashes the client sent, if any
+	md5Sum := md5.New()
+	hashes := []io.Writer{md5Sum}
+	var sha hash.Hash
+	if len(payloadHash) == 64 {
+		sha = sha256.New()
+		hashes = append(hashes, sha)
+	}
+	upload = io.TeeReader(upload, io.MultiWriter(hashes...))
+	verify := func() *S3Error {
+		if sha != nil && hex.EncodeToString(sha.Sum(nil)) != payloadHash {
+			return s3Err(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match what was computed")
+		}
+		if want := r.Header.Get("Content-MD5"); want != "" && base64.StdEncoding.EncodeToString(md5Sum.Sum(nil)) != want {
+			return s3Err(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received")
+		}
+		return nil
+	}
+
+	targetPath := filepath.ToSlash(filepath.Dir(relPath))
+	if s.quarantine != nil {
+		// The quarantine stores what it reads, so spool and verify first
+		spool, err := os.CreateTemp("", "s3-upload-*")
+		if err != nil {
+			return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, upload); err != nil {
+			return s3Err(http.StatusBadRequest, "IncompleteBody", err.Error())
+		}
+		if s3e := verify(); s3e != nil {
+			return s3e
+		}
+		spool.Seek(0, io.SeekStart)
+		item, err := s.quarantine.Add(spool, filename, targetPath, clientIP(r), 0, false)
+		if err != nil {
+			return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+		}
+		logf("File held for approval: %s to %s (%s)", item.Filename, targetPath, item.ID)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5Sum.Sum(nil))+`"`)
+		return nil
+	}
+
+	// Write next to the destination and rename, so readers never see a
+	// partial object and hard linked copies keep their content
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	out, err := os.CreateTemp(filepath.Dir(fullPath), ".s3-upload-*")
+	if err != nil {
+		return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, upload)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return s3Err(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	if s3e := verify(); s3e != nil {
+		return s3e
+	}
+	// An existing object is kept in append-only mode; the new one is
+	// stored next to it under a versioned key
+	if s.config.AppendOnly {
+		if fullPath, err = versionedName(fullPath); err != nil {
+			return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+		}
+		relPath = cleanRelPath(filepath.Join(targetPath, filepath.Base(fullPath)))
+	}
+	os.Chmod(out.Name(), 0644)
+	if err := os.Rename(out.Name(), fullPath); err != nil {
+		return s3Err(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	logf("File uploaded over S3: %s by %s", relPath, clientIP(r))
+	s.events.Publish(Event{Type: EventUpload, Path: relPath, Client: clientIP(r), RequestID: requestID(r)})
+	go runHooks(&HookEvent{Point: HookPostUpload, Path: relPath, Client: clientIP(r), Size: size})
+	w.Header().Set("ETag", `"`+hex.EncodeToString(md5Sum.Sum(nil))+`"`)
+	return nil
+}
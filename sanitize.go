@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum file name length in bytes supported by common filesystems
+const maxFilenameLength = 255
+
+// Device names Windows reserves regardless of extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"CONIN$": true, "CONOUT$": true,
+}
+
+// Whether Windows would open a device instead of a file for this path
+// component, e.g. "nul" or "COM1.txt"
+func isWindowsReservedName(name string) bool {
+	base := strings.ToUpper(strings.TrimSpace(strings.SplitN(name, ".", 2)[0]))
+	return windowsReservedNames[base]
+}
+
+// Turn a client supplied file name into a safe single path component.
+// Any directory part is dropped, control and reserved characters are
+// replaced, Windows device names are prefixed and "." / ".." are rejected.
+// Names are normalized to NFC, so the decomposed names macOS sends don't
+// end up next to identical looking composed ones.
+func sanitizeFilename(name string) (string, error) {
+	// Keep only the last component, whichever separator the client used
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		switch r {
+		case '<', '>', ':', '"', '|', '?', '*':
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows silently drops trailing dots and spaces
+	name = strings.TrimLeft(name, " ")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "", errors.New("invalid file name")
+	}
+
+	if isWindowsReservedName(name) {
+		name = "_" + name
+	}
+
+	if len(name) > maxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 32 {
+			ext = ""
+		}
+		stem := name[:maxFilenameLength-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+
+	return name, nil
+}
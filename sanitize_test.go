@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"plain name", "report.pdf", "report.pdf", false},
+		{"unix traversal", "../../etc/passwd", "passwd", false},
+		{"windows traversal", `..\..\windows\system32\cmd.exe`, "cmd.exe", false},
+		{"absolute path", "/tmp/photo.jpg", "photo.jpg", false},
+		{"dot", ".", "", true},
+		{"dot dot", "..", "", true},
+		{"empty", "", "", true},
+		{"only spaces", "   ", "", true},
+		{"trailing separator", "folder/", "", true},
+		{"reserved device", "CON", "_CON", false},
+		{"reserved device lowercase with extension", "nul.txt", "_nul.txt", false},
+		{"reserved device with double extension", "com1.tar.gz", "_com1.tar.gz", false},
+		{"reserved console", "CONIN$", "_CONIN$", false},
+		{"reserved device with trailing space", "aux .txt", "_aux .txt", false},
+		{"reserved prefix only", "console.txt", "console.txt", false},
+		{"trailing dots and spaces", "notes. . .", "notes", false},
+		{"trailing spaces", "file.txt   ", "file.txt", false},
+		{"leading spaces", "  leading.txt", "leading.txt", false},
+		{"hidden file", ".bashrc", ".bashrc", false},
+		{"control characters", "a\x00b\nc\td.txt", "a_b_c_d.txt", false},
+		{"delete character", "del\x7f.txt", "del_.txt", false},
+		{"reserved characters", `what?<>:"|*.txt`, "what_______.txt", false},
+		{"invalid utf-8", "bad\xff.txt", "bad_.txt", false},
+		{"decomposed unicode", "e\u0301te\u0301.txt", "\u00e9t\u00e9.txt", false},
+		{"composed unicode", "\u00e9t\u00e9.txt", "\u00e9t\u00e9.txt", false},
+		{"long name keeps extension", strings.Repeat("a", 300) + ".txt", strings.Repeat("a", 251) + ".txt", false},
+		{"long name cut on a rune boundary", strings.Repeat("é", 200), strings.Repeat("é", 127), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFilename(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sanitizeFilename(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeFilename(%q) returned error: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum number of results returned by a search
+const maxSearchResults = 1000
+
+// Files bigger than this are left out of content searches
+const maxContentSearchSize = 10 << 20
+
+// Bytes of the matching line shown before the first match, and in all
+const (
+	snippetContext = 60
+	snippetLength  = 200
+)
+
+// Fold a string for matching: case folded and with accents removed, so
+// "resume" matches "Résumé"
+func foldForSearch(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		return strings.ToLower(s)
+	}
+	return folded
+}
+
+// Whether a name contains every whitespace separated term of the query
+func matchesQuery(name string, terms []string) bool {
+	folded := foldForSearch(name)
+	for _, term := range terms {
+		if !strings.Contains(folded, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// File type categories for search filters, keyed by extension
+var fileCategories = map[string][]string{
+	"images":    {".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".svg", ".heic", ".heif", ".tif", ".tiff", ".raw"},
+	"video":     {".mp4", ".mkv", ".mov", ".avi", ".webm", ".m4v", ".wmv", ".flv", ".mpg", ".mpeg"},
+	"audio":     {".mp3", ".flac", ".wav", ".ogg", ".m4a", ".aac", ".opus", ".wma"},
+	"documents": {".pdf", ".doc", ".docx", ".odt", ".rtf", ".txt", ".md", ".xls", ".xlsx", ".ods", ".csv", ".ppt", ".pptx", ".odp", ".epub"},
+	"archives":  {".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar", ".zst"},
+}
+
+// Category of a file name, or "" if it doesn't belong to one
+func fileCategory(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	for category, exts := range fileCategories {
+		for _, e := range exts {
+			if e == ext {
+				return category
+			}
+		}
+	}
+	return ""
+}
+
+// SearchFilter holds the criteria for a server-side search
+type SearchFilter struct {
+	Query    string
+	MinSize  int64 // -1 for no limit
+	MaxSize  int64 // -1 for no limit
+	After    time.Time
+	Before   time.Time
+	Category string
+	Tag      string
+	// Also look for the query in the lines of text files
+	Contents bool
+}
+
+// Parse search criteria from query parameters: q, min_size, max_size
+// (e.g. 10MB), after and before (YYYY-MM-DD), type (a file category), tag
+// and contents=1 to search inside text files
+func parseSearchFilter(values url.Values) (SearchFilter, error) {
+	filter := SearchFilter{
+		Query:    strings.TrimSpace(values.Get("q")),
+		MinSize:  -1,
+		MaxSize:  -1,
+		Category: values.Get("type"),
+		Tag:      strings.ToLower(strings.TrimSpace(values.Get("tag"))),
+		Contents: values.Get("contents") == "1",
+	}
+
+	var err error
+	if v := values.Get("min_size"); v != "" {
+		if filter.MinSize, err = parseByteSize(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := values.Get("max_size"); v != "" {
+		if filter.MaxSize, err = parseByteSize(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := values.Get("after"); v != "" {
+		if filter.After, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			return filter, fmt.Errorf("invalid date %q", v)
+		}
+	}
+	if v := values.Get("before"); v != "" {
+		if filter.Before, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			return filter, fmt.Errorf("invalid date %q", v)
+		}
+		// Include the whole of the given day
+		filter.Before = filter.Before.AddDate(0, 0, 1)
+	}
+	if _, ok := fileCategories[filter.Category]; filter.Category != "" && !ok {
+		return filter, fmt.Errorf("unknown file type %q", filter.Category)
+	}
+
+	return filter, nil
+}
+
+// Whether any criteria other than the name query are set
+func (f SearchFilter) HasFileFilters() bool {
+	return f.MinSize >= 0 || f.MaxSize >= 0 || !f.After.IsZero() || !f.Before.IsZero() || f.Category != ""
+}
+
+// Whether the filter has anything to search for
+func (f SearchFilter) IsEmpty() bool {
+	return f.Query == "" && f.Tag == "" && !f.HasFileFilters()
+}
+
+// Whether a file's metadata passes the size, date and type criteria.
+// Folders only match when no such criteria are set.
+func (f SearchFilter) matchesInfo(info fs.FileInfo) bool {
+	if info.IsDir() {
+		return !f.HasFileFilters()
+	}
+	if f.MinSize >= 0 && info.Size() < f.MinSize {
+		return false
+	}
+	if f.MaxSize >= 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if !f.After.IsZero() && info.ModTime().Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !info.ModTime().Before(f.Before) {
+		return false
+	}
+	if f.Category != "" && fileCategory(info.Name()) != f.Category {
+		return false
+	}
+	return true
+}
+
+// Snippet is the first line of a file containing the search terms, split
+// into the matching parts and the text around them
+type Snippet struct {
+	Line  int           `json:"line"`
+	Parts []SnippetPart `json:"parts"`
+}
+
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// Find the first line of a text file that contains every term, or return
+// nil if there is none. Files that look binary are skipped.
+func contentSnippet(path string, terms []string) *Snippet {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	head, _ := reader.Peek(512)
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if !utf8.ValidString(line) {
+			return nil
+		}
+		if matchesQuery(line, terms) {
+			return &Snippet{Line: n, Parts: highlightTerms(strings.TrimSpace(line), terms)}
+		}
+	}
+	return nil
+}
+
+// Split a line into parts, marking where the terms appear, and cut it down
+// to snippetLength bytes around the first of them
+func highlightTerms(line string, terms []string) []SnippetPart {
+	// Fold rune by rune, remembering where each folded byte came from, as
+	// folding can change the length of the text
+	var folded strings.Builder
+	var offsets []int
+	for i, r := range line {
+		f := foldForSearch(string(r))
+		folded.WriteString(f)
+		for range len(f) {
+			offsets = append(offsets, i)
+		}
+	}
+	offsets = append(offsets, len(line))
+	text := folded.String()
+
+	// Byte ranges of the line matching a term, merged where they overlap
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		for from := 0; ; {
+			i := strings.Index(text[from:], term)
+			if i < 0 {
+				break
+			}
+			start := from + i
+			spans = append(spans, span{offsets[start], offsets[start+len(term)]})
+			from = start + len(term)
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var merged []span
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && sp.start <= merged[n-1].end {
+			merged[n-1].end = max(merged[n-1].end, sp.end)
+			continue
+		}
+		merged = append(merged, sp)
+	}
+
+	// The window of the line shown, on rune boundaries
+	start, end := 0, len(line)
+	if len(merged) > 0 && merged[0].start > snippetContext {
+		start = merged[0].start - snippetContext
+	}
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start++
+	}
+	if end-start > snippetLength {
+		end = start + snippetLength
+		for end < len(line) && !utf8.RuneStart(line[end]) {
+			end--
+		}
+	}
+
+	var parts []SnippetPart
+	if start > 0 {
+		parts = append(parts, SnippetPart{Text: "…"})
+	}
+	pos := start
+	for _, sp := range merged {
+		if sp.end <= pos || sp.start >= end {
+			continue
+		}
+		if sp.start > pos {
+			parts = append(parts, SnippetPart{Text: line[pos:sp.start]})
+		}
+		pos = min(sp.end, end)
+		parts = append(parts, SnippetPart{Text: line[max(sp.start, start):pos], Match: true})
+	}
+	if pos < end {
+		parts = append(parts, SnippetPart{Text: line[pos:end]})
+	}
+	if end < len(line) {
+		parts = append(parts, SnippetPart{Text: "…"})
+	}
+	return parts
+}
+
+// Search the tree below relativePath for files and folders matching filter,
+// skipping the folders canRead refuses. With filter.Contents, text files
+// whose name doesn't match are also searched line by line.
+func searchFiles(baseDir, relativePath string, filter SearchFilter, tags *TagStore, canRead func(string) bool) ([]FileInfo, error) {
+	root, err := safeJoinPath(baseDir, relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FileInfo{}
+	if filter.IsEmpty() {
+		return results, nil
+	}
+	terms := strings.Fields(foldForSearch(filter.Query))
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if len(results) >= maxSearchResults {
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() && !canRead(rel) {
+			return filepath.SkipDir
+		}
+		if d.Name() == accessFileName {
+			return nil
+		}
+		nameMatches := matchesQuery(d.Name(), terms)
+		if !nameMatches && !(filter.Contents && len(terms) > 0 && d.Type().IsRegular()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !filter.matchesInfo(info) {
+			return nil
+		}
+		if filter.Tag != "" && !tags.Has(rel, filter.Tag) {
+			return nil
+		}
+
+		fileInfo := newFileInfo(d.Name(), rel, info)
+		if !nameMatches {
+			if info.Size() > maxContentSearchSize {
+				return nil
+			}
+			if fileInfo.Snippet = contentSnippet(path, terms); fileInfo.Snippet == nil {
+				return nil
+			}
+		}
+		fileInfo.Tags = tags.Get(rel)
+		results = append(results, fileInfo)
+		return nil
+	})
+	return results, err
+}
+
+// Template for the search results page
+const searchTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Search - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        .search-form {
+            margin: 15px 0;
+            display: flex;
+        }
+        .search-form input[type=text] {
+            flex: 1;
+            padding: 8px 12px;
+            border: 1px solid #ccc;
+            border-radius: 4px;
+            font-size: 14px;
+        }
+        .search-form button {
+            margin-left: 8px;
+            padding: 8px 16px;
+            background-color: #0277bd;
+            color: white;
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+        .filters {
+            margin: 10px 0;
+            padding: 10px;
+            background-color: #f0f0f0;
+            border-radius: 4px;
+        }
+        .filters label {
+            display: inline-block;
+            margin: 4px 12px 4px 0;
+            font-size: 14px;
+        }
+        .filters input, .filters select {
+            padding: 4px;
+        }
+        .error {
+            color: #c62828;
+        }
+        .result {
+            margin: 5px 0;
+            padding: 8px;
+            background-color: #f5f5f5;
+            border-radius: 4px;
+        }
+        .result.dir {
+            background-color: #e1f5fe;
+        }
+        .tag {
+            display: inline-block;
+            margin-left: 6px;
+            padding: 1px 6px;
+            font-size: 12px;
+            background-color: #fff3e0;
+            color: #e65100;
+            border-radius: 10px;
+        }
+        .result-path {
+            color: #666;
+            font-size: 12px;
+        }
+        .snippet {
+            margin-top: 4px;
+            font-family: monospace;
+            font-size: 12px;
+            color: #333;
+            white-space: pre-wrap;
+            word-break: break-all;
+        }
+        .snippet mark {
+            background-color: #fff176;
+        }
+        .snippet-line {
+            color: #999;
+        }
+    </style>
+</head>
+<body>
+    <h1>Search</h1>
+    <p><a href="./?path={{.Path}}">&larr; Back to files</a></p>
+    <form class="search-form" id="search" action="search" method="get">
+        <input type="text" name="q" value="{{.Query}}" placeholder="Search files and folders..." autofocus>
+        <input type="hidden" name="path" value="{{.Path}}">
+        <button type="submit">Search</button>
+    </form>
+    <label><input type="checkbox" name="contents" value="1" form="search" {{if .Filter.Contents}}checked{{end}}> Search inside text files</label>
+    <details class="filters" {{if or .Filter.HasFileFilters .Filter.Tag}}open{{end}}>
+        <summary>Filters</summary>
+        <form action="search" method="get">
+            <input type="hidden" name="q" value="{{.Query}}">
+            <input type="hidden" name="path" value="{{.Path}}">
+            {{if .Filter.Contents}}<input type="hidden" name="contents" value="1">{{end}}
+            <label>Min size <input type="text" name="min_size" value="{{.Values.Get "min_size"}}" placeholder="e.g. 10MB" size="8"></label>
+            <label>Max size <input type="text" name="max_size" value="{{.Values.Get "max_size"}}" placeholder="e.g. 1GB" size="8"></label>
+            <br>
+            <label>Modified after <input type="date" name="after" value="{{.Values.Get "after"}}"></label>
+            <label>Modified before <input type="date" name="before" value="{{.Values.Get "before"}}"></label>
+            <br>
+            <label>Type
+                <select name="type">
+                    <option value="">Any</option>
+                    {{range .Categories}}
+                    <option value="{{.}}" {{if eq . $.Filter.Category}}selected{{end}}>{{.}}</option>
+                    {{end}}
+                </select>
+            </label>
+            <label>Tag
+                <select name="tag">
+                    <option value="">Any</option>
+                    {{range .Tags}}
+                    <option value="{{.}}" {{if eq . $.Filter.Tag}}selected{{end}}>{{.}}</option>
+                    {{end}}
+                </select>
+            </label>
+            <button type="submit">Apply filters</button>
+        </form>
+    </details>
+    {{if .Error}}
+    <p class="error">{{.Error}}</p>
+    {{else if not .Filter.IsEmpty}}
+    <p>{{len .Results}} result(s){{if .Query}} for "{{.Query}}"{{end}}{{if .Path}} in /{{.Path}}{{end}}{{if .Truncated}} (showing the first {{len .Results}}){{end}}</p>
+    {{range .Results}}
+    <div class="result{{if .IsDir}} dir{{end}}">
+        {{if .IsDir}}
+        📁 <a href="./?path={{.Path}}">{{.Name}}</a>
+        {{else}}
+        <a href="download/{{.Path}}">{{.Name}}</a> ({{.Size}} bytes)
+        {{end}}
+        {{range .Tags}}<a href="search?tag={{.}}" class="tag">#{{.}}</a>{{end}}
+        <div class="result-path">/{{.Path}}</div>
+        {{with .Snippet}}<div class="snippet"><span class="snippet-line">{{.Line}}:</span> {{range .Parts}}{{if .Match}}<mark>{{.Text}}</mark>{{else}}{{.Text}}{{end}}{{end}}</div>{{end}}
+    </div>
+    {{end}}
+    {{end}}
+</body>
+</html>
+`
+
+// Handler for server-side search across the whole tree; format=json returns
+// the results as JSON
+func searchHandler(config Config, tags *TagStore, rules *AccessRules) http.Handler {
+	tmpl := template.Must(template.New("search").Parse(searchTemplate))
+	categories := make([]string, 0, len(fileCategories))
+	for category := range fileCategories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		path := cleanRelPath(values.Get("path"))
+
+		var results []FileInfo
+		var errMessage string
+		filter, err := parseSearchFilter(values)
+		if err == nil {
+			canRead := func(rel string) bool { return rules.Allowed(r, rel, false) }
+			results, err = searchFiles(config.DownloadDir, path, filter, tags, canRead)
+		}
+
+		if values.Get("format") == "json" {
+			if err != nil {
+				http.Error(w, "Error searching: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+
+		if err != nil {
+			errMessage = err.Error()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = tmpl.Execute(w, struct {
+			Query      string
+			Path       string
+			Values     url.Values
+			Filter     SearchFilter
+			Categories []string
+			Tags       []string
+			Results    []FileInfo
+			Truncated  bool
+			Error      string
+		}{
+			Query:      filter.Query,
+			Path:       path,
+			Values:     values,
+			Filter:     filter,
+			Categories: categories,
+			Tags:       tags.All(),
+			Results:    results,
+			Truncated:  len(results) >= maxSearchResults,
+			Error:      errMessage,
+		})
+		if err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
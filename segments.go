@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits for splitting a file into segments
+const (
+	defaultSegments = 4
+	maxSegments     = 64
+	minSegmentSize  = 1 << 20
+)
+
+// Strong validator for a file's content. Size and modification time down
+// to the nanosecond change whenever the file is rewritten, so clients can
+// safely combine ranges fetched with the same ETag.
+func fileETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// Segment is one byte range of a file, inclusive at both ends
+type Segment struct {
+	Index int    `json:"index"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	Range string `json:"range"`
+}
+
+// SegmentPlan tells a client how to fetch a file over parallel connections
+type SegmentPlan struct {
+	Path     string    `json:"path"`
+	URL      string    `json:"url"`
+	Size     int64     `json:"size"`
+	ETag     string    `json:"etag"`
+	Modified time.Time `json:"modified"`
+	Segments []Segment `json:"segments"`
+}
+
+// Split size bytes into at most parts segments of at least minSegmentSize
+func planSegments(size int64, parts int) []Segment {
+	if size == 0 {
+		return []Segment{}
+	}
+	parts = max(1, min(parts, maxSegments))
+	if n := int((size + minSegmentSize - 1) / minSegmentSize); n < parts {
+		parts = n
+	}
+
+	segments := make([]Segment, parts)
+	segmentSize := size / int64(parts)
+	for i := range segments {
+		start := int64(i) * segmentSize
+		end := start + segmentSize - 1
+		if i == parts-1 {
+			end = size - 1
+		}
+		segments[i] = Segment{
+			Index: i,
+			Start: start,
+			End:   end,
+			Range: fmt.Sprintf("bytes=%d-%d", start, end),
+		}
+	}
+	return segments
+}
+
+// Handler describing how to download a file in parallel segments. Clients
+// fetch each segment from /download/ with its Range and an If-Range of the
+// ETag, so a file that changes midway yields a full response instead of
+// mismatched pieces. Takes the number of "segments" wanted, default 4.
+func segmentsHandler(files fs.FS, encryption *AtRestEncryption, dedup *DedupStore, burns *BurnStore, downloads *DownloadLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/segments/"))
+		if filePath == "" {
+			http.Error(w, "No file specified", http.StatusBadRequest)
+			return
+		}
+
+		info, err := fs.Stat(files, filePath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "File not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if info.IsDir() {
+			http.Error(w, "Cannot download directories", http.StatusBadRequest)
+			return
+		}
+
+		// Encrypted files are decrypted as a stream and each request to a
+		// burn-after-reading file uses up a download
+		if encryption.Covers(filePath) {
+			http.Error(w, "Encrypted files cannot be downloaded in segments", http.StatusConflict)
+			return
+		}
+		if dedup.Covers(filePath) {
+			http.Error(w, "Deduplicated files cannot be downloaded in segments", http.StatusConflict)
+			return
+		}
+		if burns.Remaining(filePath) >= 0 {
+			http.Error(w, "Files with a download limit cannot be downloaded in segments", http.StatusConflict)
+			return
+		}
+
+		parts := defaultSegments
+		if v := r.URL.Query().Get("segments"); v != "" {
+			parts, err = strconv.Atoi(v)
+			if err != nil || parts < 1 {
+				http.Error(w, "Invalid segment count", http.StatusBadRequest)
+				return
+			}
+		}
+		// Don't plan more connections than the client may open
+		if downloads != nil {
+			parts = min(parts, downloads.limit)
+		}
+
+		plan := SegmentPlan{
+			Path:     filePath,
+			URL:      basePathOf(r) + "/download/" + (&url.URL{Path: filePath}).EscapedPath(),
+			Size:     info.Size(),
+			ETag:     fileETag(info),
+			Modified: info.ModTime().UTC(),
+			Segments: planSegments(info.Size(), parts),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", plan.ETag)
+		json.NewEncoder(w).Encode(plan)
+	})
+}
@@ -0,0 +1,984 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Server holds the state and handlers of a running file server
+type Server struct {
+	config Config
+
+	// Read access to the served directory for listings, downloads and
+	// segmented downloads. Every other handler, and all writes, work on
+	// config.DownloadDir on disk.
+	files fs.FS
+
+	signer  *URLSigner
+	apiKeys []APIKey
+	lockout *AuthLockout
+	auth    *PasswordAuth
+	rules   *AccessRules
+
+	db          *sql.DB
+	stats       *StatsStore
+	burns       *BurnStore
+	tags        *TagStore
+	favorites   *FavoritesStore
+	visits      *VisitStore
+	snapshots   *SnapshotStore
+	locks       *LockStore
+	appends     *AppendLocks
+	clipboard   *Clipboard
+	codes       *ShareCodeStore
+	uploadKeys  *UploadKeys
+	guests      *GuestUploadStore
+	direct      *DirectRooms
+	clients     *ClientTracker
+	chunked     *ChunkedUploads
+	thumbs      *ThumbnailCache
+	transcoder  *Transcoder
+	archives    *ArchiveCache
+	index       *TreeIndex
+	watcher     *FileWatcher
+	checksums   *ChecksumStore
+	torrents    *TorrentCache
+	mirror      *Mirror
+	quarantine  *QuarantineStore
+	encryption  *AtRestEncryption
+	dedup       *DedupStore
+	uploadTypes UploadTypeFilter
+	events      *EventBus
+	transfers   *TransferTracker
+	downloads   *DownloadLimiter
+	bandwidth   *BandwidthLimiter
+	smallFiles  *SmallFileCache
+	budget      *TransferBudget
+	disk        *DiskMonitor
+
+	hosts *HostAllowlist
+
+	tmpl    *template.Template
+	handler http.Handler
+	http    *http.Server
+}
+
+// Create a server for config, loading persistent state from its data
+// directory. Folders are listed and files downloaded through files, or
+// straight from config.DownloadDir when files is nil; the other handlers
+// always use config.DownloadDir, so files should show the same tree.
+func NewServer(config Config, files fs.FS) (*Server, error) {
+	if _, err := os.Stat(config.DownloadDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("download directory does not exist: %s", config.DownloadDir)
+	}
+
+	// With an absolute root every joined path is absolute too, which lets
+	// the os package add the \\?\ prefix on Windows for paths longer than
+	// MAX_PATH (260 characters)
+	root, err := filepath.Abs(config.DownloadDir)
+	if err != nil {
+		return nil, err
+	}
+	config.DownloadDir = root
+
+	if files == nil {
+		files = os.DirFS(config.DownloadDir)
+	}
+
+	config.BasePath = cleanBasePath(config.BasePath)
+	s := &Server{config: config, files: files}
+
+	// Signed URLs let other services grant short-lived access
+	if config.URLSecret != "" {
+		s.signer = newURLSigner(config.URLSecret)
+	}
+
+	// Static API keys for scripts
+	if config.APIKeysFile != "" {
+		s.apiKeys, err = loadAPIKeys(config.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading API keys: %w", err)
+		}
+		if len(s.apiKeys) == 0 {
+			return nil, fmt.Errorf("no API keys found in %s", config.APIKeysFile)
+		}
+	}
+
+	// Failed attempts are counted within the lockout period itself
+	s.lockout = newAuthLockout(config.LockoutAttempts, config.LockoutDuration, config.LockoutDuration)
+
+	// Ensure the data directory exists and load persistent state
+	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	if s.db, err = openDatabase(config.DataDir); err != nil {
+		return nil, fmt.Errorf("opening state database: %w", err)
+	}
+
+	// Password, with an optional authenticator app code
+	if config.TOTP && config.Password == "" {
+		return nil, fmt.Errorf("-totp requires -password")
+	}
+	var totpSecret []byte
+	if config.TOTP {
+		if totpSecret, err = loadOrCreateTOTPSecret(filepath.Join(config.DataDir, "totp.secret")); err != nil {
+			return nil, fmt.Errorf("loading TOTP secret: %w", err)
+		}
+	}
+	if s.auth, err = openPasswordAuth(config.Password, totpSecret, s.db, config.DataDir, s.lockout); err != nil {
+		return nil, fmt.Errorf("loading sessions: %w", err)
+	}
+	if config.AccessFiles {
+		s.rules = newAccessRules(config.DownloadDir, s.auth)
+	}
+
+	if s.stats, err = openStatsStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading download stats: %w", err)
+	}
+	if s.burns, err = openBurnStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading download limits: %w", err)
+	}
+	if s.tags, err = openTagStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading tags: %w", err)
+	}
+	if s.favorites, err = openFavoritesStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading favorites: %w", err)
+	}
+	if s.visits, err = openVisitStore(config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading visits: %w", err)
+	}
+	if s.snapshots, err = openSnapshotStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("opening snapshots: %w", err)
+	}
+	if s.chunked, err = openChunkedUploads(config.DataDir); err != nil {
+		return nil, fmt.Errorf("opening partial uploads: %w", err)
+	}
+	if s.clipboard, err = openClipboard(config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading clipboard: %w", err)
+	}
+	if s.codes, err = openShareCodeStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading share codes: %w", err)
+	}
+	s.uploadKeys = newUploadKeys(s.db)
+	if s.guests, err = openGuestUploadStore(s.db, config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading guest upload links: %w", err)
+	}
+	s.direct = newDirectRooms()
+
+	// Clients seen recently, for the -tui dashboard
+	if config.TUI {
+		s.clients = newClientTracker()
+	}
+
+	// Video poster frames, when ffmpeg is installed
+	thumbnailCache, err := parseByteSize(config.ThumbnailCache)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -thumbnail-cache: %w", err)
+	}
+	if s.thumbs, err = openThumbnailCache(config.DataDir, thumbnailCache); err != nil {
+		return nil, fmt.Errorf("setting up thumbnails: %w", err)
+	}
+
+	// Converting videos browsers can't play
+	if config.Transcode {
+		if config.TranscodeJobs < 1 {
+			return nil, fmt.Errorf("invalid -transcode-jobs: %d", config.TranscodeJobs)
+		}
+		s.transcoder = newTranscoder(config.TranscodeJobs)
+	}
+
+	// Background walks of the tree for warm caches and folder sizes
+	s.index = startTreeIndex(config.DownloadDir, config.IndexInterval)
+
+	// Folder archives built for download
+	if s.archives, err = openArchiveCache(config.DataDir); err != nil {
+		return nil, fmt.Errorf("setting up archive cache: %w", err)
+	}
+
+	if s.checksums, err = openChecksumStore(config.DataDir); err != nil {
+		return nil, fmt.Errorf("loading checksums: %w", err)
+	}
+
+	// Torrents of big files, with this server as web seed and tracker
+	if s.torrents, err = openTorrentCache(config.DataDir, config.Torrent); err != nil {
+		return nil, fmt.Errorf("setting up torrents: %w", err)
+	}
+
+	// Uploads awaiting approval when quarantine is enabled
+	if config.Quarantine {
+		if s.quarantine, err = openQuarantine(config.DataDir); err != nil {
+			return nil, fmt.Errorf("opening quarantine area: %w", err)
+		}
+	}
+
+	// Encryption at rest for the protected subfolder
+	if config.EncryptDir != "" {
+		keyFile := config.EncryptKeyFile
+		if keyFile == "" {
+			keyFile = filepath.Join(config.DataDir, "encryption.key")
+		}
+		if s.encryption, err = newAtRestEncryption(config.EncryptDir, keyFile); err != nil {
+			return nil, fmt.Errorf("setting up encryption: %w", err)
+		}
+		logf("Uploads to %s are encrypted at rest", s.encryption.Folder)
+	}
+
+	// Deduplicated storage for the folder of images and backups
+	if config.DedupDir != "" {
+		if s.dedup, err = openDedupStore(config.DedupDir, config.DownloadDir, config.DataDir); err != nil {
+			return nil, fmt.Errorf("setting up deduplication: %w", err)
+		}
+		if s.encryption != nil && (s.encryption.Covers(s.dedup.Folder) || s.dedup.Covers(s.encryption.Folder)) {
+			return nil, errors.New("-dedup-dir and -encrypt-dir cannot overlap")
+		}
+		logf("Uploads to %s are stored deduplicated", s.dedup.Folder)
+	}
+
+	// Restrictions on what may be uploaded
+	s.uploadTypes = newUploadTypeFilter(config.AllowUploadTypes, config.DenyUploadTypes)
+
+	// Recent uploads, downloads and deletes for the activity feed
+	s.events = newEventBus(500)
+
+	// Uploads and downloads in progress, for speed and ETA displays
+	s.transfers = newTransferTracker()
+	s.downloads = newDownloadLimiter(config.MaxClientDownloads)
+
+	// Advisory locks of files being edited
+	s.locks = newLockStore()
+	s.appends = newAppendLocks()
+
+	// Post chat notifications for the selected event types
+	notifyTypes, err := parseEventTypes(config.NotifyEvents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -notify-events: %w", err)
+	}
+	var notifiers []Notifier
+	for kind, url := range map[string]string{"slack": config.NotifySlack, "discord": config.NotifyDiscord, "matrix": config.NotifyMatrix} {
+		if url != "" {
+			notifiers = append(notifiers, Notifier{Kind: kind, URL: url})
+		}
+	}
+	subscribeNotifiers(s.events, notifiers, notifyTypes)
+
+	// Changes on disk, whoever makes them
+	if config.Watch {
+		if s.watcher, err = startFileWatcher(config.DownloadDir, s.events); err != nil {
+			return nil, fmt.Errorf("watching %s: %w", config.DownloadDir, err)
+		}
+	}
+
+	// Drop tags of deleted files
+	s.events.Subscribe(func(e Event) {
+		if e.Type == EventDelete {
+			s.tags.Forget(e.Path)
+		}
+	})
+
+	// Parse the HTML template
+	s.tmpl, err = template.New("fileList").Funcs(template.FuncMap{
+		"isArchive": isExtractableArchive,
+		"isVideo":   isVideo,
+		"isHEIC":    isHEIC,
+		"static":    staticURL,
+	}).Parse(htmlTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+
+	// Expiry deletes files, which append-only mode promises never to do
+	if config.AppendOnly && len(config.ExpireAfter) > 0 {
+		return nil, fmt.Errorf("-expire-after cannot be used with -append-only")
+	}
+
+	// Pull files from another instance
+	if s.mirror, err = newMirror(config.Mirror, config.MirrorKey, config.DownloadDir, config.AppendOnly); err != nil {
+		return nil, fmt.Errorf("invalid -mirror: %w", err)
+	}
+
+	// Warn before the served volume fills up
+	minFree, err := parseByteSize(config.MinFreeSpace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -min-free-space: %w", err)
+	}
+	s.disk = startDiskMonitor(config.DownloadDir, minFree, s.events)
+
+	maxBandwidth, err := parseByteSize(config.MaxBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-bandwidth: %w", err)
+	}
+	s.bandwidth = newBandwidthLimiter(maxBandwidth)
+
+	maxBytes, err := parseByteSize(config.MaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -max-bytes: %w", err)
+	}
+	s.budget = newTransferBudget(maxBytes)
+
+	mmapCache, err := parseByteSize(config.MmapCache)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -mmap-cache: %w", err)
+	}
+	s.smallFiles = newSmallFileCache(mmapCache)
+
+	mux, err := s.routes()
+	if err != nil {
+		return nil, err
+	}
+	// S3 clients authenticate with their own signatures
+	handler := passwordAuth(accessRulesFilter(mux, s.rules), s.auth, parsePublicFolders(config.Public))
+	if config.S3 {
+		if (config.S3AccessKey == "") != (config.S3SecretKey == "") {
+			return nil, fmt.Errorf("-s3-access-key and -s3-secret-key must be set together")
+		}
+		if config.Password != "" && config.S3SecretKey == "" {
+			return nil, fmt.Errorf("-s3 with -password requires -s3-access-key and -s3-secret-key")
+		}
+		handler = s3Dispatch(handler, localNetworkFilter(http.HandlerFunc(s.handleS3), config.LocalOnly))
+	}
+	s.hosts = newHostAllowlist(config.AllowedHosts)
+	hours, err := parseServiceHours(config.Hours)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -hours: %w", err)
+	}
+	s.handler = requestIDs(accessLog(trackClients(hostFilter(crossSiteFilter(serviceHoursFilter(withBasePath(apiKeyAuth(signedURLs(handler, s.signer, s.lockout), s.apiKeys, s.lockout), config.BasePath), hours)), s.hosts), s.clients)))
+	s.http = &http.Server{
+		Addr:        fmt.Sprintf(":%d", config.Port),
+		Handler:     s.handler,
+		ConnContext: listenContext,
+	}
+	s.http.RegisterOnShutdown(s.clipboard.Close)
+	s.http.RegisterOnShutdown(s.direct.Close)
+	if s.index != nil {
+		s.http.RegisterOnShutdown(s.index.Close)
+	}
+	if s.watcher != nil {
+		s.http.RegisterOnShutdown(s.watcher.Close)
+	}
+
+	return s, nil
+}
+
+// Set up the routes with local network filtering
+func (s *Server) routes() (*http.ServeMux, error) {
+	config := s.config
+	mux := http.NewServeMux()
+	var home http.Handler = http.HandlerFunc(s.handleHome)
+	if config.Git {
+		home = gitDumbHTTP(home, config, s.encryption, s.dedup, s.rules)
+	}
+	mux.Handle("/", localNetworkFilter(home, config.LocalOnly))
+	mux.Handle("/list", localNetworkFilter(http.HandlerFunc(s.handleList), config.LocalOnly))
+	mux.Handle("/download/", localNetworkFilter(limitDownloads(budgetDownloads(http.HandlerFunc(s.handleDownload), s.budget), s.downloads), config.LocalOnly))
+	mux.Handle("/archive/", localNetworkFilter(limitDownloads(budgetDownloads(http.HandlerFunc(s.handleArchive), s.budget), s.downloads), config.LocalOnly))
+	mux.Handle("/checksums/", localNetworkFilter(http.HandlerFunc(s.handleChecksums), config.LocalOnly))
+	admin := adminHandler(config, s.quarantine, s.burns, s.snapshots, s.guests, s.checksums, s.encryption, s.dedup, s.uploadTypes, s.events, s.transfers)
+	mux.Handle("/admin", admin)
+	mux.Handle("/admin/", admin)
+	mux.Handle("/search", localNetworkFilter(searchHandler(config, s.tags, s.rules), config.LocalOnly))
+	mux.Handle("/recent", localNetworkFilter(recentHandler(config, s.tags, s.rules), config.LocalOnly))
+	mux.Handle("/tags", localNetworkFilter(tagsHandler(s.tags, s.rules), config.LocalOnly))
+	mux.Handle("/extract", localNetworkFilter(extractHandler(config, s.encryption, s.dedup, s.uploadTypes, s.events), config.LocalOnly))
+	mux.Handle("/compress", localNetworkFilter(compressHandler(config, s.encryption, s.dedup, s.events, s.rules, s.locks), config.LocalOnly))
+	mux.Handle("/transfers/", localNetworkFilter(transferStatusHandler(s.transfers), config.LocalOnly))
+	mux.Handle("/segments/", localNetworkFilter(segmentsHandler(s.files, s.encryption, s.dedup, s.burns, s.downloads), config.LocalOnly))
+	mux.Handle("/delta/", localNetworkFilter(deltaHandler(config, s.encryption, s.dedup, s.uploadTypes, s.events, s.transfers, s.locks), config.LocalOnly))
+	mux.Handle("/upload/", localNetworkFilter(http.HandlerFunc(s.handleChunkedUpload), config.LocalOnly))
+	mux.Handle("/append/", localNetworkFilter(http.HandlerFunc(s.handleAppend), config.LocalOnly))
+	mux.Handle("/lock", localNetworkFilter(lockHandler(s.locks), config.LocalOnly))
+	mux.Handle("/duplicate", localNetworkFilter(duplicateHandler(config, s.events), config.LocalOnly))
+	mux.Handle("/favorites", localNetworkFilter(favoritesHandler(s.favorites), config.LocalOnly))
+	mux.Handle("/activity", localNetworkFilter(activityHandler(s.events, s.rules), config.LocalOnly))
+	mux.Handle("/stats", localNetworkFilter(statsHandler(s.stats, s.rules), config.LocalOnly))
+	clipboard := localNetworkFilter(clipboardHandler(s.clipboard), config.LocalOnly)
+	mux.Handle("/code", localNetworkFilter(shareCodeHandler(config, s.codes, s.lockout), config.LocalOnly))
+	mux.Handle("/clipboard", clipboard)
+	mux.Handle("/clipboard/", clipboard)
+	direct := localNetworkFilter(directHandler(s.direct, s.lockout), config.LocalOnly)
+	mux.Handle("/direct", direct)
+	mux.Handle("/direct/", direct)
+	favicon, err := faviconHandler(config)
+	if err != nil {
+		return nil, fmt.Errorf("loading favicon: %w", err)
+	}
+	mux.Handle("/favicon.ico", favicon)
+	static, err := staticHandler()
+	if err != nil {
+		return nil, fmt.Errorf("loading static assets: %w", err)
+	}
+	mux.Handle("/static/", static)
+	mux.Handle("/thumb/", localNetworkFilter(thumbnailHandler(config, s.thumbs, s.encryption, s.dedup, s.smallFiles), config.LocalOnly))
+	mux.Handle("/preview/", localNetworkFilter(previewHandler(config, s.thumbs, s.encryption, s.dedup), config.LocalOnly))
+	mux.Handle("/play", localNetworkFilter(playerHandler(config, s.transcoder), config.LocalOnly))
+	mux.Handle("/transcode/", localNetworkFilter(transcodeHandler(config, s.transcoder, s.encryption, s.dedup), config.LocalOnly))
+	mux.Handle("/torrent/", localNetworkFilter(torrentHandler(config, s.torrents, s.encryption, s.dedup), config.LocalOnly))
+	if s.watcher != nil {
+		mux.Handle("/changes", localNetworkFilter(changesHandler(s.watcher, s.rules), config.LocalOnly))
+	}
+	mux.Handle("/announce", localNetworkFilter(trackerHandler(s.torrents), config.LocalOnly))
+	if s.auth != nil {
+		login := loginHandler(s.auth)
+		mux.Handle("/login", login)
+		mux.Handle("/logout", login)
+	}
+	// The link is the credential, so guests can upload from anywhere
+	mux.Handle("/guest/", s.guestUploadHandler())
+	mux.Handle("/qr/", localNetworkFilter(qrHandler(config), config.LocalOnly))
+	return mux, nil
+}
+
+// Accept requests addressed to another host name, such as a tunnel's
+// public name
+func (s *Server) AllowHost(host string) {
+	s.hosts.Allow(host)
+}
+
+// The server's HTTP handler, including authentication middleware
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Start background tasks and serve requests on the listeners until Stop is
+// called
+func (s *Server) Start(listeners ...net.Listener) error {
+	// Clean up old files in the background
+	startJanitor(s.config.DownloadDir, s.config.ExpireAfter, s.events)
+	s.mirror.Start(s.config.MirrorInterval)
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			err := s.http.Serve(listener)
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errs <- err
+		}()
+	}
+	// Serving ends on all listeners at once when the server stops
+	for range listeners {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop accepting connections and wait for in-flight requests to finish or
+// ctx to be done
+func (s *Server) Stop(ctx context.Context) error {
+	return s.http.Shutdown(ctx)
+}
+
+// Handler for the home page (file listing and upload form)
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Get the requested path from query parameter
+	requestedPath := r.URL.Query().Get("path")
+	// Clean and validate the path
+	requestedPath = strings.TrimPrefix(requestedPath, "/")
+
+	if r.Method == "POST" {
+		// A retried upload that already went through is answered with its
+		// first outcome rather than stored again
+		var uploadedTo string
+		if header := r.Header.Get("Idempotency-Key"); header != "" {
+			key := transferID(header)
+			if key == "" {
+				http.Error(w, "Invalid Idempotency-Key: "+header, http.StatusBadRequest)
+				return
+			}
+			client := uploadKeyClient(r, s.auth)
+			location, busy, err := s.uploadKeys.Begin(client, key)
+			switch {
+			case err != nil:
+				http.Error(w, "Error checking upload: "+err.Error(), http.StatusInternalServerError)
+				return
+			case busy:
+				http.Error(w, "An upload with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			case location != "":
+				debugf("Upload %s from %s already received, not storing it again", key, clientIP(r))
+				w.Header().Set("Idempotent-Replayed", "true")
+				redirect(w, r, location, http.StatusSeeOther)
+				return
+			}
+			defer func() {
+				if err := s.uploadKeys.Finish(client, key, uploadedTo); err != nil {
+					log.Printf("Error recording upload %s: %v", key, err)
+				}
+			}()
+		}
+
+		// Count the request body as it arrives so the uploading page and
+		// the admin dashboard can show speed and time remaining
+		transferPath := requestedPath
+		if name, err := url.PathUnescape(r.Header.Get("X-Upload-Name")); err == nil && name != "" {
+			transferPath = cleanRelPath(path.Join(requestedPath, path.Base(name)))
+		}
+		transfer := s.transfers.Start(transferID(r.Header.Get("X-Upload-ID")), "upload", transferPath, clientIP(r), r.ContentLength)
+		defer s.transfers.Finish(transfer)
+		r.Body = countingReader{r.Body, transfer}
+
+		// Fail fast rather than running out of space halfway through. The
+		// body is spooled to the temporary directory before it is saved.
+		dirs := []string{s.config.DownloadDir, os.TempDir()}
+		if s.quarantine != nil {
+			dirs = append(dirs, s.config.DataDir)
+		}
+		if err := checkDiskSpace(r.ContentLength, dirs...); err != nil {
+			log.Printf("Rejected upload from %s: %v", clientIP(r), err)
+			http.Error(w, "Upload rejected: "+err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+
+		// Handle file upload
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving file from form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		// Never trust the client supplied name to be a plain file name
+		filename, err := sanitizeFilename(header.Filename)
+		if err != nil {
+			http.Error(w, "Invalid file name: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Reject disallowed file types before storing anything
+		upload, err := s.uploadTypes.Check(filename, file)
+		if err != nil {
+			log.Printf("Rejected upload of %s from %s: %v", filename, clientIP(r), err)
+			http.Error(w, "Upload rejected: "+err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Get the target path for uploading
+		targetPath := r.FormValue("path")
+		if s.rules != nil && (filename == accessFileName || !s.rules.Allowed(r, targetPath, true)) {
+			log.Printf("Blocked upload of %s to %s by access rules for %s", filename, targetPath, clientIP(r))
+			http.Error(w, "Access denied: not allowed by the folder's access rules", http.StatusForbidden)
+			return
+		}
+
+		// Create the target directory if it doesn't exist yet
+		uploadDir, err := safeJoinPath(s.config.DownloadDir, targetPath)
+		if err != nil {
+			http.Error(w, "Invalid upload path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Don't replace a file someone else is editing
+		if lock := s.locks.Conflict(cleanRelPath(filepath.Join(targetPath, filename)), lockToken(r)); lock != nil {
+			writeLockConflict(w, lock)
+			return
+		}
+
+		// Only replace the file if it is still the version the client expects
+		if !writePreconditionsMet(r, writeTarget(filepath.Join(uploadDir, filename))) {
+			http.Error(w, "Upload rejected: the file is not the version the request expects", http.StatusPreconditionFailed)
+			return
+		}
+
+		// Let hooks veto the upload before anything is stored
+		if err := runHooks(&HookEvent{
+			Point:  HookPreUpload,
+			Path:   cleanRelPath(filepath.Join(targetPath, filename)),
+			Client: clientIP(r),
+			Size:   header.Size,
+		}); err != nil {
+			log.Printf("Upload of %s from %s rejected by hook: %v", filename, clientIP(r), err)
+			http.Error(w, "Upload rejected: "+err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// Optionally delete the file after a number of downloads
+		maxDownloads, _ := strconv.Atoi(r.FormValue("max_downloads"))
+		extract := r.FormValue("extract") != ""
+		if s.config.AppendOnly {
+			// Both would remove a file later on
+			if maxDownloads > 0 {
+				http.Error(w, "Upload rejected: "+appendOnlyMessage, http.StatusForbidden)
+				return
+			}
+			extract = false
+		}
+
+		// Redirect back to the same path
+		redirectURL := "/"
+		if targetPath != "" {
+			redirectURL += "?path=" + targetPath
+		}
+
+		// Hold the upload for review instead of publishing it
+		if s.quarantine != nil {
+			item, err := s.quarantine.Add(upload, filename, targetPath, clientIP(r), maxDownloads, extract)
+			if err != nil {
+				http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logf("File held for approval: %s to %s (%s)", item.Filename, targetPath, item.ID)
+			uploadedTo = redirectURL + "#pending"
+			redirect(w, r, uploadedTo, http.StatusSeeOther)
+			return
+		}
+
+		// Make sure the directory exists
+		err = os.MkdirAll(uploadDir, 0755)
+		if err != nil {
+			http.Error(w, "Error creating directory: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Never replace a file in append-only mode; store a new version
+		// next to it instead
+		if s.config.AppendOnly {
+			versioned, err := versionedName(filepath.Join(uploadDir, filename))
+			if err != nil {
+				http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			filename = filepath.Base(versioned)
+		}
+
+		// Replace rather than truncate an existing file, which may be hard
+		// linked to copies that should keep their content
+		if s.config.HardlinkCopies && !s.config.AppendOnly {
+			os.Remove(filepath.Join(uploadDir, filename))
+		}
+
+		// Create a new file in the target directory
+		out, err := os.Create(filepath.Join(uploadDir, filename))
+		if err != nil {
+			http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer out.Close()
+
+		// Copy the uploaded file to the destination file, encrypting it
+		// first if it lands in the protected folder
+		if s.encryption.Covers(filepath.Join(targetPath, filename)) {
+			_, err = s.encryption.Encrypt(out, upload)
+		} else if s.dedup.Covers(filepath.Join(targetPath, filename)) {
+			_, err = s.dedup.Store(out, upload)
+		} else {
+			_, err = io.Copy(out, upload)
+		}
+		if err != nil {
+			http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Unpack archives on request, replacing the archive with its contents
+		if extract && isExtractableArchive(filename) && !s.encryption.Covers(targetPath) && !s.dedup.Covers(targetPath) {
+			out.Close()
+			archivePath := filepath.Join(uploadDir, filename)
+			count, err := extractArchive(archivePath, uploadDir, s.uploadTypes)
+			os.Remove(archivePath)
+			if err != nil {
+				http.Error(w, "Error extracting archive: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			logf("Uploaded archive %s extracted to %s (%d files)", filename, targetPath, count)
+			s.events.Publish(Event{Type: EventUpload, Path: cleanRelPath(filepath.Join(targetPath, filename)) + " (extracted)", Client: clientIP(r), RequestID: requestID(r)})
+			uploadedTo = redirectURL
+			redirect(w, r, uploadedTo, http.StatusSeeOther)
+			return
+		}
+
+		logf("File uploaded successfully: %s to %s", filename, targetPath)
+		uploadedPath := cleanRelPath(filepath.Join(targetPath, filename))
+		s.events.Publish(Event{Type: EventUpload, Path: uploadedPath, Client: clientIP(r), RequestID: requestID(r)})
+		s.burns.Set(uploadedPath, maxDownloads)
+		go runHooks(&HookEvent{Point: HookPostUpload, Path: uploadedPath, Client: clientIP(r), Size: header.Size})
+
+		// Hand out a code another device can type to receive the file
+		if r.FormValue("share_code") != "" {
+			share, err := s.codes.Create(uploadedPath)
+			if err != nil {
+				log.Printf("Error creating share code for %s: %v", uploadedPath, err)
+			} else {
+				logf("Share code %s created for %s", share.Code, uploadedPath)
+				separator := "?"
+				if strings.Contains(redirectURL, "?") {
+					separator = "&"
+				}
+				redirectURL += separator + "code=" + share.Code
+			}
+		}
+
+		uploadedTo = redirectURL
+		redirect(w, r, uploadedTo, http.StatusSeeOther)
+		return
+	}
+
+	// For GET requests, list the first page of files and directories;
+	// the browser fetches the rest from /list as it scrolls. The view
+	// counts towards the visit that decides which files are new.
+	s.visits.Seen(visitorID(w, r))
+	page, err := s.listingPage(w, r, requestedPath, 0, listingPageSize, 10)
+	if err != nil {
+		writeListingError(w, err)
+		return
+	}
+	files := page.Entries
+
+	// Pinned items of this visitor, shown at the top of the root listing
+	var favoriteItems []FileInfo
+	if requestedPath == "" {
+		favoriteItems = s.favorites.List(visitorID(w, r), s.config.DownloadDir)
+		s.tags.Annotate(favoriteItems)
+	}
+
+	// Generate breadcrumbs for navigation
+	breadcrumbs := generateBreadcrumbs(requestedPath)
+
+	// Render the template
+	view := listingView(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	lowDisk, free := s.disk.Low()
+
+	// Show the code of a file just uploaded with "share with a code"
+	var shareCode *ShareCode
+	if code := r.URL.Query().Get("code"); code != "" {
+		if share, ok := s.codes.Resolve(code); ok {
+			shareCode = &share
+		}
+	}
+
+	err = s.tmpl.Execute(w, struct {
+		Files       []FileInfo
+		Favorites   []FileInfo
+		CurrentPath string
+		Breadcrumbs []BreadcrumbItem
+		LowDisk     bool
+		FreeSpace   string
+		View        string
+		Next        int
+		ShareCode   *ShareCode
+		LoggedIn    bool
+		Watch       bool
+	}{
+		Files:       files,
+		Favorites:   favoriteItems,
+		CurrentPath: requestedPath,
+		Breadcrumbs: breadcrumbs,
+		LowDisk:     lowDisk,
+		FreeSpace:   formatByteSize(free),
+		View:        view,
+		Next:        page.Next,
+		ShareCode:   shareCode,
+		LoggedIn:    s.auth.LoggedIn(r),
+		Watch:       s.watcher != nil,
+	})
+
+	if err != nil {
+		http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Handler for downloading files
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	filePath := strings.TrimPrefix(r.URL.Path, "/download/")
+	if filePath == "" {
+		http.Error(w, "No file specified", http.StatusBadRequest)
+		return
+	}
+
+	// Get the full path in a safe way, preventing directory traversal
+	fullPath, err := safeJoinPath(s.config.DownloadDir, filePath)
+	if err != nil {
+		http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Open the file once and stat the handle. For files on disk the handle
+	// is an *os.File, which ServeContent hands through every wrapping
+	// ResponseWriter's ReadFrom to the connection, so the kernel sends it
+	// with sendfile instead of copying it through user space.
+	file, err := s.files.Open(cleanRelPath(filePath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check if it's a regular file
+	if fileInfo.IsDir() {
+		http.Error(w, "Cannot download directories", http.StatusBadRequest)
+		return
+	}
+
+	if err := runHooks(&HookEvent{Point: HookPreDownload, Path: cleanRelPath(filePath), Client: clientIP(r), Size: fileInfo.Size()}); err != nil {
+		log.Printf("Download of %s by %s rejected by hook: %v", filePath, clientIP(r), err)
+		http.Error(w, "Access denied: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// A smaller copy of a photo with ?w=, when ffmpeg is installed to make it
+	servePath := fullPath
+	if v := r.URL.Query().Get("w"); v != "" && s.thumbs != nil && canResize(filePath) && !s.encryption.Covers(filePath) && !s.dedup.Covers(filePath) {
+		width, err := parseResizeWidth(v)
+		if err != nil {
+			http.Error(w, "Invalid width: "+v, http.StatusBadRequest)
+			return
+		}
+		if servePath, err = s.thumbs.Resized(fullPath, fileInfo, width); err != nil {
+			log.Printf("Error resizing %s: %v", filePath, err)
+			http.Error(w, "Error resizing image: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resized, err := os.Open(servePath)
+		if err != nil {
+			http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer resized.Close()
+		if fileInfo, err = resized.Stat(); err != nil {
+			http.Error(w, "Error accessing file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		file = resized
+	}
+
+	// Deduplicated files are put back together from their chunks
+	var chunks *dedupReader
+	if s.dedup.Covers(filePath) && isDedupFile(fullPath) {
+		if chunks, err = s.dedup.Open(fullPath); err != nil {
+			http.Error(w, "Error opening file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer chunks.Close()
+	}
+
+	// Enforce burn-after-reading limits before sending anything. Only whole
+	// downloads use one up; HEAD and later ranges just need one left.
+	fullDownload := r.Method == "GET" && isFullDownload(r)
+	var last bool
+	if fullDownload {
+		limited, allowed, claimedLast := s.burns.Claim(cleanRelPath(filePath))
+		if limited && !allowed {
+			http.Error(w, "This file is no longer available", http.StatusGone)
+			return
+		}
+		last = claimedLast
+	} else if s.burns.Remaining(cleanRelPath(filePath)) == 0 {
+		http.Error(w, "This file is no longer available", http.StatusGone)
+		return
+	}
+
+	// Set headers for file download. Resized photos are shown inline so
+	// they can be previewed where the link is shared.
+	filename := filepath.Base(filePath)
+	if servePath != fullPath {
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+		w.Header().Set("Content-Disposition", contentDisposition("inline", filename))
+		w.Header().Set("Content-Type", "image/jpeg")
+	} else {
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	// Track progress for the admin dashboard. The total is only known for
+	// whole-file downloads.
+	size := int64(-1)
+	if r.Header.Get("Range") == "" {
+		size = fileInfo.Size()
+		if s.encryption.Covers(filePath) && isEncryptedFile(fullPath) {
+			size = s.encryption.PlainSize(size)
+		} else if chunks != nil {
+			size = chunks.Size()
+		}
+	}
+	transfer := s.transfers.Start("", "download", filePath, clientIP(r), size)
+	defer s.transfers.Finish(transfer)
+	// Share the -max-bandwidth cap with the other downloads
+	if s.bandwidth != nil {
+		share := s.bandwidth.Start()
+		defer share.Done()
+		w = throttledResponseWriter{w, share}
+	}
+	w = countingResponseWriter{w, transfer}
+
+	// Serve the file, decrypting it on the fly if it's stored encrypted
+	if s.encryption.Covers(filePath) && isEncryptedFile(fullPath) {
+		plain, err := s.encryption.Open(fullPath)
+		if err != nil {
+			http.Error(w, "Error opening file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer plain.Close()
+
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", s.encryption.PlainSize(fileInfo.Size())))
+		if _, err := io.Copy(w, plain); err != nil {
+			log.Printf("Error sending decrypted file %s: %v", filePath, err)
+			return
+		}
+	} else {
+		// A strong ETag lets segmented and resumed downloads use If-Range
+		w.Header().Set("ETag", fileETag(fileInfo))
+		content, seekable := file.(io.ReadSeeker)
+		switch {
+		case chunks != nil:
+			http.ServeContent(w, r, filename, fileInfo.ModTime(), chunks)
+		case s.smallFiles.Serve(w, r, servePath, filename, fileInfo):
+			// Small files come from memory with -mmap-cache
+		case seekable:
+			http.ServeContent(w, r, filename, fileInfo.ModTime(), content)
+		default:
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+			if _, err := io.Copy(w, file); err != nil {
+				log.Printf("Error sending file %s: %v", filePath, err)
+				return
+			}
+		}
+	}
+	logf("File downloaded: %s", filePath)
+	if fullDownload {
+		s.stats.RecordDownload(cleanRelPath(filePath))
+		s.events.Publish(Event{Type: EventDownload, Path: cleanRelPath(filePath), Client: clientIP(r), RequestID: requestID(r)})
+	}
+
+	// Remove the file once its last allowed download has been served,
+	// unless the server has become append-only since the limit was set
+	if last && !s.config.AppendOnly {
+		if err := os.Remove(fullPath); err != nil {
+			log.Printf("Error removing burned file %s: %v", filePath, err)
+		} else {
+			logf("File reached its download limit and was deleted: %s", filePath)
+			s.events.Publish(Event{Type: EventDelete, Path: cleanRelPath(filePath), Client: clientIP(r), RequestID: requestID(r)})
+		}
+		s.burns.Set(cleanRelPath(filePath), 0)
+	}
+}
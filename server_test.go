@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// Start a server on a temporary folder, listing and downloading through
+// files when it isn't nil. configure can change the configuration first.
+func newTestServer(t *testing.T, files fs.FS, configure ...func(*Config)) (*httptest.Server, Config) {
+	t.Helper()
+	config := Config{
+		DownloadDir:    t.TempDir(),
+		DataDir:        t.TempDir(),
+		MinFreeSpace:   "0",
+		MaxBandwidth:   "0",
+		MaxBytes:       "0",
+		MmapCache:      "0",
+		ThumbnailCache: "0",
+	}
+	for _, fn := range configure {
+		fn(&config)
+	}
+	s, err := NewServer(config, files)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts, s.config
+}
+
+func TestServerListsInjectedFS(t *testing.T) {
+	ts, _ := newTestServer(t, fstest.MapFS{
+		"docs/notes.txt": {Data: []byte("hello")},
+		"docs/old.txt":   {Data: []byte("bye")},
+	})
+
+	resp, err := http.Get(ts.URL + "/list?path=docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var page ListingPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range page.Entries {
+		names = append(names, entry.Name)
+	}
+	if len(names) != 2 || names[0] != "notes.txt" || names[1] != "old.txt" {
+		t.Errorf("entries = %v, want [notes.txt old.txt]", names)
+	}
+}
+
+func TestServerDownloadsFromInjectedFS(t *testing.T) {
+	ts, _ := newTestServer(t, fstest.MapFS{
+		"docs/notes.txt": {Data: []byte("hello")},
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/download/docs/notes.txt", http.StatusOK, "hello"},
+		{"/download/docs/missing.txt", http.StatusNotFound, ""},
+		{"/download/docs", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("GET %s: body = %q, want %q", tt.path, body, tt.body)
+		}
+	}
+}
+
+func TestServerRefusesTraversal(t *testing.T) {
+	ts, config := newTestServer(t, nil)
+	secret := filepath.Join(filepath.Dir(config.DownloadDir), "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret)
+
+	for _, path := range []string{"/download/../secret.txt", "/download/..%2fsecret.txt", "/download/%2e%2e/secret.txt"} {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Send the path exactly as written rather than cleaned by the client
+		req.URL.Opaque = path
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if bytes.Contains(body, []byte("secret")) {
+			t.Errorf("GET %s served a file outside the served folder", path)
+		}
+	}
+}
+
+func TestServerUploadsToDisk(t *testing.T) {
+	ts, config := newTestServer(t, nil)
+	if err := os.Mkdir(filepath.Join(config.DownloadDir, "inbox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("path", "inbox")
+	part, err := form.CreateFormFile("file", `..\..\evil.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("uploaded"))
+	form.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Post(ts.URL+"/", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("status = %d, want 303", resp.StatusCode)
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.DownloadDir, "inbox", "evil.txt"))
+	if err != nil {
+		t.Fatalf("uploaded file not stored in the target folder: %v", err)
+	}
+	if string(data) != "uploaded" {
+		t.Errorf("stored %q, want %q", data, "uploaded")
+	}
+}
+
+// Write files, given by slash separated path, under dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A request to the test server as sent by the client at from. Requests from
+// the test client itself come from localhost, which the server trusts as
+// this machine, so the filters are tested with other addresses.
+type accessCase struct {
+	name   string
+	from   string
+	method string
+	path   string
+	form   url.Values
+	header http.Header
+	host   string // Host header, if not the server's address
+	status int
+}
+
+// Serve a request as coming from c.from and check its status
+func (c accessCase) run(t *testing.T, ts *httptest.Server) *httptest.ResponseRecorder {
+	t.Helper()
+	var body io.Reader
+	if c.form != nil {
+		body = strings.NewReader(c.form.Encode())
+	}
+	req := httptest.NewRequest(c.method, ts.URL+c.path, body)
+	req.RemoteAddr = net.JoinHostPort(c.from, "40000")
+	if c.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+	rec := httptest.NewRecorder()
+	ts.Config.Handler.ServeHTTP(rec, req)
+	if rec.Code != c.status {
+		t.Errorf("%s: %s %s from %s: status = %d, want %d (%s)", c.name, c.method, c.path, c.from, rec.Code, c.status, strings.TrimSpace(rec.Body.String()))
+	}
+	return rec
+}
+
+func TestAccessRules(t *testing.T) {
+	ts, config := newTestServer(t, nil, func(c *Config) { c.AccessFiles = true })
+	writeTestFiles(t, config.DownloadDir, map[string]string{
+		"open/a.txt":              "a",
+		"open/private/.access":    "read 192.168.1.10\n",
+		"open/private/c.txt":      "c",
+		"family/.access":          "read 192.168.1.0/24\nwrite 192.168.1.10\n",
+		"family/b.txt":            "b",
+		"family/photos/.access":   "write 192.168.1.0/24\n",
+		"family/photos/photo.jpg": "jpg",
+	})
+	const (
+		stranger = "203.0.113.5"
+		relative = "192.168.1.20"
+		parent   = "192.168.1.10"
+	)
+
+	tests := []accessCase{
+		{name: "open file", from: stranger, method: "GET", path: "/download/open/a.txt", status: http.StatusOK},
+		{name: "closed file", from: stranger, method: "GET", path: "/download/family/b.txt", status: http.StatusForbidden},
+		{name: "reader", from: relative, method: "GET", path: "/download/family/b.txt", status: http.StatusOK},
+		{name: "access file", from: parent, method: "GET", path: "/download/family/.access", status: http.StatusNotFound},
+		{name: "closed folder listed", from: stranger, method: "GET", path: "/list?path=family", status: http.StatusForbidden},
+		{name: "closed folder archived", from: stranger, method: "GET", path: "/archive/open", status: http.StatusForbidden},
+
+		{name: "tag open file", from: stranger, method: "POST", path: "/tags",
+			form: url.Values{"path": {"open/a.txt"}, "add": {"x"}}, status: http.StatusSeeOther},
+		{name: "tag closed file after open one", from: stranger, method: "POST", path: "/tags",
+			form: url.Values{"path": {"open/a.txt", "family/b.txt"}, "add": {"x"}}, status: http.StatusForbidden},
+		{name: "tag as reader", from: relative, method: "POST", path: "/tags",
+			form: url.Values{"path": {"family/b.txt"}, "add": {"x"}}, status: http.StatusForbidden},
+		{name: "tag as writer", from: parent, method: "POST", path: "/tags",
+			form: url.Values{"path": {"family/b.txt"}, "add": {"x"}}, status: http.StatusSeeOther},
+
+		{name: "compress with closed subfolder", from: stranger, method: "POST", path: "/compress",
+			form: url.Values{"path": {"open"}}, status: http.StatusForbidden},
+		{name: "compress into closed parent", from: relative, method: "POST", path: "/compress",
+			form: url.Values{"path": {"family/photos"}}, status: http.StatusForbidden},
+		{name: "compress as writer", from: parent, method: "POST", path: "/compress",
+			form: url.Values{"path": {"family/photos"}}, status: http.StatusSeeOther},
+		{name: "compress readable tree", from: parent, method: "POST", path: "/compress",
+			form: url.Values{"path": {"open"}}, status: http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		tt.run(t, ts)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(config.DownloadDir, "open.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if path.Base(f.Name) == accessFileName {
+			t.Errorf("archive contains %s", f.Name)
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(keys, []byte(`[
+		{"name": "reader", "key": "read-key-0123456789", "scopes": ["read"]},
+		{"name": "writer", "key": "write-key-0123456789", "scopes": ["read", "write"]},
+		{"name": "owner", "key": "admin-key-0123456789", "scopes": ["admin"]}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, config := newTestServer(t, nil, func(c *Config) {
+		c.APIKeysFile = keys
+		c.LocalOnly = true
+	})
+	writeTestFiles(t, config.DownloadDir, map[string]string{"a.txt": "a"})
+	withKey := func(key string) http.Header { return http.Header{"X-Api-Key": {key}} }
+	tag := url.Values{"path": {"a.txt"}, "add": {"x"}}
+	const stranger = "203.0.113.5"
+
+	tests := []accessCase{
+		{name: "no key", from: stranger, method: "GET", path: "/download/a.txt", status: http.StatusForbidden},
+		{name: "read key", from: stranger, method: "GET", path: "/download/a.txt", header: withKey("read-key-0123456789"), status: http.StatusOK},
+		{name: "unknown key", from: stranger, method: "GET", path: "/download/a.txt", header: withKey("wrong-key-0123456789"), status: http.StatusUnauthorized},
+		{name: "write with read key", from: stranger, method: "POST", path: "/tags", form: tag, header: withKey("read-key-0123456789"), status: http.StatusForbidden},
+		{name: "write with write key", from: stranger, method: "POST", path: "/tags", form: tag, header: withKey("write-key-0123456789"), status: http.StatusSeeOther},
+		{name: "admin with write key", from: stranger, method: "GET", path: "/admin/transfers", header: withKey("write-key-0123456789"), status: http.StatusForbidden},
+		{name: "admin with admin key", from: stranger, method: "GET", path: "/admin/transfers", header: withKey("admin-key-0123456789"), status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt.run(t, ts)
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	ts, config := newTestServer(t, nil, func(c *Config) {
+		c.URLSecret = "test-secret"
+		c.LocalOnly = true
+	})
+	writeTestFiles(t, config.DownloadDir, map[string]string{"a.txt": "a", "b.txt": "b"})
+	signer := newURLSigner(config.URLSecret)
+	sign := func(path string, ttl time.Duration) string {
+		signed, err := signer.Sign("GET", path, time.Time{}, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	signedA := sign("/download/a.txt", time.Hour)
+	const stranger = "203.0.113.5"
+
+	tests := []accessCase{
+		{name: "unsigned", from: stranger, method: "GET", path: "/download/a.txt", status: http.StatusForbidden},
+		{name: "signed", from: stranger, method: "GET", path: signedA, status: http.StatusOK},
+		{name: "signature for another file", from: stranger, method: "GET",
+			path: "/download/b.txt?" + signedA[strings.Index(signedA, "?")+1:], status: http.StatusForbidden},
+		{name: "expired", from: stranger, method: "GET", path: sign("/download/a.txt", -time.Hour), status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt.run(t, ts)
+	}
+}
+
+func TestHostAndCrossSiteFilters(t *testing.T) {
+	ts, config := newTestServer(t, nil)
+	writeTestFiles(t, config.DownloadDir, map[string]string{"a.txt": "a"})
+	host := strings.TrimPrefix(ts.URL, "http://")
+	tag := url.Values{"path": {"a.txt"}, "add": {"x"}}
+	const neighbor = "192.168.1.20"
+
+	tests := []accessCase{
+		{name: "server address", from: neighbor, method: "GET", path: "/download/a.txt", status: http.StatusOK},
+		{name: "rebound host name", from: neighbor, method: "GET", path: "/download/a.txt",
+			host: "evil.example", status: http.StatusForbidden},
+		{name: "same origin", from: neighbor, method: "POST", path: "/tags", form: tag,
+			header: http.Header{"Sec-Fetch-Site": {"same-origin"}}, status: http.StatusSeeOther},
+		{name: "cross site", from: neighbor, method: "POST", path: "/tags", form: tag,
+			header: http.Header{"Sec-Fetch-Site": {"cross-site"}}, status: http.StatusForbidden},
+		{name: "own origin", from: neighbor, method: "POST", path: "/tags", form: tag,
+			header: http.Header{"Origin": {"http://" + host}}, status: http.StatusSeeOther},
+		{name: "other origin", from: neighbor, method: "POST", path: "/tags", form: tag,
+			header: http.Header{"Origin": {"http://evil.example"}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt.run(t, ts)
+	}
+}
+
+func TestPasswordLoginAndLockout(t *testing.T) {
+	ts, config := newTestServer(t, nil, func(c *Config) {
+		c.Password = "correct horse"
+		c.LockoutAttempts = 2
+		c.LockoutDuration = time.Minute
+	})
+	writeTestFiles(t, config.DownloadDir, map[string]string{"a.txt": "a"})
+	const (
+		guesser = "203.0.113.5"
+		owner   = "203.0.113.6"
+	)
+	wrong := url.Values{"password": {"guess"}}
+	right := url.Values{"password": {"correct horse"}}
+
+	// Failed logins lock the client out, even once it has the password
+	for _, tt := range []accessCase{
+		{name: "no session", from: guesser, method: "GET", path: "/download/a.txt", status: http.StatusUnauthorized},
+		{name: "first wrong password", from: guesser, method: "POST", path: "/login", form: wrong, status: http.StatusUnauthorized},
+		{name: "second wrong password", from: guesser, method: "POST", path: "/login", form: wrong, status: http.StatusUnauthorized},
+		{name: "locked out", from: guesser, method: "POST", path: "/login", form: right, status: http.StatusTooManyRequests},
+	} {
+		tt.run(t, ts)
+	}
+
+	// Other clients log in, use the session and log out again
+	login := accessCase{name: "log in", from: owner, method: "POST", path: "/login", form: right, status: http.StatusSeeOther}.run(t, ts)
+	var session string
+	for _, cookie := range login.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			session = cookie.Name + "=" + cookie.Value
+		}
+	}
+	if session == "" {
+		t.Fatal("logging in set no session cookie")
+	}
+	withSession := http.Header{"Cookie": {session}}
+	for _, tt := range []accessCase{
+		{name: "logged in", from: owner, method: "GET", path: "/download/a.txt", header: withSession, status: http.StatusOK},
+		{name: "log out", from: owner, method: "POST", path: "/logout", header: withSession, status: http.StatusSeeOther},
+		{name: "logged out", from: owner, method: "GET", path: "/download/a.txt", header: withSession, status: http.StatusUnauthorized},
+	} {
+		tt.run(t, ts)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Share codes are short enough to type on a phone and use no characters
+// that are easily confused, like 0 and O or 1 and I
+const (
+	shareCodeLength   = 6
+	shareCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	shareCodeTTL      = time.Hour
+)
+
+// ShareCode maps a short code to a file for a limited time
+type ShareCode struct {
+	Code    string    `json:"code"`
+	Path    string    `json:"path"`
+	Expires time.Time `json:"expires"`
+}
+
+// ShareCodeStore keeps the codes handed out for device to device
+// transfers, in the state database
+type ShareCodeStore struct {
+	db *sql.DB
+}
+
+// Open the share code store, importing the codes.json of earlier versions
+func openShareCodeStore(db *sql.DB, dataDir string) (*ShareCodeStore, error) {
+	s := &ShareCodeStore{db: db}
+
+	codes := make(map[string]ShareCode)
+	err := importJSON(filepath.Join(dataDir, "codes.json"), &codes, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for _, share := range codes {
+				_, err := tx.Exec("INSERT OR REPLACE INTO share_codes (code, path, expires) VALUES (?, ?, ?)",
+					share.Code, share.Path, share.Expires.UnixNano())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Normalize a code as typed, ignoring case and spaces
+func normalizeShareCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// Generate a random code from the share code alphabet
+func randomShareCode() (string, error) {
+	b := make([]byte, shareCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(shareCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = shareCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Hand out a new code for a file
+func (s *ShareCodeStore) Create(path string) (ShareCode, error) {
+	now := time.Now()
+	if _, err := s.db.Exec("DELETE FROM share_codes WHERE expires < ?", now.UnixNano()); err != nil {
+		return ShareCode{}, err
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := randomShareCode()
+		if err != nil {
+			return ShareCode{}, err
+		}
+		share := ShareCode{Code: code, Path: path, Expires: now.Add(shareCodeTTL)}
+		result, err := s.db.Exec("INSERT OR IGNORE INTO share_codes (code, path, expires) VALUES (?, ?, ?)",
+			share.Code, share.Path, share.Expires.UnixNano())
+		if err != nil {
+			return ShareCode{}, err
+		}
+		// A code still in use is left alone
+		if n, _ := result.RowsAffected(); n == 1 {
+			return share, nil
+		}
+	}
+	return ShareCode{}, errors.New("no free code found")
+}
+
+// Look up an unexpired code
+func (s *ShareCodeStore) Resolve(code string) (ShareCode, bool) {
+	share := ShareCode{Code: normalizeShareCode(code)}
+	var expires int64
+	err := s.db.QueryRow("SELECT path, expires FROM share_codes WHERE code = ?", share.Code).Scan(&share.Path, &expires)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error reading share codes: %v", err)
+		}
+		return ShareCode{}, false
+	}
+	share.Expires = time.Unix(0, expires)
+	if time.Now().After(share.Expires) {
+		return ShareCode{}, false
+	}
+	return share, true
+}
+
+// Handler for share codes. GET with "c" downloads the file behind a code,
+// POST with "path" hands out a code for a file. Wrong codes count as
+// failed attempts, so codes cannot be guessed by trying them all.
+func shareCodeHandler(config Config, codes *ShareCodeStore, lockout *AuthLockout) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if lockout.reject(w, r) {
+				return
+			}
+			share, ok := codes.Resolve(r.URL.Query().Get("c"))
+			if !ok {
+				lockout.Fail(clientIP(r))
+				http.Error(w, "Unknown or expired code", http.StatusNotFound)
+				return
+			}
+			debugf("Share code %s used by %s for %s", share.Code, clientIP(r), share.Path)
+			redirect(w, r, (&url.URL{Path: "/download/" + share.Path}).EscapedPath(), http.StatusSeeOther)
+
+		case "POST":
+			relPath := cleanRelPath(r.FormValue("path"))
+			fullPath, err := safeJoinPath(config.DownloadDir, relPath)
+			if err != nil || relPath == "" {
+				http.Error(w, "Invalid file path", http.StatusBadRequest)
+				return
+			}
+			if info, err := os.Stat(fullPath); err != nil || !info.Mode().IsRegular() {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			share, err := codes.Create(relPath)
+			if err != nil {
+				http.Error(w, "Error creating code: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logf("Share code %s created for %s by %s", share.Code, relPath, clientIP(r))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(share)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Files larger than this are never cached; sendfile already serves them
+// with few syscalls for the amount of data
+const smallFileMaxSize = 1 << 20
+
+// SmallFileCache keeps small, frequently requested files such as video
+// thumbnails and icons mapped into memory, so a gallery loaded by several
+// devices at once costs a stat per file rather than an open, read and
+// close. The least recently used files are dropped once the cache holds
+// more than its limit.
+type SmallFileCache struct {
+	limit int64
+
+	mu    sync.Mutex
+	used  int64
+	files map[string]*mappedFile
+	// Most recently used at the front
+	lru *list.List
+}
+
+// A file mapped into memory, unmapped once dropped from the cache and no
+// longer being sent
+type mappedFile struct {
+	path    string
+	data    []byte
+	modTime time.Time
+	refs    int
+	dropped bool
+	elem    *list.Element
+}
+
+// Create a cache holding up to limit bytes, or nil if limit is zero
+func newSmallFileCache(limit int64) *SmallFileCache {
+	if limit <= 0 {
+		return nil
+	}
+	return &SmallFileCache{
+		limit: limit,
+		files: make(map[string]*mappedFile),
+		lru:   list.New(),
+	}
+}
+
+// Get the mapped content of fullPath, mapping it on first use or when info
+// shows it changed. Call release once it's sent. Returns false for files
+// that aren't cached.
+func (c *SmallFileCache) get(fullPath string, info fs.FileInfo) (*mappedFile, bool) {
+	if !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > min(smallFileMaxSize, c.limit) {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	if m, ok := c.files[fullPath]; ok {
+		if int64(len(m.data)) == info.Size() && m.modTime.Equal(info.ModTime()) {
+			m.refs++
+			c.lru.MoveToFront(m.elem)
+			c.mu.Unlock()
+			return m, true
+		}
+		c.drop(m)
+	}
+	c.mu.Unlock()
+
+	m, err := c.mapFile(fullPath)
+	if err != nil {
+		log.Printf("Error caching %s: %v", fullPath, err)
+		return nil, false
+	}
+	if m == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another request may have mapped the file meanwhile
+	if old, ok := c.files[fullPath]; ok {
+		c.drop(old)
+	}
+	m.refs = 1
+	m.elem = c.lru.PushFront(m)
+	c.files[fullPath] = m
+	c.used += int64(len(m.data))
+	for c.used > c.limit {
+		c.drop(c.lru.Back().Value.(*mappedFile))
+	}
+	return m, true
+}
+
+// Map a file, or return nil if it's no longer small enough to cache
+func (c *SmallFileCache) mapFile(fullPath string) (*mappedFile, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The file may have changed since the caller looked at it
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > min(smallFileMaxSize, c.limit) {
+		return nil, nil
+	}
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{path: fullPath, data: data, modTime: info.ModTime()}, nil
+}
+
+// Remove a file from the cache, unmapping it unless it's still being sent.
+// Call with c.mu held.
+func (c *SmallFileCache) drop(m *mappedFile) {
+	if m.dropped {
+		return
+	}
+	m.dropped = true
+	delete(c.files, m.path)
+	c.lru.Remove(m.elem)
+	c.used -= int64(len(m.data))
+	if m.refs == 0 {
+		unmapFile(m.data)
+	}
+}
+
+// Give back a file returned by get
+func (c *SmallFileCache) release(m *mappedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m.refs--
+	if m.dropped && m.refs == 0 {
+		unmapFile(m.data)
+	}
+}
+
+// Serve fullPath from the cache with ServeContent, returning false without
+// writing anything if it isn't cached so the caller can serve it normally
+func (c *SmallFileCache) Serve(w http.ResponseWriter, r *http.Request, fullPath, name string, info fs.FileInfo) bool {
+	if c == nil {
+		return false
+	}
+	m, ok := c.get(fullPath, info)
+	if !ok {
+		return false
+	}
+	defer c.release(m)
+
+	// Another program truncating a mapped file turns reading past its new
+	// end into a fault; make that end this response instead of the server
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	http.ServeContent(w, r, name, m.modTime, bytes.NewReader(m.data))
+	return true
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot names, kept safe to use in URLs and file names
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// SnapshotEntry is the recorded metadata of one file or folder
+type SnapshotEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+}
+
+// Snapshot is the metadata of the whole served tree at one point in time.
+// File contents are not kept, so a snapshot can only tell what changed.
+type Snapshot struct {
+	Name    string                   `json:"name"`
+	Created time.Time                `json:"created"`
+	Files   map[string]SnapshotEntry `json:"files"`
+}
+
+// SnapshotInfo summarizes a stored snapshot
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Files   int       `json:"files"`
+}
+
+// SnapshotChange is one difference between two states of the tree
+type SnapshotChange struct {
+	Path    string    `json:"path"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Size    int64     `json:"size"`
+	OldSize int64     `json:"old_size,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// SnapshotDiff lists what was added, removed and changed since a snapshot
+type SnapshotDiff struct {
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Added   []SnapshotChange `json:"added"`
+	Removed []SnapshotChange `json:"removed"`
+	Changed []SnapshotChange `json:"changed"`
+}
+
+// SnapshotStore keeps named snapshots in the state database
+type SnapshotStore struct {
+	db *sql.DB
+}
+
+// Open the snapshot store, importing the snapshot files of earlier
+// versions
+func openSnapshotStore(db *sql.DB, dataDir string) (*SnapshotStore, error) {
+	s := &SnapshotStore{db: db}
+
+	paths, _ := filepath.Glob(filepath.Join(dataDir, "snapshots", "*.json"))
+	for _, path := range paths {
+		var snapshot Snapshot
+		err := importJSON(path, &snapshot, func() error {
+			// The file was named after the snapshot
+			snapshot.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+			return s.save(&snapshot)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Check that a snapshot name is valid
+func checkSnapshotName(name string) error {
+	if !snapshotNamePattern.MatchString(name) {
+		return errors.New("names may contain letters, digits, '.', '_' and '-' and be up to 64 characters long")
+	}
+	return nil
+}
+
+// Store a snapshot, replacing one with the same name
+func (s *SnapshotStore) save(snapshot *Snapshot) error {
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM snapshot_files WHERE snapshot = ?", snapshot.Name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO snapshots (name, created) VALUES (?, ?)",
+			snapshot.Name, snapshot.Created.UnixNano()); err != nil {
+			return err
+		}
+		insert, err := tx.Prepare("INSERT INTO snapshot_files (snapshot, path, size, mod_time, is_dir) VALUES (?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+		for path, entry := range snapshot.Files {
+			if _, err := insert.Exec(snapshot.Name, path, entry.Size, entry.ModTime.UnixNano(), entry.IsDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Record the metadata of every file and folder under baseDir. Symlinks are
+// skipped like everywhere else the tree is walked.
+func scanTree(baseDir string) (map[string]SnapshotEntry, error) {
+	files := make(map[string]SnapshotEntry)
+	err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable entries are left out rather than failing the snapshot
+			if path != baseDir {
+				return nil
+			}
+			return err
+		}
+		if path == baseDir || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		relPath, _ := filepath.Rel(baseDir, path)
+		entry := SnapshotEntry{ModTime: info.ModTime().UTC(), IsDir: d.IsDir()}
+		if !d.IsDir() {
+			entry.Size = info.Size()
+		}
+		files[filepath.ToSlash(relPath)] = entry
+		return nil
+	})
+	return files, err
+}
+
+// Take a snapshot of baseDir under name, replacing one with the same name
+func (s *SnapshotStore) Take(name, baseDir string) (*Snapshot, error) {
+	if err := checkSnapshotName(name); err != nil {
+		return nil, err
+	}
+	files, err := scanTree(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Name: name, Created: time.Now().UTC(), Files: files}
+	return snapshot, s.save(snapshot)
+}
+
+// Load a snapshot by name
+func (s *SnapshotStore) Load(name string) (*Snapshot, error) {
+	if err := checkSnapshotName(name); err != nil {
+		return nil, err
+	}
+
+	var created int64
+	err := s.db.QueryRow("SELECT created FROM snapshots WHERE name = ?", name).Scan(&created)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no such snapshot")
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Name: name, Created: time.Unix(0, created).UTC(), Files: make(map[string]SnapshotEntry)}
+
+	rows, err := s.db.Query("SELECT path, size, mod_time, is_dir FROM snapshot_files WHERE snapshot = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		var entry SnapshotEntry
+		var modTime int64
+		if err := rows.Scan(&path, &entry.Size, &modTime, &entry.IsDir); err != nil {
+			return nil, err
+		}
+		entry.ModTime = time.Unix(0, modTime).UTC()
+		snapshot.Files[path] = entry
+	}
+	return snapshot, rows.Err()
+}
+
+// Delete a snapshot by name
+func (s *SnapshotStore) Delete(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM snapshots WHERE name = ?", name)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errors.New("no such snapshot")
+		}
+		_, err = tx.Exec("DELETE FROM snapshot_files WHERE snapshot = ?", name)
+		return err
+	})
+}
+
+// List the stored snapshots, newest first
+func (s *SnapshotStore) List() []SnapshotInfo {
+	rows, err := s.db.Query(`SELECT name, created, (SELECT COUNT(*) FROM snapshot_files WHERE snapshot = name)
+		FROM snapshots ORDER BY created DESC`)
+	if err != nil {
+		log.Printf("Error reading snapshots: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []SnapshotInfo
+	for rows.Next() {
+		var info SnapshotInfo
+		var created int64
+		if err := rows.Scan(&info.Name, &created, &info.Files); err != nil {
+			log.Printf("Error reading snapshots: %v", err)
+			return nil
+		}
+		info.Created = time.Unix(0, created).UTC()
+		result = append(result, info)
+	}
+	return result
+}
+
+// Compare two states of the tree. Files count as changed when their size or
+// modification time differs; folders only when they are added or removed.
+func diffSnapshots(from, to map[string]SnapshotEntry) SnapshotDiff {
+	var diff SnapshotDiff
+	for path, old := range from {
+		now, ok := to[path]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, SnapshotChange{Path: path, IsDir: old.IsDir, Size: old.Size, ModTime: old.ModTime})
+		case old.IsDir != now.IsDir:
+			diff.Removed = append(diff.Removed, SnapshotChange{Path: path, IsDir: old.IsDir, Size: old.Size, ModTime: old.ModTime})
+			diff.Added = append(diff.Added, SnapshotChange{Path: path, IsDir: now.IsDir, Size: now.Size, ModTime: now.ModTime})
+		case !now.IsDir && (old.Size != now.Size || !old.ModTime.Equal(now.ModTime)):
+			diff.Changed = append(diff.Changed, SnapshotChange{Path: path, Size: now.Size, OldSize: old.Size, ModTime: now.ModTime})
+		}
+	}
+	for path, now := range to {
+		if _, ok := from[path]; !ok {
+			diff.Added = append(diff.Added, SnapshotChange{Path: path, IsDir: now.IsDir, Size: now.Size, ModTime: now.ModTime})
+		}
+	}
+	for _, changes := range [][]SnapshotChange{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	}
+	return diff
+}
+
+// Template for the snapshot list and diff pages
+const snapshotsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Snapshots - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            text-align: left;
+            padding: 8px;
+            border-bottom: 1px solid #ddd;
+        }
+        th {
+            background-color: #f0f0f0;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        form {
+            display: inline;
+        }
+        .added {
+            color: #2e7d32;
+        }
+        .removed {
+            color: #c62828;
+        }
+        .changed {
+            color: #ef6c00;
+        }
+        .muted {
+            color: #777;
+        }
+    </style>
+</head>
+<body>
+    {{if .Diff}}
+    {{with .Diff}}
+    <h1>Changes since {{.From}}</h1>
+    <p><a href="../snapshots">&larr; Back to snapshots</a> | Compared with {{.To}}</p>
+    {{if not (or .Added .Removed .Changed)}}
+    <p>Nothing was added, removed or changed.</p>
+    {{end}}
+    {{if .Added}}
+    <h3 class="added">Added ({{len .Added}})</h3>
+    <table>
+        {{range .Added}}
+        <tr><td>{{.Path}}{{if .IsDir}}/{{end}}</td><td>{{if not .IsDir}}{{formatSize .Size}}{{end}}</td><td>{{.ModTime.Local.Format "2006-01-02 15:04:05"}}</td></tr>
+        {{end}}
+    </table>
+    {{end}}
+    {{if .Removed}}
+    <h3 class="removed">Removed ({{len .Removed}})</h3>
+    <table>
+        {{range .Removed}}
+        <tr><td>{{.Path}}{{if .IsDir}}/{{end}}</td><td>{{if not .IsDir}}{{formatSize .Size}}{{end}}</td><td class="muted">last seen {{.ModTime.Local.Format "2006-01-02 15:04:05"}}</td></tr>
+        {{end}}
+    </table>
+    {{end}}
+    {{if .Changed}}
+    <h3 class="changed">Changed ({{len .Changed}})</h3>
+    <table>
+        {{range .Changed}}
+        <tr><td>{{.Path}}</td><td>{{formatSize .OldSize}} &rarr; {{formatSize .Size}}</td><td>{{.ModTime.Local.Format "2006-01-02 15:04:05"}}</td></tr>
+        {{end}}
+    </table>
+    {{end}}
+    {{end}}
+    {{else}}
+    <h1>Snapshots</h1>
+    <p><a href="../admin">&larr; Back to admin</a></p>
+    <p>A snapshot records the names, sizes and modification times of everything in the served folder, so you can later see what was added, removed or changed since.</p>
+    <form method="post" action="snapshots">
+        <input type="text" name="name" placeholder="Snapshot name, e.g. before-weekend" required pattern="[A-Za-z0-9][A-Za-z0-9._\-]{0,63}">
+        <button type="submit">Take snapshot</button>
+    </form>
+    {{if .Snapshots}}
+    <table>
+        <tr><th>Name</th><th>Taken</th><th>Entries</th><th></th></tr>
+        {{range .Snapshots}}
+        <tr>
+            <td><a href="snapshots/diff?name={{.Name}}">{{.Name}}</a></td>
+            <td>{{.Created.Local.Format "2006-01-02 15:04:05"}}</td>
+            <td>{{.Files}}</td>
+            <td>
+                <form method="post" action="snapshots/delete">
+                    <input type="hidden" name="name" value="{{.Name}}">
+                    <button type="submit">Delete</button>
+                </form>
+            </td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p class="muted">No snapshots have been taken yet.</p>
+    {{end}}
+    {{end}}
+</body>
+</html>
+`
+
+// Admin handler for taking snapshots and showing what changed since one.
+// The diff compares with the current tree, or with the snapshot named in
+// "against"; add format=json for machine readable output.
+func snapshotsHandler(config Config, snapshots *SnapshotStore) http.Handler {
+	tmpl := template.Must(template.New("snapshots").Funcs(template.FuncMap{
+		"formatSize": formatByteSize,
+	}).Parse(snapshotsTemplate))
+	render := func(w http.ResponseWriter, data interface{}) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Query().Get("format") == "json" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(snapshots.List())
+				return
+			}
+			render(w, struct {
+				Diff      *SnapshotDiff
+				Snapshots []SnapshotInfo
+			}{Snapshots: snapshots.List()})
+
+		case "POST":
+			name := strings.TrimSpace(r.FormValue("name"))
+			snapshot, err := snapshots.Take(name, config.DownloadDir)
+			if err != nil {
+				http.Error(w, "Error taking snapshot: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			logf("Snapshot %s taken with %d entries by %s", snapshot.Name, len(snapshot.Files), clientIP(r))
+			redirect(w, r, "/admin/snapshots", http.StatusSeeOther)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/admin/snapshots/diff", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, err := snapshots.Load(query.Get("name"))
+		if err != nil {
+			http.Error(w, "Error loading snapshot: "+err.Error(), http.StatusNotFound)
+			return
+		}
+
+		to := "the current folder"
+		var current map[string]SnapshotEntry
+		if against := query.Get("against"); against != "" {
+			other, err := snapshots.Load(against)
+			if err != nil {
+				http.Error(w, "Error loading snapshot: "+err.Error(), http.StatusNotFound)
+				return
+			}
+			to, current = "snapshot "+other.Name, other.Files
+		} else if current, err = scanTree(config.DownloadDir); err != nil {
+			http.Error(w, "Error reading folder: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		diff := diffSnapshots(from.Files, current)
+		diff.From, diff.To = from.Name, to
+		if query.Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(diff)
+			return
+		}
+		render(w, struct {
+			Diff      *SnapshotDiff
+			Snapshots []SnapshotInfo
+		}{Diff: &diff})
+	})
+
+	mux.HandleFunc("/admin/snapshots/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := snapshots.Delete(r.FormValue("name")); err != nil {
+			http.Error(w, "Error deleting snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logf("Snapshot %s deleted by %s", r.FormValue("name"), clientIP(r))
+		redirect(w, r, "/admin/snapshots", http.StatusSeeOther)
+	})
+
+	return mux
+}
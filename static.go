@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stylesheets, scripts and icons used by the pages
+//
+//go:embed static
+var staticFiles embed.FS
+
+// How long browsers may reuse static assets before revalidating them
+const staticMaxAge = "public, max-age=3600"
+
+// Fingerprinted names change with the content, so browsers may keep them
+// for good
+const staticImmutable = "public, max-age=31536000, immutable"
+
+// An embedded asset with its validator
+type staticAsset struct {
+	data        []byte
+	contentType string
+	etag        string
+	// Name with a hash of the content, e.g. app.1f2e3d4c5b6a7988.css
+	fingerprinted string
+}
+
+// The embedded assets by name, loaded on first use
+var staticAssets = sync.OnceValues(func() (map[string]staticAsset, error) {
+	assets := make(map[string]staticAsset)
+	err := fs.WalkDir(staticFiles, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := staticFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		sum := hex.EncodeToString(hash[:8])
+		ext := path.Ext(p)
+		contentType := mime.TypeByExtension(ext)
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		name := strings.TrimPrefix(p, "static/")
+		assets[name] = staticAsset{
+			data:          data,
+			contentType:   contentType,
+			etag:          `"` + sum + `"`,
+			fingerprinted: strings.TrimSuffix(name, ext) + "." + sum + ext,
+		}
+		return nil
+	})
+	return assets, err
+})
+
+// Path of an asset for the pages, relative like their other links so the
+// base path carries over. The name holds a hash of the content, so a
+// browser that has it never asks again and a changed asset gets a new
+// name.
+func staticURL(name string) string {
+	assets, _ := staticAssets()
+	if asset, ok := assets[name]; ok {
+		return "static/" + asset.fingerprinted
+	}
+	return "static/" + name
+}
+
+// Serve the embedded assets under /static/, by their plain and
+// fingerprinted names. Each response carries an ETag derived from the
+// content so revalidation of a plain name is cheap once the cache expires.
+func staticHandler() (http.Handler, error) {
+	assets, err := staticAssets()
+	if err != nil {
+		return nil, err
+	}
+	fingerprinted := make(map[string]staticAsset, len(assets))
+	for _, asset := range assets {
+		fingerprinted[asset.fingerprinted] = asset
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/static/")
+		cacheControl := staticMaxAge
+		asset, ok := assets[name]
+		if !ok {
+			asset, ok = fingerprinted[name]
+			cacheControl = staticImmutable
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", asset.contentType)
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", asset.etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(asset.data))
+	}), nil
+}
@@ -0,0 +1,767 @@
+function toggleFolder(path, event) {
+    // Stop event propagation to prevent parent folders from toggling
+    if (event) {
+        event.stopPropagation();
+    }
+
+    const folder = document.getElementById('folder-' + path);
+    const children = document.getElementById('children-' + path);
+
+    if (children.style.display === 'none') {
+        children.style.display = 'block';
+        folder.classList.add('folder-expanded');
+    } else {
+        children.style.display = 'none';
+        folder.classList.remove('folder-expanded');
+    }
+}
+
+// Show a QR code with the download URL of a file
+function showQR(path, event) {
+    if (event) {
+        event.preventDefault();
+    }
+    const encoded = path.split('/').map(encodeURIComponent).join('/');
+    document.getElementById('qr-image').src = 'qr/' + encoded;
+    document.getElementById('qr-name').textContent = path;
+    document.getElementById('qr-modal').classList.remove('hidden');
+}
+
+function hideQR() {
+    document.getElementById('qr-modal').classList.add('hidden');
+}
+
+// Videos that get a play link, as isVideo on the server
+const videoPattern = /\.(mp4|m4v|mov|mkv|webm|avi|wmv|flv|mpg|mpeg|3gp|ts)$/i;
+
+// Photos browsers can't show, which get a link to a JPEG version
+const heicPattern = /\.(heic|heif)$/i;
+
+// Fall back to the generic icon when no video thumbnail can be made
+function thumbnailFailed(img) {
+    const icon = document.createElement('span');
+    icon.className = 'file-icon';
+    img.replaceWith(icon);
+}
+
+// Show or hide the metadata of a listing entry
+function toggleDetails(button, event) {
+    if (event) {
+        event.stopPropagation();
+    }
+    const details = button.parentElement.querySelector('.details');
+    details.classList.toggle('hidden');
+    button.title = details.classList.contains('hidden') ? 'Show details' : 'Hide details';
+}
+
+// Pin or unpin an item in the favorites section
+function toggleFavorite(path, pinned, event) {
+    if (event) {
+        event.stopPropagation();
+    }
+    const body = new URLSearchParams({path: path, action: pinned ? 'unpin' : 'pin'});
+    fetch('favorites', {method: 'POST', body: body}).then(() => window.location.reload());
+}
+
+// Show the bulk action bar while items are selected
+function updateSelection() {
+    const selected = document.querySelectorAll('.select-item:checked').length;
+    document.getElementById('bulk-tag-form').classList.toggle('hidden', selected === 0);
+    document.getElementById('selection-count').textContent = selected + ' selected';
+}
+
+// Copy the selected paths into the bulk form before submitting
+function collectSelection(form) {
+    form.querySelectorAll('input[name=path]').forEach(input => input.remove());
+    document.querySelectorAll('.select-item:checked').forEach(checkbox => {
+        const input = document.createElement('input');
+        input.type = 'hidden';
+        input.name = 'path';
+        input.value = checkbox.value;
+        form.appendChild(input);
+    });
+    return true;
+}
+
+// Lower case and strip accents, matching the server-side search
+function foldForSearch(text) {
+    return text.normalize('NFD').replace(/[\u0300-\u036f]/g, '').toLowerCase();
+}
+
+// Function to filter files and folders as user types
+function filterFileList() {
+    const searchTerm = foldForSearch(document.getElementById('search-input').value.trim());
+    const fileElements = document.querySelectorAll('.file');
+    const folderElements = document.querySelectorAll('.folder');
+    const noResultsMessage = document.getElementById('no-search-results');
+    const toggleButton = document.getElementById('toggle-folders-button');
+
+    let visibleItems = 0;
+    let expandedFolders = 0;
+    let totalFolders = 0;
+
+    // Function to check if text contains search term
+    const matchesSearch = (text) => foldForSearch(text).includes(searchTerm);
+
+    // Filter files
+    fileElements.forEach(file => {
+        const fileName = file.querySelector('a').textContent;
+        const isMatch = searchTerm === '' || matchesSearch(fileName);
+        file.classList.toggle('hidden', !isMatch);
+        if (isMatch) visibleItems++;
+    });
+
+    // Filter folders and their children
+    folderElements.forEach(folder => {
+        totalFolders++;
+        const folderName = folder.querySelector('.folder-name').textContent;
+        const isMatch = searchTerm === '' || matchesSearch(folderName);
+        const childrenContainer = document.getElementById('children-' + folder.id.substring(7)); // Remove 'folder-' prefix
+
+        // Check if any children are visible when searching
+        let hasVisibleChildren = false;
+        if (childrenContainer) {
+            const childFiles = childrenContainer.querySelectorAll('.file');
+            const childFolders = childrenContainer.querySelectorAll('.folder');
+
+            // Check child files
+            childFiles.forEach(childFile => {
+                const childFileName = childFile.querySelector('a').textContent;
+                const childMatch = searchTerm === '' || matchesSearch(childFileName);
+                childFile.classList.toggle('hidden', !childMatch);
+                hasVisibleChildren = hasVisibleChildren || childMatch;
+            });
+
+            // Check child folders
+            childFolders.forEach(childFolder => {
+                const childFolderName = childFolder.querySelector('.folder-name').textContent;
+                const childMatch = searchTerm === '' || matchesSearch(childFolderName);
+                hasVisibleChildren = hasVisibleChildren || childMatch;
+            });
+        }
+
+        // Show folder if it matches search or has matching children
+        folder.classList.toggle('hidden', !isMatch && !hasVisibleChildren);
+
+        // Expand folder if we're searching and there are matches inside
+        if (searchTerm !== '' && hasVisibleChildren) {
+            childrenContainer.style.display = 'block';
+            folder.classList.add('folder-expanded');
+            expandedFolders++;
+        } else if (searchTerm === '') {
+            // Restore collapsed state when search is cleared
+            childrenContainer.style.display = 'none';
+            folder.classList.remove('folder-expanded');
+        } else if (childrenContainer.style.display === 'block') {
+            // Count already expanded folders
+            expandedFolders++;
+        }
+
+        if (isMatch || hasVisibleChildren) visibleItems++;
+    });
+
+    // Update the global state and button text based on the actual state of folders
+    if (totalFolders > 0) {
+        // Update allFoldersExpanded based on if all folders are expanded
+        allFoldersExpanded = (expandedFolders === totalFolders);
+
+        // Update button text to match current state
+        if (toggleButton) {
+            toggleButton.textContent = allFoldersExpanded ? 'Collapse All Folders' : 'Expand All Folders';
+        }
+    }
+
+    // Show a message if no results found
+    if (noResultsMessage) {
+        noResultsMessage.style.display = visibleItems > 0 ? 'none' : 'block';
+    }
+}
+
+function clearSearch() {
+    const searchInput = document.getElementById('search-input');
+    searchInput.value = '';
+    filterFileList();
+    searchInput.focus();
+}
+
+// Initialize search when the page loads
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('.select-item').forEach(checkbox => {
+        checkbox.addEventListener('change', updateSelection);
+    });
+
+    if (window.location.hash === '#pending') {
+        document.getElementById('pending-notice').classList.remove('hidden');
+    }
+
+    const searchInput = document.getElementById('search-input');
+    if (searchInput) {
+        searchInput.addEventListener('input', filterFileList);
+        searchInput.addEventListener('keydown', function(e) {
+            // Clear search on Escape key
+            if (e.key === 'Escape') {
+                clearSearch();
+            }
+        });
+    }
+
+    const clearButton = document.getElementById('clear-search');
+    if (clearButton) {
+        clearButton.addEventListener('click', clearSearch);
+    }
+
+    const uploadForm = document.getElementById('upload-form');
+    if (uploadForm && window.XMLHttpRequest && window.FormData) {
+        uploadForm.addEventListener('submit', uploadWithProgress);
+    }
+
+    // Remember how many files to upload at once
+    const parallel = document.getElementById('upload-parallel');
+    if (parallel) {
+        parallel.value = localStorage.getItem('uploadParallel') || parallel.value;
+        parallel.addEventListener('change', () => localStorage.setItem('uploadParallel', parallel.value));
+    }
+
+    // Set up expand/collapse button functionality
+    const toggleFoldersButton = document.getElementById('toggle-folders-button');
+    if (toggleFoldersButton) {
+        toggleFoldersButton.addEventListener('click', toggleAllFolders);
+    }
+});
+
+// Global variable to track current folder expansion state
+let allFoldersExpanded = false;
+
+// Function to toggle all folders
+function toggleAllFolders() {
+    const folderElements = document.querySelectorAll('.folder');
+    const toggleButton = document.getElementById('toggle-folders-button');
+
+    // Toggle the global state
+    allFoldersExpanded = !allFoldersExpanded;
+
+    // Update button text
+    if (toggleButton) {
+        toggleButton.textContent = allFoldersExpanded ? 'Collapse All Folders' : 'Expand All Folders';
+    }
+
+    // For each folder, expand or collapse based on new state
+    folderElements.forEach(folder => {
+        const folderId = folder.id;
+        const folderPath = folderId.substring(7); // Remove 'folder-' prefix
+        const childrenContainer = document.getElementById('children-' + folderPath);
+
+        if (childrenContainer) {
+            childrenContainer.style.display = allFoldersExpanded ? 'block' : 'none';
+
+            if (allFoldersExpanded) {
+                folder.classList.add('folder-expanded');
+            } else {
+                folder.classList.remove('folder-expanded');
+            }
+        }
+    });
+}
+
+// Human readable byte counts and durations for upload progress
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+}
+
+function formatDuration(seconds) {
+    seconds = Math.round(seconds);
+    if (seconds < 60) {
+        return seconds + 's';
+    }
+    if (seconds < 3600) {
+        return Math.floor(seconds / 60) + 'm ' + (seconds % 60) + 's';
+    }
+    return Math.floor(seconds / 3600) + 'h ' + Math.floor((seconds % 3600) / 60) + 'm';
+}
+
+// Upload queue: each chosen file is sent on its own, a few side by side,
+// and sent again after a transient failure. A file keeps its
+// Idempotency-Key across attempts, so the server stores it once even when
+// the response to an attempt that went through was lost.
+const uploadRetries = 5;
+const uploadQueue = [];
+let uploadsRunning = 0;
+let uploadsFailed = 0;
+let lastUploadLocation = null;
+
+// Number of files uploaded at once, as set next to the upload button
+function uploadParallelism() {
+    const input = document.getElementById('upload-parallel');
+    const n = parseInt(input ? input.value : '', 10);
+    return n >= 1 ? Math.min(n, 8) : 2;
+}
+
+function newUploadId() {
+    return Date.now().toString(36) + Math.random().toString(36).slice(2, 10);
+}
+
+// Queue the chosen files with the form's other fields as they are now
+function uploadWithProgress(event) {
+    event.preventDefault();
+    const form = event.target;
+    const input = form.querySelector('input[type=file]');
+    const fields = new FormData(form);
+    fields.delete('file');
+
+    const list = document.getElementById('upload-queue');
+    Array.from(input.files).forEach(file => {
+        const item = document.createElement('li');
+        const name = document.createElement('span');
+        name.className = 'upload-name';
+        name.textContent = file.name;
+        const bar = document.createElement('progress');
+        bar.max = 100;
+        bar.value = 0;
+        const status = document.createElement('span');
+        status.className = 'upload-status';
+        status.textContent = 'Queued';
+        item.append(name, bar, status);
+        list.appendChild(item);
+        uploadQueue.push({file, fields, action: form.action || window.location.href, key: newUploadId(), attempts: 0, item, bar, status});
+    });
+    list.classList.remove('hidden');
+    // More files can be picked while these are sent
+    input.value = '';
+    startUploads();
+}
+
+function startUploads() {
+    while (uploadsRunning < uploadParallelism() && uploadQueue.length > 0) {
+        uploadsRunning++;
+        sendUpload(uploadQueue.shift());
+    }
+}
+
+// Whether a failed attempt is worth repeating: the connection dropped, the
+// server was busy or restarting, or an earlier attempt is still running
+function transientUploadError(status) {
+    return status === 0 || status === 408 || status === 409 || status === 429 || status === 502 || status === 503 || status === 504;
+}
+
+function sendUpload(upload) {
+    upload.attempts++;
+    upload.item.className = 'uploading';
+    upload.status.textContent = 'Starting...';
+
+    const data = new FormData();
+    for (const [name, value] of upload.fields) {
+        data.append(name, value);
+    }
+    data.append('file', upload.file);
+
+    const xhr = new XMLHttpRequest();
+    xhr.open('POST', upload.action);
+    xhr.setRequestHeader('X-Upload-ID', upload.key);
+    xhr.setRequestHeader('X-Upload-Name', encodeURIComponent(upload.file.name));
+    xhr.setRequestHeader('Idempotency-Key', upload.key);
+
+    const started = Date.now();
+    xhr.upload.onprogress = function(event) {
+        if (!event.lengthComputable) {
+            return;
+        }
+        upload.bar.value = 100 * event.loaded / event.total;
+        let line = formatBytes(event.loaded) + ' of ' + formatBytes(event.total);
+        const speed = event.loaded / ((Date.now() - started) / 1000);
+        if (speed > 0 && event.loaded < event.total) {
+            line += ' — ' + formatBytes(speed) + '/s, ' + formatDuration((event.total - event.loaded) / speed) + ' left';
+        }
+        upload.status.textContent = line;
+    };
+
+    const done = function(status, message) {
+        if (status > 0 && status < 400) {
+            upload.item.className = 'uploaded';
+            upload.bar.value = 100;
+            upload.status.textContent = 'Done';
+            lastUploadLocation = xhr.responseURL;
+            finishUpload();
+        } else if (transientUploadError(status) && upload.attempts <= uploadRetries) {
+            const delay = Math.min(30, 2 ** upload.attempts);
+            upload.item.className = 'retrying';
+            upload.status.textContent = message + ', retrying in ' + delay + 's';
+            setTimeout(() => sendUpload(upload), delay * 1000);
+        } else {
+            upload.item.className = 'upload-failed';
+            upload.status.textContent = 'Failed: ' + message + ' ';
+            const retry = document.createElement('button');
+            retry.textContent = 'Retry';
+            retry.addEventListener('click', function() {
+                retry.remove();
+                uploadsFailed--;
+                upload.attempts = 0;
+                upload.status.textContent = 'Queued';
+                uploadQueue.push(upload);
+                startUploads();
+            });
+            upload.status.appendChild(retry);
+            uploadsFailed++;
+            finishUpload();
+        }
+    };
+    xhr.onload = () => done(xhr.status, xhr.responseText.trim() || 'error ' + xhr.status);
+    xhr.onerror = () => done(0, 'connection error');
+    xhr.send(data);
+}
+
+// Start the next file, and once all are in show the folder as the server
+// redirected to, unless some failed and are waiting to be retried
+function finishUpload() {
+    uploadsRunning--;
+    startUploads();
+    if (uploadsRunning === 0 && uploadQueue.length === 0 && uploadsFailed === 0 && lastUploadLocation) {
+        window.location.href = lastUploadLocation;
+    }
+}
+
+// Keyboard navigation of the listing: arrows move, Enter opens or
+// downloads, / focuses search and Backspace goes up a folder
+let focusedItem = null;
+
+function visibleItems() {
+    const listing = document.getElementById('file-listing');
+    if (!listing) {
+        return [];
+    }
+    return Array.from(listing.querySelectorAll('.file, .folder')).filter(item => item.offsetParent !== null);
+}
+
+function focusItem(item) {
+    if (focusedItem) {
+        focusedItem.classList.remove('keyboard-focus');
+    }
+    focusedItem = item;
+    if (item) {
+        item.classList.add('keyboard-focus');
+        item.scrollIntoView({block: 'nearest'});
+    }
+}
+
+// Number of tiles per row in the grid view, 1 in the list view
+function itemsPerRow(items) {
+    const listing = document.getElementById('file-listing');
+    if (!listing.classList.contains('view-grid') || items.length === 0) {
+        return 1;
+    }
+    const top = items[0].offsetTop;
+    const row = items.findIndex(item => item.offsetTop !== top);
+    return row === -1 ? items.length : row;
+}
+
+function moveFocus(step) {
+    const items = visibleItems();
+    if (items.length === 0) {
+        return;
+    }
+    let index = items.indexOf(focusedItem);
+    if (index === -1) {
+        index = step > 0 ? 0 : items.length - 1;
+    } else {
+        index = Math.max(0, Math.min(items.length - 1, index + step));
+    }
+    focusItem(items[index]);
+}
+
+function openFocused() {
+    if (!focusedItem) {
+        return;
+    }
+    const link = focusedItem.querySelector(focusedItem.classList.contains('folder') ? '.folder-name' : 'a[href^="download/"]');
+    if (link) {
+        window.location.href = link.href;
+    }
+}
+
+function goUp() {
+    const current = document.querySelector('#upload-form input[name=path]');
+    if (!current || current.value === '') {
+        return;
+    }
+    const parent = current.value.split('/').slice(0, -1).join('/');
+    window.location.href = './?path=' + encodeURIComponent(parent);
+}
+
+function setFocusedFolderExpanded(expanded) {
+    if (!focusedItem || !focusedItem.classList.contains('folder')) {
+        return;
+    }
+    const children = document.getElementById('children-' + focusedItem.id.substring(7)); // Remove 'folder-' prefix
+    if (children && (children.style.display !== 'none') !== expanded) {
+        toggleFolder(focusedItem.id.substring(7));
+    }
+}
+
+document.addEventListener('keydown', function(e) {
+    if (e.ctrlKey || e.metaKey || e.altKey) {
+        return;
+    }
+    if (e.key === 'Escape') {
+        hideQR();
+    }
+    const target = e.target;
+    if (target.isContentEditable || ['INPUT', 'TEXTAREA', 'SELECT', 'BUTTON'].includes(target.tagName)) {
+        return;
+    }
+
+    const grid = document.querySelector('#file-listing.view-grid') !== null;
+    switch (e.key) {
+    case 'ArrowDown':
+        moveFocus(itemsPerRow(visibleItems()));
+        break;
+    case 'ArrowUp':
+        moveFocus(-itemsPerRow(visibleItems()));
+        break;
+    case 'ArrowRight':
+        if (grid) {
+            moveFocus(1);
+        } else {
+            setFocusedFolderExpanded(true);
+        }
+        break;
+    case 'ArrowLeft':
+        if (grid) {
+            moveFocus(-1);
+        } else {
+            setFocusedFolderExpanded(false);
+        }
+        break;
+    case 'Enter':
+        // Let a link focused with Tab follow itself
+        if (target.tagName === 'A' || !focusedItem) {
+            return;
+        }
+        openFocused();
+        break;
+    case '/': {
+        const searchInput = document.getElementById('search-input');
+        if (searchInput) {
+            searchInput.focus();
+        }
+        break;
+    }
+    case 'Backspace':
+        goUp();
+        break;
+    default:
+        return;
+    }
+    e.preventDefault();
+});
+
+// Badge for an entry added or changed since the last visit, if it is
+function renderNewBadge(entry) {
+    if (!entry.new) {
+        return [];
+    }
+    const badge = document.createElement('span');
+    badge.className = 'new-badge';
+    badge.title = 'Added or changed since your last visit';
+    badge.textContent = 'new';
+    return [' ', badge];
+}
+
+// Build a listing entry fetched from /list, matching the server-rendered
+// markup. Folders link to their own page instead of expanding in place.
+function renderEntry(entry) {
+    const item = document.createElement('div');
+    const checkbox = document.createElement('input');
+    checkbox.type = 'checkbox';
+    checkbox.className = 'select-item';
+    checkbox.value = entry.path;
+    checkbox.addEventListener('change', updateSelection);
+    item.appendChild(checkbox);
+
+    let icon = document.createElement('span');
+    const link = document.createElement('a');
+    link.textContent = entry.name;
+    if (entry.is_dir) {
+        item.className = 'folder';
+        item.id = 'folder-' + entry.path;
+        icon.className = 'folder-icon';
+        link.className = 'folder-name';
+        link.href = './?path=' + encodeURIComponent(entry.path);
+        item.append(icon, link, ...renderNewBadge(entry));
+    } else {
+        item.className = 'file';
+        if (entry.thumbnail) {
+            icon = document.createElement('img');
+            icon.className = 'thumbnail';
+            icon.src = 'thumb/' + entry.path.split('/').map(encodeURIComponent).join('/');
+            icon.alt = '';
+            icon.loading = 'lazy';
+            icon.addEventListener('error', () => thumbnailFailed(icon));
+        } else {
+            icon.className = 'file-icon';
+        }
+        link.href = 'download/' + entry.path.split('/').map(encodeURIComponent).join('/');
+        const qr = document.createElement('a');
+        qr.href = '#';
+        qr.className = 'qr-link';
+        qr.title = 'Show QR code';
+        qr.textContent = '▦ QR';
+        qr.addEventListener('click', event => showQR(entry.path, event));
+        item.append(icon, link, ...renderNewBadge(entry), ' (' + entry.size + ' bytes) ');
+        if (videoPattern.test(entry.name)) {
+            const play = document.createElement('a');
+            play.href = 'play?path=' + encodeURIComponent(entry.path);
+            play.className = 'play-link';
+            play.title = 'Play in the browser';
+            play.textContent = '▶ Play';
+            item.append(play, ' ');
+        }
+        if (entry.thumbnail && heicPattern.test(entry.name)) {
+            const view = document.createElement('a');
+            view.href = 'preview/' + entry.path.split('/').map(encodeURIComponent).join('/');
+            view.className = 'play-link';
+            view.title = 'View as JPEG; the original stays HEIC';
+            view.textContent = '▣ View';
+            item.append(view, ' ');
+        }
+        item.append(qr);
+        if (entry.torrent) {
+            const torrent = document.createElement('a');
+            torrent.href = 'torrent/' + entry.path.split('/').map(encodeURIComponent).join('/');
+            torrent.className = 'torrent-link';
+            torrent.title = 'Download with BitTorrent, sharing pieces with other receivers';
+            torrent.textContent = '⇶ Torrent';
+            item.append(' ', torrent);
+        }
+    }
+
+    const favorite = document.createElement('button');
+    favorite.className = 'favorite-button';
+    favorite.title = entry.favorite ? 'Unpin from favorites' : 'Pin to favorites';
+    favorite.textContent = entry.favorite ? '★' : '☆';
+    favorite.addEventListener('click', event => toggleFavorite(entry.path, entry.favorite, event));
+    item.appendChild(favorite);
+
+    (entry.tags || []).forEach(tag => {
+        const tagLink = document.createElement('a');
+        tagLink.className = 'tag';
+        tagLink.href = 'search?tag=' + encodeURIComponent(tag);
+        tagLink.textContent = '#' + tag;
+        item.appendChild(tagLink);
+    });
+    item.append(...renderDetails(entry));
+
+    if (!entry.is_dir) {
+        return [item];
+    }
+    // An empty children container keeps the search filter and the
+    // expand/collapse button working on loaded folders
+    const children = document.createElement('div');
+    children.id = 'children-' + entry.path;
+    children.className = 'children';
+    children.style.display = 'none';
+    return [item, children];
+}
+
+// The details toggle and metadata list of a listing entry
+function renderDetails(entry) {
+    const button = document.createElement('button');
+    button.className = 'details-button';
+    button.title = 'Show details';
+    button.textContent = 'ⓘ';
+    button.addEventListener('click', event => toggleDetails(button, event));
+
+    const details = document.createElement('dl');
+    details.className = 'details hidden';
+    details.addEventListener('click', event => event.stopPropagation());
+    const modified = new Date(entry.mod_time);
+    const pad = n => String(n).padStart(2, '0');
+    const rows = [
+        ['Modified', modified.getFullYear() + '-' + pad(modified.getMonth() + 1) + '-' + pad(modified.getDate()) + ' ' +
+            pad(modified.getHours()) + ':' + pad(modified.getMinutes()) + ':' + pad(modified.getSeconds())],
+        ['Permissions', entry.mode],
+        ['Owner', entry.owner],
+        ['Type', entry.mime_type],
+        ['Size', entry.is_dir ? (entry.tree_files ? entry.tree_size + ' bytes in ' + entry.tree_files + ' file(s)' : '') : entry.size + ' bytes'],
+    ];
+    rows.forEach(([label, value]) => {
+        if (!value) {
+            return;
+        }
+        const dt = document.createElement('dt');
+        dt.textContent = label;
+        const dd = document.createElement('dd');
+        dd.textContent = value;
+        details.append(dt, dd);
+    });
+    return [button, details];
+}
+
+// Fetch the next page of a large folder when the end of the listing
+// scrolls into view
+function loadMoreEntries(observer) {
+    const listing = document.getElementById('file-listing');
+    const more = document.getElementById('listing-more');
+    const next = parseInt(listing.dataset.next, 10);
+    if (listing.dataset.loading || !(next >= 0)) {
+        return;
+    }
+    listing.dataset.loading = '1';
+
+    const query = new URLSearchParams({path: listing.dataset.path, offset: next});
+    fetch('list?' + query).then(response => {
+        if (!response.ok) {
+            throw new Error(response.statusText);
+        }
+        return response.json();
+    }).then(page => {
+        page.entries.forEach(entry => listing.append(...renderEntry(entry)));
+        listing.dataset.next = page.next;
+        delete listing.dataset.loading;
+        if (page.next < 0) {
+            observer.disconnect();
+            more.remove();
+        } else {
+            more.textContent = 'Loading more... (' + (page.offset + page.entries.length) + ' of ' + page.total + ')';
+            // Observing again reports whether the end is still in view
+            observer.unobserve(more);
+            observer.observe(more);
+        }
+        if (document.getElementById('search-input').value.trim() !== '') {
+            filterFileList();
+        }
+    }).catch(err => {
+        delete listing.dataset.loading;
+        more.textContent = 'Could not load more entries: ' + err.message;
+    });
+}
+
+document.addEventListener('DOMContentLoaded', function() {
+    const more = document.getElementById('listing-more');
+    if (!more || !window.IntersectionObserver) {
+        return;
+    }
+    const observer = new IntersectionObserver(entries => {
+        if (entries.some(entry => entry.isIntersecting)) {
+            loadMoreEntries(observer);
+        }
+    }, {rootMargin: '400px'});
+    observer.observe(more);
+});
+
+// With -watch, offer a reload as soon as files in the shown folder change
+document.addEventListener('DOMContentLoaded', function() {
+    const notice = document.getElementById('changes-notice');
+    const listing = document.getElementById('file-listing');
+    if (!notice || !listing || !window.EventSource) {
+        return;
+    }
+    const changes = new EventSource('changes?path=' + encodeURIComponent(listing.dataset.path));
+    changes.onmessage = () => {
+        notice.hidden = false;
+    };
+});
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DownloadStat holds download statistics for a single file
+type DownloadStat struct {
+	Path         string    `json:"path"`
+	Count        int64     `json:"count"`
+	LastDownload time.Time `json:"last_download"`
+}
+
+// StatsStore tracks per-file download statistics in the state database
+type StatsStore struct {
+	db *sql.DB
+}
+
+// Open the stats store, importing the stats.json of earlier versions
+func openStatsStore(db *sql.DB, dataDir string) (*StatsStore, error) {
+	s := &StatsStore{db: db}
+
+	var stats []*DownloadStat
+	err := importJSON(filepath.Join(dataDir, "stats.json"), &stats, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for _, stat := range stats {
+				_, err := tx.Exec("INSERT OR REPLACE INTO downloads (path, count, last_download) VALUES (?, ?, ?)",
+					stat.Path, stat.Count, stat.LastDownload.UnixNano())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record a completed download of a file
+func (s *StatsStore) RecordDownload(path string) {
+	_, err := s.db.Exec(`INSERT INTO downloads (path, count, last_download) VALUES (?, 1, ?)
+		ON CONFLICT (path) DO UPDATE SET count = count + 1, last_download = excluded.last_download`,
+		path, time.Now().UnixNano())
+	if err != nil {
+		log.Printf("Error saving download stats: %v", err)
+	}
+}
+
+// Get all statistics, most downloaded first
+func (s *StatsStore) All() []DownloadStat {
+	rows, err := s.db.Query("SELECT path, count, last_download FROM downloads ORDER BY count DESC, path")
+	if err != nil {
+		log.Printf("Error reading download stats: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var result []DownloadStat
+	for rows.Next() {
+		var stat DownloadStat
+		var lastDownload int64
+		if err := rows.Scan(&stat.Path, &stat.Count, &lastDownload); err != nil {
+			log.Printf("Error reading download stats: %v", err)
+			return result
+		}
+		stat.LastDownload = time.Unix(0, lastDownload)
+		result = append(result, stat)
+	}
+	return result
+}
+
+// Whether a request fetches a file from the start, so that resumed or
+// segmented downloads aren't counted more than once
+func isFullDownload(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// Template for the download statistics page
+const statsTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Download Statistics - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 800px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            text-align: left;
+            padding: 8px;
+            border-bottom: 1px solid #ddd;
+        }
+        th {
+            background-color: #f0f0f0;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+    </style>
+</head>
+<body>
+    <h1>Download Statistics</h1>
+    <p><a href="./">&larr; Back to files</a></p>
+    {{if .}}
+    <table>
+        <tr><th>File</th><th>Downloads</th><th>Last downloaded</th></tr>
+        {{range .}}
+        <tr>
+            <td><a href="download/{{.Path}}">{{.Path}}</a></td>
+            <td>{{.Count}}</td>
+            <td>{{.LastDownload.Format "2006-01-02 15:04:05"}}</td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <p>No files have been downloaded yet.</p>
+    {{end}}
+</body>
+</html>
+`
+
+// Handler for the download statistics page
+func statsHandler(stats *StatsStore, rules *AccessRules) http.Handler {
+	tmpl := template.Must(template.New("stats").Parse(statsTemplate))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only files the client could download themselves are listed
+		var visible []DownloadStat
+		for _, stat := range stats.All() {
+			if rules.Allowed(r, stat.Path, false) {
+				visible = append(visible, stat)
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := tmpl.Execute(w, visible); err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Default file name for data read from stdin
+const defaultStdinName = "stdin"
+
+// Copy everything from r into a new temporary directory as a single file,
+// returning the directory so it can be served like any other download dir
+func spoolStdin(r io.Reader, name string) (string, error) {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = defaultStdinName
+	}
+
+	dir, err := os.MkdirTemp("", "local-fileserver-stdin-")
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	logf("Reading data from stdin into %s", name)
+	n, err := io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("spooling stdin: %w", err)
+	}
+
+	logf("Read %d bytes from stdin", n)
+	return dir, nil
+}
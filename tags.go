@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// TagStore keeps user assigned tags for files and folders in the state
+// database
+type TagStore struct {
+	db *sql.DB
+}
+
+// Open the tag store, importing the tags.json of earlier versions
+func openTagStore(db *sql.DB, dataDir string) (*TagStore, error) {
+	s := &TagStore{db: db}
+
+	tags := make(map[string][]string)
+	err := importJSON(filepath.Join(dataDir, "tags.json"), &tags, func() error {
+		return inTransaction(db, func(tx *sql.Tx) error {
+			for path, pathTags := range tags {
+				for _, tag := range pathTags {
+					if _, err := tx.Exec("INSERT OR IGNORE INTO tags (path, tag) VALUES (?, ?)", path, tag); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Normalize a comma separated list of tags
+func parseTags(list string) []string {
+	var result []string
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// Add and remove tags on a set of paths
+func (s *TagStore) Update(paths, add, remove []string) error {
+	return inTransaction(s.db, func(tx *sql.Tx) error {
+		for _, path := range paths {
+			for _, tag := range add {
+				if _, err := tx.Exec("INSERT OR IGNORE INTO tags (path, tag) VALUES (?, ?)", path, tag); err != nil {
+					return err
+				}
+			}
+			for _, tag := range remove {
+				if _, err := tx.Exec("DELETE FROM tags WHERE path = ? AND tag = ?", path, tag); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Drop all tags for a path, e.g. after it was deleted
+func (s *TagStore) Forget(path string) {
+	if _, err := s.db.Exec("DELETE FROM tags WHERE path = ?", path); err != nil {
+		log.Printf("Error saving tags: %v", err)
+	}
+}
+
+// Tags of a single path, sorted
+func (s *TagStore) Get(path string) []string {
+	return s.query("SELECT tag FROM tags WHERE path = ? ORDER BY tag", path)
+}
+
+// Whether a path has the given tag
+func (s *TagStore) Has(path, tag string) bool {
+	var found bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM tags WHERE path = ? AND tag = ?)", path, tag).Scan(&found)
+	if err != nil {
+		log.Printf("Error reading tags: %v", err)
+	}
+	return found
+}
+
+// All tags in use, sorted
+func (s *TagStore) All() []string {
+	tags := s.query("SELECT DISTINCT tag FROM tags ORDER BY tag")
+	if tags == nil {
+		tags = []string{}
+	}
+	return tags
+}
+
+// Run a query returning tags
+func (s *TagStore) query(query string, args ...any) []string {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error reading tags: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			log.Printf("Error reading tags: %v", err)
+			break
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Fill in the tags of a listing recursively
+func (s *TagStore) Annotate(files []FileInfo) {
+	for i := range files {
+		files[i].Tags = s.Get(cleanRelPath(files[i].Path))
+		s.Annotate(files[i].Children)
+	}
+}
+
+// Handler for bulk tagging from the multi-select UI. Expects one or more
+// "path" values plus comma separated "add" and/or "remove" tag lists.
+func tagsHandler(tags *TagStore, rules *AccessRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var paths []string
+		for _, p := range r.PostForm["path"] {
+			if p = cleanRelPath(p); p != "" {
+				// The access rules filter only sees the first path
+				if !rules.Allowed(r, p, true) {
+					log.Printf("Blocked tagging %s by access rules for %s", p, clientIP(r))
+					http.Error(w, "Access denied: not allowed by the folder's access rules", http.StatusForbidden)
+					return
+				}
+				paths = append(paths, p)
+			}
+		}
+		if len(paths) == 0 {
+			http.Error(w, "No files selected", http.StatusBadRequest)
+			return
+		}
+
+		if err := tags.Update(paths, parseTags(r.PostFormValue("add")), parseTags(r.PostFormValue("remove"))); err != nil {
+			http.Error(w, "Error saving tags: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logf("Tags updated on %d item(s) by %s", len(paths), clientIP(r))
+
+		redirectURL := "/"
+		if current := r.PostFormValue("current"); current != "" {
+			redirectURL += "?path=" + url.QueryEscape(current)
+		}
+		redirect(w, r, redirectURL, http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "os"
+
+// The terminal size can't be queried here
+func terminalSize(f *os.File) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Width of generated poster frames; the height keeps the aspect ratio
+const thumbnailWidth = 320
+
+// Longest a single ffmpeg run may take
+const thumbnailTimeout = 30 * time.Second
+
+// How often the thumbnail cache is measured against its limit, which also
+// catches thumbnails removed or added by hand
+const thumbnailCleanupInterval = time.Hour
+
+// Thumbnails in use have their modification time refreshed at most this
+// often, which is how the least recently used ones are found
+const thumbnailTouchInterval = time.Hour
+
+// Check if a file is a video ffmpeg can take a poster frame from
+func isVideo(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi", ".wmv", ".flv", ".mpg", ".mpeg", ".3gp", ".ts":
+		return true
+	}
+	return false
+}
+
+// Check if a file is a HEIC or HEIF photo, as iPhones take, which most
+// browsers can't show
+func isHEIC(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// Whether the listing shows a thumbnail of a file
+func hasThumbnail(name string) bool {
+	return isVideo(name) || isHEIC(name)
+}
+
+// ThumbnailCache generates video poster frames and JPEG versions of HEIC
+// photos with ffmpeg and keeps them in the data directory. A nil cache
+// means ffmpeg is not installed. Once
+// the thumbnails take up more than the limit, the least recently used are
+// removed to make room, and generated again if they are asked for.
+type ThumbnailCache struct {
+	dir    string
+	ffmpeg string
+	// libheif's converter for HEIC photos, if installed
+	heifConvert string
+	// Most bytes the thumbnails may take up, 0 for no limit
+	limit int64
+	// Limits how many ffmpeg processes run at once
+	slots chan struct{}
+
+	mu     sync.Mutex
+	failed map[string]bool
+	// Bytes taken up, as of the last cleanup plus thumbnails made since
+	used     int64
+	cleaning bool
+}
+
+// Set up the thumbnail cache, or return nil when ffmpeg is not on the PATH
+func openThumbnailCache(dataDir string, limit int64) (*ThumbnailCache, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		logf("ffmpeg not found, video thumbnails and HEIC previews are disabled")
+		return nil, nil
+	}
+	heifConvert, _ := exec.LookPath("heif-convert")
+
+	c := &ThumbnailCache{
+		dir:         filepath.Join(dataDir, "thumbnails"),
+		ffmpeg:      ffmpeg,
+		heifConvert: heifConvert,
+		limit:       limit,
+		slots:       make(chan struct{}, 2),
+		failed:      make(map[string]bool),
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		go func() {
+			for {
+				c.cleanup()
+				time.Sleep(thumbnailCleanupInterval)
+			}
+		}()
+	}
+	return c, nil
+}
+
+// Mark the videos and HEIC photos in a listing recursively so a thumbnail
+// is shown for them
+func (c *ThumbnailCache) Annotate(files []FileInfo) {
+	if c == nil {
+		return
+	}
+	for i := range files {
+		files[i].Thumbnail = !files[i].IsDir && hasThumbnail(files[i].Name)
+		c.Annotate(files[i].Children)
+	}
+}
+
+// Get the cached poster frame of a video or thumbnail of a HEIC photo,
+// generating it on first use
+func (c *ThumbnailCache) Get(fullPath string, info os.FileInfo) (string, error) {
+	if isHEIC(fullPath) {
+		return c.cached(fullPath, info, "thumb", func(dest string) error {
+			tmp, err := os.CreateTemp(c.dir, "thumb-*.jpg")
+			if err != nil {
+				return err
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+			if err := c.convertHEIC(fullPath, tmp.Name()); err != nil {
+				return err
+			}
+			return c.generate(tmp.Name(), dest)
+		})
+	}
+	return c.cached(fullPath, info, "", func(dest string) error {
+		return c.generate(fullPath, dest)
+	})
+}
+
+// Get a full size JPEG of a HEIC photo, converting it on first use. The
+// original is left untouched.
+func (c *ThumbnailCache) Preview(fullPath string, info os.FileInfo) (string, error) {
+	return c.cached(fullPath, info, "preview", func(dest string) error {
+		return c.convertHEIC(fullPath, dest)
+	})
+}
+
+// Get an image made from a file, running generate to make it on first use.
+// The cache key covers the size and modification time so edited files get
+// a fresh image, and the variant, which tells apart images of one file.
+func (c *ThumbnailCache) cached(fullPath string, info os.FileInfo, variant string, generate func(dest string) error) (string, error) {
+	name := fmt.Sprintf("%s|%d|%d", fullPath, info.Size(), info.ModTime().UnixNano())
+	if variant != "" {
+		name += "|" + variant
+	}
+	sum := sha256.Sum256([]byte(name))
+	key := hex.EncodeToString(sum[:])
+	thumbPath := filepath.Join(c.dir, key+".jpg")
+	if thumbInfo, err := os.Stat(thumbPath); err == nil {
+		if now := time.Now(); now.Sub(thumbInfo.ModTime()) > thumbnailTouchInterval {
+			os.Chtimes(thumbPath, now, now)
+		}
+		return thumbPath, nil
+	}
+
+	// Don't run ffmpeg again on files it already failed on
+	c.mu.Lock()
+	failed := c.failed[key]
+	c.mu.Unlock()
+	if failed {
+		return "", errors.New("no thumbnail could be generated for this file")
+	}
+
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	// Another request may have generated it while this one waited
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+	if err := generate(thumbPath); err != nil {
+		c.mu.Lock()
+		c.failed[key] = true
+		c.mu.Unlock()
+		return "", err
+	}
+
+	if thumbInfo, err := os.Stat(thumbPath); err == nil && c.limit > 0 {
+		c.mu.Lock()
+		c.used += thumbInfo.Size()
+		full := c.used > c.limit
+		c.mu.Unlock()
+		if full {
+			go c.cleanup()
+		}
+	}
+	return thumbPath, nil
+}
+
+// Measure the cache and, if it is over the limit, remove the least
+// recently used thumbnails until it is back to 90% of it, so the next
+// cleanup isn't due after the next thumbnail
+func (c *ThumbnailCache) cleanup() {
+	c.mu.Lock()
+	if c.cleaning {
+		c.mu.Unlock()
+		return
+	}
+	c.cleaning = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.cleaning = false
+		c.mu.Unlock()
+	}()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Error reading thumbnail cache: %v", err)
+		return
+	}
+	var thumbs []os.FileInfo
+	var used int64
+	for _, entry := range entries {
+		// Thumbnails being generated are left alone
+		if !strings.HasSuffix(entry.Name(), ".jpg") || strings.HasPrefix(entry.Name(), "thumb-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		thumbs = append(thumbs, info)
+		used += info.Size()
+	}
+
+	removed := 0
+	if used > c.limit {
+		sort.Slice(thumbs, func(i, j int) bool { return thumbs[i].ModTime().Before(thumbs[j].ModTime()) })
+		target := c.limit / 10 * 9
+		for _, info := range thumbs {
+			if used <= target {
+				break
+			}
+			if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing thumbnail %s: %v", info.Name(), err)
+				continue
+			}
+			used -= info.Size()
+			removed++
+		}
+		debugf("Removed %d thumbnail(s) to keep the cache under %s", removed, formatByteSize(c.limit))
+	}
+
+	c.mu.Lock()
+	c.used = used
+	c.mu.Unlock()
+}
+
+// Run ffmpeg to extract a representative frame
+func (c *ThumbnailCache) generate(src, dest string) error {
+	// The thumbnail filter picks a typical frame among the first ones, which
+	// skips black intros and works on clips shorter than any fixed offset
+	return c.ffmpegImage(src, dest, nil, []string{"-vf", fmt.Sprintf("thumbnail,scale=%d:-2", thumbnailWidth)})
+}
+
+// Run ffmpeg to write a JPEG made from the first frame of src with the
+// given input and output options, writing it atomically
+func (c *ThumbnailCache) ffmpegImage(src, dest string, input, output []string) error {
+	tmp, err := os.CreateTemp(c.dir, "thumb-*.jpg")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	args = append(args, input...)
+	args = append(args, "-i", src)
+	args = append(args, output...)
+	args = append(args, "-frames:v", "1", "-y", tmp.Name())
+	cmd := exec.CommandContext(ctx, c.ffmpeg, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if info, err := os.Stat(tmp.Name()); err != nil || info.Size() == 0 {
+		return errors.New("ffmpeg produced no image")
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Convert a HEIC photo to a full size JPEG, with heif-convert from libheif
+// when it is installed, as it handles the tiled images phones take, and
+// ffmpeg otherwise
+func (c *ThumbnailCache) convertHEIC(src, dest string) error {
+	// heif-convert may write depth maps and such next to the photo, so it
+	// gets a folder of its own
+	tmpDir, err := os.MkdirTemp(c.dir, "heic-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	out := filepath.Join(tmpDir, "photo.jpg")
+
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if c.heifConvert != "" {
+		cmd = exec.CommandContext(ctx, c.heifConvert, "-q", "90", src, out)
+	} else {
+		cmd = exec.CommandContext(ctx, c.ffmpeg,
+			"-hide_banner", "-loglevel", "error", "-nostdin",
+			"-i", src, "-frames:v", "1", "-q:v", "2", "-y", out)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", filepath.Base(cmd.Path), err, strings.TrimSpace(string(output)))
+	}
+
+	if info, err := os.Stat(out); err != nil || info.Size() == 0 {
+		return errors.New("HEIC conversion produced no image")
+	}
+	return os.Rename(out, dest)
+}
+
+// Handler serving video poster frames and photo thumbnails
+func thumbnailHandler(config Config, thumbs *ThumbnailCache, encryption *AtRestEncryption, dedup *DedupStore, smallFiles *SmallFileCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := strings.TrimPrefix(r.URL.Path, "/thumb/")
+		if thumbs == nil || !hasThumbnail(filePath) || encryption.Covers(filePath) || dedup.Covers(filePath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		fullPath, err := safeJoinPath(config.DownloadDir, filePath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		thumbPath, err := thumbs.Get(fullPath, info)
+		if err != nil {
+			log.Printf("Error generating thumbnail for %s: %v", filePath, err)
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		if thumbInfo, err := os.Stat(thumbPath); err == nil && smallFiles.Serve(w, r, thumbPath, thumbPath, thumbInfo) {
+			return
+		}
+		http.ServeFile(w, r, thumbPath)
+	})
+}
+
+// Handler serving HEIC photos converted to JPEG, for browsers that can't
+// show the original
+func previewHandler(config Config, thumbs *ThumbnailCache, encryption *AtRestEncryption, dedup *DedupStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := strings.TrimPrefix(r.URL.Path, "/preview/")
+		if thumbs == nil || !isHEIC(filePath) || encryption.Covers(filePath) || dedup.Covers(filePath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		fullPath, err := safeJoinPath(config.DownloadDir, filePath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		previewPath, err := thumbs.Preview(fullPath, info)
+		if err != nil {
+			log.Printf("Error converting %s: %v", filePath, err)
+			http.Error(w, "Error converting photo", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeFile(w, r, previewPath)
+	})
+}
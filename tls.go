@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long the certificate files must stay unchanged before they are
+// reloaded, as renewals write the certificate and key one after the other
+const certReloadDelay = time.Second
+
+// CertReloader holds the HTTPS certificate and loads it again when its
+// files change or the server gets SIGHUP. New connections get the new
+// certificate; open ones, and the transfers on them, carry on.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Load the certificate and key for HTTPS listeners and keep them up to date
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("HTTPS needs both -tls-cert and -tls-key")
+	}
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	c.watch()
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// Load the certificate from its files, keeping the current one on error
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// The current certificate, for tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Reload on SIGHUP and whenever the certificate or key file changes. The
+// folders are watched rather than the files, since renewals often move a
+// new file into place.
+func (c *CertReloader) watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	var changes chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Error watching the TLS certificate, reload it with SIGHUP: %v", err)
+	} else {
+		for _, dir := range []string{filepath.Dir(c.certFile), filepath.Dir(c.keyFile)} {
+			if err := watcher.Add(dir); err != nil {
+				log.Printf("Error watching %s, reload the TLS certificate with SIGHUP: %v", dir, err)
+			}
+		}
+		changes, errs = watcher.Events, watcher.Errors
+	}
+	certFile, _ := filepath.Abs(c.certFile)
+	keyFile, _ := filepath.Abs(c.keyFile)
+
+	go func() {
+		timer := time.NewTimer(certReloadDelay)
+		timer.Stop()
+		for {
+			select {
+			case event := <-changes:
+				name, _ := filepath.Abs(event.Name)
+				if name == certFile || name == keyFile {
+					timer.Reset(certReloadDelay)
+				}
+				continue
+			case err := <-errs:
+				log.Printf("Error watching the TLS certificate: %v", err)
+				continue
+			case <-timer.C:
+			case <-sighup:
+			}
+			if err := c.Reload(); err != nil {
+				log.Printf("Error reloading TLS certificate, keeping the current one: %v", err)
+			} else {
+				logf("Reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+	}()
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files from this size on get a torrent link in the listing
+const minTorrentSize = 256 << 20
+
+// Piece sizes of generated torrents: at most about 2000 pieces, in powers
+// of two between 256 KiB and 16 MiB
+const (
+	minTorrentPiece     = 256 << 10
+	maxTorrentPiece     = 16 << 20
+	targetTorrentPieces = 2000
+)
+
+// How often peers announce to the built-in tracker, and when one that
+// stopped announcing is forgotten
+const (
+	trackerInterval = 2 * time.Minute
+	trackerPeerTTL  = 3 * trackerInterval
+	maxTrackerPeers = 50
+)
+
+// bencoded is data that is already bencoded, like a cached info dictionary
+type bencoded []byte
+
+// Write v in BitTorrent's bencoding. Supports strings, byte slices,
+// integers, lists and dictionaries with string keys.
+func bencode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case bencoded:
+		buf.Write(v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range v {
+			bencode(buf, item)
+		}
+		buf.WriteByte('e')
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range v {
+			bencode(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		// Keys must be sorted as raw strings
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencode(buf, key)
+			bencode(buf, v[key])
+		}
+		buf.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// Pick a piece size for a torrent of total bytes
+func torrentPieceLength(total int64) int64 {
+	piece := int64(minTorrentPiece)
+	for piece < maxTorrentPiece && total/piece > targetTorrentPieces {
+		piece *= 2
+	}
+	return piece
+}
+
+// A file in a torrent, relative to the torrent's root
+type torrentFile struct {
+	fullPath string
+	path     []string
+	info     fs.FileInfo
+}
+
+// List the files a torrent of fullPath holds: the file itself, or the
+// regular files in a folder in a stable order. Symlinks are skipped.
+func torrentFiles(fullPath string) ([]torrentFile, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []torrentFile{{fullPath: fullPath, info: info}}, nil
+	}
+
+	var files []torrentFile
+	err = filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(fullPath, path)
+		files = append(files, torrentFile{fullPath: path, path: strings.Split(filepath.ToSlash(relPath), "/"), info: info})
+		return nil
+	})
+	if err == nil && len(files) == 0 {
+		err = errors.New("the folder has no files")
+	}
+	return files, err
+}
+
+// Hash the pieces of the files and build the bencoded info dictionary
+func buildTorrentInfo(name string, isDir bool, files []torrentFile) (bencoded, error) {
+	var total int64
+	for _, f := range files {
+		total += f.info.Size()
+	}
+	pieceLength := torrentPieceLength(total)
+
+	// Pieces run across file boundaries, so hash the files as one stream
+	var pieces bytes.Buffer
+	piece := sha1.New()
+	var inPiece int64
+	for _, f := range files {
+		in, err := os.Open(f.fullPath)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, err := io.CopyN(piece, in, pieceLength-inPiece)
+			inPiece += n
+			if inPiece == pieceLength {
+				pieces.Write(piece.Sum(nil))
+				piece.Reset()
+				inPiece = 0
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				in.Close()
+				return nil, err
+			}
+		}
+		in.Close()
+	}
+	if inPiece > 0 {
+		pieces.Write(piece.Sum(nil))
+	}
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces.Bytes(),
+	}
+	if isDir {
+		list := make([]interface{}, len(files))
+		for i, f := range files {
+			list[i] = map[string]interface{}{"length": f.info.Size(), "path": f.path}
+		}
+		info["files"] = list
+	} else {
+		info["length"] = total
+	}
+
+	var buf bytes.Buffer
+	bencode(&buf, info)
+	return buf.Bytes(), nil
+}
+
+// TorrentCache keeps the info dictionaries of generated torrents in the
+// data directory, since hashing a huge file takes a while. It also runs
+// the tracker for them. A nil cache means torrents are disabled.
+type TorrentCache struct {
+	dir string
+	// Hashing is disk bound, so one torrent is built at a time
+	slots chan struct{}
+
+	mu    sync.Mutex
+	known map[[sha1.Size]byte]bool
+	// info hash -> peer ID -> peer
+	swarms map[[sha1.Size]byte]map[string]trackerPeer
+}
+
+type trackerPeer struct {
+	ip      net.IP
+	port    int
+	expires time.Time
+}
+
+// Set up the torrent cache, or return nil when torrents are disabled
+func openTorrentCache(dataDir string, enabled bool) (*TorrentCache, error) {
+	if !enabled {
+		return nil, nil
+	}
+	c := &TorrentCache{
+		dir:    filepath.Join(dataDir, "torrents"),
+		slots:  make(chan struct{}, 1),
+		known:  make(map[[sha1.Size]byte]bool),
+		swarms: make(map[[sha1.Size]byte]map[string]trackerPeer),
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Keep tracking torrents handed out before a restart
+	cached, _ := filepath.Glob(filepath.Join(c.dir, "*.info"))
+	for _, path := range cached {
+		if info, err := os.ReadFile(path); err == nil {
+			c.known[sha1.Sum(info)] = true
+		}
+	}
+	return c, nil
+}
+
+// Mark the big files in a listing recursively so a torrent link is shown
+func (c *TorrentCache) Annotate(files []FileInfo) {
+	if c == nil {
+		return
+	}
+	for i := range files {
+		files[i].Torrent = !files[i].IsDir && files[i].Size >= minTorrentSize
+		c.Annotate(files[i].Children)
+	}
+}
+
+// Get the info dictionary for a file or folder, building it on first use.
+// The cache key covers the names, sizes and modification times of all
+// files, so changed content gets a fresh torrent.
+func (c *TorrentCache) Info(fullPath string) (bencoded, error) {
+	files, err := torrentFiles(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.New()
+	fmt.Fprintf(key, "%s\n", fullPath)
+	for _, f := range files {
+		fmt.Fprintf(key, "%s|%d|%d\n", strings.Join(f.path, "/"), f.info.Size(), f.info.ModTime().UnixNano())
+	}
+	cachePath := filepath.Join(c.dir, hex.EncodeToString(key.Sum(nil))+".info")
+	if info, err := os.ReadFile(cachePath); err == nil {
+		return info, nil
+	}
+
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	start := time.Now()
+	// Files of a folder have a path inside it, a single file has none
+	isDir := files[0].path != nil
+	info, err := buildTorrentInfo(filepath.Base(fullPath), isDir, files)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(cachePath, info, 0600); err != nil {
+		return nil, err
+	}
+	logf("Torrent of %s built in %v", filepath.Base(fullPath), time.Since(start).Round(time.Millisecond))
+
+	c.mu.Lock()
+	c.known[sha1.Sum(info)] = true
+	c.mu.Unlock()
+	return info, nil
+}
+
+// Record an announce and return the other peers of the torrent. Only
+// torrents generated here are tracked.
+func (c *TorrentCache) Announce(infoHash [sha1.Size]byte, peerID string, peer trackerPeer, stopped bool) ([]trackerPeer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.known[infoHash] {
+		return nil, false
+	}
+	swarm := c.swarms[infoHash]
+	if swarm == nil {
+		swarm = make(map[string]trackerPeer)
+		c.swarms[infoHash] = swarm
+	}
+	if stopped {
+		delete(swarm, peerID)
+	} else {
+		swarm[peerID] = peer
+	}
+
+	now := time.Now()
+	var others []trackerPeer
+	for id, other := range swarm {
+		if now.After(other.expires) {
+			delete(swarm, id)
+			continue
+		}
+		if id != peerID && len(others) < maxTrackerPeers {
+			others = append(others, other)
+		}
+	}
+	return others, true
+}
+
+// Reply to a tracker request with a bencoded failure
+func writeTrackerFailure(w http.ResponseWriter, reason string) {
+	var buf bytes.Buffer
+	bencode(&buf, map[string]interface{}{"failure reason": reason})
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// Handler for .torrent files of a file or folder at /torrent/<path>. The
+// torrent lists this server as web seed, so it can always be completed
+// from here, and as tracker, so receivers on the LAN find each other and
+// swap pieces instead of all reading from this disk.
+func torrentHandler(config Config, torrents *TorrentCache, encryption *AtRestEncryption, dedup *DedupStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if torrents == nil {
+			http.NotFound(w, r)
+			return
+		}
+		relPath := cleanRelPath(strings.TrimPrefix(r.URL.Path, "/torrent/"))
+		if relPath == "" || encryption.Covers(relPath) || dedup.Covers(relPath) {
+			http.Error(w, "Invalid file path", http.StatusBadRequest)
+			return
+		}
+		fullPath, err := safeJoinPath(config.DownloadDir, relPath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fileInfo, err := os.Stat(fullPath)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		// Pieces of encrypted files would be hashed as stored, not as served
+		if fileInfo.IsDir() && encryption != nil && strings.HasPrefix(encryption.Folder+"/", relPath+"/") {
+			http.Error(w, "Folders containing the encrypted folder cannot be shared as a torrent", http.StatusBadRequest)
+			return
+		}
+
+		info, err := torrents.Info(fullPath)
+		if err != nil {
+			http.Error(w, "Error creating torrent: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Web seeds of folders name the folder containing the torrent's
+		// root, clients add the file paths
+		seed := externalURL(r, "/download/"+relPath).String()
+		if fileInfo.IsDir() {
+			seed = externalURL(r, "/download/"+filepath.ToSlash(filepath.Dir(relPath))+"/").String()
+			if filepath.Dir(relPath) == "." {
+				seed = externalURL(r, "/download/").String()
+			}
+		}
+		var buf bytes.Buffer
+		bencode(&buf, map[string]interface{}{
+			"announce":      externalURL(r, "/announce").String(),
+			"url-list":      []string{seed},
+			"created by":    "local-fileserver",
+			"creation date": time.Now().Unix(),
+			"info":          info,
+		})
+
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(relPath)+".torrent"))
+		w.Write(buf.Bytes())
+		logf("Torrent of %s fetched by %s", relPath, clientIP(r))
+	})
+}
+
+// Handler for the built-in BitTorrent tracker at /announce
+func trackerHandler(torrents *TorrentCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if torrents == nil {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		var infoHash [sha1.Size]byte
+		if len(query.Get("info_hash")) != sha1.Size {
+			writeTrackerFailure(w, "invalid info_hash")
+			return
+		}
+		copy(infoHash[:], query.Get("info_hash"))
+		peerID := query.Get("peer_id")
+		port, err := strconv.Atoi(query.Get("port"))
+		if peerID == "" || err != nil || port <= 0 || port > 65535 {
+			writeTrackerFailure(w, "invalid peer_id or port")
+			return
+		}
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil {
+			writeTrackerFailure(w, "unknown client address")
+			return
+		}
+
+		peer := trackerPeer{ip: ip, port: port, expires: time.Now().Add(trackerPeerTTL)}
+		others, ok := torrents.Announce(infoHash, peerID, peer, query.Get("event") == "stopped")
+		if !ok {
+			writeTrackerFailure(w, "unknown torrent")
+			return
+		}
+
+		// Compact peer lists: 4 or 16 address bytes and a 2 byte port each
+		var peers, peers6 []byte
+		for _, other := range others {
+			var portBytes [2]byte
+			binary.BigEndian.PutUint16(portBytes[:], uint16(other.port))
+			if ip4 := other.ip.To4(); ip4 != nil {
+				peers = append(append(peers, ip4...), portBytes[:]...)
+			} else {
+				peers6 = append(append(peers6, other.ip.To16()...), portBytes[:]...)
+			}
+		}
+		var buf bytes.Buffer
+		bencode(&buf, map[string]interface{}{
+			"interval": int(trackerInterval.Seconds()),
+			"peers":    peers,
+			"peers6":   peers6,
+		})
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transcoder converts videos a browser can't play, such as HEVC in MKV, to
+// H.264 and AAC with ffmpeg while they are watched. Each visitor may have
+// a limited number of conversions running, so one tablet flicking through
+// videos can't keep every core busy. A nil Transcoder means it is off.
+type Transcoder struct {
+	ffmpeg string
+	jobs   int
+
+	mu      sync.Mutex
+	running map[string]int // visitor ID -> conversions in progress
+}
+
+// Set up transcoding with at most jobs conversions per visitor, or return
+// nil when ffmpeg is not on the PATH
+func newTranscoder(jobs int) *Transcoder {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		logf("ffmpeg not found, transcoding is disabled")
+		return nil
+	}
+	return &Transcoder{
+		ffmpeg:  ffmpeg,
+		jobs:    jobs,
+		running: make(map[string]int),
+	}
+}
+
+// Take one of a visitor's conversion slots, returning false when they are
+// all in use
+func (t *Transcoder) acquire(visitor string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[visitor] >= t.jobs {
+		return false
+	}
+	t.running[visitor]++
+	return true
+}
+
+func (t *Transcoder) release(visitor string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[visitor]--; t.running[visitor] <= 0 {
+		delete(t.running, visitor)
+	}
+}
+
+// Convert src to fragmented MP4 written to w, starting start seconds in.
+// The conversion stops when ctx is done, as when the viewer goes away.
+func (t *Transcoder) Stream(ctx context.Context, w http.ResponseWriter, src string, start float64) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', -1, 64))
+	}
+	// Fragmented MP4 can be played while it is being written. Videos are
+	// scaled down to 1280 pixels wide, which older tablets decode smoothly.
+	args = append(args, "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-vf", "scale='min(1280,iw)':-2",
+		"-c:a", "aac", "-ac", "2", "-b:a", "128k",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4", "pipe:1")
+
+	cmd := exec.CommandContext(ctx, t.ffmpeg, args...)
+	var stderr strings.Builder
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Handler streaming a video converted for playback in any browser. The
+// stream can't be seeked; "start" gives the second to begin at instead.
+func transcodeHandler(config Config, transcoder *Transcoder, encryption *AtRestEncryption, dedup *DedupStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := strings.TrimPrefix(r.URL.Path, "/transcode/")
+		if transcoder == nil || !isVideo(filePath) || encryption.Covers(filePath) || dedup.Covers(filePath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		fullPath, err := safeJoinPath(config.DownloadDir, filePath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		var start float64
+		if v := r.URL.Query().Get("start"); v != "" {
+			if start, err = strconv.ParseFloat(v, 64); err != nil || start < 0 {
+				http.Error(w, "Invalid start: "+v, http.StatusBadRequest)
+				return
+			}
+		}
+
+		visitor := visitorID(w, r)
+		if !transcoder.acquire(visitor) {
+			http.Error(w, "Too many videos are being converted for you, stop one and try again", http.StatusTooManyRequests)
+			return
+		}
+		defer transcoder.release(visitor)
+
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "HEAD" {
+			return
+		}
+		debugf("Transcoding %s for %s", filePath, clientIP(r))
+		if err := transcoder.Stream(r.Context(), w, fullPath, start); err != nil {
+			log.Printf("Error transcoding %s: %v", filePath, err)
+		}
+	})
+}
+
+// Template for the video player page
+const playerTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Name}} - Local File Server</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <style>
+        body {
+            font-family: Arial, sans-serif;
+            max-width: 1000px;
+            margin: 0 auto;
+            padding: 20px;
+        }
+        h1 {
+            color: #333;
+            font-size: 20px;
+            word-break: break-all;
+        }
+        a {
+            text-decoration: none;
+            color: #0066cc;
+        }
+        video {
+            width: 100%;
+            max-height: 80vh;
+            background-color: #000;
+        }
+        .note {
+            color: #666;
+            font-size: 14px;
+        }
+    </style>
+</head>
+<body>
+    <h1>{{.Name}}</h1>
+    <p><a href="./?path={{.Folder}}">&larr; Back to files</a> &middot; <a href="download/{{.Path}}">Download</a></p>
+    <video id="player" controls autoplay playsinline src="{{if .Transcode}}transcode/{{.Path}}{{else}}download/{{.Path}}{{end}}"></video>
+    {{if .CanTranscode}}
+    <p class="note" id="note">
+        {{if .Transcode}}Converted for this browser as it plays; seeking is not available.
+        <a href="play?path={{.Path}}">Play the original</a>
+        {{else}}Black picture or no sound? <a href="play?path={{.Path}}&amp;transcode=1">Convert it for this browser</a>{{end}}
+    </p>
+    <script>
+        // Switch to the converted stream when the browser can't decode the
+        // original, or only its sound
+        (function() {
+            var player = document.getElementById('player');
+            var transcodeURL = 'transcode/' + {{.Path}}.split('/').map(encodeURIComponent).join('/');
+            function fallBack() {
+                if (player.src.indexOf('transcode/') !== -1) {
+                    return;
+                }
+                player.src = transcodeURL;
+                player.play();
+                document.getElementById('note').textContent = 'This browser can\'t play the original, so it is converted as it plays; seeking is not available.';
+            }
+            player.addEventListener('error', fallBack);
+            player.addEventListener('loadedmetadata', function() {
+                if (player.videoWidth === 0) {
+                    fallBack();
+                }
+            });
+        })();
+    </script>
+    {{end}}
+</body>
+</html>
+`
+
+// Handler for the page playing the video given as "path". Videos the
+// browser can't play are switched to a converted stream when transcoding
+// is on; transcode=1 asks for it straight away.
+func playerHandler(config Config, transcoder *Transcoder) http.Handler {
+	tmpl := template.Must(template.New("player").Parse(playerTemplate))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := cleanRelPath(r.URL.Query().Get("path"))
+		if !isVideo(filePath) {
+			http.NotFound(w, r)
+			return
+		}
+		fullPath, err := safeJoinPath(config.DownloadDir, filePath)
+		if err != nil {
+			http.Error(w, "Invalid file path: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if info, err := os.Stat(fullPath); err != nil || info.IsDir() {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+
+		folder := ""
+		if i := strings.LastIndex(filePath, "/"); i >= 0 {
+			folder = filePath[:i]
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = tmpl.Execute(w, struct {
+			Name         string
+			Path         string
+			Folder       string
+			CanTranscode bool
+			Transcode    bool
+		}{
+			Name:         path.Base(filePath),
+			Path:         filePath,
+			Folder:       folder,
+			CanTranscode: transcoder != nil,
+			Transcode:    transcoder != nil && r.URL.Query().Get("transcode") == "1",
+		})
+		if err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer is an upload or download in progress
+type Transfer struct {
+	ID      string
+	Kind    string // upload or download
+	Path    string
+	Client  string
+	Size    int64 // -1 if unknown
+	Started time.Time
+
+	bytes atomic.Int64
+
+	// Smoothed transfer rate, updated whenever the status is read
+	mu        sync.Mutex
+	lastBytes int64
+	lastTime  time.Time
+	rate      float64
+}
+
+// TransferStatus is a snapshot of a transfer with its speed and ETA
+type TransferStatus struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path"`
+	Client  string    `json:"client"`
+	Size    int64     `json:"size"`
+	Bytes   int64     `json:"bytes"`
+	Speed   float64   `json:"speed"` // bytes per second
+	ETA     float64   `json:"eta"`   // seconds, -1 if unknown
+	Started time.Time `json:"started"`
+}
+
+// Count transferred bytes
+func (t *Transfer) Add(n int64) {
+	t.bytes.Add(n)
+}
+
+// Take a snapshot, folding the bytes moved since the previous one into an
+// exponentially weighted moving average so the speed doesn't jump around
+func (t *Transfer) Status() TransferStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	done := t.bytes.Load()
+	if elapsed := now.Sub(t.lastTime).Seconds(); elapsed >= 0.5 {
+		current := float64(done-t.lastBytes) / elapsed
+		if t.rate == 0 {
+			t.rate = current
+		} else {
+			t.rate = 0.7*t.rate + 0.3*current
+		}
+		t.lastBytes, t.lastTime = done, now
+	}
+
+	eta := -1.0
+	if t.Size >= 0 && t.rate > 0 {
+		eta = float64(max(t.Size-done, 0)) / t.rate
+	}
+
+	return TransferStatus{
+		ID:      t.ID,
+		Kind:    t.Kind,
+		Path:    t.Path,
+		Client:  t.Client,
+		Size:    t.Size,
+		Bytes:   done,
+		Speed:   t.rate,
+		ETA:     eta,
+		Started: t.Started,
+	}
+}
+
+// TransferTracker keeps track of the transfers in progress
+type TransferTracker struct {
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+}
+
+func newTransferTracker() *TransferTracker {
+	return &TransferTracker{transfers: make(map[string]*Transfer)}
+}
+
+// Register a transfer. An empty id gets a random one.
+func (t *TransferTracker) Start(id, kind, path, client string, size int64) *Transfer {
+	if id == "" {
+		id, _ = randomID()
+	}
+	now := time.Now()
+	transfer := &Transfer{
+		ID:       id,
+		Kind:     kind,
+		Path:     path,
+		Client:   client,
+		Size:     size,
+		Started:  now,
+		lastTime: now,
+	}
+
+	t.mu.Lock()
+	t.transfers[id] = transfer
+	t.mu.Unlock()
+	return transfer
+}
+
+// Forget a finished transfer
+func (t *TransferTracker) Finish(transfer *Transfer) {
+	t.mu.Lock()
+	if t.transfers[transfer.ID] == transfer {
+		delete(t.transfers, transfer.ID)
+	}
+	t.mu.Unlock()
+}
+
+// Status of one transfer
+func (t *TransferTracker) Get(id string) (TransferStatus, bool) {
+	t.mu.Lock()
+	transfer, ok := t.transfers[id]
+	t.mu.Unlock()
+	if !ok {
+		return TransferStatus{}, false
+	}
+	return transfer.Status(), true
+}
+
+// Status of all transfers, oldest first
+func (t *TransferTracker) List() []TransferStatus {
+	t.mu.Lock()
+	transfers := make([]*Transfer, 0, len(t.transfers))
+	for _, transfer := range t.transfers {
+		transfers = append(transfers, transfer)
+	}
+	t.mu.Unlock()
+
+	result := make([]TransferStatus, len(transfers))
+	for i, transfer := range transfers {
+		result[i] = transfer.Status()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+// Reader counting the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	transfer *Transfer
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.transfer.Add(int64(n))
+	return n, err
+}
+
+// How much a counted response hands to the underlying ReadFrom at once
+const transferChunk = 4 << 20
+
+// ResponseWriter counting the bytes written through it
+type countingResponseWriter struct {
+	http.ResponseWriter
+	transfer *Transfer
+}
+
+func (w countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.transfer.Add(int64(n))
+	return n, err
+}
+
+// Keep the underlying ReadFrom (and with it sendfile) but feed it in chunks
+// so progress is visible while a large file is sent
+func (w countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+
+	limit := int64(-1)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, limit = lr.R, lr.N
+	}
+
+	var total int64
+	for limit != 0 {
+		chunk := int64(transferChunk)
+		if limit > 0 && limit < chunk {
+			chunk = limit
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		total += n
+		w.transfer.Add(n)
+		if limit > 0 {
+			limit -= n
+		}
+		if err != nil || n < chunk {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (w countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Accept a client chosen transfer ID only if it is short and plain
+func transferID(id string) string {
+	if len(id) > 64 {
+		return ""
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return id
+}
+
+// Handler reporting the progress of one transfer, by the ID an uploading
+// page passed in X-Upload-ID
+func transferStatusHandler(transfers *TransferTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, ok := transfers.Get(strings.TrimPrefix(r.URL.Path, "/transfers/"))
+		if !ok {
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
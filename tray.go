@@ -0,0 +1,284 @@
+//go:build tray
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"fyne.io/systray"
+)
+
+// Show an icon in the system tray that runs the server in a child process,
+// so it can be started, stopped and pointed at another folder without a
+// terminal. args are the command-line options, passed on to the server.
+func runTray(config Config, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	t := &trayServer{
+		exe:     exe,
+		args:    args,
+		dir:     config.DownloadDir,
+		urls:    accessURLs(config.Listen, cleanBasePath(config.BasePath)),
+		changed: make(chan struct{}, 1),
+	}
+	systray.Run(t.ready, t.Stop)
+	return nil
+}
+
+// The server process controlled from the tray icon
+type trayServer struct {
+	exe  string
+	args []string
+	urls []string
+	// Told when the server starts or stops, including by itself
+	changed chan struct{}
+
+	mu     sync.Mutex
+	dir    string
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// Set up the menu and start serving
+func (t *trayServer) ready() {
+	if icon, err := trayIcon(); err == nil {
+		systray.SetIcon(icon)
+	} else {
+		log.Printf("Error loading tray icon: %v", err)
+	}
+	systray.SetTooltip(AppName)
+
+	status := systray.AddMenuItem("", "")
+	status.Disable()
+	toggle := systray.AddMenuItem("", "Start or stop serving files")
+	browse := systray.AddMenuItem("Open in browser", "Open the file server in the web browser")
+	copyURL := systray.AddMenuItem("Copy URL", "Copy the address other devices can use")
+	folder := systray.AddMenuItem("Choose folder...", "Serve another folder")
+	systray.AddSeparator()
+	quit := systray.AddMenuItem("Quit", "Stop the server and quit")
+
+	update := func() {
+		running, dir := t.Running()
+		if running {
+			status.SetTitle("Serving " + dir)
+			toggle.SetTitle("Stop server")
+			browse.Enable()
+			copyURL.Enable()
+		} else {
+			status.SetTitle("Stopped")
+			toggle.SetTitle("Start server")
+			browse.Disable()
+			copyURL.Disable()
+		}
+	}
+
+	if err := t.Start(); err != nil {
+		log.Printf("Error starting server: %v", err)
+	}
+	update()
+
+	go func() {
+		for {
+			select {
+			case <-t.changed:
+				update()
+			case <-toggle.ClickedCh:
+				if running, _ := t.Running(); running {
+					t.Stop()
+				} else if err := t.Start(); err != nil {
+					log.Printf("Error starting server: %v", err)
+				}
+			case <-browse.ClickedCh:
+				if err := openBrowser(t.localURL()); err != nil {
+					log.Printf("Error opening the browser: %v", err)
+				}
+			case <-copyURL.ClickedCh:
+				if err := copyToClipboard(t.urls[0]); err != nil {
+					log.Printf("Error copying URL to the clipboard: %v", err)
+				}
+			case <-folder.ClickedCh:
+				dir, err := chooseFolder()
+				if err != nil {
+					log.Printf("Error choosing a folder: %v", err)
+				} else if dir != "" {
+					if err := t.SetDir(dir); err != nil {
+						log.Printf("Error starting server: %v", err)
+					}
+				}
+			case <-quit.ClickedCh:
+				systray.Quit()
+				return
+			}
+		}
+	}()
+}
+
+// The site icon as the tray wants it: the .ico itself on Windows, and the
+// PNG image inside it elsewhere
+func trayIcon() ([]byte, error) {
+	icon, err := staticFiles.ReadFile("static/favicon.ico")
+	if err != nil || runtime.GOOS == "windows" {
+		return icon, err
+	}
+	// The first directory entry holds the image's size and offset
+	if len(icon) < 22 {
+		return nil, errors.New("invalid icon")
+	}
+	size := binary.LittleEndian.Uint32(icon[14:18])
+	offset := binary.LittleEndian.Uint32(icon[18:22])
+	if uint64(offset)+uint64(size) > uint64(len(icon)) {
+		return nil, errors.New("invalid icon")
+	}
+	return icon[offset : offset+size], nil
+}
+
+// Whether the server is running, and the folder it serves or will serve
+func (t *trayServer) Running() (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cmd != nil, t.dir
+}
+
+// Start the server on the chosen folder unless it is already running
+func (t *trayServer) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cmd != nil {
+		return nil
+	}
+
+	// Later options win, so the chosen folder replaces any -dir given, and
+	// the server never opens a tray of its own from the configuration file
+	args := append(append([]string{}, t.args...), "-tray=false", "-dir", t.dir)
+	cmd := exec.Command(t.exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	t.cmd, t.exited = cmd, exited
+	t.notify()
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Server stopped: %v", err)
+		}
+		t.mu.Lock()
+		if t.cmd == cmd {
+			t.cmd = nil
+		}
+		t.mu.Unlock()
+		close(exited)
+		t.notify()
+	}()
+	return nil
+}
+
+// Stop the server, letting it clean up like on Ctrl+C where the platform
+// allows, and wait for it to exit
+func (t *trayServer) Stop() {
+	t.mu.Lock()
+	cmd, exited := t.cmd, t.exited
+	t.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	if runtime.GOOS == "windows" || cmd.Process.Signal(os.Interrupt) != nil {
+		cmd.Process.Kill()
+	}
+	<-exited
+}
+
+// Serve dir from now on, restarting the server if it is running
+func (t *trayServer) SetDir(dir string) error {
+	running, _ := t.Running()
+	t.Stop()
+	t.mu.Lock()
+	t.dir = dir
+	t.mu.Unlock()
+	t.notify()
+	if running {
+		return t.Start()
+	}
+	return nil
+}
+
+func (t *trayServer) notify() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// The address to open on this machine, preferring localhost
+func (t *trayServer) localURL() string {
+	for _, u := range t.urls {
+		if strings.Contains(u, "://localhost:") {
+			return u
+		}
+	}
+	return t.urls[0]
+}
+
+// Open url in the default web browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// Folder pickers to try in order on this platform, with their arguments
+func folderDialogCommands() [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"osascript", "-e", `POSIX path of (choose folder with prompt "Folder to share")`}}
+	case "windows":
+		return [][]string{{"powershell", "-NoProfile", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; " +
+				"$d = New-Object System.Windows.Forms.FolderBrowserDialog; " +
+				"if ($d.ShowDialog() -eq 'OK') { $d.SelectedPath }"}}
+	}
+	return [][]string{
+		{"zenity", "--file-selection", "--directory", "--title=Folder to share"},
+		{"kdialog", "--getexistingdirectory"},
+	}
+}
+
+// Ask for a folder with the platform's dialog. Returns "" if the dialog
+// was cancelled.
+func chooseFolder() (string, error) {
+	for _, args := range folderDialogCommands() {
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			continue
+		}
+		out, err := exec.Command(path, args[1:]...).Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// Cancelling exits with an error status
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return "", errors.New("no folder dialog found; install zenity or kdialog")
+}
@@ -0,0 +1,11 @@
+//go:build !tray
+
+package main
+
+import "errors"
+
+// The tray icon needs a desktop toolkit, so it is only built with
+// -tags tray
+func runTray(config Config, args []string) error {
+	return errors.New("this build has no tray icon; build with: go build -tags tray")
+}
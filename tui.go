@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// How long a client counts as connected after its last request, and how
+// many log lines the dashboard keeps
+const (
+	clientIdleTimeout = 5 * time.Minute
+	dashboardLogLines = 200
+)
+
+// ClientStatus is a client seen recently
+type ClientStatus struct {
+	IP       string
+	Requests int64
+	LastSeen time.Time
+}
+
+// ClientTracker remembers which clients made requests recently
+type ClientTracker struct {
+	mu      sync.Mutex
+	clients map[string]*ClientStatus
+}
+
+// Create an empty client tracker
+func newClientTracker() *ClientTracker {
+	return &ClientTracker{clients: make(map[string]*ClientStatus)}
+}
+
+// Record a request from ip
+func (c *ClientTracker) Seen(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, ok := c.clients[ip]
+	if !ok {
+		client = &ClientStatus{IP: ip}
+		c.clients[ip] = client
+	}
+	client.Requests++
+	client.LastSeen = time.Now()
+}
+
+// Get the clients seen within clientIdleTimeout, most recent first
+func (c *ClientTracker) List() []ClientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := time.Now().Add(-clientIdleTimeout)
+	var result []ClientStatus
+	for ip, client := range c.clients {
+		if client.LastSeen.Before(cutoff) {
+			delete(c.clients, ip)
+			continue
+		}
+		result = append(result, *client)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+// Record the client of every request, if tracking is enabled
+func trackClients(next http.Handler, clients *ClientTracker) http.Handler {
+	if clients == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients.Seen(clientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Dashboard draws a live view of the server in the terminal for -tui,
+// instead of letting log lines scroll by. Log output is captured and shown
+// in the bottom pane.
+type Dashboard struct {
+	server  *Server
+	out     *os.File
+	urls    []string
+	started time.Time
+
+	mu   sync.Mutex
+	logs []string
+	// Part of a log line not yet ended by a newline
+	partial []byte
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Take over the terminal on out and redraw it every second until Close
+func startDashboard(server *Server, out *os.File) *Dashboard {
+	d := &Dashboard{
+		server:  server,
+		out:     out,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.urls = accessURLs(server.config.Listen, cleanBasePath(server.config.BasePath))
+	log.SetOutput(d)
+
+	// Switch to the alternate screen and hide the cursor
+	io.WriteString(out, "\x1b[?1049h\x1b[?25l")
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Capture log output for the log pane
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		d.logs = append(d.logs, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+	if len(d.logs) > dashboardLogLines {
+		d.logs = d.logs[len(d.logs)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// Stop drawing, give the terminal back and print the most recent log lines
+// so they aren't lost with the alternate screen
+func (d *Dashboard) Close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		io.WriteString(d.out, "\x1b[?25h\x1b[?1049l")
+		log.SetOutput(os.Stderr)
+
+		d.mu.Lock()
+		logs := d.logs
+		if len(logs) > 20 {
+			logs = logs[len(logs)-20:]
+		}
+		d.mu.Unlock()
+		for _, line := range logs {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	})
+}
+
+// The size of the terminal, or the classic 80x24 if it can't be read
+func (d *Dashboard) size() (int, int) {
+	if width, height, ok := terminalSize(d.out); ok {
+		return width, height
+	}
+	return 80, 24
+}
+
+// Cut a line to the terminal width
+func fitLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	runes := []rune(line)
+	return string(runes[:width])
+}
+
+// Format a duration for the dashboard, e.g. 1h02m or 45s
+func formatShortDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+}
+
+// Redraw the whole screen
+func (d *Dashboard) draw() {
+	width, height := d.size()
+	config := d.server.config
+	transfers := d.server.transfers.List()
+	clients := d.server.clients.List()
+	events := d.server.events.Recent()
+
+	var speed float64
+	for _, t := range transfers {
+		speed += t.Speed
+	}
+
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("\x1b[1m%s v%s\x1b[0m  serving %s  up %s  %s/s total", AppName, AppVersion, config.DownloadDir, formatShortDuration(time.Since(d.started)), formatByteSize(int64(speed)))
+	add("%s", strings.Join(d.urls, "  "))
+
+	// Transfers and clients get the room they need, up to a third of the
+	// screen each; events and the log share what is left
+	section := func(title string, rows []string, limit int) {
+		add("")
+		add("\x1b[1m%s (%d)\x1b[0m", title, len(rows))
+		if len(rows) == 0 {
+			add("  none")
+		}
+		for i, row := range rows {
+			if i == limit-1 && len(rows) > limit {
+				add("  ... and %d more", len(rows)-i)
+				break
+			}
+			add("  %s", row)
+		}
+	}
+	third := max(height/3, 3)
+
+	var rows []string
+	for _, t := range transfers {
+		arrow := "↓"
+		if t.Kind == "upload" {
+			arrow = "↑"
+		}
+		progress := formatByteSize(t.Bytes)
+		eta := ""
+		if t.Size > 0 {
+			progress = fmt.Sprintf("%3d%% %s of %s", t.Bytes*100/t.Size, progress, formatByteSize(t.Size))
+		}
+		if t.ETA >= 0 {
+			eta = "  ETA " + formatShortDuration(time.Duration(t.ETA*float64(time.Second)))
+		}
+		rows = append(rows, fmt.Sprintf("%s %-15s %s  %s  %s/s%s", arrow, t.Client, t.Path, progress, formatByteSize(int64(t.Speed)), eta))
+	}
+	section("Transfers", rows, third)
+
+	rows = nil
+	for _, c := range clients {
+		rows = append(rows, fmt.Sprintf("%-15s %6d requests  last seen %s ago", c.IP, c.Requests, formatShortDuration(time.Since(c.LastSeen))))
+	}
+	section("Clients", rows, third)
+
+	remaining := height - len(lines) - 4
+	rows = nil
+	for _, e := range events {
+		if len(rows) >= remaining/2 {
+			break
+		}
+		row := fmt.Sprintf("%s %-8s %s from %s", e.Time.Format("15:04:05"), e.Type, e.Path, e.Client)
+		if e.Detail != "" {
+			row += " (" + e.Detail + ")"
+		}
+		rows = append(rows, row)
+	}
+	add("")
+	add("\x1b[1mRecent events\x1b[0m")
+	for _, row := range rows {
+		add("  %s", row)
+	}
+
+	add("")
+	add("\x1b[1mLog\x1b[0m")
+	d.mu.Lock()
+	logs := d.logs
+	if room := height - len(lines); room < len(logs) {
+		logs = logs[len(logs)-max(room, 0):]
+	}
+	for _, line := range logs {
+		add("  %s", line)
+	}
+	d.mu.Unlock()
+
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		// Bold titles carry escape codes, which don't take up room
+		visible := width + len(line) - len(strings.NewReplacer("\x1b[1m", "", "\x1b[0m", "").Replace(line))
+		screen.WriteString(fitLine(line, visible))
+		screen.WriteString("\x1b[0m\x1b[K")
+		if i < len(lines)-1 {
+			screen.WriteString("\r\n")
+		}
+	}
+	screen.WriteString("\x1b[J")
+	io.WriteString(d.out, screen.String())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Set once a reverse SSH tunnel is opened. Its visitors arrive from
+// localhost, so from then on loopback connections no longer mean this
+// machine.
+var tunnelOpen atomic.Bool
+
+// Matches the public URL printed by tunnel providers such as localhost.run
+var tunnelURLPattern = regexp.MustCompile(`https?://[A-Za-z0-9.-]+\.[A-Za-z]{2,}(:\d+)?\S*`)
+
+// Tunnel is an outbound SSH connection forwarding a remote port to the server
+type Tunnel struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// Open a reverse SSH tunnel to dest (user@host) forwarding remotePort to the
+// local port. The system ssh client is used so existing keys, agents and
+// ~/.ssh/config entries keep working. Any URL printed by the remote side is
+// reported to onURL; otherwise the URL is derived from the host and remote
+// port.
+func openTunnel(dest string, remotePort, localPort int, onURL func(publicURL string)) (*Tunnel, error) {
+	cmd := exec.Command("ssh",
+		"-T",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-R", fmt.Sprintf("%d:localhost:%d", remotePort, localPort),
+		dest,
+	)
+
+	// Keep stdin open so providers that expect an interactive session stay connected
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelOpen.Store(true)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting ssh: %w", err)
+	}
+
+	var once sync.Once
+	reportURL := func(line string) {
+		if u := tunnelURLPattern.FindString(line); u != "" {
+			once.Do(func() {
+				u = strings.TrimRight(u, ".,")
+				logf("Access the server publicly at: %s", u)
+				onURL(u)
+			})
+		}
+	}
+	go scanTunnelOutput(stdout, reportURL)
+	go scanTunnelOutput(stderr, reportURL)
+
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Tunnel to %s closed: %v", dest, err)
+	}()
+
+	host := dest
+	if i := strings.LastIndex(host, "@"); i != -1 {
+		host = host[i+1:]
+	}
+	logf("Tunnel to %s started, forwarding remote port %d (http://%s:%d if the host allows GatewayPorts)", dest, remotePort, host, remotePort)
+	onURL(fmt.Sprintf("http://%s:%d", host, remotePort))
+
+	return &Tunnel{cmd: cmd, stdin: stdin}, nil
+}
+
+// Close the tunnel
+func (t *Tunnel) Close() error {
+	t.stdin.Close()
+	if t.cmd.Process != nil {
+		return t.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// Log each line of ssh output and look for a public URL in it
+func scanTunnelOutput(r io.Reader, reportURL func(string)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		log.Printf("tunnel: %s", line)
+		reportURL(line)
+	}
+}
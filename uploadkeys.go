@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long a finished upload is remembered for clients retrying it
+const uploadKeyTTL = 24 * time.Hour
+
+// UploadKeys remembers the outcome of uploads sent with an Idempotency-Key
+// header. A client that lost the response to an upload sends it again with
+// the same key and gets the first outcome back, instead of the file being
+// stored twice. Finished uploads are kept in the state database, so a retry
+// after a restart is recognized too. Keys are scoped to the client that
+// sent them, so one client can't replay or block another's uploads by
+// guessing its keys.
+type UploadKeys struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	active map[uploadKey]bool // uploads still being received
+}
+
+// An Idempotency-Key and the client it belongs to
+type uploadKey struct {
+	client, key string
+}
+
+func newUploadKeys(db *sql.DB) *UploadKeys {
+	return &UploadKeys{db: db, active: make(map[uploadKey]bool)}
+}
+
+// The client an Idempotency-Key belongs to: the API key it presented, its
+// login session, or else its IP address
+func uploadKeyClient(r *http.Request, auth *PasswordAuth) string {
+	if key := presentedAPIKey(r); key != "" {
+		// Only a hash is stored, as the key is a credential
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:])
+	}
+	if id, ok := auth.SessionID(r); ok {
+		return "session:" + id
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Begin an upload with a client's key. Returns where the upload that
+// finished with this key before redirected to, or busy if it is still
+// being received; otherwise the upload goes ahead and Finish must be
+// called after it.
+func (k *UploadKeys) Begin(client, key string) (location string, busy bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.active[uploadKey{client, key}] {
+		return "", true, nil
+	}
+	err = k.db.QueryRow("SELECT location FROM client_upload_keys WHERE client = ? AND key = ? AND created >= ?",
+		client, key, time.Now().Add(-uploadKeyTTL).UnixNano()).Scan(&location)
+	if err == nil {
+		return location, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", false, err
+	}
+	k.active[uploadKey{client, key}] = true
+	return "", false, nil
+}
+
+// Finish an upload begun with a client's key, remembering where it
+// redirected to. An empty location means it failed, so a retry is received
+// afresh.
+func (k *UploadKeys) Finish(client, key, location string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.active, uploadKey{client, key})
+	if location == "" {
+		return nil
+	}
+	now := time.Now()
+	if _, err := k.db.Exec("DELETE FROM client_upload_keys WHERE created < ?", now.Add(-uploadKeyTTL).UnixNano()); err != nil {
+		return err
+	}
+	_, err := k.db.Exec("INSERT OR REPLACE INTO client_upload_keys (client, key, location, created) VALUES (?, ?, ?, ?)",
+		client, key, location, now.UnixNano())
+	return err
+}
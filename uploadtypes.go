@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UploadTypeFilter restricts uploads by file extension and sniffed MIME type
+type UploadTypeFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Create a filter from comma separated lists of extensions (".exe") and
+// MIME patterns ("image/*", "application/pdf")
+func newUploadTypeFilter(allow, deny string) UploadTypeFilter {
+	return UploadTypeFilter{
+		Allow: parseTypeList(allow),
+		Deny:  parseTypeList(deny),
+	}
+}
+
+func parseTypeList(list string) []string {
+	var result []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		// Accept "exe" as shorthand for ".exe"
+		if !strings.Contains(entry, "/") && !strings.HasPrefix(entry, ".") {
+			entry = "." + entry
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// Whether the filter restricts anything
+func (f UploadTypeFilter) Enabled() bool {
+	return len(f.Allow) > 0 || len(f.Deny) > 0
+}
+
+// Check an upload against the filter. The returned reader replays the bytes
+// consumed for sniffing and must be used in place of r.
+func (f UploadTypeFilter) Check(filename string, r io.Reader) (io.Reader, error) {
+	if !f.Enabled() {
+		return r, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	replay := io.MultiReader(bytes.NewReader(head), r)
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	mimeTypes := []string{mediaType(http.DetectContentType(head))}
+	if byExt := mime.TypeByExtension(ext); byExt != "" {
+		mimeTypes = append(mimeTypes, mediaType(byExt))
+	}
+
+	for _, pattern := range f.Deny {
+		if matchesUploadType(pattern, ext, mimeTypes) {
+			return nil, fmt.Errorf("uploads of this type are not allowed (%s)", pattern)
+		}
+	}
+
+	if len(f.Allow) > 0 {
+		for _, pattern := range f.Allow {
+			if matchesUploadType(pattern, ext, mimeTypes) {
+				return replay, nil
+			}
+		}
+		return nil, fmt.Errorf("uploads of this type are not allowed (%s)", strings.Join(mimeTypes, ", "))
+	}
+
+	return replay, nil
+}
+
+// Check a file already written to path against the filter, as an upload
+// named filename
+func checkUploadType(f UploadTypeFilter, filename, path string) error {
+	if !f.Enabled() {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = f.Check(filename, file)
+	return err
+}
+
+// Strip parameters such as charset from a MIME type
+func mediaType(contentType string) string {
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mt
+	}
+	return contentType
+}
+
+func matchesUploadType(pattern, ext string, mimeTypes []string) bool {
+	if strings.HasPrefix(pattern, ".") {
+		return pattern == ext
+	}
+	for _, mt := range mimeTypes {
+		if pattern == mt {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mt, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifyReport lists what re-hashing a tree found
+type VerifyReport struct {
+	Checked int `json:"checked"`
+	// Files seen for the first time, now recorded
+	Added int `json:"added"`
+	// Content changed although size and modification time didn't, which
+	// points at disk or copy errors rather than edits
+	Corrupted []string `json:"corrupted"`
+	// Content changed along with the size or modification time
+	Modified []string `json:"modified"`
+	// Recorded files that are gone
+	Missing []string `json:"missing"`
+	Seconds float64  `json:"seconds"`
+}
+
+// Whether the check found anything that shouldn't happen to a backup
+func (r VerifyReport) Failed() bool {
+	return len(r.Corrupted) > 0 || len(r.Missing) > 0
+}
+
+// Print the report for people
+func (r VerifyReport) WriteText(w io.Writer) {
+	for _, path := range r.Corrupted {
+		fmt.Fprintf(w, "CORRUPTED %s\n", path)
+	}
+	for _, path := range r.Modified {
+		fmt.Fprintf(w, "modified  %s\n", path)
+	}
+	for _, path := range r.Missing {
+		fmt.Fprintf(w, "MISSING   %s\n", path)
+	}
+	fmt.Fprintf(w, "Checked %d file(s) in %v: %d corrupted, %d modified, %d missing, %d newly recorded\n",
+		r.Checked, time.Duration(r.Seconds*float64(time.Second)).Round(time.Second), len(r.Corrupted), len(r.Modified), len(r.Missing), r.Added)
+}
+
+// Re-hash every file below relPath of baseDir and compare it with the
+// recorded checksum. New and modified files are recorded for next time;
+// corrupted files keep their old checksum so they are reported until
+// restored, and missing files are reported once and forgotten.
+func (c *ChecksumStore) Verify(baseDir, relPath string) (VerifyReport, error) {
+	started := time.Now()
+	report := VerifyReport{Corrupted: []string{}, Modified: []string{}, Missing: []string{}}
+	root, err := safeJoinPath(baseDir, relPath)
+	if err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		report.Checked++
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		recorded, ok := c.sums[rel]
+		switch {
+		case !ok:
+			report.Added++
+		case recorded.SHA256 == sum:
+		case recorded.Size == info.Size() && recorded.Modified.Equal(info.ModTime()):
+			report.Corrupted = append(report.Corrupted, rel)
+			return nil
+		default:
+			report.Modified = append(report.Modified, rel)
+		}
+		c.sums[rel] = &FileChecksum{Path: rel, SHA256: sum, Size: info.Size(), Modified: info.ModTime(), Hashed: time.Now()}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	c.mu.Lock()
+	prefix := cleanRelPath(relPath)
+	for rel := range c.sums {
+		if (prefix == "" || rel == prefix || strings.HasPrefix(rel, prefix+"/")) && !seen[rel] {
+			report.Missing = append(report.Missing, rel)
+			delete(c.sums, rel)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(report.Missing)
+	c.Save()
+
+	report.Seconds = time.Since(started).Seconds()
+	return report, nil
+}
+
+// Admin handler re-hashing the files below "path" (everything by default)
+// and returning the report as JSON, or as text with format=text
+func verifyHandler(config Config, checksums *ChecksumStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		report, err := checksums.Verify(config.DownloadDir, r.FormValue("path"))
+		if err != nil {
+			http.Error(w, "Error verifying files: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			report.WriteText(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
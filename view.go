@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Cookie remembering whether a browser prefers the list or the grid view
+const viewCookieName = "lfs_view"
+
+const (
+	ViewList = "list"
+	ViewGrid = "grid"
+)
+
+// Get the listing view for a request. A ?view= parameter switches the view
+// and is remembered in a cookie so later pages render the same way.
+func listingView(w http.ResponseWriter, r *http.Request) string {
+	if view := r.URL.Query().Get("view"); view == ViewList || view == ViewGrid {
+		http.SetCookie(w, &http.Cookie{
+			Name:     viewCookieName,
+			Value:    view,
+			Path:     "/",
+			Expires:  time.Now().AddDate(1, 0, 0),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return view
+	}
+
+	if cookie, err := r.Cookie(viewCookieName); err == nil && cookie.Value == ViewGrid {
+		return ViewGrid
+	}
+	return ViewList
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Cookie identifying a browser across visits
+const visitorCookieName = "lfs_visitor"
+
+// Get the visitor ID for a request, issuing a new long-lived cookie if needed
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(visitorCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return ""
+	}
+	cookie := &http.Cookie{
+		Name:     visitorCookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+	// Later calls for the same request get the same ID
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	return id
+}
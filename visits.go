@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Page views further apart than this are separate visits
+const visitGap = 30 * time.Minute
+
+// How often the time a visitor was last seen is saved while they browse
+const visitSaveInterval = time.Minute
+
+// Visit is when a visitor's current visit started from, and when they were
+// last seen
+type Visit struct {
+	// End of the visit before the current one; anything modified after it
+	// is new to the visitor
+	Previous time.Time `json:"previous"`
+	Last     time.Time `json:"last"`
+}
+
+// VisitStore remembers each visitor's visits, so files and folders added
+// since their last visit can be badged as new. Browsing around during a
+// visit keeps the badges; they go once the visitor comes back later.
+type VisitStore struct {
+	mu     sync.Mutex
+	path   string
+	visits map[string]*Visit // visitor ID -> visits
+	saved  time.Time
+}
+
+// Open the visit store in the data directory
+func openVisitStore(dataDir string) (*VisitStore, error) {
+	s := &VisitStore{
+		path:   filepath.Join(dataDir, "visits.json"),
+		visits: make(map[string]*Visit),
+	}
+	if err := loadJSON(s.path, &s.visits); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record a page view of a visitor and return the time after which files
+// are new to them, zero on their first visit
+func (s *VisitStore) Seen(visitor string) time.Time {
+	if visitor == "" {
+		return time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	visit, ok := s.visits[visitor]
+	save := now.Sub(s.saved) >= visitSaveInterval
+	switch {
+	case !ok:
+		visit = &Visit{}
+		s.visits[visitor] = visit
+		save = true
+	case now.Sub(visit.Last) > visitGap:
+		visit.Previous = visit.Last
+		save = true
+	}
+	visit.Last = now
+
+	if save {
+		s.saved = now
+		if err := saveJSON(s.path, s.visits); err != nil {
+			log.Printf("Error saving visits: %v", err)
+		}
+	}
+	return visit.Previous
+}
+
+// The time after which files are new to a visitor, without recording a view
+func (s *VisitStore) Since(visitor string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if visit, ok := s.visits[visitor]; ok {
+		return visit.Previous
+	}
+	return time.Time{}
+}
+
+// Mark the files and folders modified after since as new, recursively. A
+// folder counts as modified when entries are added to or removed from it.
+func markNew(files []FileInfo, since time.Time) {
+	if since.IsZero() {
+		return
+	}
+	for i := range files {
+		files[i].New = files[i].ModTime.After(since)
+		markNew(files[i].Children, since)
+	}
+}
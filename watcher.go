@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Kinds of change the watcher reports
+const (
+	ChangeCreate = "create"
+	ChangeDelete = "delete"
+	ChangeRename = "rename"
+)
+
+// FileChange is a file or folder appearing in, disappearing from or being
+// renamed in the served tree, whoever did it
+type FileChange struct {
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	IsDir bool      `json:"is_dir,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// FileWatcher follows changes to the served tree with the operating
+// system's file notifications. Every change is streamed to the browsers
+// listening on /changes and published on the event bus as a "change"
+// event, so notifications cover files added by other programs too.
+type FileWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+	events  *EventBus
+
+	mu       sync.Mutex
+	watchers map[chan FileChange]bool
+	// Watched folders, to tell whether a removed path was one
+	dirs map[string]bool
+
+	// Closed on shutdown to end the streams
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Start watching root and every folder below it
+func startFileWatcher(root string, events *EventBus) (*FileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWatcher{
+		root:     root,
+		watcher:  watcher,
+		events:   events,
+		watchers: make(map[chan FileChange]bool),
+		dirs:     make(map[string]bool),
+		closed:   make(chan struct{}),
+	}
+	if err := w.addTree(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Watch a folder and all folders below it. Notifications aren't recursive,
+// so each folder needs its own watch.
+func (w *FileWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := w.watcher.Add(p); err != nil {
+			// Usually the inotify watch limit; say how to raise it
+			return fmt.Errorf("watching %s: %w (on Linux, raise fs.inotify.max_user_watches)", p, err)
+		}
+		w.mu.Lock()
+		w.dirs[w.rel(p)] = true
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// The path of a file relative to the served folder
+func (w *FileWatcher) rel(p string) string {
+	rel, err := filepath.Rel(w.root, p)
+	if err != nil {
+		return ""
+	}
+	return cleanRelPath(filepath.ToSlash(rel))
+}
+
+func (w *FileWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching %s: %v", w.root, err)
+		}
+	}
+}
+
+// Turn a notification into a change. Writes to existing files and mode
+// changes aren't reported; a move within the tree shows up as a rename
+// of the old path followed by a create of the new one.
+func (w *FileWatcher) handle(event fsnotify.Event) {
+	rel := w.rel(event.Name)
+	if rel == "" {
+		return
+	}
+	change := FileChange{Path: rel, Time: time.Now()}
+	switch {
+	case event.Has(fsnotify.Create):
+		change.Op = ChangeCreate
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			change.IsDir = true
+			// Files may already be inside a folder moved into the tree
+			if err := w.addTree(event.Name); err != nil {
+				log.Printf("Error watching new folder: %v", err)
+			}
+		}
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		change.Op = ChangeDelete
+		if event.Has(fsnotify.Rename) {
+			change.Op = ChangeRename
+		}
+		w.mu.Lock()
+		change.IsDir = w.dirs[rel]
+		for dir := range w.dirs {
+			if dir == rel || strings.HasPrefix(dir, rel+"/") {
+				delete(w.dirs, dir)
+			}
+		}
+		w.mu.Unlock()
+	default:
+		return
+	}
+	w.publish(change)
+}
+
+// Send a change to the streams and the event bus
+func (w *FileWatcher) publish(change FileChange) {
+	w.mu.Lock()
+	for watcher := range w.watchers {
+		select {
+		case watcher <- change:
+		default:
+			// A stream too slow to keep up misses changes rather than
+			// holding up the others
+		}
+	}
+	w.mu.Unlock()
+
+	detail := change.Op + "d"
+	if change.Op == ChangeRename {
+		detail = "renamed or moved away"
+	}
+	w.events.Publish(Event{Type: EventChange, Path: change.Path, Client: "disk", Detail: detail, Time: change.Time})
+}
+
+// Receive changes until the returned function is called
+func (w *FileWatcher) Watch() (<-chan FileChange, func()) {
+	watcher := make(chan FileChange, 64)
+	w.mu.Lock()
+	w.watchers[watcher] = true
+	w.mu.Unlock()
+	return watcher, func() {
+		w.mu.Lock()
+		delete(w.watchers, watcher)
+		w.mu.Unlock()
+	}
+}
+
+// Stop watching and end all streams
+func (w *FileWatcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.watcher.Close()
+	})
+}
+
+// Whether a change is at or below folder
+func changeWithin(change FileChange, folder string) bool {
+	return folder == "" || change.Path == folder || strings.HasPrefix(change.Path, folder+"/")
+}
+
+// Handler streaming changes as server-sent events, only those below the
+// folder given as "path" if set. Folders the client can't read under the
+// access rules are left out.
+func changesHandler(watcher *FileWatcher, rules *AccessRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folder := cleanRelPath(r.URL.Query().Get("path"))
+		changes, stop := watcher.Watch()
+		defer stop()
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		// Comments keep proxies from closing an idle stream
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case change := <-changes:
+				if !changeWithin(change, folder) || !rules.Allowed(r, change.Path, false) {
+					continue
+				}
+				if rules != nil && path.Base(change.Path) == accessFileName {
+					continue
+				}
+				data, _ := json.Marshal(change)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			case <-keepalive.C:
+				io.WriteString(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			case <-watcher.closed:
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}